@@ -0,0 +1,73 @@
+package main
+
+import (
+	"backend/models"
+	"backend/services"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Управление реестром принимаемых jetton в коллекции settings. Режимы:
+//   show    — вывести действующий реестр в JSON
+//   publish — сохранить реестр из файла -file (бэкенд применит его после перезапуска)
+//
+//go run cmd/jettons/main.go -db ht_db -mode publish -file jettons.json
+
+func main() {
+	mongoURI := flag.String("mongo", "mongodb://localhost:27017", "строка подключения к MongoDB")
+	dbName := flag.String("db", "ht_db", "имя базы данных")
+	mode := flag.String("mode", "show", "режим: show или publish")
+	file := flag.String("file", "", "JSON-файл с реестром для publish")
+	flag.Parse()
+
+	// Подключаемся к MongoDB
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*mongoURI))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	// Проверяем подключение
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	settingsCollection := client.Database(*dbName).Collection("settings")
+
+	switch *mode {
+	case "show":
+		registry, err := services.LoadJettonRegistry(ctx, settingsCollection)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, _ := json.MarshalIndent(registry, "", "  ")
+		fmt.Println(string(out))
+	case "publish":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatalf("Не удалось прочитать файл реестра: %v", err)
+		}
+		var registry models.JettonRegistry
+		if err := json.Unmarshal(data, &registry); err != nil {
+			log.Fatalf("Некорректный JSON реестра: %v", err)
+		}
+		published, err := services.PublishJettonRegistry(ctx, settingsCollection, registry)
+		if err != nil {
+			log.Printf("Ошибка публикации реестра: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Опубликован реестр jetton: %d", len(published.Jettons))
+	default:
+		log.Printf("Неизвестный режим: %s", *mode)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"backend/services"
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Сверка users.balance с журналом WILL. Режимы:
+//   verify  — вывести расхождения, код выхода 1, если они есть
+//   open    — записать в журнал балансы, накопленные до его появления (один раз при внедрении)
+//   rebuild — перезаписать users.balance суммой журнала
+//
+//go run cmd/ledger/main.go -db ht_db -mode verify
+
+func main() {
+	mongoURI := flag.String("mongo", "mongodb://localhost:27017", "строка подключения к MongoDB")
+	dbName := flag.String("db", "ht_db", "имя базы данных")
+	mode := flag.String("mode", "verify", "режим: verify, open или rebuild")
+	flag.Parse()
+
+	// Подключаемся к MongoDB
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*mongoURI))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	// Проверяем подключение
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := client.Database(*dbName)
+	ledger := services.NewLedger(db.Collection("ledger"), db.Collection("users"), db.Collection("settings"))
+	if err := ledger.EnsureIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *mode {
+	case "verify", "rebuild":
+		// Записи, брошенные при падении между проводкой и применением, сначала доприменяются
+		recovered, err := ledger.RecoverPending(ctx)
+		if err != nil {
+			log.Printf("Ошибка при доприменении записей журнала: %v", err)
+			os.Exit(1)
+		}
+		if recovered > 0 {
+			log.Printf("Доприменено записей журнала: %d", recovered)
+		}
+		mismatches, err := ledger.Reconcile(ctx, *mode == "rebuild")
+		if err != nil {
+			log.Printf("Ошибка при сверке балансов: %v", err)
+			os.Exit(1)
+		}
+		for _, m := range mismatches {
+			log.Printf("Пользователь %d: users.balance = %d, журнал = %d", m.TelegramID, m.Balance, m.Ledger)
+		}
+		if *mode == "rebuild" {
+			log.Printf("Балансы пересобраны по журналу, исправлено расхождений: %d", len(mismatches))
+			return
+		}
+		if len(mismatches) > 0 {
+			log.Printf("Найдено расхождений: %d", len(mismatches))
+			os.Exit(1)
+		}
+		log.Println("Балансы совпадают с журналом")
+	case "open":
+		recorded, err := ledger.RecordOpeningBalances(ctx)
+		if err != nil {
+			log.Printf("Ошибка при записи начальных балансов: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Записано начальных балансов: %d", recorded)
+	default:
+		log.Printf("Неизвестный режим: %s", *mode)
+		os.Exit(1)
+	}
+}
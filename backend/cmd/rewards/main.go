@@ -0,0 +1,78 @@
+package main
+
+import (
+	"backend/models"
+	"backend/services"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Управление правилами наград WILL в коллекции settings. Режимы:
+//   show    — вывести действующие правила в JSON
+//   publish — сохранить правила из файла -file как новую версию (бэкенд подхватит их в течение минуты)
+//
+//go run cmd/rewards/main.go -db ht_db -mode publish -file rules.json
+
+func main() {
+	mongoURI := flag.String("mongo", "mongodb://localhost:27017", "строка подключения к MongoDB")
+	dbName := flag.String("db", "ht_db", "имя базы данных")
+	mode := flag.String("mode", "show", "режим: show или publish")
+	file := flag.String("file", "", "JSON-файл с правилами для publish")
+	flag.Parse()
+
+	// Подключаемся к MongoDB
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*mongoURI))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	// Проверяем подключение
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	settingsCollection := client.Database(*dbName).Collection("settings")
+
+	switch *mode {
+	case "show":
+		rules := services.DefaultRewardRules()
+		err := settingsCollection.FindOne(ctx, bson.M{"_id": models.RewardRulesID}).Decode(&rules)
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Fatal(err)
+		}
+		if err == mongo.ErrNoDocuments {
+			log.Println("Правила не опубликованы, действуют правила по умолчанию")
+		}
+		out, _ := json.MarshalIndent(rules, "", "  ")
+		fmt.Println(string(out))
+	case "publish":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatalf("Не удалось прочитать файл правил: %v", err)
+		}
+		var rules models.RewardRules
+		if err := json.Unmarshal(data, &rules); err != nil {
+			log.Fatalf("Некорректный JSON правил: %v", err)
+		}
+		published, err := services.PublishRewardRules(ctx, settingsCollection, rules)
+		if err != nil {
+			log.Printf("Ошибка публикации правил: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Опубликованы правила наград версии %d", published.Version)
+	default:
+		log.Printf("Неизвестный режим: %s", *mode)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"backend/migrations"
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//go run cmd/timezone_changed_at/main.go -db ht_db
+
+func main() {
+	mongoURI := flag.String("mongo", "mongodb://localhost:27017", "строка подключения к MongoDB")
+	dbName := flag.String("db", "ht_db", "имя базы данных")
+	flag.Parse()
+
+	// Подключаемся к MongoDB
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*mongoURI))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	// Проверяем подключение
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Первая смена часового пояса должна ждать так же, как последующие
+	if err := migrations.SetTimezoneChangedAt(client, *dbName); err != nil {
+		log.Printf("Ошибка при заполнении времени смены часового пояса: %v", err)
+		os.Exit(1)
+	}
+
+	log.Println("Миграция успешно завершена")
+}
@@ -0,0 +1,190 @@
+package freeze
+
+import (
+	"backend/middleware"
+	"backend/models"
+	"backend/services"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultFreezePrice - цена одной заморозки стрика в WILL по умолчанию
+const defaultFreezePrice = 50
+
+// maxFreezesPerPurchase ограничивает количество заморозок в одной покупке
+const maxFreezesPerPurchase = 10
+
+type Handler struct {
+	freezesCollection *mongo.Collection
+	usersCollection   *mongo.Collection
+	ledger            *services.Ledger
+}
+
+func NewHandler(freezesCollection, usersCollection *mongo.Collection, ledger *services.Ledger) *Handler {
+	return &Handler{
+		freezesCollection: freezesCollection,
+		usersCollection:   usersCollection,
+		ledger:            ledger,
+	}
+}
+
+// EnsureIndexes создает уникальный индекс закрытых заморозками дней
+func (h *Handler) EnsureIndexes(ctx context.Context) error {
+	return services.EnsureFreezeIndexes(ctx, h.freezesCollection)
+}
+
+// freezePrice возвращает цену заморозки из STREAK_FREEZE_PRICE
+func freezePrice() int {
+	if value := os.Getenv("STREAK_FREEZE_PRICE"); value != "" {
+		price, err := strconv.Atoi(value)
+		if err == nil && price > 0 {
+			return price
+		}
+		log.Printf("Некорректное значение STREAK_FREEZE_PRICE=%s, используется %d", value, defaultFreezePrice)
+	}
+	return defaultFreezePrice
+}
+
+// HandleList возвращает заморозки пользователя: сколько доступно и какие дни закрыли использованные
+func (h *Handler) HandleList(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "purchased_at", Value: -1}})
+	cursor, err := h.freezesCollection.Find(context.Background(), bson.M{"telegram_id": initData.User.ID}, findOptions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get freezes"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	freezes := []models.StreakFreeze{}
+	if err = cursor.All(context.Background(), &freezes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode freezes"})
+		return
+	}
+
+	available := 0
+	used := []models.StreakFreeze{}
+	for _, freeze := range freezes {
+		if freeze.UsedAt == nil {
+			available++
+		} else {
+			used = append(used, freeze)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"available": available,
+		"price":     freezePrice(),
+		"used":      used,
+	})
+}
+
+// HandleBuy покупает заморозки стрика за WILL
+func (h *Handler) HandleBuy(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		Count int `json:"count"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	if req.Count < 0 || req.Count > maxFreezesPerPurchase {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid count"})
+		return
+	}
+
+	price := freezePrice()
+	total := price * req.Count
+
+	// Списываем WILL только если баланса хватает
+	purchaseID := primitive.NewObjectID()
+	_, err := h.ledger.Spend(context.Background(), models.LedgerEntry{
+		TelegramID:     initData.User.ID,
+		Amount:         -total,
+		Reason:         models.LedgerFreezePurchase,
+		RefType:        models.LedgerRefFreeze,
+		RefID:          purchaseID.Hex(),
+		IdempotencyKey: "freeze_purchase:" + purchaseID.Hex(),
+	})
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient balance"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update balance"})
+		return
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, 0, req.Count)
+	for i := 0; i < req.Count; i++ {
+		docs = append(docs, models.StreakFreeze{
+			TelegramID:  initData.User.ID,
+			PurchaseID:  purchaseID,
+			Price:       price,
+			PurchasedAt: now,
+		})
+	}
+	if _, err := h.freezesCollection.InsertMany(context.Background(), docs); err != nil {
+		log.Printf("Ошибка при создании заморозок для пользователя %d: %v", initData.User.ID, err)
+		// Возвращаем списанные WILL
+		_, refundErr := h.ledger.Post(context.Background(), models.LedgerEntry{
+			TelegramID:     initData.User.ID,
+			Amount:         total,
+			Reason:         models.LedgerFreezeRefund,
+			RefType:        models.LedgerRefFreeze,
+			RefID:          purchaseID.Hex(),
+			IdempotencyKey: "freeze_refund:" + purchaseID.Hex(),
+		})
+		if refundErr != nil {
+			log.Printf("Ошибка возврата %d WILL пользователю %d: %v", total, initData.User.ID, refundErr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create freezes"})
+		return
+	}
+
+	log.Printf("Пользователь %d купил %d заморозок за %d WILL", initData.User.ID, req.Count, total)
+
+	available, err := h.freezesCollection.CountDocuments(context.Background(), bson.M{"telegram_id": initData.User.ID, "used_at": nil})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count freezes"})
+		return
+	}
+
+	var user models.User
+	if err := h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"available": available,
+		"balance":   user.Balance,
+	})
+}
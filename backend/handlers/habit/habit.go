@@ -3,12 +3,18 @@ package habit
 import (
 	"backend/models"
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"backend/middleware"
+	"backend/schedule"
 	// "backend/services" // <--- ЗАКОММЕНТИРОВАТЬ ИЛИ УДАЛИТЬ
 	"backend/services" // <--- ИСПОЛЬЗУЕМ ПРАВИЛЬНЫЙ ПУТЬ МОДУЛЯ
 
@@ -19,30 +25,37 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// Вспомогательная функция для проверки наличия элемента в массиве
-func contains(arr []int, val int) bool {
-	for _, a := range arr {
-		if a == val {
-			return true
-		}
-	}
-	return false
-}
-
 type Handler struct {
 	habitsCollection  *mongo.Collection
 	historyCollection *mongo.Collection
 	usersCollection   *mongo.Collection
+	tagsCollection    *mongo.Collection
+	ledger            *services.Ledger
+	rewards           *services.RewardEngine
+	pots              *services.PotService
 }
 
-func NewHandler(habitsCollection, historyCollection, usersCollection *mongo.Collection) *Handler {
+func NewHandler(habitsCollection, historyCollection, usersCollection, tagsCollection *mongo.Collection, ledger *services.Ledger, rewards *services.RewardEngine, pots *services.PotService) *Handler {
 	return &Handler{
 		habitsCollection:  habitsCollection,
 		historyCollection: historyCollection,
 		usersCollection:   usersCollection,
+		tagsCollection:    tagsCollection,
+		ledger:            ledger,
+		rewards:           rewards,
+		pots:              pots,
 	}
 }
 
+// scheduleChanged проверяет, меняет ли правка расписание или дневную цель привычки
+func scheduleChanged(existing, edited models.Habit) bool {
+	return !slices.Equal(existing.Days, edited.Days) ||
+		!reflect.DeepEqual(existing.Recurrence, edited.Recurrence) ||
+		existing.IsOneTime != edited.IsOneTime ||
+		existing.DueDate != edited.DueDate ||
+		existing.Target != edited.Target
+}
+
 func (h *Handler) HandleCreate(c *gin.Context) {
 	// Получаем данные из контекста Telegram
 	initData, exists := middleware.CtxInitData(c.Request.Context())
@@ -79,6 +92,27 @@ func (h *Handler) HandleCreate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "title обязателен"})
 		return
 	}
+	if habit.Target < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target не может быть отрицательным"})
+		return
+	}
+	if err := schedule.Validate(habit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateDisplay(habit.Color, habit.Icon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	habit.Tags = services.UniqueTags(habit.Tags)
+	if err := services.ValidateHabitTags(context.Background(), h.tagsCollection, initData.User.ID, habit.Tags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.PrepareChecklist(&habit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Создаем новую привычку
 	habit.ID = primitive.NewObjectID()
@@ -86,10 +120,19 @@ func (h *Handler) HandleCreate(c *gin.Context) {
 	habit.CreatedAt = time.Now().In(loc)
 	habit.LastClickDate = ""
 	habit.Streak = 0
+	habit.LongestStreak = 0
 	habit.Score = 0
 	habit.Followers = []string{} // пустой массив подписчиков
 	habit.Archived = false
 
+	// Новая привычка встает в конец списка
+	habit.Position, err = services.NextHabitPosition(context.Background(), h.habitsCollection, initData.User.ID)
+	if err != nil {
+		log.Printf("Ошибка при определении позиции привычки: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении привычки"})
+		return
+	}
+
 	// Сначала сохраняем привычку
 	result, err := h.habitsCollection.InsertOne(context.Background(), habit)
 	if err != nil {
@@ -102,82 +145,24 @@ func (h *Handler) HandleCreate(c *gin.Context) {
 	// Если это автопривычка и она должна быть выполнена сегодня, отмечаем её
 	if habit.IsAuto {
 		today := time.Now().In(loc).Format("2006-01-02")
-		shouldComplete := false
-
-		weekday := int(time.Now().In(loc).Weekday())
-		if weekday == 0 {
-			weekday = 6
-		} else {
-			weekday--
-		}
-		shouldComplete = contains(habit.Days, weekday)
+		shouldComplete := schedule.IsDue(habit, time.Now().In(loc))
 
 		if shouldComplete {
-			// Обновляем привычку
-			_, err = h.habitsCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": habit.ID},
-				bson.M{
-					"$set": bson.M{
-						"last_click_date": today,
-						"streak":          1,
-						"score":           1,
-					},
-				},
-			)
-			if err != nil {
-				log.Printf("Ошибка при обновлении автопривычки: %v", err)
-			}
-
 			// Создаем запись в истории
-			history := models.History{
-				TelegramID: habit.TelegramID,
-				Date:       today,
-				Habits: []models.HabitHistory{
-					{
-						HabitID: habit.ID,
-						Title:   habit.Title,
-						Done:    true,
-					},
-				},
-			}
-
-			// Проверяем существование записи в истории
-			var existingHistory models.History
-			err = h.historyCollection.FindOne(
-				context.Background(),
-				bson.M{
-					"telegram_id": habit.TelegramID,
-					"date":        today,
-				},
-			).Decode(&existingHistory)
-
-			if err == mongo.ErrNoDocuments {
-				// Если записи нет, создаем новую
-				_, err = h.historyCollection.InsertOne(context.Background(), history)
-			} else if err == nil {
-				// Если запись существует, добавляем привычку
-				_, err = h.historyCollection.UpdateOne(
-					context.Background(),
-					bson.M{
-						"telegram_id": habit.TelegramID,
-						"date":        today,
-					},
-					bson.M{
-						"$push": bson.M{
-							"habits": models.HabitHistory{
-								HabitID: habit.ID,
-								Title:   habit.Title,
-								Done:    true,
-							},
-						},
-					},
-				)
-			}
-
+			err = services.SetHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, today, models.HabitHistory{
+				HabitID: habit.ID,
+				Title:   habit.Title,
+				Done:    true,
+				Value:   habit.DailyTarget(),
+			})
 			if err != nil {
 				log.Printf("Ошибка при обновлении истории для автопривычки: %v", err)
 			}
+
+			// Пересчитываем показатели привычки по истории
+			if _, err = services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, time.Now().In(loc)); err != nil {
+				log.Printf("Ошибка при обновлении автопривычки: %v", err)
+			}
 		}
 	}
 
@@ -224,7 +209,10 @@ func (h *Handler) HandleUpdate(c *gin.Context) {
 	}
 
 	var req struct {
-		ID string `json:"_id" binding:"required"`
+		ID    string  `json:"_id" binding:"required"`
+		Value *int    `json:"value,omitempty"` // Сколько добавить к дневному значению (по умолчанию 1)
+		Note  *string `json:"note,omitempty"`  // Заметка к выполнению
+		Mood  *int    `json:"mood,omitempty"`  // Оценка настроения/усилия от 1 до 5
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -232,6 +220,19 @@ func (h *Handler) HandleUpdate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат JSON"})
 		return
 	}
+	if err := validateCompletionMeta(req.Note, req.Mood); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	increment := 1
+	if req.Value != nil {
+		increment = *req.Value
+	}
+	if increment <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value должен быть положительным"})
+		return
+	}
 
 	// Преобразуем ID привычки
 	habitID, err := primitive.ObjectIDFromHex(req.ID)
@@ -269,114 +270,66 @@ func (h *Handler) HandleUpdate(c *gin.Context) {
 		return
 	}
 
-	// --- Начало: Начисление токенов WILL ---
-	// Находим текущего пользователя
-	var currentUser models.User
-	err = h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&currentUser)
-	if err != nil {
-		log.Printf("HandleUpdate: Не удалось найти пользователя %d для начисления токенов: %v", initData.User.ID, err)
-		// Не блокируем основной функционал, просто логируем
-	} else {
-		// 1. Начисляем токен самому пользователю
-		_, err := h.usersCollection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": currentUser.ID},
-			bson.M{"$inc": bson.M{"balance": 1}},
-		)
-		if err != nil {
-			log.Printf("HandleUpdate: Ошибка при начислении токена пользователю %d: %v", currentUser.TelegramID, err)
-		} else {
-			log.Printf("Пользователю %d начислен 1 WILL", currentUser.TelegramID)
-		}
-
-		// 2. Если есть реферер, начисляем токен и ему
-		if currentUser.ReferrerID != 0 {
-			_, err := h.usersCollection.UpdateOne(
-				context.Background(),
-				bson.M{"telegram_id": currentUser.ReferrerID},
-				bson.M{"$inc": bson.M{"balance": 1}},
-			)
-			if err != nil {
-				log.Printf("HandleUpdate: Ошибка при начислении токена рефереру %d: %v", currentUser.ReferrerID, err)
-			} else {
-				log.Printf("Рефереру %d начислен 1 WILL", currentUser.ReferrerID)
-			}
-		}
-	}
-	// --- Конец: Начисление токенов WILL ---
-
-	// Обновляем привычку
-	update := bson.M{
-		"$set": bson.M{
-			"last_click_date": today,
-			"streak":          habit.Streak + 1,
-			"score":           habit.Score + 1,
-		},
+	// Разовая задача выполняется только один раз
+	if habit.IsOneTime && habit.LastClickDate != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Разовая задача уже выполнена"})
+		return
 	}
 
-	_, err = h.habitsCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": habitID},
-		update,
-	)
+	// Получаем накопленное за сегодня значение
+	target := habit.DailyTarget()
+	entry, _, err := services.FindHabitDayEntry(context.Background(), h.historyCollection, initData.User.ID, today, habitID)
 	if err != nil {
-		log.Printf("Ошибка при обновлении привычки: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении привычки"})
+		log.Printf("Ошибка при получении истории: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении истории"})
 		return
 	}
-
-	// Обновляем историю
-	history := models.History{
-		TelegramID: initData.User.ID,
-		Date:       today,
-		Habits: []models.HabitHistory{
-			{
-				HabitID: habitID,
-				Title:   habit.Title,
-				Done:    true,
-			},
-		},
+	currentValue := entry.Progress(target)
+	if currentValue >= target {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Привычка уже выполнена сегодня"})
+		return
 	}
 
-	// Проверяем существование записи в истории
-	var existingHistory models.History
-	err = h.historyCollection.FindOne(
-		context.Background(),
-		bson.M{
-			"telegram_id": initData.User.ID,
-			"date":        today,
-		},
-	).Decode(&existingHistory)
-
-	if err == mongo.ErrNoDocuments {
-		// Если записи нет, создаем новую
-		_, err = h.historyCollection.InsertOne(context.Background(), history)
-	} else if err == nil {
-		// Если запись существует, добавляем привычку
-		_, err = h.historyCollection.UpdateOne(
-			context.Background(),
-			bson.M{
-				"telegram_id": initData.User.ID,
-				"date":        today,
-			},
-			bson.M{
-				"$push": bson.M{
-					"habits": models.HabitHistory{
-						HabitID: habitID,
-						Title:   habit.Title,
-						Done:    true,
-					},
-				},
-			},
-		)
-	}
+	newValue := currentValue + increment
+	completed := newValue >= target
 
+	// Обновляем историю, сохраняя заметку и оценку, оставленные ранее за этот день
+	entry.HabitID = habitID
+	entry.Title = habit.Title
+	entry.Done = completed
+	entry.Value = newValue
+	if completed {
+		completedAt := time.Now()
+		entry.CompletedAt = &completedAt
+		// Клик по привычке с чек-листом отмечает все пункты сразу
+		if len(habit.Checklist) > 0 {
+			entry.Items = services.ChecklistItemIDs(habit)
+		}
+	}
+	applyCompletionMeta(&entry, req.Note, req.Mood)
+	err = services.SetHabitDayEntry(context.Background(), h.historyCollection, initData.User.ID, today, entry)
 	if err != nil {
 		log.Printf("Ошибка при обновлении истории: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении истории"})
 		return
 	}
 
+	// Пока дневная цель не достигнута, стрик и награды не трогаем
+	if completed {
+		// Пересчитываем показатели привычки по истории
+		refreshed, err := services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, time.Now().In(loc))
+		if err != nil {
+			log.Printf("Ошибка при обновлении привычки: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении привычки"})
+			return
+		}
+
+		// Награда зависит от стрика, поэтому начисляется после пересчета
+		h.rewardCompletion(initData.User.ID, refreshed, today, true)
+
+		h.syncOneTimeArchive(habit, true)
+	}
+
 	// Получаем обновленную привычку
 	var updatedHabit models.Habit
 	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&updatedHabit)
@@ -435,15 +388,58 @@ func (h *Handler) HandleEdit(c *gin.Context) {
 		return
 	}
 
+	if habit.Target < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target не может быть отрицательным"})
+		return
+	}
+	if err := schedule.Validate(habit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateDisplay(habit.Color, habit.Icon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	habit.Tags = services.UniqueTags(habit.Tags)
+	if err := services.ValidateHabitTags(context.Background(), h.tagsCollection, initData.User.ID, habit.Tags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.PrepareChecklist(&habit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if scheduleChanged(existingHabit, habit) {
+		inPot, err := h.pots.HabitInOpenPot(context.Background(), habit.ID)
+		if err != nil {
+			log.Printf("Ошибка при проверке участия привычки в банке: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении привычки"})
+			return
+		}
+		if inPot {
+			c.JSON(http.StatusConflict, gin.H{"error": "Расписание привычки нельзя менять, пока она участвует в банке"})
+			return
+		}
+	}
+
 	// Обновляем привычку
 	update := bson.M{
 		"$set": bson.M{
-			"title":          habit.Title,
-			"want_to_become": habit.WantToBecome,
-			"days":           habit.Days,
-			"is_one_time":    habit.IsOneTime,
-			"is_auto":        habit.IsAuto,
-			"stake":          habit.Stake,
+			"title":               habit.Title,
+			"want_to_become":      habit.WantToBecome,
+			"days":                habit.Days,
+			"recurrence":          habit.Recurrence,
+			"is_one_time":         habit.IsOneTime,
+			"due_date":            habit.DueDate,
+			"is_auto":             habit.IsAuto,
+			"stake":               habit.Stake,
+			"target":              habit.Target,
+			"unit":                habit.Unit,
+			"tags":                habit.Tags,
+			"color":               habit.Color,
+			"icon":                habit.Icon,
+			"checklist":           habit.Checklist,
+			"checklist_threshold": habit.ChecklistThreshold,
 		},
 	}
 
@@ -598,6 +594,7 @@ func (h *Handler) HandleJoin(c *gin.Context) {
 			cursor, err := h.habitsCollection.Find(
 				context.Background(),
 				bson.M{"telegram_id": request.TelegramID},
+				options.Find().SetSort(services.HabitSort()),
 			)
 			if err != nil {
 				log.Printf("Ошибка при получении привычек после проверки повторного join: %v", err)
@@ -645,19 +642,35 @@ func (h *Handler) HandleJoin(c *gin.Context) {
 			return
 		}
 
+		position, err := services.NextHabitPosition(context.Background(), h.habitsCollection, request.TelegramID)
+		if err != nil {
+			log.Printf("Ошибка при определении позиции привычки: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании привычки"})
+			return
+		}
+
 		// Создаем новую привычку
 		newHabit := models.Habit{
-			ID:            primitive.NewObjectID(),
-			TelegramID:    request.TelegramID,
-			Title:         originalHabit.Title,
-			WantToBecome:  originalHabit.WantToBecome,
-			Days:          originalHabit.Days,
-			IsOneTime:     originalHabit.IsOneTime,
-			CreatedAt:     time.Now(),
-			LastClickDate: "",
-			Streak:        0,
-			Score:         0,
-			Followers:     []string{request.SharedByHabitID},
+			ID:                 primitive.NewObjectID(),
+			TelegramID:         request.TelegramID,
+			Title:              originalHabit.Title,
+			WantToBecome:       originalHabit.WantToBecome,
+			Days:               originalHabit.Days,
+			Recurrence:         originalHabit.Recurrence,
+			IsOneTime:          originalHabit.IsOneTime,
+			DueDate:            originalHabit.DueDate,
+			Target:             originalHabit.Target,
+			Unit:               originalHabit.Unit,
+			Checklist:          originalHabit.Checklist,
+			ChecklistThreshold: originalHabit.ChecklistThreshold,
+			Position:           position,
+			Color:              originalHabit.Color, // Теги личные, переносим только оформление
+			Icon:               originalHabit.Icon,
+			CreatedAt:          time.Now(),
+			LastClickDate:      "",
+			Streak:             0,
+			Score:              0,
+			Followers:          []string{request.SharedByHabitID},
 		}
 
 		// Сохраняем новую привычку
@@ -701,6 +714,7 @@ func (h *Handler) HandleJoin(c *gin.Context) {
 	cursor, err := h.habitsCollection.Find(
 		context.Background(),
 		bson.M{"telegram_id": request.TelegramID},
+		options.Find().SetSort(services.HabitSort()),
 	)
 	if err != nil {
 		log.Printf("Ошибка при получении привычек: %v", err)
@@ -914,6 +928,12 @@ func (h *Handler) HandleGetFollowers(c *gin.Context) {
 }
 
 func (h *Handler) HandleGetActivity(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
 	habitID := c.Query("habit_id")
 	if habitID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "habit_id is required"})
@@ -938,6 +958,13 @@ func (h *Handler) HandleGetActivity(c *gin.Context) {
 		return
 	}
 
+	// Заметки и оценки видны владельцу и пользователям, с которыми привычка связана
+	showNotes, err := h.canSeeNotes(habit, initData.User.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
 	// Получаем историю активности
 	cursor, err := h.historyCollection.Find(
 		context.Background(),
@@ -963,10 +990,31 @@ func (h *Handler) HandleGetActivity(c *gin.Context) {
 		// Находим информацию о привычке в истории
 		for _, h := range history.Habits {
 			if h.HabitID == objectID {
-				activity = append(activity, map[string]interface{}{
-					"date": history.Date,
-					"done": h.Done,
-				})
+				item := map[string]interface{}{
+					"date":  history.Date,
+					"done":  h.Done,
+					"value": h.Value,
+				}
+				if h.Status != "" {
+					item["status"] = h.Status
+				}
+				if h.CompletedAt != nil {
+					item["completed_at"] = h.CompletedAt
+				}
+				// Для чек-листа отдаем отмеченные пункты, чтобы показать частично выполненные дни
+				if len(habit.Checklist) > 0 {
+					item["items"] = h.Items
+					item["items_total"] = len(habit.Checklist)
+				}
+				if showNotes {
+					if h.Note != "" {
+						item["note"] = h.Note
+					}
+					if h.Mood != 0 {
+						item["mood"] = h.Mood
+					}
+				}
+				activity = append(activity, item)
 				break
 			}
 		}
@@ -975,6 +1023,149 @@ func (h *Handler) HandleGetActivity(c *gin.Context) {
 	c.JSON(http.StatusOK, activity)
 }
 
+// canSeeNotes отвечает, может ли пользователь видеть заметки к привычке: это ее владелец
+// или пользователь, чья привычка связана с ней через followers.
+func (h *Handler) canSeeNotes(habit models.Habit, telegramID int64) (bool, error) {
+	if habit.TelegramID == telegramID {
+		return true, nil
+	}
+
+	var followerIDs []primitive.ObjectID
+	for _, id := range habit.Followers {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			followerIDs = append(followerIDs, objectID)
+		}
+	}
+
+	count, err := h.habitsCollection.CountDocuments(context.Background(), bson.M{
+		"telegram_id": telegramID,
+		"$or": []bson.M{
+			{"_id": bson.M{"$in": followerIDs}},
+			{"followers": habit.ID.Hex()},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// validateCompletionMeta проверяет заметку и оценку, переданные вместе с выполнением
+func validateCompletionMeta(note *string, mood *int) error {
+	if note != nil && utf8.RuneCountInString(strings.TrimSpace(*note)) > models.MaxNoteLength {
+		return fmt.Errorf("note must not be longer than %d characters", models.MaxNoteLength)
+	}
+	// 0 означает «без оценки»
+	if mood != nil && *mood != 0 && (*mood < models.MinMood || *mood > models.MaxMood) {
+		return fmt.Errorf("mood must be between %d and %d", models.MinMood, models.MaxMood)
+	}
+	return nil
+}
+
+// applyCompletionMeta переносит заметку и оценку в запись истории. Непереданные поля не меняются,
+// пустая заметка и нулевая оценка очищают значения.
+func applyCompletionMeta(entry *models.HabitHistory, note *string, mood *int) {
+	if note != nil {
+		entry.Note = strings.TrimSpace(*note)
+	}
+	if mood != nil {
+		entry.Mood = *mood
+	}
+}
+
+// HandleNote изменяет заметку и оценку к уже отмеченному дню привычки
+func (h *Handler) HandleNote(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	timezone, exists := middleware.CtxTimezone(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Timezone not provided in context"})
+		return
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+
+	var req struct {
+		ID   string  `json:"_id" binding:"required"`
+		Date string  `json:"date,omitempty"` // По умолчанию сегодня
+		Note *string `json:"note,omitempty"`
+		Mood *int    `json:"mood,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if err := validateCompletionMeta(req.Note, req.Mood); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	habitID, err := primitive.ObjectIDFromHex(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid habit_id format"})
+		return
+	}
+
+	today := time.Now().In(loc).Format(schedule.DateLayout)
+	if req.Date == "" {
+		req.Date = today
+	}
+	if _, err := time.Parse(schedule.DateLayout, req.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format"})
+		return
+	}
+	if req.Date > today {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date must not be in the future"})
+		return
+	}
+
+	var habit models.Habit
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if habit.TelegramID != initData.User.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+
+	// Заметку можно оставить только к дню, по которому уже есть запись
+	entry, found, err := services.FindHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, req.Date, habitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get history"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no history entry for this date"})
+		return
+	}
+
+	applyCompletionMeta(&entry, req.Note, req.Mood)
+	err = services.SetHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, req.Date, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"date":  req.Date,
+		"entry": entry,
+	})
+}
+
 func (h *Handler) HandleUndo(c *gin.Context) {
 	// Получаем данные из контекста Telegram
 	initData, exists := middleware.CtxInitData(c.Request.Context())
@@ -998,7 +1189,8 @@ func (h *Handler) HandleUndo(c *gin.Context) {
 	}
 
 	var req struct {
-		ID string `json:"_id" binding:"required"`
+		ID    string `json:"_id" binding:"required"`
+		Value *int   `json:"value,omitempty"` // Сколько вычесть из дневного значения (по умолчанию день сбрасывается)
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -1023,86 +1215,62 @@ func (h *Handler) HandleUndo(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
+	if habit.TelegramID != initData.User.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
 
-	// Обновляем статистику привычки
+	// Получаем накопленное за сегодня значение
 	today := time.Now().In(loc).Format("2006-01-02")
-	if habit.LastClickDate == today {
-		habit.LastClickDate = ""
-		if habit.Streak > 0 {
-			habit.Streak--
-			habit.Score--
-		}
+	target := habit.DailyTarget()
+	entry, found, err := services.FindHabitDayEntry(context.Background(), h.historyCollection, initData.User.ID, today, habitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get history"})
+		return
+	}
 
-		// Обновляем привычку
-		_, err = h.habitsCollection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": habitID},
-			bson.M{"$set": bson.M{
-				"last_click_date": habit.LastClickDate,
-				"streak":          habit.Streak,
-				"score":           habit.Score,
-			}},
-		)
+	if found || habit.LastClickDate == today {
+		oldValue := entry.Progress(target)
+		wasDone := oldValue >= target || habit.LastClickDate == today
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update habit"})
-			return
+		// Частичная отмена уменьшает значение, иначе день сбрасывается полностью
+		newValue := 0
+		if req.Value != nil && *req.Value > 0 && *req.Value < oldValue {
+			newValue = oldValue - *req.Value
 		}
 
 		// Обновляем историю
-		update := bson.M{
-			"$pull": bson.M{
-				"habits": bson.M{"habit_id": habit.ID},
-			},
-		}
-
-		_, err = h.historyCollection.UpdateOne(
-			context.Background(),
-			bson.M{
-				"telegram_id": initData.User.ID,
-				"date":        today,
-			},
-			update,
-		)
-
+		if newValue > 0 {
+			entry.HabitID = habitID
+			entry.Title = habit.Title
+			entry.Done = newValue >= target
+			entry.Value = newValue
+			if !entry.Done {
+				entry.CompletedAt = nil
+			}
+			err = services.SetHabitDayEntry(context.Background(), h.historyCollection, initData.User.ID, today, entry)
+		} else {
+			err = services.RemoveHabitDayEntry(context.Background(), h.historyCollection, initData.User.ID, today, habitID)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update history"})
 			return
 		}
 
-		// --- Списание токенов WILL за отмену выполнения привычки (включая автопривычки) ---
-		var currentUser models.User
-		err = h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&currentUser)
-		if err != nil {
-			log.Printf("HandleUndo: Не удалось найти пользователя %d для списания токенов: %v", initData.User.ID, err)
-		} else {
-			// 1) Списываем 1 WILL у пользователя
-			_, err := h.usersCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": currentUser.ID},
-				bson.M{"$inc": bson.M{"balance": -1}},
-			)
+		// Стрик и награды откатываем, только если день перестал быть выполненным
+		if wasDone && newValue < target {
+			// Пересчитываем показатели привычки по истории
+			_, err = services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, time.Now().In(loc))
 			if err != nil {
-				log.Printf("HandleUndo: Ошибка при списании токена у пользователя %d: %v", currentUser.TelegramID, err)
-			} else {
-				log.Printf("У пользователя %d списан 1 WILL за отмену выполнения", currentUser.TelegramID)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update habit"})
+				return
 			}
 
-			// 2) Если есть реферер — списываем 1 WILL и у него
-			if currentUser.ReferrerID != 0 {
-				_, err := h.usersCollection.UpdateOne(
-					context.Background(),
-					bson.M{"telegram_id": currentUser.ReferrerID},
-					bson.M{"$inc": bson.M{"balance": -1}},
-				)
-				if err != nil {
-					log.Printf("HandleUndo: Ошибка при списании токена у реферера %d: %v", currentUser.ReferrerID, err)
-				} else {
-					log.Printf("У реферера %d списан 1 WILL за отмену у реферала %d", currentUser.ReferrerID, currentUser.TelegramID)
-				}
-			}
+			// Списание токенов WILL за отмену выполнения привычки (включая автопривычки)
+			h.rewardCompletion(initData.User.ID, habit, today, false)
+
+			h.syncOneTimeArchive(habit, false)
 		}
-		// --- Конец списания ---
 
 		// Получаем обновленную версию привычки
 		err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
@@ -1122,6 +1290,219 @@ func (h *Handler) HandleUndo(c *gin.Context) {
 	c.JSON(http.StatusOK, enrichedHabit)
 }
 
+// HandleBackfill отмечает или снимает выполнение привычки за прошедший день в пределах окна исправления
+func (h *Handler) HandleBackfill(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	timezone, exists := middleware.CtxTimezone(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Timezone not provided in context"})
+		return
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+
+	var req struct {
+		ID    string `json:"_id" binding:"required"`
+		Date  string `json:"date" binding:"required"`
+		Done  bool   `json:"done"`
+		Value *int   `json:"value,omitempty"` // Значение за день для количественных привычек
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+
+	habitID, err := primitive.ObjectIDFromHex(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid habit_id format"})
+		return
+	}
+
+	// Проверяем, что дата в прошлом и попадает в окно исправления
+	now := time.Now().In(loc)
+	date, err := time.ParseInLocation(schedule.DateLayout, req.Date, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format"})
+		return
+	}
+	today := schedule.Day(now)
+	if !date.Before(today) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date must be in the past"})
+		return
+	}
+	if date.Before(today.AddDate(0, 0, -services.BackfillWindowDays())) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date is outside of the backfill window"})
+		return
+	}
+
+	var habit models.Habit
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if habit.TelegramID != initData.User.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+	if req.Date < habit.CreatedAt.In(loc).Format(schedule.DateLayout) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date is before habit creation"})
+		return
+	}
+
+	// Новое значение за день: явное value или полная дневная цель
+	target := habit.DailyTarget()
+	newValue := 0
+	if req.Value != nil {
+		if *req.Value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value must not be negative"})
+			return
+		}
+		newValue = *req.Value
+	} else if req.Done {
+		newValue = target
+	}
+
+	entry, _, err := services.FindHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, req.Date, habitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get history"})
+		return
+	}
+	wasDone := entry.Progress(target) >= target
+	nowDone := newValue >= target
+
+	// Обновляем историю за выбранный день. Отметку о заморозке сохраняем,
+	// чтобы снятие выполнения не оборвало стрик, закрытый заморозкой.
+	if newValue > 0 || entry.Status == models.HistoryStatusFrozen {
+		entry.HabitID = habitID
+		entry.Title = habit.Title
+		entry.Done = nowDone
+		entry.Value = newValue
+		if !nowDone {
+			entry.CompletedAt = nil
+		}
+		if len(habit.Checklist) > 0 {
+			if nowDone {
+				entry.Items = services.ChecklistItemIDs(habit)
+			} else {
+				entry.Items = nil
+			}
+		}
+		err = services.SetHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, req.Date, entry)
+	} else {
+		err = services.RemoveHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, req.Date, habitID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update history"})
+		return
+	}
+
+	if wasDone != nowDone {
+		// Пересчитываем стрик и очки по истории с учетом исправленного дня
+		refreshed, err := services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update habit"})
+			return
+		}
+
+		// Начисляем или списываем WILL так же, как при обычном клике
+		h.rewardCompletion(habit.TelegramID, refreshed, req.Date, nowDone)
+
+		h.syncOneTimeArchive(habit, nowDone)
+	}
+
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get updated habit"})
+		return
+	}
+
+	enrichedHabit, err := h.enrichHabitWithFollowers(c.Request.Context(), habit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enrich habit"})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrichedHabit)
+}
+
+// rewardCompletion начисляет (done = true) или списывает (done = false) WILL пользователю и его рефереру
+// за выполнение привычки за день date. Суммы рассчитывает движок правил наград.
+// Ошибки только логируются, чтобы не блокировать основной функционал.
+func (h *Handler) rewardCompletion(telegramID int64, habit models.Habit, date string, done bool) {
+	ctx := context.Background()
+	var currentUser models.User
+	err := h.usersCollection.FindOne(ctx, bson.M{"telegram_id": telegramID}).Decode(&currentUser)
+	if err != nil {
+		log.Printf("rewardCompletion: Не удалось найти пользователя %d для изменения баланса: %v", telegramID, err)
+		return
+	}
+
+	reason, referralReason := models.LedgerHabitCompletion, models.LedgerReferralReward
+	payout, err := h.rewards.Completion(ctx, currentUser, habit, date)
+	if !done {
+		reason, referralReason = models.LedgerHabitUndo, models.LedgerReferralUndo
+		payout, err = h.rewards.Undo(ctx, currentUser, habit, date)
+	}
+	if err != nil {
+		log.Printf("rewardCompletion: Ошибка расчета награды пользователя %d: %v", currentUser.TelegramID, err)
+		return
+	}
+
+	userKey, referrerKey := payout.Keys(habit.ID, date)
+
+	// 1. Изменяем баланс самого пользователя
+	if payout.UserAmount != 0 {
+		_, err = h.ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     currentUser.TelegramID,
+			Amount:         payout.UserAmount,
+			Reason:         reason,
+			RefType:        models.LedgerRefHabit,
+			RefID:          habit.ID.Hex(),
+			IdempotencyKey: userKey,
+			RewardDate:     date,
+			RuleVersion:    payout.RuleVersion,
+		})
+		if err != nil {
+			log.Printf("rewardCompletion: Ошибка при изменении баланса пользователя %d: %v", currentUser.TelegramID, err)
+		} else {
+			log.Printf("Баланс пользователя %d изменен на %d WILL (правила v%d)", currentUser.TelegramID, payout.UserAmount, payout.RuleVersion)
+		}
+	}
+
+	// 2. Если рефереру положена доля, изменяем баланс и ему
+	if currentUser.ReferrerID != 0 && payout.ReferrerAmount != 0 {
+		_, err := h.ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     currentUser.ReferrerID,
+			Amount:         payout.ReferrerAmount,
+			Reason:         referralReason,
+			RefType:        models.LedgerRefHabit,
+			RefID:          habit.ID.Hex(),
+			IdempotencyKey: referrerKey,
+			RewardDate:     date,
+			RuleVersion:    payout.RuleVersion,
+		})
+		if err != nil {
+			log.Printf("rewardCompletion: Ошибка при изменении баланса реферера %d: %v", currentUser.ReferrerID, err)
+		} else {
+			log.Printf("Баланс реферера %d изменен на %d WILL за реферала %d (правила v%d)", currentUser.ReferrerID, payout.ReferrerAmount, currentUser.TelegramID, payout.RuleVersion)
+		}
+	}
+}
+
 // Вспомогательная функция для обогащения данных привычки информацией о подписчиках
 func (h *Handler) enrichHabitWithFollowers(ctx context.Context, habit models.Habit) (models.HabitResponse, error) {
 	// Получаем timezone
@@ -1140,28 +1521,55 @@ func (h *Handler) enrichHabitWithFollowers(ctx context.Context, habit models.Hab
 	}
 
 	// Рассчитываем прогресс выполнения подписчиками через сервис
-	progress, err := services.CalculateHabitCompletionProgress(ctx, habit, timezone, h.habitsCollection)
+	progress, err := services.CalculateHabitCompletionProgress(ctx, habit, timezone, h.habitsCollection, h.historyCollection)
 	if err != nil {
 		log.Printf("Ошибка расчета прогресса для привычки %s: %v. Установлен прогресс 0.", habit.ID.Hex(), err)
 		progress = 0.0
 	}
 
+	// Накопленное за сегодня значение (для количественных привычек), отмеченные пункты чек-листа
+	// и просрочка разовой задачи
+	todayValue := 0
+	var todayItems []primitive.ObjectID
+	overdue := false
+	if loc, err := time.LoadLocation(timezone); err == nil {
+		todayValue, todayItems, err = services.HabitDayState(ctx, h.historyCollection, habit, time.Now().In(loc).Format("2006-01-02"))
+		if err != nil {
+			log.Printf("Ошибка получения значения за сегодня для привычки %s: %v", habit.ID.Hex(), err)
+		}
+		overdue = schedule.IsOverdue(habit, time.Now().In(loc))
+	}
+
 	response := models.HabitResponse{
-		ID:            habit.ID,
-		TelegramID:    habit.TelegramID,
-		Title:         habit.Title,
-		WantToBecome:  habit.WantToBecome,
-		Days:          habit.Days,
-		IsOneTime:     habit.IsOneTime,
-		IsAuto:        habit.IsAuto,
-		CreatedAt:     habit.CreatedAt,
-		LastClickDate: habit.LastClickDate,
-		Streak:        habit.Streak,
-		Score:         habit.Score,
-		Stake:         habit.Stake,
-		Archived:      habit.Archived,
-		Followers:     []models.FollowerInfo{}, // Это поле теперь будет заполняться отдельным запросом getHabitFollowers на фронте
-		Progress:      progress,
+		ID:                 habit.ID,
+		TelegramID:         habit.TelegramID,
+		Title:              habit.Title,
+		WantToBecome:       habit.WantToBecome,
+		Days:               habit.Days,
+		Recurrence:         habit.Recurrence,
+		IsOneTime:          habit.IsOneTime,
+		DueDate:            habit.DueDate,
+		Overdue:            overdue,
+		IsAuto:             habit.IsAuto,
+		CreatedAt:          habit.CreatedAt,
+		LastClickDate:      habit.LastClickDate,
+		Streak:             habit.Streak,
+		LongestStreak:      habit.LongestStreak,
+		Score:              habit.Score,
+		Stake:              habit.Stake,
+		Target:             habit.Target,
+		Unit:               habit.Unit,
+		TodayValue:         todayValue,
+		Checklist:          habit.Checklist,
+		ChecklistThreshold: habit.ChecklistThreshold,
+		TodayItems:         todayItems,
+		Archived:           habit.Archived,
+		Position:           habit.Position,
+		Tags:               habit.Tags,
+		Color:              habit.Color,
+		Icon:               habit.Icon,
+		Followers:          []models.FollowerInfo{}, // Это поле теперь будет заполняться отдельным запросом getHabitFollowers на фронте
+		Progress:           progress,
 	}
 
 	// Старая логика заполнения Followers здесь больше не нужна,
@@ -1305,10 +1713,16 @@ func (h *Handler) HandleListArchived(c *gin.Context) {
 		return
 	}
 
+	filter := bson.M{"telegram_id": initData.User.ID, "archived": true, "is_one_time": bson.M{"$ne": true}}
+	if err := services.TagFilter(filter, c.Query("tag")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	cursor, err := h.habitsCollection.Find(
 		context.Background(),
-		bson.M{"telegram_id": initData.User.ID, "archived": true},
-		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+		filter,
+		options.Find().SetSort(services.HabitSort()),
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query archived habits"})
@@ -1334,6 +1748,259 @@ func (h *Handler) HandleListArchived(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+// HandleListOneTime возвращает разовые задачи пользователя. Параметр status фильтрует
+// список: active — невыполненные, overdue — просроченные, completed — выполненные.
+func (h *Handler) HandleListOneTime(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	status := c.Query("status")
+	if status != "" && status != "active" && status != "overdue" && status != "completed" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+
+	cursor, err := h.habitsCollection.Find(
+		context.Background(),
+		bson.M{"telegram_id": initData.User.ID, "is_one_time": true},
+		options.Find().SetSort(services.HabitSort()),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query one-time habits"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	var habits []models.Habit
+	if err := cursor.All(context.Background(), &habits); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode one-time habits"})
+		return
+	}
+
+	resp := make([]models.HabitResponse, 0, len(habits))
+	for _, hbt := range habits {
+		completed := hbt.LastClickDate != ""
+		if (status == "active" && (completed || hbt.Archived)) || (status == "completed" && !completed) {
+			continue
+		}
+		hResp, err := h.enrichHabitWithFollowers(c.Request.Context(), hbt)
+		if err != nil {
+			continue
+		}
+		if status == "overdue" && !hResp.Overdue {
+			continue
+		}
+		resp = append(resp, hResp)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleChecklistToggle отмечает или снимает отметку с пункта чек-листа привычки за сегодня.
+// Привычка считается выполненной, когда отмечены все обязательные пункты или набран порог.
+func (h *Handler) HandleChecklistToggle(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	timezone, exists := middleware.CtxTimezone(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Timezone not provided in context"})
+		return
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+
+	var req struct {
+		ID     string `json:"_id" binding:"required"`
+		ItemID string `json:"item_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+
+	habitID, err := primitive.ObjectIDFromHex(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid habit_id format"})
+		return
+	}
+	itemID, err := primitive.ObjectIDFromHex(req.ItemID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item_id format"})
+		return
+	}
+
+	var habit models.Habit
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if habit.TelegramID != initData.User.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+
+	itemExists := false
+	for _, item := range habit.Checklist {
+		if item.ID == itemID {
+			itemExists = true
+			break
+		}
+	}
+	if !itemExists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "checklist item not found"})
+		return
+	}
+
+	now := time.Now().In(loc)
+	today := now.Format(schedule.DateLayout)
+	target := habit.DailyTarget()
+	entry, _, err := services.FindHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, today, habitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get history"})
+		return
+	}
+	wasDone := entry.Progress(target) >= target
+	if wasDone && len(entry.Items) == 0 {
+		// День отмечен целиком без пунктов (автопривычка или старая запись)
+		entry.Items = services.ChecklistItemIDs(habit)
+	}
+
+	// Переключаем пункт
+	items := make([]primitive.ObjectID, 0, len(entry.Items)+1)
+	ticked := false
+	for _, id := range entry.Items {
+		if id == itemID {
+			ticked = true
+			continue
+		}
+		items = append(items, id)
+	}
+	if !ticked {
+		items = append(items, itemID)
+	}
+
+	nowDone := services.ChecklistDone(habit, items)
+	entry.HabitID = habitID
+	entry.Title = habit.Title
+	entry.Items = items
+	entry.Done = nowDone
+	entry.Value = 0
+	if nowDone {
+		entry.Value = target
+		if entry.CompletedAt == nil {
+			completedAt := time.Now()
+			entry.CompletedAt = &completedAt
+		}
+	} else {
+		entry.CompletedAt = nil
+	}
+
+	if len(items) > 0 || entry.Note != "" || entry.Mood != 0 {
+		err = services.SetHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, today, entry)
+	} else {
+		err = services.RemoveHabitDayEntry(context.Background(), h.historyCollection, habit.TelegramID, today, habitID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update history"})
+		return
+	}
+
+	if wasDone != nowDone {
+		refreshed, err := services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update habit"})
+			return
+		}
+		h.rewardCompletion(habit.TelegramID, refreshed, today, nowDone)
+		h.syncOneTimeArchive(habit, nowDone)
+	}
+
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID}).Decode(&habit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get updated habit"})
+		return
+	}
+
+	enrichedHabit, err := h.enrichHabitWithFollowers(c.Request.Context(), habit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enrich habit"})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrichedHabit)
+}
+
+// HandleReorder сохраняет ручной порядок привычек. Принимает ID привычек в новом порядке.
+func (h *Handler) HandleReorder(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		IDs []string `json:"ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids must not be empty"})
+		return
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid habit_id format"})
+			return
+		}
+		ids = append(ids, objectID)
+	}
+
+	if err := services.ReorderHabits(context.Background(), h.habitsCollection, initData.User.ID, ids); err != nil {
+		log.Printf("Ошибка при сортировке привычек пользователя %d: %v", initData.User.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// syncOneTimeArchive убирает выполненную разовую задачу в архив и возвращает ее обратно,
+// если выполнение отменено. Для регулярных привычек ничего не делает.
+func (h *Handler) syncOneTimeArchive(habit models.Habit, done bool) {
+	if !habit.IsOneTime {
+		return
+	}
+	_, err := h.habitsCollection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": habit.ID},
+		bson.M{"$set": bson.M{"archived": done}},
+	)
+	if err != nil {
+		log.Printf("Ошибка при обновлении архива разовой задачи %s: %v", habit.ID.Hex(), err)
+	}
+}
+
 // HandleSubscribeToFollower обрабатывает подписку текущего пользователя на привычку другого пользователя
 func (h *Handler) HandleSubscribeToFollower(c *gin.Context) {
 	initData, exists := middleware.CtxInitData(c.Request.Context())
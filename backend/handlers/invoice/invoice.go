@@ -1,8 +1,11 @@
 package invoice
 
 import (
+	"backend/middleware"
 	"backend/models"
+	"backend/services"
 	"context"
+	"log"
 	"math/rand"
 	"net/http"
 	"strconv"
@@ -12,40 +15,63 @@ import (
 	tgbotapi "github.com/go-telegram/bot/models"
 )
 
+// maxInvoiceStars ограничивает сумму одного счета в Telegram Stars
+const maxInvoiceStars = 10000
+
 type Handler struct {
-	bot *bot.Bot
+	bot   *bot.Bot
+	stars *services.StarsService
 }
 
-func NewHandler(b *bot.Bot) *Handler {
+func NewHandler(b *bot.Bot, stars *services.StarsService) *Handler {
 	return &Handler{
-		bot: b,
+		bot:   b,
+		stars: stars,
 	}
 }
 
 func (h *Handler) HandleCreateInvoice(c *gin.Context) {
+	// Получаем данные из контекста Telegram
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
 	// Получаем сумму из параметров запроса
 	amountStr := c.Query("amount")
 	amount, err := strconv.Atoi(amountStr)
-	if err != nil {
+	if err != nil || amount <= 0 || amount > maxInvoiceStars {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
 		return
 	}
 
+	// Сохраняем покупку: по ее payload проверяется оплата и начисляются WILL
+	payment, err := h.stars.CreatePayment(context.Background(), initData.User.ID, amount)
+	if err != nil {
+		log.Printf("Ошибка сохранения покупки за Stars для пользователя %d: %v", initData.User.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invoice"})
+		return
+	}
+
 	titles := []string{"Штраф за лень", "Дань привычке", "Налог на прокрастинацию", "Ленькопошлина", "Фонд упущенных возможностей"}
 
 	params := bot.CreateInvoiceLinkParams{
 		Title:         titles[rand.Intn(len(titles))],
 		Description:   "Плата равна количеству пропущенных привычек за последний день",
-		Payload:       "some_payload",
+		Payload:       payment.Payload,
 		ProviderToken: "",
 		Currency:      "XTR",
 		Prices: []tgbotapi.LabeledPrice{
-			{Label: "Some label", Amount: amount},
+			{Label: strconv.Itoa(payment.WillAmount) + " WILL", Amount: amount},
 		},
 	}
 
 	invoiceURL, err := h.bot.CreateInvoiceLink(context.Background(), &params)
 	if err != nil {
+		if delErr := h.stars.DeletePayment(context.Background(), payment); delErr != nil {
+			log.Printf("Ошибка удаления покупки %s: %v", payment.Payload, delErr)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invoice"})
 		return
 	}
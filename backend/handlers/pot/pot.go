@@ -0,0 +1,417 @@
+package pot
+
+import (
+	"backend/middleware"
+	"backend/models"
+	"backend/schedule"
+	"backend/services"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxPotDays ограничивает длительность банка
+const maxPotDays = 90
+
+type Handler struct {
+	potsCollection   *mongo.Collection
+	habitsCollection *mongo.Collection
+	usersCollection  *mongo.Collection
+	pots             *services.PotService
+}
+
+func NewHandler(potsCollection, habitsCollection, usersCollection *mongo.Collection, pots *services.PotService) *Handler {
+	return &Handler{
+		potsCollection:   potsCollection,
+		habitsCollection: habitsCollection,
+		usersCollection:  usersCollection,
+		pots:             pots,
+	}
+}
+
+// ownHabit возвращает привычку пользователя по идентификатору из запроса
+func (h *Handler) ownHabit(telegramID int64, habitIDHex string) (models.Habit, bool, error) {
+	var habit models.Habit
+	habitID, err := primitive.ObjectIDFromHex(habitIDHex)
+	if err != nil {
+		return habit, false, nil
+	}
+	err = h.habitsCollection.FindOne(context.Background(), bson.M{"_id": habitID, "telegram_id": telegramID}).Decode(&habit)
+	if err == mongo.ErrNoDocuments {
+		return habit, false, nil
+	}
+	return habit, err == nil, err
+}
+
+// linkedHabitIDs возвращает привычку и все привычки, связанные с ней через совместное выполнение
+func (h *Handler) linkedHabitIDs(habit models.Habit) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{habit.ID}
+	for _, follower := range habit.Followers {
+		if id, err := primitive.ObjectIDFromHex(follower); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	cursor, err := h.habitsCollection.Find(
+		context.Background(),
+		bson.M{"followers": habit.ID.Hex()},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var linked models.Habit
+		if err := cursor.Decode(&linked); err == nil {
+			ids = append(ids, linked.ID)
+		}
+	}
+	return ids, cursor.Err()
+}
+
+// findPot возвращает банк по идентификатору из запроса
+func (h *Handler) findPot(c *gin.Context, potIDHex string) (models.Pot, bool) {
+	var pot models.Pot
+	potID, err := primitive.ObjectIDFromHex(potIDHex)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pot_id"})
+		return pot, false
+	}
+	err = h.potsCollection.FindOne(context.Background(), bson.M{"_id": potID}).Decode(&pot)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pot not found"})
+		return pot, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get pot"})
+		return pot, false
+	}
+	return pot, true
+}
+
+// enrollmentError переводит ошибку входа или выхода из банка в ответ API
+func enrollmentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInsufficientBalance):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient balance"})
+	case errors.Is(err, services.ErrPotClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "enrollment is closed"})
+	case errors.Is(err, services.ErrPotMember):
+		c.JSON(http.StatusConflict, gin.H{"error": "invalid membership"})
+	case errors.Is(err, services.ErrPotNoDueDays):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "habit has no due days in the pot period"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update pot"})
+	}
+}
+
+// HandleCreate создает банк на совместной привычке пользователя и блокирует ставку создателя.
+// Набор участников идет до дня старта, поэтому start_date должна быть позже сегодняшнего дня.
+func (h *Handler) HandleCreate(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	timezone, exists := middleware.CtxTimezone(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Timezone not provided in context"})
+		return
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+
+	var req struct {
+		HabitID   string `json:"habit_id"`
+		Stake     int    `json:"stake"`
+		StartDate string `json:"start_date"`
+		EndDate   string `json:"end_date"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if req.Stake <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid stake"})
+		return
+	}
+
+	start, err := time.ParseInLocation(schedule.DateLayout, req.StartDate, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start_date"})
+		return
+	}
+	end, err := time.ParseInLocation(schedule.DateLayout, req.EndDate, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end_date"})
+		return
+	}
+	today := time.Now().In(loc).Format(schedule.DateLayout)
+	if req.StartDate <= today {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_date must be in the future"})
+		return
+	}
+	if end.Before(start) || end.After(start.AddDate(0, 0, maxPotDays-1)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid period"})
+		return
+	}
+
+	habit, found, err := h.ownHabit(initData.User.ID, req.HabitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get habit"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+		return
+	}
+	if habit.IsOneTime || habit.Archived {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "habit cannot have a pot"})
+		return
+	}
+
+	pot := models.Pot{
+		ID:           primitive.NewObjectID(),
+		HabitID:      habit.ID,
+		CreatorID:    initData.User.ID,
+		Title:        habit.Title,
+		Stake:        req.Stake,
+		StartDate:    req.StartDate,
+		EndDate:      req.EndDate,
+		Timezone:     timezone,
+		Status:       models.PotOpen,
+		Participants: []models.PotParticipant{},
+		CreatedAt:    time.Now(),
+	}
+	if _, err := h.potsCollection.InsertOne(context.Background(), pot); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create pot"})
+		return
+	}
+
+	participant, err := h.pots.Enroll(context.Background(), pot, initData.User.ID, habit.ID)
+	if err != nil {
+		// Без ставки создателя банк не нужен
+		if _, delErr := h.potsCollection.DeleteOne(context.Background(), bson.M{"_id": pot.ID}); delErr != nil {
+			log.Printf("Ошибка удаления банка %s: %v", pot.ID.Hex(), delErr)
+		}
+		enrollmentError(c, err)
+		return
+	}
+	pot.Participants = append(pot.Participants, participant)
+
+	c.JSON(http.StatusOK, pot)
+}
+
+// HandleJoin добавляет пользователя в банк: его привычка должна быть связана с привычкой банка.
+func (h *Handler) HandleJoin(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		PotID   string `json:"pot_id"`
+		HabitID string `json:"habit_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+
+	pot, ok := h.findPot(c, req.PotID)
+	if !ok {
+		return
+	}
+
+	habit, found, err := h.ownHabit(initData.User.ID, req.HabitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get habit"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+		return
+	}
+
+	linked, err := h.linkedHabitIDs(habit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get linked habits"})
+		return
+	}
+	isLinked := false
+	for _, id := range linked {
+		if id == pot.HabitID {
+			isLinked = true
+			break
+		}
+	}
+	if !isLinked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "habit is not shared with the pot"})
+		return
+	}
+
+	participant, err := h.pots.Enroll(context.Background(), pot, initData.User.ID, habit.ID)
+	if err != nil {
+		enrollmentError(c, err)
+		return
+	}
+	pot.Participants = append(pot.Participants, participant)
+
+	c.JSON(http.StatusOK, pot)
+}
+
+// HandleLeave исключает пользователя из банка до старта и возвращает ставку
+func (h *Handler) HandleLeave(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		PotID string `json:"pot_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+
+	pot, ok := h.findPot(c, req.PotID)
+	if !ok {
+		return
+	}
+
+	if err := h.pots.Leave(context.Background(), pot, initData.User.ID); err != nil {
+		enrollmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// HandleList возвращает банки пользователя. С параметром habit_id — банки на совместной привычке,
+// включая те, в которые можно вступить.
+func (h *Handler) HandleList(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	filter := bson.M{"participants.telegram_id": initData.User.ID}
+	if habitID := c.Query("habit_id"); habitID != "" {
+		habit, found, err := h.ownHabit(initData.User.ID, habitID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get habit"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "habit not found"})
+			return
+		}
+		linked, err := h.linkedHabitIDs(habit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get linked habits"})
+			return
+		}
+		filter = bson.M{"habit_id": bson.M{"$in": linked}}
+	}
+
+	cursor, err := h.potsCollection.Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.D{{Key: "start_date", Value: -1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get pots"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	pots := []models.Pot{}
+	if err := cursor.All(context.Background(), &pots); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode pots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pots)
+}
+
+// participantStatus - участник банка с прогрессом для экрана статуса
+type participantStatus struct {
+	models.PotParticipant
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	PhotoURL  string `json:"photo_url"`
+}
+
+// HandleStatus возвращает банк с прогрессом всех участников. Доступен только участникам.
+// До расчета required и done показывают текущий прогресс, после — зафиксированные итоги.
+func (h *Handler) HandleStatus(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	pot, ok := h.findPot(c, c.Query("pot_id"))
+	if !ok {
+		return
+	}
+
+	isParticipant := false
+	for _, participant := range pot.Participants {
+		if participant.TelegramID == initData.User.ID {
+			isParticipant = true
+			break
+		}
+	}
+	if !isParticipant {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	participants := make([]participantStatus, 0, len(pot.Participants))
+	for _, participant := range pot.Participants {
+		if pot.Status == models.PotOpen {
+			required, done, err := h.pots.Progress(context.Background(), pot, participant)
+			if err != nil {
+				log.Printf("Ошибка расчета прогресса участника %d банка %s: %v", participant.TelegramID, pot.ID.Hex(), err)
+			}
+			participant.Required = required
+			participant.Done = done
+		}
+
+		status := participantStatus{PotParticipant: participant}
+		var user models.User
+		if err := h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": participant.TelegramID}).Decode(&user); err == nil {
+			status.Username = user.Username
+			status.FirstName = user.FirstName
+			status.PhotoURL = user.PhotoURL
+		}
+		participants = append(participants, status)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pot":             pot,
+		"participants":    participants,
+		"enrollment_open": h.pots.EnrollmentOpen(pot, time.Now()),
+		"total_stake":     pot.Stake * len(pot.Participants),
+	})
+}
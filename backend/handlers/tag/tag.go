@@ -0,0 +1,253 @@
+package tag
+
+import (
+	"backend/middleware"
+	"backend/models"
+	"backend/services"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxTagNameLength - максимальная длина названия тега в символах
+const maxTagNameLength = 32
+
+// maxTagsPerUser ограничивает количество тегов у одного пользователя
+const maxTagsPerUser = 50
+
+type Handler struct {
+	tagsCollection   *mongo.Collection
+	habitsCollection *mongo.Collection
+}
+
+func NewHandler(tagsCollection, habitsCollection *mongo.Collection) *Handler {
+	return &Handler{
+		tagsCollection:   tagsCollection,
+		habitsCollection: habitsCollection,
+	}
+}
+
+type tagRequest struct {
+	ID    string `json:"_id,omitempty"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Icon  string `json:"icon"`
+}
+
+// validate приводит название к виду для сохранения и проверяет поля тега
+func (req *tagRequest) validate() string {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return "name is required"
+	}
+	if utf8.RuneCountInString(req.Name) > maxTagNameLength {
+		return "name is too long"
+	}
+	if err := services.ValidateDisplay(req.Color, req.Icon); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// nameTaken проверяет, есть ли у пользователя другой тег с таким же названием
+func (h *Handler) nameTaken(telegramID int64, name string, exceptID primitive.ObjectID) (bool, error) {
+	filter := bson.M{"telegram_id": telegramID, "name": name}
+	if !exceptID.IsZero() {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+	count, err := h.tagsCollection.CountDocuments(context.Background(), filter)
+	return count > 0, err
+}
+
+// HandleList возвращает теги пользователя
+func (h *Handler) HandleList(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	cursor, err := h.tagsCollection.Find(
+		context.Background(),
+		bson.M{"telegram_id": initData.User.ID},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query tags"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	tags := []models.Tag{}
+	if err := cursor.All(context.Background(), &tags); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tags)
+}
+
+// HandleCreate создает тег
+func (h *Handler) HandleCreate(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req tagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	count, err := h.tagsCollection.CountDocuments(context.Background(), bson.M{"telegram_id": initData.User.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count tags"})
+		return
+	}
+	if count >= maxTagsPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many tags"})
+		return
+	}
+
+	taken, err := h.nameTaken(initData.User.ID, req.Name, primitive.NilObjectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check tag name"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "tag already exists"})
+		return
+	}
+
+	tag := models.Tag{
+		ID:         primitive.NewObjectID(),
+		TelegramID: initData.User.ID,
+		Name:       req.Name,
+		Color:      req.Color,
+		Icon:       req.Icon,
+		CreatedAt:  time.Now(),
+	}
+	if _, err := h.tagsCollection.InsertOne(context.Background(), tag); err != nil {
+		log.Printf("Ошибка при создании тега: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create tag"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tag)
+}
+
+// HandleEdit изменяет название, цвет и иконку тега
+func (h *Handler) HandleEdit(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req tagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	tagID, err := primitive.ObjectIDFromHex(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tag_id format"})
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	taken, err := h.nameTaken(initData.User.ID, req.Name, tagID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check tag name"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "tag already exists"})
+		return
+	}
+
+	var tag models.Tag
+	err = h.tagsCollection.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": tagID, "telegram_id": initData.User.ID},
+		bson.M{"$set": bson.M{
+			"name":  req.Name,
+			"color": req.Color,
+			"icon":  req.Icon,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&tag)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update tag"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tag)
+}
+
+// HandleDelete удаляет тег и снимает его со всех привычек пользователя
+func (h *Handler) HandleDelete(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		ID string `json:"_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	tagID, err := primitive.ObjectIDFromHex(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tag_id format"})
+		return
+	}
+
+	result, err := h.tagsCollection.DeleteOne(context.Background(), bson.M{"_id": tagID, "telegram_id": initData.User.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete tag"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+		return
+	}
+
+	_, err = h.habitsCollection.UpdateMany(
+		context.Background(),
+		bson.M{"telegram_id": initData.User.ID, "tags": tagID},
+		bson.M{"$pull": bson.M{"tags": tagID}},
+	)
+	if err != nil {
+		log.Printf("Ошибка при удалении тега %s из привычек: %v", tagID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove tag from habits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
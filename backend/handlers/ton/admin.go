@@ -0,0 +1,161 @@
+package ton
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/middleware"
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// refundWithdrawal возвращает пользователю WILL, зарезервированные под вывод.
+// Ключ привязан к транзакции, поэтому повторный возврат ничего не меняет.
+func (h *TonHandler) refundWithdrawal(ctx context.Context, tx TonTransaction) error {
+	_, err := h.ledger.Post(ctx, models.LedgerEntry{
+		TelegramID:     tx.TelegramID,
+		Amount:         tx.WillAmount,
+		Reason:         models.LedgerWithdrawalRefund,
+		RefType:        models.LedgerRefTransaction,
+		RefID:          tx.TransactionID,
+		IdempotencyKey: "withdraw_refund:" + tx.TransactionID,
+	})
+	return err
+}
+
+// refundRejectedWithdrawal возвращает WILL за отклоненный вывод, освобождает дневной лимит и отмечает
+// возврат в refunded_at. Вывод без refunded_at reconcileWithdrawals возвращает повторно.
+func (h *TonHandler) refundRejectedWithdrawal(ctx context.Context, tx TonTransaction) error {
+	if err := h.refundWithdrawal(ctx, tx); err != nil {
+		return err
+	}
+	result, err := h.txCollection.UpdateOne(ctx,
+		bson.M{"transaction_id": tx.TransactionID, "status": withdrawStatusRejected, "refunded_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"refunded_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	// Лимит освобождает только тот, кто отметил возврат
+	if result.ModifiedCount > 0 {
+		h.releaseWithdrawLimit(ctx, tx.TelegramID, tx.LimitDate, tx.WillAmount)
+	}
+	return nil
+}
+
+// ReviewWithdrawalRequest - решение администратора по выводу из очереди одобрения
+type ReviewWithdrawalRequest struct {
+	TransactionID string `json:"transaction_id" binding:"required"`
+	Reason        string `json:"reason"`
+}
+
+// HandleListPendingApprovals возвращает выводы, ожидающие одобрения или разбора, начиная с самых старых
+func (h *TonHandler) HandleListPendingApprovals(c *gin.Context) {
+	cursor, err := h.txCollection.Find(
+		context.Background(),
+		bson.M{"payment_type": "withdraw", "status": bson.M{"$in": []string{withdrawStatusAwaitingApproval, withdrawStatusReview}}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get withdrawals"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	transactions := []TonTransaction{}
+	if err := cursor.All(context.Background(), &transactions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode withdrawals"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transactions": transactions})
+}
+
+// HandleApproveWithdrawal переводит вывод из очереди одобрения в pending: его отправит ProcessWithdrawals.
+// Вывод на разборе одобряется, только если администратор убедился, что перевод не дошел до получателя.
+func (h *TonHandler) HandleApproveWithdrawal(c *gin.Context) {
+	h.reviewWithdrawal(c, withdrawStatusPending)
+}
+
+// HandleRejectWithdrawal отклоняет вывод из очереди одобрения и возвращает зарезервированные WILL.
+// Причина обязательна.
+func (h *TonHandler) HandleRejectWithdrawal(c *gin.Context) {
+	h.reviewWithdrawal(c, withdrawStatusRejected)
+}
+
+func (h *TonHandler) reviewWithdrawal(c *gin.Context, status string) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req ReviewWithdrawalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if status == withdrawStatusRejected && req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required"})
+		return
+	}
+
+	// Решение принимается только по выводу, который все еще ждет одобрения или разбора
+	ctx := context.Background()
+	var tx TonTransaction
+	err := h.txCollection.FindOne(ctx, bson.M{
+		"transaction_id": req.TransactionID,
+		"payment_type":   "withdraw",
+		"status":         bson.M{"$in": []string{withdrawStatusAwaitingApproval, withdrawStatusReview}},
+	}).Decode(&tx)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "withdrawal awaiting approval or review not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get withdrawal"})
+		return
+	}
+
+	now := time.Now()
+	err = h.transitionWithdrawal(ctx, tx.TransactionID, tx.Status, status, bson.M{
+		"reviewed_by":   initData.User.ID,
+		"review_reason": req.Reason,
+		"reviewed_at":   now,
+	})
+	if errors.Is(err, errWithdrawTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "withdrawal status has changed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update withdrawal"})
+		return
+	}
+	tx.Status = status
+	tx.ReviewedBy = initData.User.ID
+	tx.ReviewReason = req.Reason
+	tx.ReviewedAt = &now
+	tx.UpdatedAt = now
+
+	if status == withdrawStatusRejected {
+		if err := h.refundRejectedWithdrawal(ctx, tx); err != nil {
+			// Вывод уже rejected: reconcileWithdrawals повторит возврат
+			log.Printf("Ошибка возврата %d WILL за отклоненный вывод %s: %v", tx.WillAmount, tx.TransactionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "withdrawal rejected, refund will be retried"})
+			return
+		}
+	}
+
+	log.Printf("Администратор %d перевел вывод %s в статус %s: %s", initData.User.ID, tx.TransactionID, status, req.Reason)
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"transaction": tx,
+	})
+}
@@ -0,0 +1,87 @@
+package ton
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+)
+
+// IncomingTransfer - входящий перевод в казну, разобранный из транзакции блокчейна
+type IncomingTransfer struct {
+	Currency string
+	Amount   *big.Int // В минимальных единицах валюты
+	Decimals int
+	Sender   *address.Address
+	Comment  string
+	TxHash   string
+	LT       uint64
+}
+
+// TreasuryJetton - jetton из реестра с jetton-кошельком казны, вычисленным через мастер-контракт
+type TreasuryJetton struct {
+	Symbol   string
+	Decimals int
+	Master   *address.Address
+	Wallet   *address.Address // Jetton-кошелек казны: от него приходят уведомления о депозитах
+}
+
+// OutgoingTransfer - подписанное внешнее сообщение кошелька казны с переводом jetton.
+// Сохраняется в выводе до отправки: по хэшу сообщения перевод находится в блокчейне, сколько бы
+// транзакций ни прошло после него, а seqno внутри сообщения не дает кошельку выполнить его дважды.
+type OutgoingTransfer struct {
+	MessageHash string    `bson:"message_hash" json:"message_hash"` // Хэш тела внешнего сообщения (hex), содержит seqno и подпись
+	ValidUntil  time.Time `bson:"valid_until" json:"valid_until"`   // Позже кошелек сообщение не примет
+	FromLT      uint64    `bson:"from_lt" json:"from_lt"`           // LT последней транзакции кошелька казны до отправки
+
+	message *tlb.ExternalMessage // Само сообщение; есть только у подготовленного в этом процессе
+}
+
+// Expired сообщает, что неотправленное сообщение уже не может быть выполнено
+func (t OutgoingTransfer) Expired(now time.Time) bool {
+	return now.After(t.ValidUntil)
+}
+
+// OutgoingStatus - состояние исходящего перевода jetton в блокчейне
+type OutgoingStatus int
+
+const (
+	OutgoingNotFound  OutgoingStatus = iota // Кошелек казны перевод не отправлял
+	OutgoingSent                            // Перевод отправлен, jetton-кошелек казны его еще не обработал
+	OutgoingConfirmed                       // Jetton-кошелек казны выполнил перевод
+	OutgoingFailed                          // Jetton-кошелек казны не выполнил перевод, jetton остались в казне
+)
+
+// Chain - операции с блокчейном TON, которые нужны депозитам и выводам.
+// В работе используется LiteChain, в тестах — FakeChain без сети.
+type Chain interface {
+	// Treasury возвращает адрес кошелька казны
+	Treasury(ctx context.Context) (*address.Address, error)
+
+	// LastLT возвращает LT последней транзакции кошелька казны
+	LastLT(ctx context.Context) (uint64, error)
+
+	// SubscribeTransfers отправляет в transfers входящие переводы TON и jetton из jettons в казну,
+	// начиная с транзакций после fromLT. Блокирует до отмены ctx и закрывает transfers при выходе.
+	SubscribeTransfers(ctx context.Context, fromLT uint64, jettons []TreasuryJetton, transfers chan<- IncomingTransfer) error
+
+	// JettonWallet возвращает адрес jetton-кошелька владельца owner для мастер-контракта master
+	JettonWallet(ctx context.Context, master, owner *address.Address) (*address.Address, error)
+
+	// JettonBalance возвращает баланс jetton казны в минимальных единицах
+	JettonBalance(ctx context.Context, master *address.Address) (*big.Int, error)
+
+	// PrepareJetton подписывает, но не отправляет перевод amount jetton с кошелька казны получателю to
+	// с текстовым комментарием.
+	PrepareJetton(ctx context.Context, master, to *address.Address, amount tlb.Coins, comment string) (OutgoingTransfer, error)
+
+	// SendJetton отправляет подготовленный PrepareJetton перевод и ждет подтверждения.
+	// Возвращает хэш транзакции.
+	SendJetton(ctx context.Context, transfer OutgoingTransfer) ([]byte, error)
+
+	// FindJettonTransfer ищет перевод по сообщению transfer среди транзакций казны после transfer.FromLT
+	// и возвращает его состояние и хэш транзакции отправки.
+	FindJettonTransfer(ctx context.Context, master *address.Address, transfer OutgoingTransfer) (OutgoingStatus, []byte, error)
+}
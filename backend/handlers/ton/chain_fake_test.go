@@ -0,0 +1,221 @@
+package ton
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+)
+
+// SentJetton - перевод jetton, отправленный через FakeChain
+type SentJetton struct {
+	Master      *address.Address
+	To          *address.Address
+	Amount      *big.Int
+	Comment     string
+	MessageHash string
+	TxHash      []byte
+	Status      OutgoingStatus
+}
+
+// FakeChain - Chain без сети. Входящие переводы задаются через Deliver, исходящие
+// записываются и доступны через Sent. Подходит для проверки депозитов и выводов целиком.
+type FakeChain struct {
+	mu        sync.Mutex
+	treasury  *address.Address
+	incoming  chan IncomingTransfer
+	lastLT    uint64
+	balances  map[string]*big.Int
+	prepared  map[string]SentJetton // Подписанные, но не отправленные переводы по хэшу сообщения
+	sent      []SentJetton
+	sendError error
+}
+
+// NewFakeChain создает FakeChain с пустыми балансами
+func NewFakeChain() *FakeChain {
+	treasury := sha256.Sum256([]byte("treasury"))
+	return &FakeChain{
+		treasury: address.NewAddress(0, 0, treasury[:]),
+		incoming: make(chan IncomingTransfer, 100),
+		balances: make(map[string]*big.Int),
+		prepared: make(map[string]SentJetton),
+	}
+}
+
+// Deliver ставит входящий перевод в очередь подписки. Если LT не задан, он назначается по порядку.
+func (c *FakeChain) Deliver(transfer IncomingTransfer) {
+	c.mu.Lock()
+	c.lastLT++
+	if transfer.LT == 0 {
+		transfer.LT = c.lastLT
+	} else {
+		c.lastLT = max(c.lastLT, transfer.LT)
+	}
+	if transfer.TxHash == "" {
+		transfer.TxHash = fmt.Sprintf("%064x", transfer.LT)
+	}
+	c.mu.Unlock()
+
+	c.incoming <- transfer
+}
+
+// SetJettonBalance задает баланс jetton казны
+func (c *FakeChain) SetJettonBalance(master *address.Address, balance *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balances[master.String()] = new(big.Int).Set(balance)
+}
+
+// FailSends заставляет SendJetton возвращать err; nil возвращает обычное поведение
+func (c *FakeChain) FailSends(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendError = err
+}
+
+// SetTransferStatus задает состояние в блокчейне отправленного перевода с комментарием comment.
+// По умолчанию отправленный перевод подтвержден.
+func (c *FakeChain) SetTransferStatus(comment string, status OutgoingStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.sent {
+		if c.sent[i].Comment == comment {
+			c.sent[i].Status = status
+		}
+	}
+}
+
+// Sent возвращает отправленные переводы в порядке отправки
+func (c *FakeChain) Sent() []SentJetton {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]SentJetton(nil), c.sent...)
+}
+
+// Treasury возвращает адрес казны FakeChain
+func (c *FakeChain) Treasury(ctx context.Context) (*address.Address, error) {
+	return c.treasury, nil
+}
+
+// LastLT возвращает LT последнего доставленного перевода
+func (c *FakeChain) LastLT(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastLT, nil
+}
+
+// SubscribeTransfers отдает переводы из Deliver с LT больше fromLT, пока не отменен ctx.
+// Переводы в валюте, которой нет ни среди jettons, ни TON, пропускаются, как и в блокчейне.
+func (c *FakeChain) SubscribeTransfers(ctx context.Context, fromLT uint64, jettons []TreasuryJetton, transfers chan<- IncomingTransfer) error {
+	defer close(transfers)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case transfer := <-c.incoming:
+			if transfer.LT <= fromLT || !fakeAccepted(jettons, transfer.Currency) {
+				continue
+			}
+			select {
+			case transfers <- transfer:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// JettonWallet возвращает детерминированный адрес, зависящий от мастер-контракта и владельца
+func (c *FakeChain) JettonWallet(ctx context.Context, master, owner *address.Address) (*address.Address, error) {
+	hash := sha256.Sum256([]byte(master.String() + owner.String()))
+	return address.NewAddress(0, 0, hash[:]), nil
+}
+
+// JettonBalance возвращает баланс, заданный SetJettonBalance, за вычетом отправленного
+func (c *FakeChain) JettonBalance(ctx context.Context, master *address.Address) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if balance, ok := c.balances[master.String()]; ok {
+		return new(big.Int).Set(balance), nil
+	}
+	return big.NewInt(0), nil
+}
+
+// PrepareJetton запоминает перевод; сообщения различаются порядковым номером, как seqno кошелька
+func (c *FakeChain) PrepareJetton(ctx context.Context, master, to *address.Address, amount tlb.Coins, comment string) (OutgoingTransfer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("message|%s|%d", comment, len(c.prepared))))
+	messageHash := hex.EncodeToString(hash[:])
+	c.prepared[messageHash] = SentJetton{
+		Master:      master,
+		To:          to,
+		Amount:      amount.Nano(),
+		Comment:     comment,
+		MessageHash: messageHash,
+	}
+	return OutgoingTransfer{
+		MessageHash: messageHash,
+		ValidUntil:  time.Now().Add(time.Minute),
+		FromLT:      c.lastLT,
+	}, nil
+}
+
+// SendJetton записывает подготовленный перевод и списывает его с баланса казны
+func (c *FakeChain) SendJetton(ctx context.Context, transfer OutgoingTransfer) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sendError != nil {
+		return nil, c.sendError
+	}
+
+	sent, ok := c.prepared[transfer.MessageHash]
+	if !ok {
+		return nil, fmt.Errorf("сообщение перевода %s не подготовлено", transfer.MessageHash)
+	}
+	delete(c.prepared, transfer.MessageHash)
+
+	balance, ok := c.balances[sent.Master.String()]
+	if !ok || balance.Cmp(sent.Amount) < 0 {
+		return nil, fmt.Errorf("недостаточно jetton на балансе казны")
+	}
+	balance.Sub(balance, sent.Amount)
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", sent.Comment, len(c.sent))))
+	sent.TxHash = hash[:]
+	sent.Status = OutgoingConfirmed
+	c.sent = append(c.sent, sent)
+	return hash[:], nil
+}
+
+// FindJettonTransfer возвращает состояние перевода, отправленного сообщением transfer
+func (c *FakeChain) FindJettonTransfer(ctx context.Context, master *address.Address, transfer OutgoingTransfer) (OutgoingStatus, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sent := range c.sent {
+		if sent.MessageHash == transfer.MessageHash && sent.Master.Equals(master) {
+			return sent.Status, sent.TxHash, nil
+		}
+	}
+	return OutgoingNotFound, nil, nil
+}
+
+// fakeAccepted сообщает, распознала бы подписка перевод в валюте currency
+func fakeAccepted(jettons []TreasuryJetton, currency string) bool {
+	if currency == "ton" {
+		return true
+	}
+	for _, known := range jettons {
+		if known.Symbol == currency {
+			return true
+		}
+	}
+	return false
+}
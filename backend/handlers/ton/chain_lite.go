@@ -0,0 +1,471 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/liteclient"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// tonConfigURL - конфигурация lite-серверов основной сети
+const tonConfigURL = "https://ton.org/global.config.json"
+
+// LiteChain работает с блокчейном TON через lite-серверы. Казна задается TON_WALLET_ADDRESS,
+// отправка выводов требует WALLET_SEED_PHRASE. Соединение устанавливается при первом обращении.
+type LiteChain struct {
+	mu     sync.Mutex
+	api    ton.APIClientWrapped
+	wallet *wallet.Wallet
+}
+
+// NewLiteChain создает LiteChain
+func NewLiteChain() *LiteChain {
+	return &LiteChain{}
+}
+
+// client возвращает API-клиент, подключаясь к lite-серверам при первом вызове
+func (c *LiteChain) client(ctx context.Context) (ton.APIClientWrapped, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.api != nil {
+		return c.api, nil
+	}
+
+	pool := liteclient.NewConnectionPool()
+	cfg, err := liteclient.GetConfigFromUrl(ctx, tonConfigURL)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения конфигурации: %v", err)
+	}
+	if err := pool.AddConnectionsFromConfig(ctx, cfg); err != nil {
+		return nil, fmt.Errorf("ошибка подключения: %v", err)
+	}
+
+	api := ton.NewAPIClient(pool, ton.ProofCheckPolicySecure).WithRetry()
+	master, err := api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения информации о мастерчейне: %v", err)
+	}
+	// Устанавливаем trusted block для улучшения безопасности
+	api.SetTrustedBlock(master)
+	log.Printf("Подключение к lite серверам установлено, trusted block: seqno=%d", master.SeqNo)
+
+	c.api = api
+	return api, nil
+}
+
+// treasury возвращает адрес кошелька казны из TON_WALLET_ADDRESS
+func (c *LiteChain) treasury() (*address.Address, error) {
+	treasuryAddress := os.Getenv("TON_WALLET_ADDRESS")
+	if treasuryAddress == "" {
+		return nil, fmt.Errorf("TON_WALLET_ADDRESS не установлен")
+	}
+	return address.ParseAddr(treasuryAddress)
+}
+
+// treasuryWallet возвращает кошелек казны, созданный из WALLET_SEED_PHRASE
+func (c *LiteChain) treasuryWallet(ctx context.Context) (*wallet.Wallet, error) {
+	api, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wallet != nil {
+		return c.wallet, nil
+	}
+
+	seedPhrase := os.Getenv("WALLET_SEED_PHRASE")
+	if seedPhrase == "" {
+		return nil, fmt.Errorf("WALLET_SEED_PHRASE не установлен")
+	}
+	w, err := wallet.FromSeed(api, strings.Split(seedPhrase, " "), wallet.ConfigV5R1Final{NetworkGlobalID: -239, Workchain: 0})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при создании кошелька: %v", err)
+	}
+	log.Printf("Кошелек приложения инициализирован: %s", w.WalletAddress().String())
+
+	c.wallet = w
+	return w, nil
+}
+
+// Treasury возвращает адрес кошелька казны из TON_WALLET_ADDRESS
+func (c *LiteChain) Treasury(ctx context.Context) (*address.Address, error) {
+	return c.treasury()
+}
+
+// LastLT возвращает LT последней транзакции кошелька казны
+func (c *LiteChain) LastLT(ctx context.Context) (uint64, error) {
+	api, err := c.client(ctx)
+	if err != nil {
+		return 0, err
+	}
+	treasuryAddress, err := c.treasury()
+	if err != nil {
+		return 0, err
+	}
+
+	master, err := api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения информации о мастерчейне: %v", err)
+	}
+	acc, err := api.GetAccount(ctx, master, treasuryAddress)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения аккаунта: %v", err)
+	}
+	return acc.LastTxLT, nil
+}
+
+// SubscribeTransfers разбирает входящие транзакции казны. Депозитом считается уведомление
+// от jetton-кошелька казны из jettons или простой перевод TON без тела либо с текстовым комментарием.
+func (c *LiteChain) SubscribeTransfers(ctx context.Context, fromLT uint64, jettons []TreasuryJetton, transfers chan<- IncomingTransfer) error {
+	defer close(transfers)
+
+	api, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	treasuryAddress, err := c.treasury()
+	if err != nil {
+		return err
+	}
+
+	transactions := make(chan *tlb.Transaction)
+
+	// it is a blocking call, so we start it asynchronously
+	go api.SubscribeOnTransactions(ctx, treasuryAddress, fromLT, transactions)
+
+	log.Println("waiting for transfers...")
+
+	for tx := range transactions {
+		if tx.IO.In == nil || tx.IO.In.MsgType != tlb.MsgTypeInternal {
+			continue
+		}
+		ti := tx.IO.In.AsInternal()
+
+		if dsc, ok := tx.Description.(tlb.TransactionDescriptionOrdinary); ok && dsc.BouncePhase != nil {
+			if _, ok = dsc.BouncePhase.Phase.(tlb.BouncePhaseOk); ok {
+				// transaction was bounced, and coins were returned to sender
+				continue
+			}
+		}
+
+		// verify that event sender is our jetton wallet
+		if known, ok := findTreasuryJetton(jettons, ti.SrcAddr); ok {
+			var notification jetton.TransferNotification
+			if err := tlb.LoadFromCell(&notification, ti.Body.BeginParse()); err != nil {
+				log.Printf("Не удалось разобрать уведомление о переводе jetton: %v", err)
+				continue
+			}
+
+			// Перевод без текстового комментария тоже передаем: его разберут вручную
+			comment, _ := textComment(notification.ForwardPayload)
+			transfers <- IncomingTransfer{
+				Currency: known.Symbol,
+				Amount:   notification.Amount.Nano(),
+				Decimals: known.Decimals,
+				Sender:   notification.Sender, // реальный отправитель, а не его jetton-кошелек
+				Comment:  comment,
+				TxHash:   hex.EncodeToString(tx.Hash),
+				LT:       tx.LT,
+			}
+			continue
+		}
+
+		// Вернувшиеся сообщения и переводы без TON депозитом не являются
+		if ti.Bounced || ti.Amount.Nano().Sign() <= 0 {
+			continue
+		}
+		comment, ok := textComment(ti.Body)
+		if !ok {
+			log.Printf("Входящее сообщение от %s с %s TON не является переводом с комментарием", ti.SrcAddr.String(), ti.Amount.String())
+			continue
+		}
+		transfers <- IncomingTransfer{
+			Currency: "ton",
+			Amount:   ti.Amount.Nano(),
+			Decimals: 9,
+			Sender:   ti.SrcAddr,
+			Comment:  comment,
+			TxHash:   hex.EncodeToString(tx.Hash),
+			LT:       tx.LT,
+		}
+	}
+
+	return ctx.Err()
+}
+
+// findTreasuryJetton возвращает jetton, jetton-кошелек казны которого имеет адрес wallet
+func findTreasuryJetton(jettons []TreasuryJetton, wallet *address.Address) (TreasuryJetton, bool) {
+	for _, known := range jettons {
+		if known.Wallet.Equals(wallet) {
+			return known, true
+		}
+	}
+	return TreasuryJetton{}, false
+}
+
+// JettonWallet возвращает адрес jetton-кошелька владельца owner
+func (c *LiteChain) JettonWallet(ctx context.Context, master, owner *address.Address) (*address.Address, error) {
+	api, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tokenWallet, err := jetton.NewJettonMasterClient(api, master).GetJettonWallet(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при получении Jetton-кошелька: %v", err)
+	}
+	return tokenWallet.Address(), nil
+}
+
+// treasuryJettonWallet возвращает jetton-кошелек казны для мастер-контракта master
+func (c *LiteChain) treasuryJettonWallet(ctx context.Context, master *address.Address) (*wallet.Wallet, *jetton.WalletClient, error) {
+	w, err := c.treasuryWallet(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	api, err := c.client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenWallet, err := jetton.NewJettonMasterClient(api, master).GetJettonWallet(ctx, w.WalletAddress())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка при получении Jetton-кошелька: %v", err)
+	}
+	return w, tokenWallet, nil
+}
+
+// JettonBalance возвращает баланс jetton казны
+func (c *LiteChain) JettonBalance(ctx context.Context, master *address.Address) (*big.Int, error) {
+	_, tokenWallet, err := c.treasuryJettonWallet(ctx, master)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := tokenWallet.GetBalance(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при получении баланса Jetton-кошелька: %v", err)
+	}
+	return balance, nil
+}
+
+// outgoingMessageTTL - сколько действует внешнее сообщение кошелька казны (значение tonutils-go по умолчанию)
+const outgoingMessageTTL = 3 * time.Minute
+
+// PrepareJetton подписывает внешнее сообщение кошелька казны с переводом jetton
+func (c *LiteChain) PrepareJetton(ctx context.Context, master, to *address.Address, amount tlb.Coins, comment string) (OutgoingTransfer, error) {
+	w, tokenWallet, err := c.treasuryJettonWallet(ctx, master)
+	if err != nil {
+		return OutgoingTransfer{}, err
+	}
+	api, err := c.client(ctx)
+	if err != nil {
+		return OutgoingTransfer{}, err
+	}
+	responseAddr, err := c.treasury()
+	if err != nil {
+		return OutgoingTransfer{}, err
+	}
+
+	// Транзакция с этим сообщением будет позже последней транзакции кошелька на текущий момент
+	block, err := api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return OutgoingTransfer{}, fmt.Errorf("ошибка получения информации о мастерчейне: %v", err)
+	}
+	acc, err := api.GetAccount(ctx, block, w.WalletAddress())
+	if err != nil {
+		return OutgoingTransfer{}, fmt.Errorf("ошибка получения аккаунта: %v", err)
+	}
+
+	commentCell, err := wallet.CreateCommentCell(comment)
+	if err != nil {
+		return OutgoingTransfer{}, fmt.Errorf("ошибка при создании комментария: %v", err)
+	}
+
+	// Создаем payload для перевода Jetton
+	transferPayload, err := tokenWallet.BuildTransferPayloadV2(
+		to,                             // адрес получателя
+		responseAddr,                   // адрес для ответа
+		amount,                         // сумма перевода
+		tlb.MustFromTON("0.000000001"), // тоны для оплаты комиссии форвард-сообщения (0)
+		commentCell,                    // комментарий
+		nil,                            // дополнительный payload
+	)
+	if err != nil {
+		return OutgoingTransfer{}, fmt.Errorf("ошибка при создании payload для перевода: %v", err)
+	}
+
+	// Создаем сообщение для перевода (0.05 TON для оплаты комиссий)
+	msg := wallet.SimpleMessage(tokenWallet.Address(), tlb.MustFromTON("0.05"), transferPayload)
+	ext, err := w.BuildExternalMessageForMany(ctx, []*wallet.Message{msg})
+	if err != nil {
+		return OutgoingTransfer{}, fmt.Errorf("ошибка при подписи сообщения: %v", err)
+	}
+
+	return OutgoingTransfer{
+		MessageHash: hex.EncodeToString(ext.Body.Hash()),
+		// Срок считается после подписи, поэтому не раньше записанного в сообщение
+		ValidUntil: time.Now().Add(outgoingMessageTTL),
+		FromLT:     acc.LastTxLT,
+		message:    ext,
+	}, nil
+}
+
+// SendJetton отправляет подготовленное сообщение кошелька казны и ждет его транзакции
+func (c *LiteChain) SendJetton(ctx context.Context, transfer OutgoingTransfer) ([]byte, error) {
+	if transfer.message == nil {
+		return nil, fmt.Errorf("сообщение перевода %s не подготовлено в этом процессе", transfer.MessageHash)
+	}
+	api, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, _, _, err := api.SendExternalMessageWaitTransaction(ctx, transfer.message)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Hash, nil
+}
+
+// transactionsAfter возвращает транзакции аккаунта с LT больше afterLT, начиная с новых
+func transactionsAfter(ctx context.Context, api ton.APIClientWrapped, addr *address.Address, afterLT uint64) ([]*tlb.Transaction, error) {
+	master, err := api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения информации о мастерчейне: %v", err)
+	}
+	acc, err := api.GetAccount(ctx, master, addr)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения аккаунта: %v", err)
+	}
+	if !acc.IsActive || acc.LastTxLT == 0 {
+		return nil, nil
+	}
+
+	var result []*tlb.Transaction
+	lt, hash := acc.LastTxLT, acc.LastTxHash
+	for lt > afterLT {
+		list, err := api.ListTransactions(ctx, addr, 16, lt, hash)
+		if errors.Is(err, ton.ErrNoTransactionsWereFound) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка получения транзакций %s: %v", addr.String(), err)
+		}
+		// ListTransactions возвращает транзакции от старых к новым
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].LT <= afterLT {
+				return result, nil
+			}
+			result = append(result, list[i])
+		}
+		lt, hash = list[0].PrevTxLT, list[0].PrevTxHash
+	}
+	return result, nil
+}
+
+// FindJettonTransfer ищет транзакцию кошелька казны, выполнившую внешнее сообщение transfer,
+// а затем транзакцию jetton-кошелька, обработавшую отправленный ею перевод.
+func (c *LiteChain) FindJettonTransfer(ctx context.Context, master *address.Address, transfer OutgoingTransfer) (OutgoingStatus, []byte, error) {
+	w, tokenWallet, err := c.treasuryJettonWallet(ctx, master)
+	if err != nil {
+		return OutgoingNotFound, nil, err
+	}
+	api, err := c.client(ctx)
+	if err != nil {
+		return OutgoingNotFound, nil, err
+	}
+
+	walletTxs, err := transactionsAfter(ctx, api, w.WalletAddress(), transfer.FromLT)
+	if err != nil {
+		return OutgoingNotFound, nil, err
+	}
+
+	var sendTx *tlb.Transaction
+	for _, tx := range walletTxs {
+		if tx.IO.In == nil || tx.IO.In.MsgType != tlb.MsgTypeExternalIn {
+			continue
+		}
+		if body := tx.IO.In.AsExternalIn().Body; body != nil && hex.EncodeToString(body.Hash()) == transfer.MessageHash {
+			sendTx = tx
+			break
+		}
+	}
+	if sendTx == nil {
+		return OutgoingNotFound, nil, nil
+	}
+
+	// Сообщение принято кошельком; перевод ушел, если в транзакции есть сообщение jetton-кошельку
+	var createdLT uint64
+	if sendTx.IO.Out != nil {
+		messages, err := sendTx.IO.Out.ToSlice()
+		if err != nil {
+			return OutgoingSent, sendTx.Hash, err
+		}
+		for _, msg := range messages {
+			if msg.MsgType == tlb.MsgTypeInternal && msg.AsInternal().DstAddr.Equals(tokenWallet.Address()) {
+				createdLT = msg.AsInternal().CreatedLT
+				break
+			}
+		}
+	}
+	if createdLT == 0 {
+		return OutgoingFailed, sendTx.Hash, nil
+	}
+
+	jettonTxs, err := transactionsAfter(ctx, api, tokenWallet.Address(), createdLT)
+	if err != nil {
+		return OutgoingSent, sendTx.Hash, err
+	}
+	for _, tx := range jettonTxs {
+		if tx.IO.In == nil || tx.IO.In.MsgType != tlb.MsgTypeInternal {
+			continue
+		}
+		in := tx.IO.In.AsInternal()
+		if !in.SrcAddr.Equals(w.WalletAddress()) || in.CreatedLT != createdLT {
+			continue
+		}
+
+		dsc, ok := tx.Description.(tlb.TransactionDescriptionOrdinary)
+		if !ok || dsc.Aborted || dsc.ActionPhase == nil || !dsc.ActionPhase.Success {
+			return OutgoingFailed, sendTx.Hash, nil
+		}
+		if vm, ok := dsc.ComputePhase.Phase.(tlb.ComputePhaseVM); !ok || !vm.Success {
+			return OutgoingFailed, sendTx.Hash, nil
+		}
+		return OutgoingConfirmed, sendTx.Hash, nil
+	}
+	return OutgoingSent, sendTx.Hash, nil
+}
+
+// textComment читает текстовый комментарий (op = 0) из тела сообщения. Пустое тело — перевод
+// без комментария. Возвращает false, если в теле другая операция.
+func textComment(body *cell.Cell) (string, bool) {
+	if body == nil {
+		return "", true
+	}
+	slice := body.BeginParse()
+	if slice.BitsLeft() < 32 {
+		return "", true
+	}
+	if op, err := slice.LoadUInt(32); err != nil || op != 0 {
+		return "", false
+	}
+	comment, err := slice.LoadStringSnake()
+	if err != nil {
+		return "", true
+	}
+	return comment, true
+}
@@ -0,0 +1,278 @@
+package ton
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Причины, по которым входящий перевод не зачислен автоматически и записан в unmatched_deposits
+const (
+	unmatchedNoComment        = "no_comment"        // В переводе нет текстового комментария
+	unmatchedUnknownComment   = "unknown_comment"   // Комментарий не совпадает ни с одним депозитом
+	unmatchedCurrencyMismatch = "currency_mismatch" // Пришла не та валюта, что указана в депозите
+	unmatchedSenderMismatch   = "sender_mismatch"   // Отправитель не совпадает с кошельком депозита
+	unmatchedNotPending       = "not_pending"       // Депозит уже зачислен или закрыт — повторная оплата
+	unmatchedUnderpaid        = "underpaid"         // Пришло меньше, чем по котировке; депозит не зачислен
+	unmatchedOverpaid         = "overpaid"          // Пришло больше: зачислено по котировке, излишек требует возврата
+	unmatchedCreditFailed     = "credit_failed"     // Не удалось начислить WILL
+)
+
+// depositStatusUnderpaid - депозит оплачен не полностью и ждет ручной проверки
+const depositStatusUnderpaid = "underpaid"
+
+// UnmatchedDeposit - входящий перевод в казну, который не удалось автоматически сопоставить
+// с депозитом или зачислить как есть. Разбирается вручную.
+type UnmatchedDeposit struct {
+	TxHash        string     `bson:"tx_hash" json:"tx_hash"`
+	LT            uint64     `bson:"lt" json:"lt"`
+	Currency      string     `bson:"currency" json:"currency"`
+	Amount        float64    `bson:"amount" json:"amount"`     // Полученная сумма
+	Expected      float64    `bson:"expected" json:"expected"` // Ожидаемая сумма, если депозит найден
+	Sender        string     `bson:"sender" json:"sender"`
+	Comment       string     `bson:"comment" json:"comment"`
+	TransactionID string     `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+	Reason        string     `bson:"reason" json:"reason"`
+	CreatedAt     time.Time  `bson:"created_at" json:"created_at"`
+	ResolvedAt    *time.Time `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+}
+
+// amountFloat возвращает сумму перевода в единицах валюты
+func (t IncomingTransfer) amountFloat() float64 {
+	value, _ := new(big.Float).Quo(new(big.Float).SetInt(t.Amount), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(t.Decimals)), nil))).Float64()
+	return value
+}
+
+// toUnits переводит сумму в единицах валюты в минимальные единицы с точностью decimals
+func toUnits(amount float64, decimals int) (*big.Int, error) {
+	coins, err := tlb.FromDecimal(fmt.Sprintf("%.*f", decimals, amount), decimals)
+	if err != nil {
+		return nil, err
+	}
+	return coins.Nano(), nil
+}
+
+// parseAnyAddr разбирает адрес в raw (0:...) или user-friendly формате
+func parseAnyAddr(addr string) (*address.Address, error) {
+	if strings.Contains(addr, ":") {
+		return address.ParseRawAddr(addr)
+	}
+	return address.ParseAddr(addr)
+}
+
+// ensureUnmatchedIndexes создает уникальный индекс несопоставленных переводов: повторная обработка
+// той же транзакции блокчейна не создает дубликатов.
+func (h *TonHandler) ensureUnmatchedIndexes(ctx context.Context) error {
+	_, err := h.unmatchedCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tx_hash", Value: 1}, {Key: "reason", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// recordUnmatched сохраняет перевод для ручного разбора
+func (h *TonHandler) recordUnmatched(ctx context.Context, transfer IncomingTransfer, deposit *TonTransaction, reason string) {
+	record := UnmatchedDeposit{
+		TxHash:    transfer.TxHash,
+		LT:        transfer.LT,
+		Currency:  transfer.Currency,
+		Amount:    transfer.amountFloat(),
+		Comment:   transfer.Comment,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if transfer.Sender != nil {
+		record.Sender = transfer.Sender.String()
+	}
+	if deposit != nil {
+		record.TransactionID = deposit.TransactionID
+		record.Expected = deposit.Amount
+	}
+
+	_, err := h.unmatchedCollection.InsertOne(ctx, record)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Ошибка записи несопоставленного перевода %s: %v", transfer.TxHash, err)
+		return
+	}
+	log.Printf("Перевод %s (%f %s от %s, комментарий %q) отложен для ручной проверки: %s",
+		transfer.TxHash, record.Amount, transfer.Currency, record.Sender, transfer.Comment, reason)
+}
+
+// matchDeposit сопоставляет входящий перевод с депозитом по комментарию и сверяет валюту,
+// отправителя и сумму. WILL начисляются только при переходе депозита из pending в completed,
+// поэтому уже зачисленный депозит повторно не зачисляется. Перевод без подходящего комментария
+// зачисляется владельцу, если отправитель — привязанный кошелек.
+func (h *TonHandler) matchDeposit(ctx context.Context, transfer IncomingTransfer) {
+	if transfer.Comment == "" {
+		if !h.creditFromLinkedWallet(ctx, transfer) {
+			h.recordUnmatched(ctx, transfer, nil, unmatchedNoComment)
+		}
+		return
+	}
+
+	var deposit TonTransaction
+	err := h.txCollection.FindOne(ctx, bson.M{"transaction_id": transfer.Comment, "payment_type": "deposit"}).Decode(&deposit)
+	if err == mongo.ErrNoDocuments {
+		if !h.creditFromLinkedWallet(ctx, transfer) {
+			h.recordUnmatched(ctx, transfer, nil, unmatchedUnknownComment)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка поиска депозита %s: %v", transfer.Comment, err)
+		return
+	}
+
+	if deposit.Currency != transfer.Currency {
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedCurrencyMismatch)
+		return
+	}
+	if deposit.Status != "pending" {
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedNotPending)
+		return
+	}
+	if expectedSender, err := parseAnyAddr(deposit.WalletAddress); err != nil || transfer.Sender == nil || !transfer.Sender.Equals(expectedSender) {
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedSenderMismatch)
+		return
+	}
+
+	expected, err := toUnits(deposit.Amount, transfer.Decimals)
+	if err != nil {
+		log.Printf("Некорректная сумма депозита %s: %v", deposit.TransactionID, err)
+		return
+	}
+
+	now := time.Now()
+	received := transfer.amountFloat()
+	if transfer.Amount.Cmp(expected) < 0 {
+		// Недоплата: WILL не начисляем, депозит ждет ручного решения
+		_, err := h.txCollection.UpdateOne(ctx,
+			bson.M{"transaction_id": deposit.TransactionID, "status": "pending"},
+			bson.M{"$set": bson.M{
+				"status":          depositStatusUnderpaid,
+				"received_amount": received,
+				"tx_hash":         transfer.TxHash,
+				"updated_at":      now,
+			}},
+		)
+		if err != nil {
+			log.Printf("Ошибка обновления статуса депозита %s: %v", deposit.TransactionID, err)
+		}
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedUnderpaid)
+		return
+	}
+
+	// Зачисляет только тот, кто перевел депозит из pending в completed
+	result, err := h.txCollection.UpdateOne(ctx,
+		bson.M{"transaction_id": deposit.TransactionID, "status": "pending"},
+		bson.M{"$set": bson.M{
+			"status":          "completed",
+			"received_amount": received,
+			"tx_hash":         transfer.TxHash,
+			"updated_at":      now,
+		}},
+	)
+	if err != nil {
+		log.Printf("Ошибка обновления статуса депозита %s: %v", deposit.TransactionID, err)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedNotPending)
+		return
+	}
+
+	// Переплата: WILL начисляются по котировке, излишек отмечаем для возврата
+	if transfer.Amount.Cmp(expected) > 0 {
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedOverpaid)
+	}
+
+	if err := h.creditDeposit(ctx, deposit); err != nil {
+		// Депозит уже completed, начисление повторит RetryFailedDepositCredits
+		log.Printf("Ошибка начисления депозита %s: %v", deposit.TransactionID, err)
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedCreditFailed)
+		return
+	}
+	log.Printf("Депозит %s зачислен: %f %s, пользователю %d начислено %d WILL",
+		deposit.TransactionID, received, transfer.Currency, deposit.TelegramID, deposit.WillAmount)
+}
+
+// RetryFailedDepositCredits повторяет начисление WILL по депозитам, переведенным в completed,
+// но не зачисленным из-за ошибки. Ключ проводки привязан к депозиту, поэтому повтор не начисляет
+// дважды. Успешно зачисленные записи credit_failed отмечаются разобранными.
+// Возвращает количество зачисленных депозитов.
+func (h *TonHandler) RetryFailedDepositCredits(ctx context.Context) (int, error) {
+	cursor, err := h.unmatchedCollection.Find(ctx, bson.M{
+		"reason":      unmatchedCreditFailed,
+		"resolved_at": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var failed []UnmatchedDeposit
+	if err := cursor.All(ctx, &failed); err != nil {
+		return 0, err
+	}
+
+	credited := 0
+	for _, record := range failed {
+		var deposit TonTransaction
+		err := h.txCollection.FindOne(ctx, bson.M{
+			"transaction_id": record.TransactionID,
+			"payment_type":   "deposit",
+			"status":         "completed",
+		}).Decode(&deposit)
+		if err != nil {
+			log.Printf("Депозит %s для повторного начисления не найден: %v", record.TransactionID, err)
+			continue
+		}
+		if err := h.creditDeposit(ctx, deposit); err != nil {
+			log.Printf("Ошибка повторного начисления депозита %s: %v", deposit.TransactionID, err)
+			continue
+		}
+
+		_, err = h.unmatchedCollection.UpdateOne(ctx,
+			bson.M{"tx_hash": record.TxHash, "reason": unmatchedCreditFailed},
+			bson.M{"$set": bson.M{"resolved_at": time.Now()}},
+		)
+		if err != nil {
+			log.Printf("Ошибка отметки повторного начисления депозита %s: %v", deposit.TransactionID, err)
+		}
+		log.Printf("Депозит %s зачислен повторно: пользователю %d начислено %d WILL",
+			deposit.TransactionID, deposit.TelegramID, deposit.WillAmount)
+		credited++
+	}
+	return credited, nil
+}
+
+// HandleListUnmatchedDeposits возвращает неразобранные несопоставленные переводы, начиная с новых
+func (h *TonHandler) HandleListUnmatchedDeposits(c *gin.Context) {
+	cursor, err := h.unmatchedCollection.Find(
+		context.Background(),
+		bson.M{"resolved_at": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(maxTransactionsLimit),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get deposits"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	deposits := []UnmatchedDeposit{}
+	if err := cursor.All(context.Background(), &deposits); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode deposits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deposits": deposits})
+}
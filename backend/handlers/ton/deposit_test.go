@@ -0,0 +1,158 @@
+package ton
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// watchTransfers запускает наблюдатель блокчейна с начала истории FakeChain и останавливает его,
+// когда выполнится done или истечет время ожидания
+func (e *testEnv) watchTransfers(t *testing.T, done func() bool) {
+	t.Helper()
+	_, err := e.handler.settingsCollection.InsertOne(context.Background(), bson.M{"key": "usdt_last_tx_lt", "value": uint64(0)})
+	if err != nil {
+		t.Fatalf("Ошибка сохранения lastProcessedLT: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		e.handler.CheckUsdtTransaction(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("Наблюдатель не обработал переводы вовремя")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// unmatchedCount возвращает число несопоставленных переводов с причиной reason
+func (e *testEnv) unmatchedCount(t *testing.T, reason string) int64 {
+	t.Helper()
+	count, err := e.handler.unmatchedCollection.CountDocuments(context.Background(), bson.M{"reason": reason})
+	if err != nil {
+		t.Fatalf("Ошибка чтения несопоставленных переводов: %v", err)
+	}
+	return count
+}
+
+func TestDepositCreditedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	sender := testWallet("depositor")
+	env.addUser(t, 1, 10)
+	env.addTransaction(t, TonTransaction{
+		TransactionID: "deposit-1",
+		Amount:        1.5,
+		Currency:      testJettonSymbol,
+		WillAmount:    1500,
+		WalletAddress: sender.String(),
+		TelegramID:    1,
+		Status:        "pending",
+		PaymentType:   "deposit",
+	})
+
+	// Тот же депозит оплачен дважды: второй перевод не зачисляется и ждет ручного разбора
+	for range 2 {
+		env.chain.Deliver(IncomingTransfer{
+			Currency: testJettonSymbol,
+			Amount:   jettonUnits(t, 1.5),
+			Decimals: 6,
+			Sender:   sender,
+			Comment:  "deposit-1",
+		})
+	}
+	env.watchTransfers(t, func() bool { return env.unmatchedCount(t, unmatchedNotPending) > 0 })
+
+	if tx := env.transaction(t, "deposit-1"); tx.Status != "completed" {
+		t.Errorf("Статус депозита %q, ожидался completed", tx.Status)
+	}
+	if balance := env.balance(t, 1); balance != 1510 {
+		t.Errorf("Баланс %d, ожидался 1510", balance)
+	}
+}
+
+func TestDepositUnderpaidNotCredited(t *testing.T) {
+	env := newTestEnv(t)
+	sender := testWallet("depositor")
+	env.addUser(t, 1, 0)
+	env.addTransaction(t, TonTransaction{
+		TransactionID: "deposit-1",
+		Amount:        1.5,
+		Currency:      testJettonSymbol,
+		WillAmount:    1500,
+		WalletAddress: sender.String(),
+		TelegramID:    1,
+		Status:        "pending",
+		PaymentType:   "deposit",
+	})
+
+	env.chain.Deliver(IncomingTransfer{
+		Currency: testJettonSymbol,
+		Amount:   jettonUnits(t, 1),
+		Decimals: 6,
+		Sender:   sender,
+		Comment:  "deposit-1",
+	})
+	env.watchTransfers(t, func() bool { return env.unmatchedCount(t, unmatchedUnderpaid) > 0 })
+
+	if tx := env.transaction(t, "deposit-1"); tx.Status != depositStatusUnderpaid {
+		t.Errorf("Статус депозита %q, ожидался %s", tx.Status, depositStatusUnderpaid)
+	}
+	if balance := env.balance(t, 1); balance != 0 {
+		t.Errorf("Баланс %d, недоплаченный депозит не должен зачисляться", balance)
+	}
+}
+
+func TestFailedDepositCreditRetried(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	// Депозит переведен в completed, но начисление WILL не прошло
+	env.addTransaction(t, TonTransaction{
+		TransactionID: "deposit-1",
+		Amount:        1.5,
+		Currency:      testJettonSymbol,
+		WillAmount:    1500,
+		WalletAddress: testWallet("depositor").String(),
+		TelegramID:    1,
+		Status:        "completed",
+		PaymentType:   "deposit",
+		TxHash:        "hash-1",
+	})
+	_, err := env.handler.unmatchedCollection.InsertOne(context.Background(), UnmatchedDeposit{
+		TxHash:        "hash-1",
+		TransactionID: "deposit-1",
+		Reason:        unmatchedCreditFailed,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Ошибка сохранения несопоставленного перевода: %v", err)
+	}
+
+	for range 2 {
+		if _, err := env.handler.RetryFailedDepositCredits(context.Background()); err != nil {
+			t.Fatalf("Ошибка повторного начисления: %v", err)
+		}
+	}
+
+	if balance := env.balance(t, 1); balance != 1500 {
+		t.Errorf("Баланс %d, ожидался 1500: депозит зачисляется один раз", balance)
+	}
+	var record UnmatchedDeposit
+	if err := env.handler.unmatchedCollection.FindOne(context.Background(), bson.M{"tx_hash": "hash-1"}).Decode(&record); err != nil {
+		t.Fatalf("Ошибка чтения несопоставленного перевода: %v", err)
+	}
+	if record.ResolvedAt == nil {
+		t.Error("Запись credit_failed не отмечена разобранной после начисления")
+	}
+}
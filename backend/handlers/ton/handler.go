@@ -2,24 +2,23 @@ package ton
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"backend/middleware"
+	"backend/models"
+	"backend/services"
 
 	"github.com/gin-gonic/gin"
-	"github.com/xssnick/tonutils-go/address"
-	"github.com/xssnick/tonutils-go/liteclient"
 	"github.com/xssnick/tonutils-go/tlb"
-	"github.com/xssnick/tonutils-go/ton"
-	"github.com/xssnick/tonutils-go/ton/jetton"
-	"github.com/xssnick/tonutils-go/ton/wallet"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -27,55 +26,111 @@ import (
 
 // TonHandler структура для обработки TON-транзакций
 type TonHandler struct {
-	usersCollection    *mongo.Collection
-	txCollection       *mongo.Collection
-	settingsCollection *mongo.Collection
+	usersCollection     *mongo.Collection
+	txCollection        *mongo.Collection
+	settingsCollection  *mongo.Collection
+	unmatchedCollection *mongo.Collection
+	limitsCollection    *mongo.Collection // Счетчики дневного лимита вывода
+	ledger              *services.Ledger
+	quotes              *services.QuoteService
+	proofs              *services.TonProofService
+	chain               Chain
+	jettonsMu           sync.RWMutex
+	jettons             []TreasuryJetton // Реестр jetton, заполняется LoadJettons
+	jettonsLoaded       bool             // Реестр загружен; до этого функции TON отключены
 }
 
 // NewHandler создает новый экземпляр TonHandler
-func NewHandler(usersCollection, txCollection, settingsCollection *mongo.Collection) *TonHandler {
+func NewHandler(usersCollection, txCollection, settingsCollection, unmatchedCollection, limitsCollection *mongo.Collection, ledger *services.Ledger, quotes *services.QuoteService, proofs *services.TonProofService, chain Chain) *TonHandler {
 	return &TonHandler{
-		usersCollection:    usersCollection,
-		txCollection:       txCollection,
-		settingsCollection: settingsCollection,
+		usersCollection:     usersCollection,
+		txCollection:        txCollection,
+		settingsCollection:  settingsCollection,
+		unmatchedCollection: unmatchedCollection,
+		limitsCollection:    limitsCollection,
+		ledger:              ledger,
+		quotes:              quotes,
+		proofs:              proofs,
+		chain:               chain,
 	}
 }
 
-// DepositRequest структура для запроса депозита TON
-type DepositRequest struct {
-	TransactionID string  `json:"transaction_id"`
-	Amount        float64 `json:"amount"`
-	Currency      string  `json:"currency"`
-	WillAmount    int     `json:"will_amount"`
-	WalletAddress string  `json:"wallet_address"`
+// EnsureIndexes создает индекс для истории транзакций пользователя, уникальный индекс transaction_id,
+// индекс несопоставленных переводов, уникальный индекс привязанных кошельков
+// и TTL-индекс счетчиков дневного лимита вывода
+func (h *TonHandler) EnsureIndexes(ctx context.Context) error {
+	_, err := h.txCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "telegram_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		// transaction_id приходит от клиента: только индекс гарантирует, что две транзакции его не делят
+		{Keys: bson.D{{Key: "transaction_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.ensureUnmatchedIndexes(ctx); err != nil {
+		return err
+	}
+	if err := h.ensureWithdrawLimitIndexes(ctx); err != nil {
+		return err
+	}
+	return h.ensureWalletIndexes(ctx)
+}
+
+// creditDeposit начисляет WILL за подтвержденный депозит. Ключ идемпотентности привязан к транзакции,
+// поэтому депозит, подтвержденный и проверкой клиента, и наблюдателем блокчейна, зачисляется один раз.
+func (h *TonHandler) creditDeposit(ctx context.Context, tx TonTransaction) error {
+	credited, err := h.ledger.Post(ctx, models.LedgerEntry{
+		TelegramID:     tx.TelegramID,
+		Amount:         tx.WillAmount,
+		Reason:         models.LedgerDeposit,
+		RefType:        models.LedgerRefTransaction,
+		RefID:          tx.TransactionID,
+		IdempotencyKey: "deposit:" + tx.TransactionID,
+	})
+	if err != nil {
+		return err
+	}
+	if !credited {
+		log.Printf("Депозит %s уже зачислен", tx.TransactionID)
+	}
+	return nil
 }
 
-// UsdtDepositRequest структура для запроса депозита USDT
-type UsdtDepositRequest struct {
-	TransactionID     string  `json:"transaction_id"`
-	Amount            float64 `json:"amount"`
-	Currency          string  `json:"currency"`
-	WillAmount        int     `json:"will_amount"`
-	WalletAddress     string  `json:"wallet_address"`
-	UsdtMasterAddress string  `json:"usdt_master_address"`
+// DepositRequest структура для запроса депозита. Суммы и валюта берутся из котировки QuoteID.
+type DepositRequest struct {
+	TransactionID string `json:"transaction_id"`
+	QuoteID       string `json:"quote_id"`
+	WalletAddress string `json:"wallet_address"`
 }
 
 // TonTransaction структура для хранения информации о транзакциях
 type TonTransaction struct {
-	TransactionID    string    `bson:"transaction_id" json:"transaction_id"`
-	Amount           float64   `bson:"amount" json:"amount"`     // Единое поле для суммы в любой валюте
-	Currency         string    `bson:"currency" json:"currency"` // 'ton' или 'usdt'
-	WillAmount       int       `bson:"will_amount" json:"will_amount"`
-	WalletAddress    string    `bson:"wallet_address" json:"wallet_address"`
-	TelegramID       int64     `bson:"telegram_id" json:"telegram_id"`
-	Status           string    `bson:"status" json:"status"`                                             // pending, completed, failed
-	PaymentType      string    `bson:"payment_type" json:"payment_type"`                                 // deposit, withdraw
-	JettonMasterAddr string    `bson:"jetton_master_addr,omitempty" json:"jetton_master_addr,omitempty"` // для USDT
-	CreatedAt        time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt        time.Time `bson:"updated_at" json:"updated_at"`
+	TransactionID    string            `bson:"transaction_id" json:"transaction_id"`
+	Amount           float64           `bson:"amount" json:"amount"`     // Единое поле для суммы в любой валюте
+	Currency         string            `bson:"currency" json:"currency"` // 'ton' или 'usdt'
+	WillAmount       int               `bson:"will_amount" json:"will_amount"`
+	WalletAddress    string            `bson:"wallet_address" json:"wallet_address"`
+	TelegramID       int64             `bson:"telegram_id" json:"telegram_id"`
+	Status           string            `bson:"status" json:"status"`                                             // депозит: pending, completed, underpaid; вывод: см. withdrawTransitions
+	PaymentType      string            `bson:"payment_type" json:"payment_type"`                                 // deposit, withdraw
+	JettonMasterAddr string            `bson:"jetton_master_addr,omitempty" json:"jetton_master_addr,omitempty"` // для USDT
+	QuoteID          string            `bson:"quote_id,omitempty" json:"quote_id,omitempty"`                     // Котировка, по которой рассчитаны суммы
+	ReceivedAmount   float64           `bson:"received_amount,omitempty" json:"received_amount,omitempty"`       // Фактически полученная сумма депозита
+	Fee              float64           `bson:"fee,omitempty" json:"fee,omitempty"`                               // Комиссия вывода в валюте транзакции
+	TxHash           string            `bson:"tx_hash,omitempty" json:"tx_hash,omitempty"`                       // Хэш транзакции в блокчейне (hex): отправленного вывода или полученного депозита
+	Attempts         int               `bson:"attempts,omitempty" json:"attempts,omitempty"`                     // Сколько раз вывод брался в отправку
+	Send             *OutgoingTransfer `bson:"send,omitempty" json:"send,omitempty"`                             // Подписанное сообщение перевода, сохраненное до отправки
+	FailureReason    string            `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`         // Почему вывод не выполнен
+	ReviewedBy       int64             `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`               // Администратор, одобривший или отклонивший вывод
+	ReviewReason     string            `bson:"review_reason,omitempty" json:"review_reason,omitempty"`           // Причина решения администратора
+	ReviewedAt       *time.Time        `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	RefundedAt       *time.Time        `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"` // Когда возвращены WILL за отклоненный вывод
+	LimitDate        string            `bson:"limit_date,omitempty" json:"-"`                      // Сутки UTC, в дневном лимите которых зарезервирован вывод
+	CreatedAt        time.Time         `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time         `bson:"updated_at" json:"updated_at"`
 }
 
-// HandleDeposit обрабатывает депозиты TON
+// HandleDeposit регистрирует депозит TON. Зачисляет его наблюдатель блокчейна, когда перевод придет в казну.
 func (h *TonHandler) HandleDeposit(c *gin.Context) {
 	// Получаем данные из контекста Telegram
 	initData, exists := middleware.CtxInitData(c.Request.Context())
@@ -83,6 +138,9 @@ func (h *TonHandler) HandleDeposit(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
 		return
 	}
+	if !h.requireJettons(c) {
+		return
+	}
 
 	var req DepositRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -90,35 +148,17 @@ func (h *TonHandler) HandleDeposit(c *gin.Context) {
 		return
 	}
 
-	// Проверяем обязательные поля
-	if req.TransactionID == "" || req.Amount <= 0 || req.Currency == "" || req.WalletAddress == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
+	tx, ok := h.depositFromQuote(c, initData.User.ID, req, func(currency string) bool { return currency == "ton" })
+	if !ok {
 		return
 	}
 
-	// Нормализуем адрес кошелька
-	normalizedAddr := normalizeAddress(req.WalletAddress)
-	if normalizedAddr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet address"})
-		return
-	}
-
-	// Создаем транзакцию
-	tx := TonTransaction{
-		TransactionID: req.TransactionID,
-		Amount:        req.Amount,
-		Currency:      req.Currency,
-		WillAmount:    req.WillAmount,
-		WalletAddress: normalizedAddr,
-		TelegramID:    initData.User.ID,
-		Status:        "pending",
-		PaymentType:   "deposit",
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-
 	// Сохраняем транзакцию в базу данных
 	_, err := h.txCollection.InsertOne(context.Background(), tx)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "transaction already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save transaction"})
 		return
@@ -130,69 +170,40 @@ func (h *TonHandler) HandleDeposit(c *gin.Context) {
 	})
 }
 
-// Добавим вспомогательную функцию для конвертации адресов
-func normalizeAddress(addr string) string {
-	// Если адрес начинается с 0: (raw формат), преобразуем его в user-friendly (EQ)
-	if strings.HasPrefix(addr, "0:") {
-		if parsedAddr, err := address.ParseAddr(addr); err == nil {
-			return parsedAddr.String() // Возвращает в формате EQ...
-		}
-	}
-
-	// Если адрес начинается с EQ или UQ, оставляем как есть
-	if strings.HasPrefix(addr, "EQ") || strings.HasPrefix(addr, "UQ") {
-		return addr
-	}
-
-	// В остальных случаях возвращаем исходный адрес
-	return addr
-}
-
-// HandleUsdtDeposit обрабатывает депозиты USDT (Jetton)
-func (h *TonHandler) HandleUsdtDeposit(c *gin.Context) {
+// HandleJettonDeposit регистрирует депозит в jetton из реестра. Валюта берется из котировки.
+func (h *TonHandler) HandleJettonDeposit(c *gin.Context) {
 	// Получаем данные из контекста Telegram
 	initData, exists := middleware.CtxInitData(c.Request.Context())
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
 		return
 	}
-
-	var req UsdtDepositRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+	if !h.requireJettons(c) {
 		return
 	}
 
-	// Проверяем обязательные поля
-	if req.TransactionID == "" || req.Amount <= 0 || req.Currency == "" || req.WalletAddress == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
+	var req DepositRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
 		return
 	}
 
-	// Нормализуем адрес кошелька
-	normalizedAddr := normalizeAddress(req.WalletAddress)
-	if normalizedAddr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet address"})
+	tx, ok := h.depositFromQuote(c, initData.User.ID, req, func(currency string) bool {
+		_, ok := h.jetton(currency)
+		return ok
+	})
+	if !ok {
 		return
 	}
-
-	// Создаем транзакцию
-	tx := TonTransaction{
-		TransactionID:    req.TransactionID,
-		Amount:           req.Amount,
-		Currency:         req.Currency,
-		WillAmount:       req.WillAmount,
-		WalletAddress:    normalizedAddr,
-		TelegramID:       initData.User.ID,
-		Status:           "pending",
-		PaymentType:      "deposit",
-		JettonMasterAddr: req.UsdtMasterAddress,
-		CreatedAt:        time.Now(),
-		UpdatedAt:        time.Now(),
-	}
+	known, _ := h.jetton(tx.Currency)
+	tx.JettonMasterAddr = known.Master.String()
 
 	// Сохраняем транзакцию в базу данных
 	_, err := h.txCollection.InsertOne(context.Background(), tx)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "transaction already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save transaction"})
 		return
@@ -209,94 +220,7 @@ type CheckTransactionRequest struct {
 	TransactionID string `json:"transaction_id" binding:"required"`
 }
 
-// HandleCheckTransaction проверяет статус TON-транзакции
-func (h *TonHandler) HandleCheckTransaction(c *gin.Context) {
-	transactionID := c.Query("transaction_id")
-	if transactionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "transaction_id is required"})
-		return
-	}
-
-	// Получаем транзакцию из базы данных
-	var tx TonTransaction
-	err := h.txCollection.FindOne(
-		context.Background(),
-		bson.M{"transaction_id": transactionID},
-	).Decode(&tx)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "transaction not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return
-	}
-
-	// Если транзакция уже завершена, возвращаем её статус
-	if tx.Status == "completed" {
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "completed",
-			"transaction": tx,
-		})
-		return
-	}
-
-	// Проверяем статус транзакции в блокчейне
-	completed, err := checkTonTransaction(context.Background(), os.Getenv("APP_WALLET_ADDRESS"), tx)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check transaction"})
-		return
-	}
-
-	if completed {
-		// Обновляем статус транзакции
-		_, err = h.txCollection.UpdateOne(
-			context.Background(),
-			bson.M{"transaction_id": transactionID},
-			bson.M{
-				"$set": bson.M{
-					"status":     "completed",
-					"updated_at": time.Now(),
-				},
-			},
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update transaction status"})
-			return
-		}
-
-		// Увеличиваем баланс пользователя
-		_, err = h.usersCollection.UpdateOne(
-			context.Background(),
-			bson.M{"telegram_id": tx.TelegramID},
-			bson.M{
-				"$inc": bson.M{
-					"balance": tx.WillAmount,
-				},
-			},
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user balance"})
-			return
-		}
-
-		tx.Status = "completed"
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "completed",
-			"transaction": tx,
-		})
-	} else {
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "pending",
-			"transaction": tx,
-		})
-	}
-}
-
-// HandleCheckUsdtTransaction проверяет статус USDT-транзакции
+// HandleCheckUsdtTransaction возвращает статус USDT-депозита
 func (h *TonHandler) HandleCheckUsdtTransaction(c *gin.Context) {
 	// Получаем данные из контекста Telegram
 	initData, exists := middleware.CtxInitData(c.Request.Context())
@@ -336,749 +260,215 @@ func (h *TonHandler) HandleCheckUsdtTransaction(c *gin.Context) {
 		return
 	}
 
-	// Проверяем статус транзакции
-	if tx.Status == "completed" {
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "completed",
-			"transaction": tx,
-		})
-		return
-	}
-
-	// Проверяем транзакцию в блокчейне
-	completed, err := checkTonTransaction(context.Background(), tx.WalletAddress, tx)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check transaction"})
-		return
-	}
-
-	if completed {
-		// Обновляем статус транзакции
-		_, err = h.txCollection.UpdateOne(
-			context.Background(),
-			bson.M{"transaction_id": req.TransactionID},
-			bson.M{
-				"$set": bson.M{
-					"status":     "completed",
-					"updated_at": time.Now(),
-				},
-			},
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update transaction status"})
-			return
-		}
-
-		// Обновляем баланс пользователя
-		_, err = h.usersCollection.UpdateOne(
-			context.Background(),
-			bson.M{"telegram_id": initData.User.ID},
-			bson.M{
-				"$inc": bson.M{
-					"balance": tx.WillAmount,
-				},
-			},
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user balance"})
-			return
-		}
-
-		tx.Status = "completed"
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "completed",
-			"transaction": tx,
-		})
-	} else {
-		c.JSON(http.StatusOK, gin.H{
-			"success":     true,
-			"status":      "pending",
-			"transaction": tx,
-		})
-	}
-}
-
-// checkTonTransaction проверяет TON-транзакцию
-func checkTonTransaction(ctx context.Context, appWalletAddress string, tx TonTransaction) (bool, error) {
-	log.Printf("Проверка транзакции %s на сумму %.2f TON от кошелька %s",
-		tx.TransactionID, tx.Amount, tx.WalletAddress)
-	log.Printf("Адрес кошелька приложения: %s", appWalletAddress)
-
-	// Проверяем, нужно ли пропустить проверку отправителя
-	skipSenderCheck := os.Getenv("SKIP_SENDER_CHECK") == "true"
-	if skipSenderCheck {
-		log.Println("Проверка адреса отправителя отключена")
-	}
-
-	// Проверяем, нужно ли пропустить проверку времени
-	skipTimeCheck := os.Getenv("SKIP_TIME_CHECK") == "true"
-	if skipTimeCheck {
-		log.Println("Проверка времени транзакции отключена")
-	}
-
-	// Используем TON Center API для проверки транзакций
-	tonCenterAPIKey := os.Getenv("TON_CENTER_API_KEY") // можете получить на toncenter.com
-	baseURL := "https://toncenter.com/api/v2/getTransactions"
-	if tonCenterAPIKey != "" {
-		baseURL += "?api_key=" + tonCenterAPIKey
-	}
-
-	// Формируем URL с параметрами
-	apiURL := fmt.Sprintf("%s&address=%s&limit=20", baseURL, appWalletAddress)
-	log.Printf("Запрос к TON Center API: %s", apiURL)
-
-	// Выполняем запрос к API
-	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
-	if err != nil {
-		return false, fmt.Errorf("ошибка при создании запроса: %w", err)
-	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("ошибка при выполнении запроса: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("некорректный статус ответа: %d", resp.StatusCode)
-	}
-
-	// Парсим ответ
-	var result struct {
-		OK     bool `json:"ok"`
-		Result []struct {
-			InMsg struct {
-				Source      string `json:"source"`
-				Destination string `json:"destination"`
-				Value       string `json:"value"`
-				Message     string `json:"message"`
-				CreatedLt   string `json:"created_lt"`
-			} `json:"in_msg"`
-			TransactionID struct {
-				Hash string `json:"hash"`
-			} `json:"transaction_id"`
-			Utime int64 `json:"utime"`
-		} `json:"result"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return false, fmt.Errorf("ошибка при декодировании ответа: %w", err)
-	}
-
-	log.Printf("Получен ответ от TON Center API: ok=%v, количество транзакций=%d", result.OK, len(result.Result))
-	log.Printf("Транзакция %s", result.Result[0].TransactionID.Hash)
-
-	if !result.OK || len(result.Result) == 0 {
-		log.Printf("Транзакция %s не найдена в блокчейне", tx.TransactionID)
-		return false, nil
-	}
-
-	// Ищем транзакцию от нужного отправителя на нужную сумму
-	expectedValueNano := int64(tx.Amount * 1_000_000_000) // конвертируем в наноТОНы
-	log.Printf("Ожидаемая сумма: %d наноТОНов", expectedValueNano)
-
-	// Время создания транзакции в Unix формате
-	txCreatedTime := tx.CreatedAt.Unix()
-	log.Printf("Время создания транзакции: %d", txCreatedTime)
-
-	// Ищем транзакцию с нашим идентификатором в сообщении
-	log.Printf("Ищем транзакцию с идентификатором %s в сообщении", tx.TransactionID)
-
-	for i, transaction := range result.Result {
-		log.Printf("Проверка транзакции #%d:", i+1)
-		log.Printf("  Отправитель: %s (ожидается: %s)", transaction.InMsg.Source, tx.WalletAddress)
-		log.Printf("  Получатель: %s (ожидается: %s)", transaction.InMsg.Destination, appWalletAddress)
-		log.Printf("  Сумма: %s наноТОНов", transaction.InMsg.Value)
-		log.Printf("  Время: %d", transaction.Utime)
-		log.Printf("  Сообщение: %s", transaction.InMsg.Message)
-
-		// Проверяем, содержит ли сообщение наш идентификатор транзакции
-		if strings.Contains(transaction.InMsg.Message, tx.TransactionID) {
-			log.Printf("  Найден идентификатор транзакции в сообщении")
-
-			// Все остальные проверки становятся дополнительными, так как
-			// идентификатор транзакции уникален
-
-			// Проверяем, что транзакция от нужного отправителя, если включена проверка
-			if transaction.InMsg.Source != tx.WalletAddress && !skipSenderCheck {
-				log.Printf("  Отправитель не совпадает, но проверка отключена, продолжаем")
-			}
-
-			// Проверяем сумму транзакции (с небольшой погрешностью из-за комиссии)
-			valueNano, err := strconv.ParseInt(transaction.InMsg.Value, 10, 64)
-			if err != nil {
-				log.Printf("  Ошибка при парсинге суммы транзакции: %v", err)
-				continue
-			}
-			log.Printf("  Разница в сумме: %d наноТОНов", expectedValueNano-valueNano)
-
-			// Допускаем погрешность в 0.05 TON из-за комиссий
-			if valueNano < expectedValueNano-50_000_000 {
-				log.Printf("  Сумма меньше ожидаемой, пропускаем")
-				continue
-			}
-
-			// Проверяем, что транзакция была создана после регистрации в нашей системе
-			// с запасом в 5 минут для учета возможных расхождений во времени
-			timeDiff := transaction.Utime - txCreatedTime
-			log.Printf("  Разница во времени: %d секунд", timeDiff)
-			if transaction.Utime < txCreatedTime-300 && !skipTimeCheck {
-				log.Printf("  Транзакция слишком старая, пропускаем")
-				continue
-			}
-
-			// Если дошли до этой точки, значит транзакция соответствует всем критериям
-			log.Printf("Найдена подтвержденная транзакция для %s в блокчейне", tx.TransactionID)
-			return true, nil
-		}
-
-		// Если идентификатор не найден в сообщении, проверяем стандартные параметры
-		// Проверяем, что транзакция от нужного отправителя
-		if transaction.InMsg.Source != tx.WalletAddress && !skipSenderCheck {
-			log.Printf("  Отправитель не совпадает, пропускаем")
-			continue
-		}
-
-		// Проверяем, что назначение транзакции - наш кошелек
-		if transaction.InMsg.Destination != appWalletAddress {
-			log.Printf("  Получатель не совпадает, пропускаем")
-			continue
-		}
-
-		// Проверяем сумму транзакции (с небольшой погрешностью из-за комиссии)
-		valueNano, err := strconv.ParseInt(transaction.InMsg.Value, 10, 64)
-		if err != nil {
-			log.Printf("  Ошибка при парсинге суммы транзакции: %v", err)
-			continue
-		}
-		log.Printf("  Разница в сумме: %d наноТОНов", expectedValueNano-valueNano)
-
-		// Допускаем погрешность в 0.05 TON из-за комиссий
-		if valueNano < expectedValueNano-50_000_000 {
-			log.Printf("  Сумма меньше ожидаемой, пропускаем")
-			continue
-		}
-
-		// Проверяем, что транзакция была создана после регистрации в нашей системе
-		// с запасом в 5 минут для учета возможных расхождений во времени
-		timeDiff := transaction.Utime - txCreatedTime
-		log.Printf("  Разница во времени: %d секунд", timeDiff)
-		if transaction.Utime < txCreatedTime-300 && !skipTimeCheck {
-			log.Printf("  Транзакция слишком старая, пропускаем")
-			continue
-		}
-
-		// Если дошли до этой точки, значит транзакция соответствует всем критериям
-		// даже без идентификатора в сообщении
-		log.Printf("Найдена подходящая транзакция для %s в блокчейне (без идентификатора в сообщении)", tx.TransactionID)
-		return true, nil
-	}
-
-	log.Printf("Транзакция %s не найдена в блокчейне или не соответствует ожиданиям", tx.TransactionID)
-	return false, nil
+	// USDT-депозиты зачисляет наблюдатель блокчейна после сверки суммы и отправителя,
+	// здесь только возвращаем текущий статус
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"status":      tx.Status,
+		"transaction": tx,
+	})
 }
 
-// CheckUsdtTransaction проверяет USDT-транзакцию следуя примеру работы с Jetton
+// CheckUsdtTransaction следит за входящими транзакциями казны и зачисляет депозиты TON и jetton из реестра
 func (h *TonHandler) CheckUsdtTransaction(ctx context.Context) (bool, error) {
-	// log.Printf("Начинаем проверку USDT транзакции: %s", tx.TransactionID)
-	// log.Printf("Параметры транзакции: сумма=%f USDT, адрес кошелька=%s, мастер-контракт=%s",
-	// 	tx.UsdtAmount, tx.WalletAddress, tx.JettonMasterAddr)
-
-	// Нормализуем адреса перед использованием
-	// normalizedAppWalletAddress := normalizeAddress(appWalletAddress)
-	appWalletAddress := os.Getenv("TON_WALLET_ADDRESS")
-	if appWalletAddress == "" {
-		log.Fatal("TON_WALLET_ADDRESS environment variable not set")
-	}
-	usdtMasterAddress := os.Getenv("USDT_MASTER_ADDRESS")
-	if usdtMasterAddress == "" {
-		log.Fatal("USDT_MASTER_ADDRESS environment variable not set")
-	}
-
-	normalizedJettonMasterAddr := normalizeAddress(usdtMasterAddress)
-
-	log.Printf("Нормализованные адреса: приложение=%s, мастер-контракт=%s",
-		appWalletAddress, normalizedJettonMasterAddr)
-
-	// Проверяем формат адреса мастер-контракта
-	if (!strings.HasPrefix(normalizedJettonMasterAddr, "EQ") && !strings.HasPrefix(normalizedJettonMasterAddr, "UQ")) &&
-		(!strings.HasPrefix(normalizedJettonMasterAddr, "0:")) {
-		log.Printf("Некорректный формат адреса Jetton мастер-контракта после нормализации: %s", normalizedJettonMasterAddr)
-		return false, fmt.Errorf("некорректный формат адреса Jetton мастер-контракта: %s", normalizedJettonMasterAddr)
-	}
-
-	client := liteclient.NewConnectionPool()
-
-	cfg, err := liteclient.GetConfigFromUrl(ctx, "https://ton.org/global.config.json")
-	if err != nil {
-		log.Printf("Ошибка получения конфигурации: %v", err)
-		return false, fmt.Errorf("ошибка получения конфигурации: %v", err)
-	}
-	log.Println("Конфигурация TON получена успешно")
-
-	// Подключаемся к lite серверам
-	err = client.AddConnectionsFromConfig(ctx, cfg)
-	if err != nil {
-		log.Printf("Ошибка подключения к серверам: %v", err)
-		return false, fmt.Errorf("ошибка подключения: %v", err)
-	}
-	log.Println("Подключение к lite серверам установлено")
-
-	// Инициализируем API клиент
-	api := ton.NewAPIClient(client, ton.ProofCheckPolicySecure).WithRetry()
-	master, err := api.CurrentMasterchainInfo(ctx)
-	if err != nil {
-		log.Printf("Ошибка получения информации о мастерчейне: %v", err)
-		return false, fmt.Errorf("ошибка получения информации о мастерчейне: %v", err)
-	}
-	log.Printf("Получена информация о мастерчейне: seqno=%d", master.SeqNo)
-
-	// Устанавливаем trusted block для улучшения безопасности
-	api.SetTrustedBlock(master)
-	log.Printf("Установлен trusted block: seqno=%d", master.SeqNo)
-
-	// Парсим адрес приложения
-	treasuryAddress, err := address.ParseAddr(appWalletAddress)
-	if err != nil {
-		log.Printf("Ошибка парсинга адреса приложения: %v", err)
-		return false, fmt.Errorf("ошибка парсинга адреса приложения: %v", err)
-	}
-	log.Printf("Адрес кошелька приложения: %s", treasuryAddress.String())
-
-	// Парсим адрес Jetton мастер-контракта
-	jettonMasterAddr, err := address.ParseAddr(normalizedJettonMasterAddr)
-	if err != nil {
-		log.Printf("Ошибка парсинга адреса Jetton мастер-контракта: %v", err)
-		return false, fmt.Errorf("ошибка парсинга адреса Jetton мастер-контракта: %v", err)
-	}
-	log.Printf("Адрес Jetton мастер-контракта: %s", jettonMasterAddr.String())
-
-	// Получаем аккаунт приложения
-	acc, err := api.GetAccount(ctx, master, treasuryAddress)
-	if err != nil {
-		log.Printf("Ошибка получения аккаунта: %v", err)
-		return false, fmt.Errorf("ошибка получения аккаунта: %v", err)
+	jettons, loaded := h.treasuryJettons()
+	if !loaded {
+		log.Println("Реестр jetton не загружен, проверка транзакций пропущена")
+		return false, nil
 	}
-	log.Printf("Получена информация об аккаунте. LastTxLT: %d, LastTxHash: %x", acc.LastTxLT, acc.LastTxHash)
 
 	// Пытаемся получить сохраненный lastProcessedLT из базы данных
 	var settings struct {
 		Key   string `bson:"key"`
 		Value uint64 `bson:"value"`
 	}
-	err = h.settingsCollection.FindOne(ctx, bson.M{"key": "usdt_last_tx_lt"}).Decode(&settings)
+	err := h.settingsCollection.FindOne(ctx, bson.M{"key": "usdt_last_tx_lt"}).Decode(&settings)
 
 	var lastProcessedLT uint64
 	if err == nil {
 		// Используем сохраненное значение
 		lastProcessedLT = settings.Value
 		log.Printf("Найдено сохраненное значение lastProcessedLT: %d", lastProcessedLT)
-	} else if err == mongo.ErrNoDocuments {
-		// Если записи нет, используем текущий LT
-		lastProcessedLT = acc.LastTxLT
-		log.Printf("Не найдено сохраненное значение lastProcessedLT, используем текущий: %d", lastProcessedLT)
 	} else {
-		// Если возникла ошибка при поиске
-		log.Printf("Ошибка получения lastProcessedLT из БД: %v, используем текущий: %d", err, acc.LastTxLT)
-		lastProcessedLT = acc.LastTxLT
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Ошибка получения lastProcessedLT из БД: %v", err)
+		}
+		// Если записи нет, начинаем с текущей транзакции казны
+		lastProcessedLT, err = h.chain.LastLT(ctx)
+		if err != nil {
+			log.Printf("Ошибка получения последней транзакции казны: %v", err)
+			return false, fmt.Errorf("ошибка получения последней транзакции казны: %v", err)
+		}
+		log.Printf("Не найдено сохраненное значение lastProcessedLT, используем текущий: %d", lastProcessedLT)
 	}
 
-	// channel with new transactions
-	transactions := make(chan *tlb.Transaction)
-
-	// it is a blocking call, so we start it asynchronously
-	go api.SubscribeOnTransactions(context.Background(), treasuryAddress, lastProcessedLT, transactions)
+	transfers := make(chan IncomingTransfer)
+	subscribeErr := make(chan error, 1)
+	go func() {
+		subscribeErr <- h.chain.SubscribeTransfers(ctx, lastProcessedLT, jettons, transfers)
+	}()
 
-	log.Println("waiting for transfers...")
-
-	// Проверяем транзакции
-	for tx := range transactions {
-		// Обновляем последний обработанный LT сразу после получения транзакции
+	for transfer := range transfers {
+		// Обновляем последний обработанный LT сразу после получения перевода
 		_, err = h.settingsCollection.UpdateOne(
 			ctx,
 			bson.M{"key": "usdt_last_tx_lt"},
-			bson.M{"$set": bson.M{"value": tx.LT}},
+			bson.M{"$set": bson.M{"value": transfer.LT}},
 			options.Update().SetUpsert(true), // Создаем запись, если она не существует
 		)
 		if err != nil {
 			log.Printf("Ошибка при обновлении lastProcessedLT в БД: %v", err)
-		} else {
-			log.Printf("Обновлен lastProcessedLT: %d", tx.LT)
 		}
 
-		if tx.IO.In != nil && tx.IO.In.MsgType == tlb.MsgTypeInternal {
-			ti := tx.IO.In.AsInternal()
-			src := ti.SrcAddr
-
-			if dsc, ok := tx.Description.(tlb.TransactionDescriptionOrdinary); ok && dsc.BouncePhase != nil {
-				if _, ok = dsc.BouncePhase.Phase.(tlb.BouncePhaseOk); ok {
-					// transaction was bounced, and coins were returned to sender
-					// this can happen mostly on custom contracts
-					continue
-				}
-			}
-
-			if !ti.ExtraCurrencies.IsEmpty() {
-				kv, err := ti.ExtraCurrencies.LoadAll()
-				if err != nil {
-					log.Fatalln("load extra currencies err: ", err.Error())
-					return false, fmt.Errorf("load extra currencies err: %v", err)
-				}
-
-				for _, dictKV := range kv {
-					currencyId := dictKV.Key.MustLoadUInt(32)
-					amount := dictKV.Value.MustLoadVarUInt(32)
-
-					log.Println("received", amount.String(), "ExtraCurrency with id", currencyId, "from", src.String())
-				}
-			}
-
-			// verify that event sender is our jetton wallet
-			treasuryJettonWallet, err := address.ParseAddr("EQDRE5lNhaH2M1nnCxTXFmUlQveGVoO10Tl5j495R2B9ZfMi")
-			if ti.SrcAddr.Equals(treasuryJettonWallet) {
-				var transfer jetton.TransferNotification
-				if err = tlb.LoadFromCell(&transfer, ti.Body.BeginParse()); err == nil {
-					// convert decimals to 6 for USDT (it can be fetched from jetton details too), default is 9
-					amt := tlb.MustFromNano(transfer.Amount.Nano(), 6)
-					payload := transfer.ForwardPayload.BeginParse()
-
-					payloadOp, err := payload.LoadUInt(32)
-					if err != nil {
-						log.Println("no text comment in transfer_notification")
-						continue
-					}
-					if payloadOp != 0 {
-						log.Println("no text comment in transfer_notification")
-						continue
-					}
-
-					comment := payload.MustLoadStringSnake()
-					log.Println("comment", comment)
-
-					// Ищем транзакцию в базе данных по комментарию
-					var transaction TonTransaction
-					sr := h.txCollection.FindOne(context.Background(), bson.M{"transaction_id": comment})
-					err = sr.Decode(&transaction)
-					if err != nil {
-						log.Printf("Ошибка при поиске транзакции по комментарию: %v", err)
-						continue
-					}
-
-					// Обновляем статус транзакции
-					updateResult, err := h.txCollection.UpdateOne(
-						context.Background(),
-						bson.M{"transaction_id": transaction.TransactionID},
-						bson.M{
-							"$set": bson.M{
-								"status":     "completed",
-								"updated_at": time.Now(),
-							},
-						},
-					)
-					if err != nil {
-						log.Printf("Ошибка при обновлении статуса транзакции: %v", err)
-						continue
-					}
-					log.Printf("Статус транзакции обновлен: %v", updateResult)
-
-					// Обновляем баланс пользователя
-					updateResult, err = h.usersCollection.UpdateOne(
-						context.Background(),
-						bson.M{"telegram_id": transaction.TelegramID},
-						bson.M{"$inc": bson.M{"balance": transaction.WillAmount}},
-					)
-					if err != nil {
-						log.Printf("Ошибка при обновлении баланса пользователя: %v", err)
-						continue
-					}
-					log.Printf("Баланс пользователя обновлен: %v", updateResult)
-					// reassign sender to real jetton sender instead of its jetton wallet contract
-					src = transfer.Sender
-					log.Println("received", amt.String(), "USDT from", src.String())
-				}
-			}
-
-			if ti.Amount.Nano().Sign() > 0 {
-				// show received ton amount
-				log.Println("received", ti.Amount.String(), "TON from", src.String())
-			}
-		}
+		log.Printf("Получен перевод %s: %s в минимальных единицах %s от %v, комментарий %q",
+			transfer.TxHash, transfer.Amount.String(), transfer.Currency, transfer.Sender, transfer.Comment)
+		h.matchDeposit(ctx, transfer)
 	}
 
-	return false, nil
+	return false, <-subscribeErr
 }
 
-// ProcessWithdrawals обрабатывает запросы на вывод средств
+// ProcessWithdrawals обрабатывает запросы на вывод средств. Сначала сверяет с блокчейном выводы
+// с неизвестным результатом, затем отправляет ожидающие. Невыполненные выводы возвращают WILL автоматически.
 func (h *TonHandler) ProcessWithdrawals(ctx context.Context) error {
 	log.Println("Начинаем обработку запросов на вывод WILL")
-
-	// Находим все транзакции вывода со статусом "pending"
-	filter := bson.M{
-		"status":       "pending",
-		"payment_type": "withdraw",
-		"currency":     "usdt", // Сейчас обрабатываем только USDT
+	if _, loaded := h.treasuryJettons(); !loaded {
+		log.Println("Реестр jetton не загружен, обработка выводов пропущена")
+		return nil
 	}
 
-	cursor, err := h.txCollection.Find(ctx, filter)
+	h.reconcileWithdrawals(ctx)
+
+	pending, err := h.findWithdrawals(ctx, withdrawStatusPending, time.Now())
 	if err != nil {
 		log.Printf("Ошибка при поиске транзакций вывода: %v", err)
 		return fmt.Errorf("ошибка при поиске транзакций вывода: %v", err)
 	}
-	defer cursor.Close(ctx)
-
-	// Получаем адрес мастер-контракта USDT из переменных окружения
-	usdtMasterAddr := os.Getenv("USDT_MASTER_ADDRESS")
-	if usdtMasterAddr == "" {
-		log.Println("USDT_MASTER_ADDRESS не установлен, используем адрес по умолчанию")
-		return fmt.Errorf("USDT_MASTER_ADDRESS не установлен")
+	if len(pending) == 0 {
+		log.Println("Нет выводов, ожидающих отправки")
+		return nil
 	}
 
-	appWalletAddressUserFriendly := os.Getenv("TON_WALLET_ADDRESS")
-	if appWalletAddressUserFriendly == "" {
-		log.Fatal("TON_WALLET_ADDRESS environment variable not set")
-	}
+	// Балансы jetton-кошельков казны, запрошенные в этом проходе
+	balances := make(map[string]*big.Int)
 
-	appWalletAddress, err := address.ParseAddr(appWalletAddressUserFriendly)
-	if err != nil {
-		log.Printf("Ошибка при парсинге адреса приложения: %v", err)
-		return fmt.Errorf("ошибка при парсинге адреса приложения: %v", err)
-	}
-
-	// Seed-фраза для кошелька приложения (в реальном приложении должна храниться в безопасном месте)
-	seedPhrase := os.Getenv("WALLET_SEED_PHRASE")
-	if seedPhrase == "" {
-		log.Printf("WALLET_SEED_PHRASE не установлен, вывод средств невозможен")
-		return fmt.Errorf("WALLET_SEED_PHRASE не установлен")
-	}
-
-	// Установка соединения с TON
-	client := liteclient.NewConnectionPool()
-	err = client.AddConnectionsFromConfigUrl(ctx, "https://ton.org/global.config.json")
-	if err != nil {
-		log.Printf("Ошибка при подключении к TON: %v", err)
-		return fmt.Errorf("ошибка при подключении к TON: %v", err)
-	}
-
-	// Инициализация API клиента
-	api := ton.NewAPIClient(client)
-
-	// Создаем кошелек из seed-фразы
-	words := strings.Split(seedPhrase, " ")
-	log.Println("words", words)
-	w, err := wallet.FromSeed(api, words, wallet.ConfigV5R1Final{NetworkGlobalID: -239, Workchain: 0})
-	if err != nil {
-		log.Printf("Ошибка при создании кошелька: %v", err)
-		return fmt.Errorf("ошибка при создании кошелька: %v", err)
-	}
-
-	log.Printf("Кошелек приложения инициализирован: %s", w.WalletAddress().String())
-
-	// Инициализация Jetton мастер-клиента
-	jettonMasterAddr, err := address.ParseAddr(usdtMasterAddr)
-	if err != nil {
-		log.Printf("Ошибка при парсинге адреса Jetton мастер-контракта: %v", err)
-		return fmt.Errorf("ошибка при парсинге адреса Jetton мастер-контракта: %v", err)
-	}
-
-	token := jetton.NewJettonMasterClient(api, jettonMasterAddr)
-
-	// Находим наш Jetton-кошелек
-	tokenWallet, err := token.GetJettonWallet(ctx, w.WalletAddress())
-	if err != nil {
-		log.Printf("Ошибка при получении Jetton-кошелька: %v", err)
-		return fmt.Errorf("ошибка при получении Jetton-кошелька: %v", err)
-	}
-
-	// Получаем баланс Jetton-кошелька
-	tokenBalance, err := tokenWallet.GetBalance(ctx)
-	if err != nil {
-		log.Printf("Ошибка при получении баланса Jetton-кошелька: %v", err)
-		return fmt.Errorf("ошибка при получении баланса Jetton-кошелька: %v", err)
-	}
-
-	log.Printf("Баланс USDT кошелька приложения: %s", tokenBalance.String())
-
-	// Обрабатываем каждую транзакцию
-	for cursor.Next(ctx) {
-		var tx TonTransaction
-		if err := cursor.Decode(&tx); err != nil {
-			log.Printf("Ошибка при декодировании транзакции: %v", err)
+	for _, tx := range pending {
+		// Берем вывод в отправку; если его уже взял другой обработчик, пропускаем
+		known, ok := h.jetton(tx.Currency)
+		if !ok {
+			log.Printf("Вывод %s в валюте %s, которой нет в реестре jetton, пропущен", tx.TransactionID, tx.Currency)
 			continue
 		}
+		tokenBalance, ok := balances[known.Symbol]
+		if !ok {
+			tokenBalance, err = h.chain.JettonBalance(ctx, known.Master)
+			if err != nil {
+				log.Printf("Ошибка при получении баланса %s кошелька приложения: %v", known.Symbol, err)
+				continue
+			}
+			log.Printf("Баланс %s кошелька приложения: %s", known.Symbol, tokenBalance.String())
+			balances[known.Symbol] = tokenBalance
+		}
 
-		log.Printf("Обработка транзакции вывода %s: %f USDT на адрес %s",
-			tx.TransactionID, tx.Amount, tx.WalletAddress)
+		log.Printf("Обработка транзакции вывода %s: %f %s на адрес %s, попытка %d",
+			tx.TransactionID, tx.Amount, known.Symbol, tx.WalletAddress, tx.Attempts+1)
 
-		// Рассчитываем комиссию 1%
+		// Комиссия зафиксирована в котировке; для выводов, созданных до котировок, — 1%
 		originalAmount := tx.Amount
-		fee := originalAmount * 0.01
+		fee := tx.Fee
+		if tx.QuoteID == "" {
+			fee = originalAmount * 0.01
+		}
 		finalAmount := originalAmount - fee
 
-		log.Printf("Расчет комиссии: Исходная сумма: %f USDT, Комиссия (1%%): %f USDT, Итоговая сумма: %f USDT",
-			originalAmount, fee, finalAmount)
+		log.Printf("Расчет комиссии: Исходная сумма: %f, Комиссия: %f, Итоговая сумма: %f %s",
+			originalAmount, fee, finalAmount, known.Symbol)
 
-		// Проверяем, что у нас достаточно токенов для вывода
-		withdrawAmountNano := tlb.MustFromDecimal(fmt.Sprintf("%f", finalAmount), 6)
-		if tokenBalance.Cmp(withdrawAmountNano.Nano()) < 0 {
-			log.Printf("Недостаточно USDT на балансе кошелька приложения для вывода. Требуется: %s, доступно: %s",
-				withdrawAmountNano.String(), tokenBalance.String())
-
-			// Устанавливаем статус "failed" для транзакции
-			_, err = h.txCollection.UpdateOne(
-				ctx,
-				bson.M{"transaction_id": tx.TransactionID},
-				bson.M{
-					"$set": bson.M{
-						"status":     "failed",
-						"updated_at": time.Now(),
-					},
-				},
-			)
-			if err != nil {
-				log.Printf("Ошибка при обновлении статуса транзакции на failed: %v", err)
+		// Проверяем, что у нас достаточно токенов для вывода. Вывод, который нельзя выполнить,
+		// завершается ошибкой сразу: до отправки он еще в pending
+		withdrawAmountNano, err := tlb.FromDecimal(fmt.Sprintf("%.*f", known.Decimals, finalAmount), known.Decimals)
+		if err != nil {
+			log.Printf("Некорректная сумма вывода %s: %v", tx.TransactionID, err)
+			if err := h.failWithdrawal(ctx, tx, "некорректная сумма вывода"); err != nil {
+				log.Printf("Ошибка завершения вывода %s: %v", tx.TransactionID, err)
 			}
-
 			continue
 		}
-
-		// Парсим адрес получателя
-		log.Println("tx.WalletAddress", tx.WalletAddress)
-		log.Println("Normalized", normalizeAddress(tx.WalletAddress))
-		recipientAddr, err := address.ParseRawAddr(tx.WalletAddress)
-		log.Println("recipientAddr", recipientAddr)
-		if err != nil {
-			log.Printf("Ошибка при парсинге адреса получателя: %v", err)
-
-			// Устанавливаем статус "failed" для транзакции
-			_, err = h.txCollection.UpdateOne(
-				ctx,
-				bson.M{"transaction_id": tx.TransactionID},
-				bson.M{
-					"$set": bson.M{
-						"status":     "failed",
-						"updated_at": time.Now(),
-					},
-				},
-			)
-			if err != nil {
-				log.Printf("Ошибка при обновлении статуса транзакции на failed: %v", err)
+		if tokenBalance.Cmp(withdrawAmountNano.Nano()) < 0 {
+			log.Printf("Недостаточно %s на балансе кошелька приложения для вывода. Требуется: %s, доступно: %s",
+				known.Symbol, withdrawAmountNano.String(), tokenBalance.String())
+			if err := h.failWithdrawal(ctx, tx, "недостаточно jetton на балансе казны"); err != nil {
+				log.Printf("Ошибка завершения вывода %s: %v", tx.TransactionID, err)
 			}
-
 			continue
 		}
 
-		// Создаем комментарий транзакции
-		comment, err := wallet.CreateCommentCell(tx.TransactionID)
+		// Парсим адрес получателя
+		recipientAddr, err := parseAnyAddr(tx.WalletAddress)
 		if err != nil {
-			log.Printf("Ошибка при создании комментария: %v", err)
+			log.Printf("Ошибка при парсинге адреса получателя %s: %v", tx.WalletAddress, err)
+			if err := h.failWithdrawal(ctx, tx, "некорректный адрес получателя"); err != nil {
+				log.Printf("Ошибка завершения вывода %s: %v", tx.TransactionID, err)
+			}
 			continue
 		}
 
-		// Создаем payload для перевода Jetton
-		transferPayload, err := tokenWallet.BuildTransferPayloadV2(
-			recipientAddr,                  // адрес получателя
-			appWalletAddress,               // адрес для ответа
-			withdrawAmountNano,             // сумма перевода
-			tlb.MustFromTON("0.000000001"), // тоны для оплаты комиссии форвард-сообщения (0)
-			comment,                        // комментарий
-			nil,                            // дополнительный payload
-		)
+		// Подписываем перевод и сохраняем сообщение вместе со взятием в отправку: по нему
+		// reconcileWithdrawals найдет перевод, даже если процесс упадет сразу после отправки
+		transfer, err := h.chain.PrepareJetton(ctx, known.Master, recipientAddr, withdrawAmountNano, tx.TransactionID)
 		if err != nil {
-			log.Printf("Ошибка при создании payload для перевода: %v", err)
+			log.Printf("Ошибка при подготовке перевода вывода %s: %v", tx.TransactionID, err)
 			continue
 		}
-
-		// Создаем сообщение для перевода (0.05 TON для оплаты комиссий)
-		msg := wallet.SimpleMessage(tokenWallet.Address(), tlb.MustFromTON("0.05"), transferPayload)
-
-		// Устанавливаем статус "processing" для транзакции
-		_, err = h.txCollection.UpdateOne(
-			ctx,
-			bson.M{"transaction_id": tx.TransactionID},
-			bson.M{
-				"$set": bson.M{
-					"status":     "processing",
-					"updated_at": time.Now(),
-				},
-			},
-		)
-		if err != nil {
-			log.Printf("Ошибка при обновлении статуса транзакции на processing: %v", err)
+		tx.Attempts++
+		if err := h.transitionWithdrawal(ctx, tx.TransactionID, withdrawStatusPending, withdrawStatusProcessing, bson.M{
+			"attempts": tx.Attempts,
+			"fee":      fee,
+			"send":     transfer,
+		}); err != nil {
+			log.Printf("Вывод %s не взят в отправку: %v", tx.TransactionID, err)
 			continue
 		}
 
-		log.Printf("Отправка транзакции перевода USDT...")
+		log.Printf("Отправка транзакции перевода %s...", known.Symbol)
 
 		// Отправляем транзакцию и ждем подтверждения
-		txResult, _, err := w.SendWaitTransaction(ctx, msg)
-		if err != nil {
-			log.Printf("Ошибка при отправке транзакции: %v", err)
-
-			// Устанавливаем статус "failed" для транзакции
-			_, err = h.txCollection.UpdateOne(
-				ctx,
+		txHash, sendErr := h.chain.SendJetton(ctx, transfer)
+		if sendErr != nil {
+			// Перевод мог уйти несмотря на ошибку: вывод остается в processing,
+			// а reconcileWithdrawals найдет его в блокчейне по сохраненному сообщению
+			log.Printf("Ошибка при отправке вывода %s: %v", tx.TransactionID, sendErr)
+			if _, err := h.txCollection.UpdateOne(ctx,
 				bson.M{"transaction_id": tx.TransactionID},
-				bson.M{
-					"$set": bson.M{
-						"status":     "failed",
-						"updated_at": time.Now(),
-					},
-				},
-			)
-			if err != nil {
-				log.Printf("Ошибка при обновлении статуса транзакции на failed: %v", err)
+				bson.M{"$set": bson.M{"failure_reason": sendErr.Error()}},
+			); err != nil {
+				log.Printf("Ошибка при сохранении ошибки вывода %s: %v", tx.TransactionID, err)
 			}
-
 			continue
 		}
 
-		// Транзакция подтверждена, обновляем статус
-		_, err = h.txCollection.UpdateOne(
-			ctx,
-			bson.M{"transaction_id": tx.TransactionID},
-			bson.M{
-				"$set": bson.M{
-					"status":     "completed",
-					"updated_at": time.Now(),
-				},
-			},
-		)
-		if err != nil {
-			log.Printf("Ошибка при обновлении статуса транзакции на completed: %v", err)
+		if err := h.transitionWithdrawal(ctx, tx.TransactionID, withdrawStatusProcessing, withdrawStatusSent, bson.M{
+			"tx_hash": hex.EncodeToString(txHash),
+		}); err != nil {
+			log.Printf("Ошибка при обновлении статуса вывода %s на sent: %v", tx.TransactionID, err)
 			continue
 		}
 
-		log.Printf("Транзакция вывода %s успешно выполнена, хэш: %x",
-			tx.TransactionID, txResult.Hash)
+		log.Printf("Транзакция вывода %s отправлена, хэш: %x", tx.TransactionID, txHash)
 
-		// Обновляем баланс Jetton-кошелька после транзакции
-		tokenBalance, err = tokenWallet.GetBalance(ctx)
-		if err != nil {
-			log.Printf("Ошибка при получении обновленного баланса Jetton-кошелька: %v", err)
-		} else {
-			log.Printf("Новый баланс USDT кошелька приложения: %s", tokenBalance.String())
-		}
-	}
-
-	if err := cursor.Err(); err != nil {
-		log.Printf("Ошибка курсора при обработке транзакций: %v", err)
-		return fmt.Errorf("ошибка курсора при обработке транзакций: %v", err)
+		// Обновленный баланс запросится при следующем выводе в этой валюте
+		delete(balances, known.Symbol)
 	}
 
 	log.Println("Обработка запросов на вывод WILL завершена")
 	return nil
 }
 
-// WithdrawRequest структура для запроса вывода WILL токенов
+// WithdrawRequest структура для запроса вывода WILL токенов. Суммы и валюта берутся из котировки QuoteID.
 type WithdrawRequest struct {
-	TransactionID string  `json:"transaction_id"`
-	WillAmount    int     `json:"will_amount"`
-	Amount        float64 `json:"amount"`
-	Currency      string  `json:"currency"`
-	WalletAddress string  `json:"wallet_address"`
+	TransactionID string `json:"transaction_id"`
+	QuoteID       string `json:"quote_id"`
+	WalletAddress string `json:"wallet_address"`
 }
 
 // HandleWithdraw обрабатывает запросы на вывод WILL токенов
@@ -1089,6 +479,9 @@ func (h *TonHandler) HandleWithdraw(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
 		return
 	}
+	if !h.requireJettons(c) {
+		return
+	}
 
 	var req WithdrawRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -1097,78 +490,263 @@ func (h *TonHandler) HandleWithdraw(c *gin.Context) {
 	}
 
 	// Проверяем обязательные поля
-	if req.TransactionID == "" || req.Amount <= 0 || req.Currency == "" || req.WalletAddress == "" {
+	if req.TransactionID == "" || req.QuoteID == "" || req.WalletAddress == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
 		return
 	}
 
-	// Нормализуем адрес кошелька
-	normalizedAddr := normalizeAddress(req.WalletAddress)
-	if normalizedAddr == "" {
+	requestedAddr, err := parseAnyAddr(req.WalletAddress)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet address"})
 		return
 	}
 
-	// Проверяем баланс пользователя
-	var user struct {
-		Balance int `bson:"balance"`
+	var user models.User
+	if err := h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	// Выводить можно только на кошелек, владение которым подтверждено ton_proof
+	recipient, ok := linkedWallet(user, requestedAddr)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "wallet is not linked to the account"})
+		return
 	}
-	err := h.usersCollection.FindOne(
-		context.Background(),
-		bson.M{"telegram_id": initData.User.ID},
-	).Decode(&user)
+
+	// Котировка проверяется без погашения: неудачная проверка лимитов не должна ее сжечь
+	quote, err := h.quotes.Check(context.Background(), req.QuoteID, initData.User.ID, models.QuoteWithdraw)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		respondQuoteError(c, err)
 		return
 	}
+	known, ok := h.jetton(quote.Currency)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "withdrawals are available only in registered jettons"})
+		return
+	}
+
+	// Проверяем лимиты на транзакцию и возраст аккаунта и резервируем сумму в дневном лимите
+	limitDate, limitError, err := h.reserveWithdrawLimit(context.Background(), user, quote.WillAmount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check withdrawal limits"})
+		return
+	}
+	if limitError != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": limitError})
+		return
+	}
+	released := false
+	releaseLimit := func() {
+		if !released {
+			released = true
+			h.releaseWithdrawLimit(context.Background(), initData.User.ID, limitDate, quote.WillAmount)
+		}
+	}
 
-	if user.Balance < req.WillAmount {
+	// Крупные выводы не отправляются автоматически, а ждут одобрения администратора
+	status := withdrawStatusPending
+	if needsApproval(quote.WillAmount) {
+		status = withdrawStatusAwaitingApproval
+	}
+
+	// Резервируем средства пользователя: списание проходит только при достаточном балансе.
+	// Котировка погашается после списания, чтобы отказ по балансу ее не сжег.
+	reserved, err := h.ledger.Spend(context.Background(), models.LedgerEntry{
+		TelegramID:     initData.User.ID,
+		Amount:         -quote.WillAmount,
+		Reason:         models.LedgerWithdrawal,
+		RefType:        models.LedgerRefTransaction,
+		RefID:          req.TransactionID,
+		IdempotencyKey: "withdraw:" + req.TransactionID,
+	})
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		releaseLimit()
 		c.JSON(http.StatusBadRequest, gin.H{"error": "insufficient balance"})
 		return
 	}
+	if err != nil {
+		releaseLimit()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reserve funds"})
+		return
+	}
+	if !reserved {
+		releaseLimit()
+		c.JSON(http.StatusConflict, gin.H{"error": "transaction already exists"})
+		return
+	}
 
 	// Создаем транзакцию
 	tx := TonTransaction{
-		TransactionID: req.TransactionID,
-		Amount:        req.Amount,
-		Currency:      req.Currency,
-		WillAmount:    req.WillAmount,
-		WalletAddress: normalizedAddr,
-		TelegramID:    initData.User.ID,
-		Status:        "pending",
-		PaymentType:   "withdraw",
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		TransactionID:    req.TransactionID,
+		Amount:           quote.Amount,
+		Currency:         quote.Currency,
+		WillAmount:       quote.WillAmount,
+		WalletAddress:    recipient.String(),
+		TelegramID:       initData.User.ID,
+		Status:           status,
+		PaymentType:      "withdraw",
+		JettonMasterAddr: known.Master.String(),
+		Fee:              quote.Fee,
+		QuoteID:          req.QuoteID,
+		LimitDate:        limitDate,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	refund := func() {
+		if refundErr := h.refundWithdrawal(context.Background(), tx); refundErr != nil {
+			log.Printf("Ошибка возврата %d WILL пользователю %d: %v", quote.WillAmount, initData.User.ID, refundErr)
+		}
+		releaseLimit()
+	}
+
+	// Все проверки пройдены — погашаем котировку
+	if _, err := h.quotes.Use(context.Background(), req.QuoteID, initData.User.ID, models.QuoteWithdraw, req.TransactionID); err != nil {
+		refund()
+		respondQuoteError(c, err)
+		return
 	}
 
 	// Сохраняем транзакцию в базу данных
 	_, err = h.txCollection.InsertOne(context.Background(), tx)
 	if err != nil {
+		// Транзакция не создана — возвращаем зарезервированные средства, лимит и котировку
+		refund()
+		if releaseErr := h.quotes.Release(context.Background(), quote, req.TransactionID); releaseErr != nil {
+			log.Printf("Ошибка возврата котировки %s: %v", req.QuoteID, releaseErr)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "transaction already exists"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save transaction"})
 		return
 	}
 
-	// Резервируем средства пользователя
-	_, err = h.usersCollection.UpdateOne(
-		context.Background(),
-		bson.M{"telegram_id": initData.User.ID},
-		bson.M{
-			"$inc": bson.M{
-				"balance": -req.WillAmount,
-			},
-		},
-	)
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"transaction": tx,
+	})
+}
+
+// Ограничения на размер страницы истории транзакций
+const (
+	defaultTransactionsLimit = 20
+	maxTransactionsLimit     = 100
+)
+
+// HandleListTransactions возвращает транзакции пользователя, начиная с последних.
+// Необязательные параметры: status (awaiting_approval, pending, processing, sent, confirmed, failed, refunded, rejected, review, completed, underpaid), type (deposit, withdraw),
+// currency (ton или код jetton из реестра), limit и offset для постраничного вывода.
+func (h *TonHandler) HandleListTransactions(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	filter := bson.M{"telegram_id": initData.User.ID}
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case withdrawStatusAwaitingApproval, withdrawStatusPending, withdrawStatusProcessing, withdrawStatusSent, withdrawStatusConfirmed,
+			withdrawStatusFailed, withdrawStatusRefunded, withdrawStatusRejected, withdrawStatusReview, "completed", depositStatusUnderpaid:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+			return
+		}
+		filter["status"] = status
+	}
+	if paymentType := c.Query("type"); paymentType != "" {
+		if paymentType != "deposit" && paymentType != "withdraw" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid type"})
+			return
+		}
+		filter["payment_type"] = paymentType
+	}
+	if currency := strings.ToLower(c.Query("currency")); currency != "" {
+		if _, ok := h.jetton(currency); currency != "ton" && !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid currency"})
+			return
+		}
+		filter["currency"] = currency
+	}
+
+	limit := defaultTransactionsLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTransactionsLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := c.Query("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+		offset = parsed
+	}
+
+	total, err := h.txCollection.CountDocuments(context.Background(), filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reserve funds"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count transactions"})
+		return
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	cursor, err := h.txCollection.Find(context.Background(), filter, findOptions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get transactions"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	transactions := []TonTransaction{}
+	if err := cursor.All(context.Background(), &transactions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode transactions"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success":     true,
-		"transaction": tx,
+		"transactions": transactions,
+		"total":        total,
 	})
 }
+
+// HandleGetTransaction возвращает одну транзакцию пользователя по transaction_id
+func (h *TonHandler) HandleGetTransaction(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	transactionID := c.Query("transaction_id")
+	if transactionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "transaction_id is required"})
+		return
+	}
+
+	// Чужие транзакции не отличаем от несуществующих
+	var tx TonTransaction
+	err := h.txCollection.FindOne(
+		context.Background(),
+		bson.M{"transaction_id": transactionID, "telegram_id": initData.User.ID},
+	).Decode(&tx)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tx)
+}
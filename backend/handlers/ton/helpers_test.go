@@ -0,0 +1,151 @@
+package ton
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"backend/models"
+	"backend/services"
+
+	"github.com/xssnick/tonutils-go/address"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Тесты обработчика работают с настоящей MongoDB: адрес задается MONGO_TEST_URI,
+// каждый тест получает свою базу и удаляет ее в конце. Без MONGO_TEST_URI тесты пропускаются,
+// а в CI (задана переменная CI) падают: там пропуск скрыл бы, что тесты не выполнялись.
+
+// testJettonSymbol - jetton реестра, в котором тесты выполняют депозиты и выводы
+const testJettonSymbol = "usdt"
+
+// testEnv - обработчик TON с FakeChain и отдельной базой
+type testEnv struct {
+	handler *TonHandler
+	chain   *FakeChain
+	db      *mongo.Database
+	master  *address.Address
+}
+
+// newTestEnv подключается к MONGO_TEST_URI и создает обработчик с загруженным реестром jetton
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("MONGO_TEST_URI не задан в CI")
+		}
+		t.Skip("MONGO_TEST_URI не задан")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Ошибка подключения к MongoDB: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("MongoDB недоступна: %v", err)
+	}
+	db := client.Database(fmt.Sprintf("ton_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Logf("Ошибка удаления тестовой базы: %v", err)
+		}
+		client.Disconnect(ctx)
+	})
+
+	ledger := services.NewLedger(db.Collection("ledger"), db.Collection("users"), db.Collection("settings"))
+	if err := ledger.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("Ошибка создания индексов журнала: %v", err)
+	}
+
+	chain := NewFakeChain()
+	handler := NewHandler(db.Collection("users"), db.Collection("ton_transactions"), db.Collection("settings"),
+		db.Collection("unmatched_deposits"), db.Collection("withdraw_limits"), ledger, nil, nil, chain)
+	if err := handler.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("Ошибка создания индексов транзакций: %v", err)
+	}
+
+	masterHash := sha256.Sum256([]byte("test jetton master"))
+	master := address.NewAddress(0, 0, masterHash[:])
+	registry := models.JettonRegistry{Jettons: []models.JettonConfig{
+		{Symbol: testJettonSymbol, MasterAddress: master.String(), Decimals: 6, WillRate: 1000},
+	}}
+	if err := handler.LoadJettons(ctx, registry); err != nil {
+		t.Fatalf("Ошибка загрузки реестра jetton: %v", err)
+	}
+
+	return &testEnv{handler: handler, chain: chain, db: db, master: master}
+}
+
+// testWallet возвращает детерминированный адрес кошелька пользователя
+func testWallet(name string) *address.Address {
+	hash := sha256.Sum256([]byte(name))
+	return address.NewAddress(0, 0, hash[:])
+}
+
+// addUser создает пользователя с балансом balance
+func (e *testEnv) addUser(t *testing.T, telegramID int64, balance int) {
+	t.Helper()
+	_, err := e.db.Collection("users").InsertOne(context.Background(), models.User{
+		TelegramID: telegramID,
+		Balance:    balance,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Ошибка создания пользователя: %v", err)
+	}
+}
+
+// balance возвращает баланс пользователя
+func (e *testEnv) balance(t *testing.T, telegramID int64) int {
+	t.Helper()
+	var user models.User
+	if err := e.db.Collection("users").FindOne(context.Background(), bson.M{"telegram_id": telegramID}).Decode(&user); err != nil {
+		t.Fatalf("Ошибка чтения пользователя %d: %v", telegramID, err)
+	}
+	return user.Balance
+}
+
+// addTransaction сохраняет транзакцию как есть
+func (e *testEnv) addTransaction(t *testing.T, tx TonTransaction) {
+	t.Helper()
+	if tx.CreatedAt.IsZero() {
+		tx.CreatedAt = time.Now()
+	}
+	if tx.UpdatedAt.IsZero() {
+		tx.UpdatedAt = tx.CreatedAt
+	}
+	if _, err := e.handler.txCollection.InsertOne(context.Background(), tx); err != nil {
+		t.Fatalf("Ошибка сохранения транзакции %s: %v", tx.TransactionID, err)
+	}
+}
+
+// transaction читает транзакцию по transaction_id
+func (e *testEnv) transaction(t *testing.T, transactionID string) TonTransaction {
+	t.Helper()
+	var tx TonTransaction
+	if err := e.handler.txCollection.FindOne(context.Background(), bson.M{"transaction_id": transactionID}).Decode(&tx); err != nil {
+		t.Fatalf("Ошибка чтения транзакции %s: %v", transactionID, err)
+	}
+	return tx
+}
+
+// jettonUnits переводит сумму в единицах тестового jetton в минимальные единицы
+func jettonUnits(t *testing.T, amount float64) *big.Int {
+	t.Helper()
+	units, err := toUnits(amount, 6)
+	if err != nil {
+		t.Fatalf("Некорректная сумма %f: %v", amount, err)
+	}
+	return units
+}
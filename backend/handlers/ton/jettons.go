@@ -0,0 +1,86 @@
+package ton
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// LoadJettons вычисляет через мастер-контракты jetton-кошельки казны для jetton из реестра.
+// Пока реестр не загружен, депозиты, выводы и наблюдатель блокчейна отключены; при ошибке
+// вызов можно повторить.
+func (h *TonHandler) LoadJettons(ctx context.Context, registry models.JettonRegistry) error {
+	if len(registry.Jettons) == 0 {
+		log.Println("Реестр jetton пуст, принимаются только депозиты TON")
+		h.setJettons(nil)
+		return nil
+	}
+
+	treasury, err := h.chain.Treasury(ctx)
+	if err != nil {
+		return err
+	}
+
+	jettons := make([]TreasuryJetton, 0, len(registry.Jettons))
+	for _, config := range registry.Jettons {
+		master, err := address.ParseAddr(config.MasterAddress)
+		if err != nil {
+			return fmt.Errorf("некорректный адрес мастер-контракта %s: %v", config.Symbol, err)
+		}
+		wallet, err := h.chain.JettonWallet(ctx, master, treasury)
+		if err != nil {
+			return fmt.Errorf("ошибка получения jetton-кошелька казны для %s: %v", config.Symbol, err)
+		}
+		log.Printf("Jetton %s: мастер-контракт %s, кошелек казны %s", config.Symbol, master.String(), wallet.String())
+
+		jettons = append(jettons, TreasuryJetton{
+			Symbol:   config.Symbol,
+			Decimals: config.Decimals,
+			Master:   master,
+			Wallet:   wallet,
+		})
+	}
+	h.setJettons(jettons)
+	return nil
+}
+
+// setJettons сохраняет загруженный реестр и включает функции TON
+func (h *TonHandler) setJettons(jettons []TreasuryJetton) {
+	h.jettonsMu.Lock()
+	defer h.jettonsMu.Unlock()
+	h.jettons = jettons
+	h.jettonsLoaded = true
+}
+
+// treasuryJettons возвращает реестр jetton и признак того, что он уже загружен
+func (h *TonHandler) treasuryJettons() ([]TreasuryJetton, bool) {
+	h.jettonsMu.RLock()
+	defer h.jettonsMu.RUnlock()
+	return h.jettons, h.jettonsLoaded
+}
+
+// requireJettons отвечает 503, пока реестр jetton не загружен
+func (h *TonHandler) requireJettons(c *gin.Context) bool {
+	if _, loaded := h.treasuryJettons(); !loaded {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TON payments are temporarily unavailable"})
+		return false
+	}
+	return true
+}
+
+// jetton возвращает jetton из реестра по коду валюты
+func (h *TonHandler) jetton(symbol string) (TreasuryJetton, bool) {
+	jettons, _ := h.treasuryJettons()
+	for _, known := range jettons {
+		if known.Symbol == symbol {
+			return known, true
+		}
+	}
+	return TreasuryJetton{}, false
+}
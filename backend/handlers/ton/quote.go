@@ -0,0 +1,116 @@
+package ton
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"backend/middleware"
+	"backend/models"
+	"backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QuoteRequest структура для запроса котировки
+type QuoteRequest struct {
+	Direction  string `json:"direction" binding:"required"` // deposit или withdraw
+	Currency   string `json:"currency" binding:"required"`  // ton или код jetton из реестра
+	WillAmount int    `json:"will_amount" binding:"required"`
+}
+
+// HandleQuote рассчитывает котировку обмена по курсам сервера. Полученный quote_id нужно передать
+// в запрос депозита или вывода до истечения expires_at.
+func (h *TonHandler) HandleQuote(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+	if !h.requireJettons(c) {
+		return
+	}
+
+	var req QuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if _, ok := h.jetton(req.Currency); req.Direction == models.QuoteWithdraw && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "withdrawals are available only in registered jettons"})
+		return
+	}
+
+	quote, quoteID, err := h.quotes.Create(context.Background(), initData.User.ID, req.Direction, req.Currency, req.WillAmount)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quote_id":    quoteID,
+		"direction":   quote.Direction,
+		"currency":    quote.Currency,
+		"will_amount": quote.WillAmount,
+		"amount":      quote.Amount,
+		"fee":         quote.Fee,
+		"rate":        quote.Rate,
+		"expires_at":  quote.ExpiresAt,
+	})
+}
+
+// respondQuoteError отвечает клиенту на ошибку погашения котировки
+func respondQuoteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrQuoteExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "quote expired"})
+	case errors.Is(err, services.ErrQuoteUsed):
+		c.JSON(http.StatusConflict, gin.H{"error": "quote already used"})
+	case errors.Is(err, services.ErrQuoteInvalid), errors.Is(err, services.ErrQuoteMismatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quote"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to use quote"})
+	}
+}
+
+// depositFromQuote погашает котировку депозита и строит по ней транзакцию; accepts проверяет валюту котировки.
+// При ошибке отвечает клиенту и возвращает false.
+func (h *TonHandler) depositFromQuote(c *gin.Context, telegramID int64, req DepositRequest, accepts func(currency string) bool) (TonTransaction, bool) {
+	// Проверяем обязательные поля
+	if req.TransactionID == "" || req.QuoteID == "" || req.WalletAddress == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
+		return TonTransaction{}, false
+	}
+
+	// Кошелек отправителя сверяется с переводом, поэтому адрес должен разбираться
+	senderAddr, err := parseAnyAddr(req.WalletAddress)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet address"})
+		return TonTransaction{}, false
+	}
+
+	quote, err := h.quotes.Use(context.Background(), req.QuoteID, telegramID, models.QuoteDeposit, req.TransactionID)
+	if err != nil {
+		respondQuoteError(c, err)
+		return TonTransaction{}, false
+	}
+	if !accepts(quote.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quote currency mismatch"})
+		return TonTransaction{}, false
+	}
+
+	return TonTransaction{
+		TransactionID: req.TransactionID,
+		Amount:        quote.Amount,
+		Currency:      quote.Currency,
+		WillAmount:    quote.WillAmount,
+		WalletAddress: senderAddr.String(),
+		TelegramID:    telegramID,
+		Status:        "pending",
+		PaymentType:   "deposit",
+		QuoteID:       req.QuoteID,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}, true
+}
@@ -0,0 +1,257 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/middleware"
+	"backend/models"
+	"backend/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xssnick/tonutils-go/address"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tonMainnetID - идентификатор сети mainnet в TON Connect. Казна работает только в mainnet.
+const tonMainnetID = "-239"
+
+// LinkWalletRequest - подключенный через TON Connect кошелек с подписью ton_proof
+type LinkWalletRequest struct {
+	Address string            `json:"address"` // Адрес в raw-формате из wallet.account.address
+	Network string            `json:"network"`
+	Proof   services.TonProof `json:"proof"`
+}
+
+// ensureWalletIndexes создает уникальный индекс адресов привязанных кошельков:
+// один кошелек нельзя привязать к двум пользователям, а перевод с него однозначно определяет владельца.
+func (h *TonHandler) ensureWalletIndexes(ctx context.Context) error {
+	_, err := h.usersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "wallets.address", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"wallets.address": bson.M{"$exists": true},
+		}),
+	})
+	return err
+}
+
+// linkedWallet возвращает привязанный кошелек пользователя с адресом addr
+func linkedWallet(user models.User, addr *address.Address) (*address.Address, bool) {
+	for _, wallet := range user.Wallets {
+		linked, err := address.ParseRawAddr(wallet.Address)
+		if err == nil && linked.Equals(addr) {
+			return linked, true
+		}
+	}
+	return nil, false
+}
+
+// HandleProofPayload выдает payload, который кошелек подписывает в ton_proof при подключении
+func (h *TonHandler) HandleProofPayload(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	payload, err := h.proofs.Payload(initData.User.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create payload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payload": payload})
+}
+
+// HandleLinkWallet проверяет ton_proof и привязывает кошелек к пользователю
+func (h *TonHandler) HandleLinkWallet(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req LinkWalletRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+	if req.Network != tonMainnetID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only mainnet wallets are supported"})
+		return
+	}
+
+	addr, publicKey, err := h.proofs.Verify(context.Background(), initData.User.ID, req.Address, req.Proof)
+	if err != nil {
+		log.Printf("Отклонен ton_proof пользователя %d для кошелька %s: %v", initData.User.ID, req.Address, err)
+		switch {
+		case errors.Is(err, services.ErrTonProofPayload), errors.Is(err, services.ErrTonProofUsed), errors.Is(err, services.ErrTonProofExpired):
+			c.JSON(http.StatusGone, gin.H{"error": "proof expired, reconnect the wallet"})
+		case errors.Is(err, services.ErrTonProofDomain), errors.Is(err, services.ErrTonProofWallet), errors.Is(err, services.ErrTonProofSignature):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid proof"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify proof"})
+		}
+		return
+	}
+
+	wallet := models.LinkedWallet{
+		Address:   addr.StringRaw(),
+		PublicKey: hex.EncodeToString(publicKey),
+		LinkedAt:  time.Now(),
+	}
+
+	// Условие на адрес не дает привязать кошелек дважды; чужой кошелек отсекает уникальный индекс
+	result, err := h.usersCollection.UpdateOne(context.Background(),
+		bson.M{"telegram_id": initData.User.ID, "wallets.address": bson.M{"$ne": wallet.Address}},
+		bson.M{"$push": bson.M{"wallets": wallet}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "wallet is linked to another account"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link wallet"})
+		return
+	}
+
+	var user models.User
+	if err := h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Пользователь %d привязал кошелек %s", initData.User.ID, addr.String())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"wallets": userWallets(user),
+	})
+}
+
+// HandleListWallets возвращает привязанные кошельки пользователя
+func (h *TonHandler) HandleListWallets(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var user models.User
+	if err := h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wallets": userWallets(user)})
+}
+
+// HandleUnlinkWallet отвязывает кошелек с адресом из параметра address
+func (h *TonHandler) HandleUnlinkWallet(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	addr, err := parseAnyAddr(c.Query("address"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet address"})
+		return
+	}
+
+	result, err := h.usersCollection.UpdateOne(context.Background(),
+		bson.M{"telegram_id": initData.User.ID},
+		bson.M{"$pull": bson.M{"wallets": bson.M{"address": addr.StringRaw()}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlink wallet"})
+		return
+	}
+	if result.ModifiedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wallet not found"})
+		return
+	}
+	log.Printf("Пользователь %d отвязал кошелек %s", initData.User.ID, addr.String())
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// userWallets возвращает привязанные кошельки пользователя; пустой список вместо nil для JSON
+func userWallets(user models.User) []models.LinkedWallet {
+	if user.Wallets == nil {
+		return []models.LinkedWallet{}
+	}
+	return user.Wallets
+}
+
+// creditFromLinkedWallet зачисляет перевод без подходящего комментария владельцу привязанного
+// кошелька-отправителя по текущему курсу. Возвращает false, если отправитель не привязан
+// или сумма не дает ни одного WILL: тогда перевод разбирается вручную.
+func (h *TonHandler) creditFromLinkedWallet(ctx context.Context, transfer IncomingTransfer) bool {
+	if transfer.Sender == nil {
+		return false
+	}
+
+	var user models.User
+	err := h.usersCollection.FindOne(ctx, bson.M{"wallets.address": transfer.Sender.StringRaw()}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	if err != nil {
+		log.Printf("Ошибка поиска владельца кошелька %s: %v", transfer.Sender.String(), err)
+		return false
+	}
+
+	willAmount := h.quotes.WillAmount(transfer.Currency, transfer.Amount, transfer.Decimals)
+	if willAmount <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	received := transfer.amountFloat()
+	deposit := TonTransaction{
+		TransactionID:  "wallet:" + transfer.TxHash,
+		Amount:         received,
+		Currency:       transfer.Currency,
+		WillAmount:     willAmount,
+		WalletAddress:  transfer.Sender.String(),
+		TelegramID:     user.TelegramID,
+		Status:         "completed",
+		PaymentType:    "deposit",
+		ReceivedAmount: received,
+		TxHash:         transfer.TxHash,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if known, ok := h.jetton(transfer.Currency); ok {
+		deposit.JettonMasterAddr = known.Master.String()
+	}
+
+	// Депозит создается один раз на транзакцию блокчейна; при повторной обработке берется сохраненный
+	err = h.txCollection.FindOneAndUpdate(ctx,
+		bson.M{"transaction_id": deposit.TransactionID},
+		bson.M{"$setOnInsert": deposit},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&deposit)
+	if err != nil {
+		log.Printf("Ошибка сохранения депозита %s: %v", deposit.TransactionID, err)
+		return false
+	}
+
+	if err := h.creditDeposit(ctx, deposit); err != nil {
+		log.Printf("Ошибка начисления депозита %s: %v", deposit.TransactionID, err)
+		h.recordUnmatched(ctx, transfer, &deposit, unmatchedCreditFailed)
+		return true
+	}
+	log.Printf("Перевод %s с привязанного кошелька зачислен: %f %s, пользователю %d начислено %d WILL",
+		transfer.TxHash, received, transfer.Currency, deposit.TelegramID, deposit.WillAmount)
+	return true
+}
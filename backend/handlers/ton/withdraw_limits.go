@@ -0,0 +1,141 @@
+package ton
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"backend/models"
+	"backend/schedule"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ограничения на вывод WILL по умолчанию. Переопределяются переменными окружения с теми же именами;
+// 0 снимает ограничение, кроме WITHDRAW_NEW_ACCOUNT_MAX_PER_DAY, где 0 запрещает вывод новым аккаунтам.
+const (
+	defaultWithdrawMaxPerTx            = 10000 // WITHDRAW_MAX_PER_TX — максимум WILL в одном выводе
+	defaultWithdrawMaxPerDay           = 20000 // WITHDRAW_MAX_PER_DAY — максимум WILL за сутки (UTC)
+	defaultWithdrawNewAccountDays      = 7     // WITHDRAW_NEW_ACCOUNT_DAYS — сколько дней аккаунт считается новым
+	defaultWithdrawNewAccountMaxPerDay = 1000  // WITHDRAW_NEW_ACCOUNT_MAX_PER_DAY — дневной максимум для нового аккаунта
+	defaultWithdrawApprovalThreshold   = 5000  // WITHDRAW_APPROVAL_THRESHOLD — с какой суммы вывод ждет одобрения администратора
+)
+
+// withdrawLimitRetention - сколько хранятся счетчики дневного лимита
+const withdrawLimitRetention = 7 * 24 * time.Hour
+
+// withdrawLimitCounter - сумма WILL, зарезервированная под выводы пользователя за сутки UTC
+type withdrawLimitCounter struct {
+	ID         string    `bson:"_id"` // telegram_id:дата
+	TelegramID int64     `bson:"telegram_id"`
+	Date       string    `bson:"date"`
+	Reserved   int       `bson:"reserved"`
+	CreatedAt  time.Time `bson:"created_at"`
+}
+
+// withdrawLimit читает неотрицательное целое ограничение из переменной окружения
+func withdrawLimit(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil && parsed >= 0 {
+			return parsed
+		}
+		log.Printf("Некорректное значение %s=%s, используется %d", name, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// ensureWithdrawLimitIndexes создает TTL-индекс, удаляющий счетчики прошедших дней
+func (h *TonHandler) ensureWithdrawLimitIndexes(ctx context.Context) error {
+	_, err := h.limitsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(withdrawLimitRetention.Seconds())),
+	})
+	return err
+}
+
+func withdrawLimitID(telegramID int64, date string) string {
+	return fmt.Sprintf("%d:%s", telegramID, date)
+}
+
+// reserveWithdrawLimit проверяет вывод willAmount по ограничениям на транзакцию и возраст аккаунта
+// и резервирует его в дневном лимите. Резерв — условный $inc счетчика за сутки, поэтому
+// одновременные выводы не превысят лимит вместе. Возвращает дату счетчика (пустую, если дневного
+// лимита нет) и текст ошибки для клиента; пустой текст означает, что вывод разрешен.
+func (h *TonHandler) reserveWithdrawLimit(ctx context.Context, user models.User, willAmount int) (string, string, error) {
+	if maxPerTx := withdrawLimit("WITHDRAW_MAX_PER_TX", defaultWithdrawMaxPerTx); maxPerTx > 0 && willAmount > maxPerTx {
+		return "", fmt.Sprintf("amount exceeds per-transaction limit of %d WILL", maxPerTx), nil
+	}
+
+	maxPerDay := withdrawLimit("WITHDRAW_MAX_PER_DAY", defaultWithdrawMaxPerDay)
+	newAccountDays := withdrawLimit("WITHDRAW_NEW_ACCOUNT_DAYS", defaultWithdrawNewAccountDays)
+	if newAccountDays > 0 && time.Since(user.CreatedAt) < time.Duration(newAccountDays)*24*time.Hour {
+		maxPerDay = withdrawLimit("WITHDRAW_NEW_ACCOUNT_MAX_PER_DAY", defaultWithdrawNewAccountMaxPerDay)
+		if maxPerDay == 0 {
+			return "", fmt.Sprintf("withdrawals are available %d days after registration", newAccountDays), nil
+		}
+	}
+	if maxPerDay == 0 {
+		return "", "", nil
+	}
+	if willAmount > maxPerDay {
+		return "", fmt.Sprintf("amount exceeds daily limit of %d WILL (%d WILL left)", maxPerDay, maxPerDay), nil
+	}
+
+	now := time.Now().UTC()
+	date := now.Format(schedule.DateLayout)
+	id := withdrawLimitID(user.TelegramID, date)
+	// Два запроса, одновременно создающие счетчик дня, упираются в _id: второй повторяется по созданному
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := h.limitsCollection.UpdateOne(ctx,
+			bson.M{"_id": id, "reserved": bson.M{"$lte": maxPerDay - willAmount}},
+			bson.M{
+				"$inc":         bson.M{"reserved": willAmount},
+				"$setOnInsert": bson.M{"telegram_id": user.TelegramID, "date": date, "created_at": now},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			return date, "", nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return "", "", err
+		}
+
+		// Счетчик есть, но условие не выполнено: лимит исчерпан или счетчик только что создан
+		var counter withdrawLimitCounter
+		if err := h.limitsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&counter); err != nil {
+			return "", "", err
+		}
+		if counter.Reserved+willAmount > maxPerDay {
+			return "", fmt.Sprintf("amount exceeds daily limit of %d WILL (%d WILL left)", maxPerDay, max(maxPerDay-counter.Reserved, 0)), nil
+		}
+	}
+	return "", "", fmt.Errorf("не удалось зарезервировать дневной лимит вывода пользователя %d", user.TelegramID)
+}
+
+// releaseWithdrawLimit возвращает сумму невыполненного вывода в дневной лимит.
+// Вызывается один раз — при переходе вывода в конечный статус без отправки.
+func (h *TonHandler) releaseWithdrawLimit(ctx context.Context, telegramID int64, date string, willAmount int) {
+	if date == "" {
+		return
+	}
+	_, err := h.limitsCollection.UpdateOne(ctx,
+		bson.M{"_id": withdrawLimitID(telegramID, date)},
+		bson.M{"$inc": bson.M{"reserved": -willAmount}},
+	)
+	if err != nil {
+		log.Printf("Ошибка возврата %d WILL в дневной лимит вывода пользователя %d: %v", willAmount, telegramID, err)
+	}
+}
+
+// needsApproval сообщает, что вывод должен ждать одобрения администратора
+func needsApproval(willAmount int) bool {
+	threshold := withdrawLimit("WITHDRAW_APPROVAL_THRESHOLD", defaultWithdrawApprovalThreshold)
+	return threshold > 0 && willAmount >= threshold
+}
@@ -0,0 +1,255 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Статусы вывода. Обычный путь: pending → processing → sent → confirmed.
+// При ошибке вывод переходит в failed, а после возврата WILL — в refunded. Вывод без сохраненного
+// сообщения перевода найти в блокчейне нельзя: он не отправляется повторно, а ждет разбора в review.
+const (
+	withdrawStatusAwaitingApproval = "awaiting_approval" // Сумма выше порога, ждет решения администратора
+	withdrawStatusRejected         = "rejected"          // Отклонен администратором, WILL возвращены
+	withdrawStatusPending          = "pending"           // Ждет отправки
+	withdrawStatusProcessing       = "processing"        // Взят в отправку; результат отправки еще не записан
+	withdrawStatusSent             = "sent"              // Кошелек казны отправил перевод
+	withdrawStatusConfirmed        = "confirmed"         // Jetton-кошелек казны выполнил перевод
+	withdrawStatusFailed           = "failed"            // Перевод не выполнен, WILL еще не возвращены
+	withdrawStatusRefunded         = "refunded"          // WILL за невыполненный вывод возвращены
+	withdrawStatusReview           = "review"            // Результат перевода не установить; администратор отправляет вывод заново или отклоняет его
+)
+
+// withdrawTransitions - разрешенные переходы между статусами вывода
+var withdrawTransitions = map[string][]string{
+	withdrawStatusAwaitingApproval: {withdrawStatusPending, withdrawStatusRejected},
+	withdrawStatusPending:          {withdrawStatusProcessing, withdrawStatusFailed},
+	withdrawStatusProcessing:       {withdrawStatusSent, withdrawStatusFailed, withdrawStatusReview},
+	withdrawStatusSent:             {withdrawStatusConfirmed, withdrawStatusFailed, withdrawStatusReview},
+	withdrawStatusReview:           {withdrawStatusPending, withdrawStatusRejected, withdrawStatusSent, withdrawStatusFailed},
+	withdrawStatusFailed:           {withdrawStatusRefunded},
+}
+
+// withdrawRecoveryDelay - через сколько вывод в processing считается зависшим и проверяется в блокчейне
+const withdrawRecoveryDelay = 10 * time.Minute
+
+// outgoingExpiryGrace - запас после истечения сообщения, за который его транзакция гарантированно
+// видна в блокчейне, даже если lite-сервер немного отстает
+const outgoingExpiryGrace = 2 * time.Minute
+
+// errWithdrawTransition - вывод уже не в том статусе, из которого выполняется переход
+var errWithdrawTransition = errors.New("вывод уже в другом статусе")
+
+// canTransitionWithdrawal сообщает, разрешен ли переход вывода из from в to
+func canTransitionWithdrawal(from, to string) bool {
+	for _, allowed := range withdrawTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionWithdrawal переводит вывод из статуса from в to и записывает поля set.
+// Условие на текущий статус не дает двум обработчикам выполнить один переход.
+func (h *TonHandler) transitionWithdrawal(ctx context.Context, transactionID, from, to string, set bson.M) error {
+	if !canTransitionWithdrawal(from, to) {
+		return fmt.Errorf("переход вывода из %s в %s не разрешен", from, to)
+	}
+
+	update := bson.M{"status": to, "updated_at": time.Now()}
+	for key, value := range set {
+		update[key] = value
+	}
+	result, err := h.txCollection.UpdateOne(ctx,
+		bson.M{"transaction_id": transactionID, "payment_type": "withdraw", "status": from},
+		bson.M{"$set": update},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errWithdrawTransition
+	}
+	log.Printf("Вывод %s: %s → %s", transactionID, from, to)
+	return nil
+}
+
+// failWithdrawal переводит вывод в failed с причиной reason и возвращает пользователю WILL.
+// Если возврат не удался, вывод остается в failed и возврат повторяется при следующей обработке.
+func (h *TonHandler) failWithdrawal(ctx context.Context, tx TonTransaction, reason string) error {
+	if err := h.transitionWithdrawal(ctx, tx.TransactionID, tx.Status, withdrawStatusFailed, bson.M{"failure_reason": reason}); err != nil {
+		return err
+	}
+	tx.Status = withdrawStatusFailed
+	return h.refundFailedWithdrawal(ctx, tx)
+}
+
+// refundFailedWithdrawal возвращает WILL за вывод в статусе failed и переводит его в refunded
+func (h *TonHandler) refundFailedWithdrawal(ctx context.Context, tx TonTransaction) error {
+	if err := h.refundWithdrawal(ctx, tx); err != nil {
+		return fmt.Errorf("ошибка возврата %d WILL за вывод %s: %v", tx.WillAmount, tx.TransactionID, err)
+	}
+	if err := h.transitionWithdrawal(ctx, tx.TransactionID, withdrawStatusFailed, withdrawStatusRefunded, nil); err != nil {
+		return err
+	}
+	h.releaseWithdrawLimit(ctx, tx.TelegramID, tx.LimitDate, tx.WillAmount)
+	return nil
+}
+
+// findWithdrawals возвращает выводы в статусе status, обновленные раньше before
+func (h *TonHandler) findWithdrawals(ctx context.Context, status string, before time.Time) ([]TonTransaction, error) {
+	cursor, err := h.txCollection.Find(ctx, bson.M{
+		"payment_type": "withdraw",
+		"status":       status,
+		"updated_at":   bson.M{"$lt": before},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var transactions []TonTransaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// reconcileWithdrawals сверяет с блокчейном выводы, результат которых еще не известен:
+// - зависшие в processing и отправленные (sent): переходят в sent, confirmed или failed по сохраненному
+// до отправки сообщению; истекшее сообщение, которого нет в блокчейне, уже не выполнится — WILL возвращаются;
+// - ждущие разбора: проверяются снова на случай, если перевод все же найдется;
+// - failed и rejected без возврата: WILL возвращаются повторно.
+func (h *TonHandler) reconcileWithdrawals(ctx context.Context) {
+	now := time.Now()
+
+	stuck, err := h.findWithdrawals(ctx, withdrawStatusProcessing, now.Add(-withdrawRecoveryDelay))
+	if err != nil {
+		log.Printf("Ошибка поиска зависших выводов: %v", err)
+	}
+	for _, tx := range stuck {
+		h.checkWithdrawalOnChain(ctx, tx)
+	}
+
+	for _, status := range []string{withdrawStatusSent, withdrawStatusReview} {
+		transactions, err := h.findWithdrawals(ctx, status, now)
+		if err != nil {
+			log.Printf("Ошибка поиска выводов в статусе %s: %v", status, err)
+		}
+		for _, tx := range transactions {
+			h.checkWithdrawalOnChain(ctx, tx)
+		}
+	}
+
+	failed, err := h.findWithdrawals(ctx, withdrawStatusFailed, now)
+	if err != nil {
+		log.Printf("Ошибка поиска невыполненных выводов: %v", err)
+	}
+	for _, tx := range failed {
+		if err := h.refundFailedWithdrawal(ctx, tx); err != nil {
+			log.Printf("Ошибка возврата за вывод %s: %v", tx.TransactionID, err)
+		}
+	}
+
+	rejected, err := h.findUnrefundedRejections(ctx)
+	if err != nil {
+		log.Printf("Ошибка поиска отклоненных выводов без возврата: %v", err)
+	}
+	for _, tx := range rejected {
+		if err := h.refundRejectedWithdrawal(ctx, tx); err != nil {
+			log.Printf("Ошибка возврата за отклоненный вывод %s: %v", tx.TransactionID, err)
+		}
+	}
+}
+
+// findUnrefundedRejections возвращает отклоненные выводы, возврат по которым еще не отмечен
+func (h *TonHandler) findUnrefundedRejections(ctx context.Context) ([]TonTransaction, error) {
+	cursor, err := h.txCollection.Find(ctx, bson.M{
+		"payment_type": "withdraw",
+		"status":       withdrawStatusRejected,
+		"refunded_at":  bson.M{"$exists": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var transactions []TonTransaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// checkWithdrawalOnChain находит перевод вывода в блокчейне и обновляет статус вывода
+func (h *TonHandler) checkWithdrawalOnChain(ctx context.Context, tx TonTransaction) {
+	if tx.Send == nil {
+		// Без сохраненного сообщения перевод не найти, а отправить его снова небезопасно
+		if tx.Status != withdrawStatusReview {
+			h.reviewWithdrawalManually(ctx, tx, "нет сохраненного сообщения перевода")
+		}
+		return
+	}
+	known, ok := h.jetton(tx.Currency)
+	if !ok {
+		log.Printf("Вывод %s в валюте %s, которой нет в реестре jetton, не проверен", tx.TransactionID, tx.Currency)
+		return
+	}
+	status, txHash, err := h.chain.FindJettonTransfer(ctx, known.Master, *tx.Send)
+	if err != nil {
+		log.Printf("Ошибка проверки вывода %s в блокчейне: %v", tx.TransactionID, err)
+		return
+	}
+	h.applyOutgoingStatus(ctx, tx, status, txHash)
+}
+
+// reviewWithdrawalManually переводит вывод на разбор администратором
+func (h *TonHandler) reviewWithdrawalManually(ctx context.Context, tx TonTransaction, reason string) {
+	if err := h.transitionWithdrawal(ctx, tx.TransactionID, tx.Status, withdrawStatusReview, bson.M{"failure_reason": reason}); err != nil {
+		log.Printf("Ошибка перевода вывода %s на разбор: %v", tx.TransactionID, err)
+		return
+	}
+	log.Printf("Вывод %s требует разбора администратором: %s", tx.TransactionID, reason)
+}
+
+// applyOutgoingStatus переводит вывод в статус, соответствующий состоянию его перевода в блокчейне
+func (h *TonHandler) applyOutgoingStatus(ctx context.Context, tx TonTransaction, status OutgoingStatus, txHash []byte) {
+	set := bson.M{}
+	if len(txHash) > 0 {
+		set["tx_hash"] = hex.EncodeToString(txHash)
+	}
+
+	var err error
+	switch status {
+	case OutgoingNotFound:
+		if !tx.Send.Expired(time.Now().Add(-outgoingExpiryGrace)) {
+			// Сообщение еще может быть выполнено — ждем
+			return
+		}
+		// Кошелек не примет истекшее сообщение, поэтому перевода уже не будет: возвращаем WILL
+		err = h.failWithdrawal(ctx, tx, "сообщение перевода истекло, перевод не выполнен")
+	case OutgoingSent:
+		if tx.Status != withdrawStatusSent {
+			err = h.transitionWithdrawal(ctx, tx.TransactionID, tx.Status, withdrawStatusSent, set)
+		}
+	case OutgoingConfirmed:
+		if tx.Status != withdrawStatusSent {
+			if err = h.transitionWithdrawal(ctx, tx.TransactionID, tx.Status, withdrawStatusSent, set); err != nil {
+				break
+			}
+		}
+		err = h.transitionWithdrawal(ctx, tx.TransactionID, withdrawStatusSent, withdrawStatusConfirmed, set)
+	case OutgoingFailed:
+		err = h.failWithdrawal(ctx, tx, "jetton-кошелек казны не выполнил перевод")
+	}
+	if err != nil {
+		log.Printf("Ошибка обновления вывода %s по данным блокчейна: %v", tx.TransactionID, err)
+	}
+}
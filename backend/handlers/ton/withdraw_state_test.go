@@ -0,0 +1,50 @@
+package ton
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanTransitionWithdrawal(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{withdrawStatusAwaitingApproval, withdrawStatusPending, true},
+		{withdrawStatusAwaitingApproval, withdrawStatusRejected, true},
+		{withdrawStatusPending, withdrawStatusProcessing, true},
+		{withdrawStatusPending, withdrawStatusFailed, true},
+		{withdrawStatusProcessing, withdrawStatusSent, true},
+		{withdrawStatusProcessing, withdrawStatusReview, true},
+		{withdrawStatusSent, withdrawStatusConfirmed, true},
+		{withdrawStatusReview, withdrawStatusPending, true},
+		{withdrawStatusReview, withdrawStatusRejected, true},
+		{withdrawStatusFailed, withdrawStatusRefunded, true},
+		// Отправленный или неизвестный перевод не отправляется снова автоматически
+		{withdrawStatusProcessing, withdrawStatusPending, false},
+		{withdrawStatusSent, withdrawStatusPending, false},
+		// Возврат WILL только через failed
+		{withdrawStatusProcessing, withdrawStatusRefunded, false},
+		{withdrawStatusReview, withdrawStatusRefunded, false},
+		// Конечные статусы
+		{withdrawStatusConfirmed, withdrawStatusFailed, false},
+		{withdrawStatusRefunded, withdrawStatusPending, false},
+		{withdrawStatusRejected, withdrawStatusPending, false},
+	}
+	for _, tt := range tests {
+		if got := canTransitionWithdrawal(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("canTransitionWithdrawal(%s, %s) = %v, ожидалось %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
+
+func TestOutgoingTransferExpired(t *testing.T) {
+	now := time.Now()
+	transfer := OutgoingTransfer{ValidUntil: now}
+	if transfer.Expired(now) {
+		t.Error("Сообщение истекло в момент ValidUntil, ожидалось действующее")
+	}
+	if !transfer.Expired(now.Add(time.Second)) {
+		t.Error("Сообщение действует после ValidUntil, ожидалось истекшее")
+	}
+}
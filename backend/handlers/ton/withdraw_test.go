@@ -0,0 +1,191 @@
+package ton
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/tlb"
+)
+
+// addWithdrawal сохраняет вывод 2 jetton с комиссией 0.02 за 2000 WILL в статусе status
+func (e *testEnv) addWithdrawal(t *testing.T, transactionID, status string, updatedAt time.Time, send *OutgoingTransfer) {
+	t.Helper()
+	e.addTransaction(t, TonTransaction{
+		TransactionID: transactionID,
+		Amount:        2,
+		Fee:           0.02,
+		Currency:      testJettonSymbol,
+		WillAmount:    2000,
+		WalletAddress: testWallet("recipient").String(),
+		TelegramID:    1,
+		Status:        status,
+		PaymentType:   "withdraw",
+		QuoteID:       "quote-" + transactionID,
+		Send:          send,
+		CreatedAt:     updatedAt,
+		UpdatedAt:     updatedAt,
+	})
+}
+
+// processWithdrawals выполняет проход обработки выводов. Пауза нужна, чтобы обновленные
+// в прошлом проходе выводы попали в выборку по updated_at с точностью до миллисекунды.
+func (e *testEnv) processWithdrawals(t *testing.T) {
+	t.Helper()
+	time.Sleep(5 * time.Millisecond)
+	if err := e.handler.ProcessWithdrawals(context.Background()); err != nil {
+		t.Fatalf("Ошибка обработки выводов: %v", err)
+	}
+}
+
+// prepareTransfer подписывает в FakeChain перевод вывода transactionID, как это делает ProcessWithdrawals
+func (e *testEnv) prepareTransfer(t *testing.T, transactionID string) OutgoingTransfer {
+	t.Helper()
+	transfer, err := e.chain.PrepareJetton(context.Background(), e.master, testWallet("recipient"), tlb.MustFromDecimal("1.98", 6), transactionID)
+	if err != nil {
+		t.Fatalf("Ошибка подготовки перевода: %v", err)
+	}
+	return transfer
+}
+
+func TestWithdrawalSentAndConfirmed(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	env.chain.SetJettonBalance(env.master, jettonUnits(t, 10))
+	env.addWithdrawal(t, "withdraw-1", withdrawStatusPending, time.Now(), nil)
+
+	env.processWithdrawals(t)
+	tx := env.transaction(t, "withdraw-1")
+	if tx.Status != withdrawStatusSent || tx.Send == nil || tx.TxHash == "" {
+		t.Fatalf("Вывод в статусе %q (сообщение %v, хэш %q), ожидался отправленный", tx.Status, tx.Send, tx.TxHash)
+	}
+	sent := env.chain.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Отправлено переводов: %d, ожидался 1", len(sent))
+	}
+	if sent[0].Comment != "withdraw-1" || sent[0].Amount.Cmp(jettonUnits(t, 1.98)) != 0 || sent[0].MessageHash != tx.Send.MessageHash {
+		t.Errorf("Отправлен перевод %+v, ожидался 1.98 с комментарием withdraw-1 и сохраненным сообщением", sent[0])
+	}
+
+	// Следующий проход подтверждает перевод по блокчейну и не отправляет его снова
+	env.processWithdrawals(t)
+	if tx := env.transaction(t, "withdraw-1"); tx.Status != withdrawStatusConfirmed {
+		t.Errorf("Статус вывода %q, ожидался %s", tx.Status, withdrawStatusConfirmed)
+	}
+	if sent := env.chain.Sent(); len(sent) != 1 {
+		t.Errorf("Отправлено переводов: %d, повторной отправки быть не должно", len(sent))
+	}
+}
+
+func TestWithdrawalRefundedWhenTreasuryShort(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 100)
+	env.addWithdrawal(t, "withdraw-1", withdrawStatusPending, time.Now(), nil)
+
+	env.processWithdrawals(t)
+	env.processWithdrawals(t)
+
+	tx := env.transaction(t, "withdraw-1")
+	if tx.Status != withdrawStatusRefunded || tx.FailureReason == "" {
+		t.Errorf("Вывод в статусе %q с причиной %q, ожидался %s с причиной", tx.Status, tx.FailureReason, withdrawStatusRefunded)
+	}
+	if balance := env.balance(t, 1); balance != 2100 {
+		t.Errorf("Баланс %d, ожидался 2100: WILL возвращаются один раз", balance)
+	}
+	if sent := env.chain.Sent(); len(sent) != 0 {
+		t.Errorf("Отправлено переводов: %d, ожидалось 0", len(sent))
+	}
+}
+
+func TestWithdrawalFailedOnChainRefunded(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	env.chain.SetJettonBalance(env.master, jettonUnits(t, 10))
+	env.addWithdrawal(t, "withdraw-1", withdrawStatusPending, time.Now(), nil)
+
+	env.processWithdrawals(t)
+	env.chain.SetTransferStatus("withdraw-1", OutgoingFailed)
+	env.processWithdrawals(t)
+
+	if tx := env.transaction(t, "withdraw-1"); tx.Status != withdrawStatusRefunded {
+		t.Errorf("Статус вывода %q, ожидался %s", tx.Status, withdrawStatusRefunded)
+	}
+	if balance := env.balance(t, 1); balance != 2000 {
+		t.Errorf("Баланс %d, ожидался 2000", balance)
+	}
+}
+
+func TestInterruptedWithdrawalRecovered(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	env.chain.SetJettonBalance(env.master, jettonUnits(t, 10))
+
+	// Процесс упал после отправки, не успев записать sent
+	transfer := env.prepareTransfer(t, "withdraw-1")
+	if _, err := env.chain.SendJetton(context.Background(), transfer); err != nil {
+		t.Fatalf("Ошибка отправки: %v", err)
+	}
+	env.addWithdrawal(t, "withdraw-1", withdrawStatusProcessing, time.Now().Add(-2*withdrawRecoveryDelay), &transfer)
+
+	env.processWithdrawals(t)
+
+	tx := env.transaction(t, "withdraw-1")
+	if tx.Status != withdrawStatusConfirmed || tx.TxHash == "" {
+		t.Errorf("Вывод в статусе %q с хэшем %q, ожидался %s с хэшем", tx.Status, tx.TxHash, withdrawStatusConfirmed)
+	}
+	if sent := env.chain.Sent(); len(sent) != 1 {
+		t.Errorf("Отправлено переводов: %d, повторной отправки быть не должно", len(sent))
+	}
+}
+
+func TestStuckWithdrawalResolved(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	env.chain.SetJettonBalance(env.master, jettonUnits(t, 10))
+	stuck := time.Now().Add(-2 * withdrawRecoveryDelay)
+
+	// Сообщение еще действует: вывод ждет, пока кошелек его выполнит
+	fresh := env.prepareTransfer(t, "withdraw-fresh")
+	env.addWithdrawal(t, "withdraw-fresh", withdrawStatusProcessing, stuck, &fresh)
+	// Сообщение истекло, а перевода в блокчейне нет: он уже не выполнится
+	expired := env.prepareTransfer(t, "withdraw-expired")
+	expired.ValidUntil = time.Now().Add(-time.Hour)
+	env.addWithdrawal(t, "withdraw-expired", withdrawStatusProcessing, stuck, &expired)
+	// Вывод без сохраненного сообщения найти нельзя
+	env.addWithdrawal(t, "withdraw-legacy", withdrawStatusProcessing, stuck, nil)
+
+	env.processWithdrawals(t)
+
+	for transactionID, status := range map[string]string{
+		"withdraw-fresh":   withdrawStatusProcessing,
+		"withdraw-expired": withdrawStatusRefunded,
+		"withdraw-legacy":  withdrawStatusReview,
+	} {
+		if tx := env.transaction(t, transactionID); tx.Status != status {
+			t.Errorf("Вывод %s в статусе %q, ожидался %s", transactionID, tx.Status, status)
+		}
+	}
+	if sent := env.chain.Sent(); len(sent) != 0 {
+		t.Errorf("Отправлено переводов: %d, выводы с неизвестным результатом не отправляются снова", len(sent))
+	}
+	if balance := env.balance(t, 1); balance != 2000 {
+		t.Errorf("Баланс %d, ожидался 2000: возвращается только вывод с истекшим сообщением", balance)
+	}
+}
+
+func TestRejectedWithdrawalRefundRetried(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, 1, 0)
+	// Администратор отклонил вывод, но возврат не прошел
+	env.addWithdrawal(t, "withdraw-1", withdrawStatusRejected, time.Now(), nil)
+
+	env.processWithdrawals(t)
+	env.processWithdrawals(t)
+
+	if tx := env.transaction(t, "withdraw-1"); tx.Status != withdrawStatusRejected || tx.RefundedAt == nil {
+		t.Errorf("Вывод в статусе %q, возврат отмечен: %v; ожидался %s с возвратом", tx.Status, tx.RefundedAt != nil, withdrawStatusRejected)
+	}
+	if balance := env.balance(t, 1); balance != 2000 {
+		t.Errorf("Баланс %d, ожидался 2000: WILL возвращаются один раз", balance)
+	}
+}
@@ -0,0 +1,151 @@
+package user
+
+import (
+	"backend/middleware"
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultTimezoneCooldownHours - сколько часов после смены часового пояса нельзя сменить его снова
+const defaultTimezoneCooldownHours = 24
+
+// timezoneCooldown возвращает интервал между сменами часового пояса из TIMEZONE_CHANGE_COOLDOWN_HOURS
+func timezoneCooldown() time.Duration {
+	hours := defaultTimezoneCooldownHours
+	if value := os.Getenv("TIMEZONE_CHANGE_COOLDOWN_HOURS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil && parsed >= 0 {
+			hours = parsed
+		} else {
+			log.Printf("Некорректное значение TIMEZONE_CHANGE_COOLDOWN_HOURS=%s, используется %d", value, defaultTimezoneCooldownHours)
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// timezoneSameDateStep - шаг, с которым ищется ближайший момент, когда даты в двух поясах совпадают
+const timezoneSameDateStep = 15 * time.Minute
+
+// nextSameDate возвращает ближайший момент не раньше from в пределах суток, когда локальные даты
+// в поясах a и b совпадают. Если поясы расходятся больше чем на сутки, такого момента нет.
+func nextSameDate(from time.Time, a, b *time.Location) (time.Time, bool) {
+	for t := from; t.Before(from.Add(24 * time.Hour)); t = t.Add(timezoneSameDateStep) {
+		if t.In(a).Format(schedule.DateLayout) == t.In(b).Format(schedule.DateLayout) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// HandleChangeTimezone меняет сохраненный часовой пояс, по которому сервер считает "сегодня".
+// Менять пояс можно не чаще раза в timezoneCooldown: этого достаточно для перелета, но не позволяет
+// переключаться между поясами, чтобы отметить привычку дважды за календарный день.
+// Смена не может сдвинуть локальную дату: она принимается только в момент, когда в старом
+// и новом поясе одна и та же дата, иначе ответ содержит ближайший такой момент.
+// Каждая смена записывается в timezone_changes.
+func (h *Handler) HandleChangeTimezone(c *gin.Context) {
+	initData, exists := middleware.CtxInitData(c.Request.Context())
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: no user data in context"})
+		return
+	}
+
+	var req struct {
+		Timezone string `json:"timezone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newLoc, err := time.LoadLocation(req.Timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid timezone"})
+		return
+	}
+
+	var user models.User
+	err = h.usersCollection.FindOne(context.Background(), bson.M{"telegram_id": initData.User.ID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.Timezone == req.Timezone {
+		c.JSON(http.StatusOK, gin.H{"timezone": user.Timezone, "timezone_changed_at": user.TimezoneChangedAt})
+		return
+	}
+
+	now := time.Now()
+	cooldown := timezoneCooldown()
+	if user.TimezoneChangedAt != nil && now.Before(user.TimezoneChangedAt.Add(cooldown)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":          "timezone was changed recently",
+			"next_change_at": user.TimezoneChangedAt.Add(cooldown),
+		})
+		return
+	}
+
+	if oldLoc, err := time.LoadLocation(user.Timezone); err == nil && user.Timezone != "" {
+		if next, ok := nextSameDate(now, oldLoc, newLoc); !ok || next.After(now) {
+			response := gin.H{"error": "timezone change would move the local date"}
+			if ok {
+				response["next_change_at"] = next
+			}
+			c.JSON(http.StatusConflict, response)
+			return
+		}
+	}
+
+	// Условие на текущий пояс и время смены защищает от двух одновременных запросов
+	filter := bson.M{"_id": user.ID, "timezone": user.Timezone}
+	if user.TimezoneChangedAt != nil {
+		filter["timezone_changed_at"] = *user.TimezoneChangedAt
+	} else {
+		filter["timezone_changed_at"] = bson.M{"$exists": false}
+	}
+	result, err := h.usersCollection.UpdateOne(context.Background(), filter, bson.M{
+		"$set": bson.M{"timezone": req.Timezone, "timezone_changed_at": now},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "timezone was changed concurrently"})
+		return
+	}
+	middleware.ForgetStoredTimezone(user.TelegramID)
+
+	clientTimezone, _ := middleware.CtxClientTimezone(c.Request.Context())
+	_, err = h.timezonesCollection.InsertOne(context.Background(), models.TimezoneChange{
+		TelegramID:     user.TelegramID,
+		From:           user.Timezone,
+		To:             req.Timezone,
+		ClientTimezone: clientTimezone,
+		CreatedAt:      now,
+	})
+	if err != nil {
+		log.Printf("Ошибка записи смены часового пояса пользователя %d (%s -> %s): %v", user.TelegramID, user.Timezone, req.Timezone, err)
+	}
+	log.Printf("Пользователь %d сменил часовой пояс: %s -> %s", user.TelegramID, user.Timezone, req.Timezone)
+
+	c.JSON(http.StatusOK, gin.H{
+		"timezone":            req.Timezone,
+		"timezone_changed_at": now,
+		"next_change_at":      now.Add(cooldown),
+	})
+}
@@ -3,65 +3,53 @@ package user
 import (
 	"backend/models"
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"backend/middleware"
+	"backend/schedule"
 	"backend/services"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const ObjectIDHexRegex = "^[0-9a-fA-F]{24}$"
 
-// Вспомогательная функция для проверки наличия элемента в массиве
-func contains(arr []int, val int) bool {
-	for _, a := range arr {
-		if a == val {
-			return true
-		}
-	}
-	return false
-}
-
 type Handler struct {
-	usersCollection   *mongo.Collection
-	historyCollection *mongo.Collection
-	habitsCollection  *mongo.Collection
+	usersCollection     *mongo.Collection
+	historyCollection   *mongo.Collection
+	habitsCollection    *mongo.Collection
+	freezesCollection   *mongo.Collection
+	timezonesCollection *mongo.Collection
+	ledger              *services.Ledger
+	rewards             *services.RewardEngine
 }
 
-func NewHandler(usersCollection, historyCollection, habitsCollection *mongo.Collection) *Handler {
+func NewHandler(usersCollection, historyCollection, habitsCollection, freezesCollection, timezonesCollection *mongo.Collection, ledger *services.Ledger, rewards *services.RewardEngine) *Handler {
 	return &Handler{
-		usersCollection:   usersCollection,
-		historyCollection: historyCollection,
-		habitsCollection:  habitsCollection,
+		usersCollection:     usersCollection,
+		historyCollection:   historyCollection,
+		habitsCollection:    habitsCollection,
+		freezesCollection:   freezesCollection,
+		timezonesCollection: timezonesCollection,
+		ledger:              ledger,
+		rewards:             rewards,
 	}
 }
 
-func findPrevHabitDay(days []int, currentWeekday int) (daysAgo int) {
-	prevWeekdayIndex := 0
-	for i := 0; i < len(days); i++ {
-		if days[i] == currentWeekday {
-			prevWeekdayIndex = i - 1
-			break
-		}
-	}
-
-	if prevWeekdayIndex == -1 {
-		prevWeekdayIndex = len(days) - 1
-	}
-
-	prevWeekday := days[prevWeekdayIndex]
-	daysAgo = currentWeekday - prevWeekday
-	if daysAgo < 0 {
-		daysAgo += 7
-	}
-	return daysAgo
+// EnsureIndexes создает индекс для истории смен часового пояса пользователя.
+func (h *Handler) EnsureIndexes(ctx context.Context) error {
+	_, err := h.timezonesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "telegram_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	return err
 }
 
 // HandleUser обрабатывает запросы на создание и обновление пользователя
@@ -163,12 +151,6 @@ func (h *Handler) HandleUser(c *gin.Context) {
 	}
 	today := time.Now().In(loc).Format("2006-01-02")
 	now := time.Now().In(loc)
-	todayWeekday := int(now.Weekday())
-	if todayWeekday == 0 {
-		todayWeekday = 6
-	} else {
-		todayWeekday--
-	}
 	originalLastVisitDate := ""
 
 	// Пытаемся найти существующего пользователя
@@ -179,12 +161,13 @@ func (h *Handler) HandleUser(c *gin.Context) {
 	).Decode(&existingUser)
 
 	if err == mongo.ErrNoDocuments {
-		// Создаем нового пользователя
+		// Создаем нового пользователя. Пояс, выбранный при регистрации, считается первой сменой:
+		// иначе первая смена прошла бы без ожидания timezoneCooldown
 		user.CreatedAt = time.Now()
+		user.TimezoneChangedAt = &user.CreatedAt
 		user.LastVisit = today
 		user.NotificationsEnabled = false
 		user.NotificationTime = "09:00"
-		user.Balance = 100 // Начисляем 100 WILL за регистрацию
 
 		// Добавляем реферера, если он был определен выше
 		if referrerUsername != "" {
@@ -201,6 +184,23 @@ func (h *Handler) HandleUser(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 			return
 		}
+
+		// Начисляем бонус за регистрацию по действующим правилам наград через журнал
+		bonus := h.rewards.Signup(context.Background())
+		credited, err := h.ledger.Post(context.Background(), models.LedgerEntry{
+			TelegramID:     user.TelegramID,
+			Amount:         bonus.UserAmount,
+			Reason:         models.LedgerSignupBonus,
+			RefType:        models.LedgerRefUser,
+			RefID:          fmt.Sprint(user.TelegramID),
+			IdempotencyKey: fmt.Sprintf("signup:%d", user.TelegramID),
+			RuleVersion:    bonus.RuleVersion,
+		})
+		if err != nil {
+			log.Printf("Ошибка начисления бонуса за регистрацию пользователю %d: %v", user.TelegramID, err)
+		} else if credited {
+			user.Balance = bonus.UserAmount
+		}
 		existingUser = user
 
 		// Для нового пользователя привычек нет, возвращаем пустой []HabitResponse
@@ -219,11 +219,16 @@ func (h *Handler) HandleUser(c *gin.Context) {
 				"first_name":    user.FirstName,
 				"username":      user.Username,
 				"language_code": user.LanguageCode,
-				"timezone":      user.Timezone,
 				"last_visit":    today, // Обновляем last_visit здесь
 			},
 		}
 
+		// Часовой пояс меняется только через /api/user/timezone; здесь его сохраняем лишь пользователям, у которых его еще нет
+		if existingUser.Timezone == "" {
+			update["$set"].(bson.M)["timezone"] = user.Timezone
+			existingUser.Timezone = user.Timezone
+		}
+
 		// Добавляем photo_url в обновление только если он передан
 		if req.PhotoURL != nil {
 			update["$set"].(bson.M)["photo_url"] = *req.PhotoURL
@@ -242,17 +247,25 @@ func (h *Handler) HandleUser(c *gin.Context) {
 		existingUser.FirstName = user.FirstName
 		existingUser.Username = user.Username
 		existingUser.LanguageCode = user.LanguageCode
-		existingUser.Timezone = user.Timezone
 		existingUser.LastVisit = today
 		if req.PhotoURL != nil {
 			existingUser.PhotoURL = *req.PhotoURL
 		}
 	}
 
+	// Фильтр по тегу влияет только на список в ответе: пересчет стриков при первом визите
+	// должен пройти по всем привычкам
+	tagFilter := bson.M{}
+	if err := services.TagFilter(tagFilter, c.Query("tag")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Загружаем привычки пользователя
 	cursor, err := h.habitsCollection.Find(
 		context.Background(),
 		bson.M{"telegram_id": user.TelegramID, "archived": bson.M{"$ne": true}},
+		options.Find().SetSort(services.HabitSort()),
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load habits"})
@@ -274,120 +287,118 @@ func (h *Handler) HandleUser(c *gin.Context) {
 	// Для каждой привычки
 	for _, habit := range habits {
 		// Проверяем, запланирована ли привычка на сегодня
-		if !contains(habit.Days, todayWeekday) {
-			continue
-		}
-
+		isDue := schedule.IsDue(habit, now)
 		updatedHabit := habit // Копируем привычку для модификаций
 
-		// Обновляем стрик, если нужно (логика обновления стрейка остается прежней)
+		// При первом визите за день пересчитываем стрик по истории
 		if originalLastVisitDate != today {
-			daysAgo := findPrevHabitDay(habit.Days, todayWeekday)
-			prevDate := now.AddDate(0, 0, -daysAgo)
-			prevDateStr := prevDate.Format("2006-01-02")
-			log.Printf("prevDateStr: %v", prevDateStr)
-
-			// Проверяем, была ли привычка выполнена в предыдущий день
-			var prevHistory models.History
-			err = h.historyCollection.FindOne(
-				context.Background(),
-				bson.M{
-					"telegram_id": user.TelegramID,
-					"date":        prevDateStr,
-					"habits": bson.M{
-						"$elemMatch": bson.M{
-							"habit_id": habit.ID,
-							"done":     true,
-						},
-					},
-				},
-			).Decode(&prevHistory)
-
-			newStreak := habit.Streak
-			newScore := habit.Score
-			wasDoneYesterday := err != mongo.ErrNoDocuments
-
-			updateFields := bson.M{}
-
-			// Обновляем стрик и скор в зависимости от типа привычки и выполнения
-			if habit.IsAuto {
-				if !wasDoneYesterday {
-					newStreak = 1
-					newScore += 1
-				} else {
-					newStreak += 1
-					newScore += 1
-				}
-				// Для автопривычек всегда обновляем историю
-				history := models.History{
-					TelegramID: user.TelegramID,
-					Date:       today,
-					Habits: []models.HabitHistory{{
-						HabitID: habit.ID,
-						Title:   habit.Title,
-						Done:    true,
-					}},
-				}
-				err = h.upsertHistory(user.TelegramID, today, history)
+			// Пропущенные дни закрываем заморозками, если их хватает. Пропуск мог быть
+			// и у привычки, которая сегодня не запланирована.
+			usedFreezes, err := services.ApplyStreakFreezes(context.Background(), h.freezesCollection, h.historyCollection, habit, now)
+			if err != nil {
+				log.Printf("Ошибка при применении заморозок для привычки %s: %v", habit.ID.Hex(), err)
+			}
+			if usedFreezes > 0 {
+				log.Printf("Для привычки %s использовано заморозок: %d", habit.ID.Hex(), usedFreezes)
+			}
+			if !isDue && usedFreezes == 0 {
+				continue
+			}
+
+			// Автопривычки отмечаются выполненными автоматически
+			if habit.IsAuto && isDue {
+				err = services.SetHabitDayEntry(context.Background(), h.historyCollection, user.TelegramID, today, models.HabitHistory{
+					HabitID: habit.ID,
+					Title:   habit.Title,
+					Done:    true,
+					Value:   habit.DailyTarget(),
+				})
 				if err != nil {
 					log.Printf("Ошибка при обновлении истории для автопривычки: %v", err)
 				}
-
-				updateFields["last_click_date"] = today
-				updatedHabit.LastClickDate = today // Обновляем копию
-			} else if !wasDoneYesterday {
-				newStreak = 0
 			}
-			// Случай 3: Не автопривычка и была выполнена вчера - ничего не делаем
-
-			// Обновляем привычку в базе
-			updateFields["streak"] = newStreak
-			updateFields["score"] = newScore
 
-			_, err = h.habitsCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": habit.ID},
-				bson.M{"$set": updateFields},
-			)
+			refreshedHabit, err := services.RefreshHabitStats(context.Background(), h.habitsCollection, h.historyCollection, habit, now)
 			if err != nil {
 				log.Printf("Ошибка при обновлении привычки %s: %v", habit.ID.Hex(), err)
+			} else {
+				updatedHabit = refreshedHabit
 			}
+		}
 
-			updatedHabit.Streak = newStreak // Обновляем копию
-			updatedHabit.Score = newScore   // Обновляем копию
+		if !isDue || !hasTag(updatedHabit, tagFilter) {
+			continue
 		}
 
 		// Вызываем функцию из сервиса
-		progress, err := services.CalculateHabitCompletionProgress(c.Request.Context(), updatedHabit, timezone, h.habitsCollection)
+		progress, err := services.CalculateHabitCompletionProgress(c.Request.Context(), updatedHabit, timezone, h.habitsCollection, h.historyCollection)
 		if err != nil {
 			log.Printf("Ошибка расчета прогресса для привычки %s в HandleUser: %v. Установлен прогресс 0.", updatedHabit.ID.Hex(), err)
 			progress = 0.0 // Устанавливаем 0 в случае ошибки
 		}
 
+		// Накопленное за сегодня значение для количественных привычек и отмеченные пункты чек-листа
+		todayValue, todayItems, err := services.HabitDayState(c.Request.Context(), h.historyCollection, updatedHabit, today)
+		if err != nil {
+			log.Printf("Ошибка получения значения за сегодня для привычки %s: %v", updatedHabit.ID.Hex(), err)
+		}
+
 		// Добавляем HabitResponse в результат
 		todayHabitResponses = append(todayHabitResponses, models.HabitResponse{
-			ID:            updatedHabit.ID,
-			TelegramID:    updatedHabit.TelegramID,
-			Title:         updatedHabit.Title,
-			WantToBecome:  updatedHabit.WantToBecome,
-			Days:          updatedHabit.Days,
-			IsOneTime:     updatedHabit.IsOneTime,
-			IsAuto:        updatedHabit.IsAuto,
-			CreatedAt:     updatedHabit.CreatedAt,
-			LastClickDate: updatedHabit.LastClickDate,
-			Streak:        updatedHabit.Streak,
-			Score:         updatedHabit.Score,
-			Stake:         updatedHabit.Stake,
-			Followers:     []models.FollowerInfo{}, // Подписчиков здесь не обогащаем
-			Progress:      progress,
+			ID:                 updatedHabit.ID,
+			TelegramID:         updatedHabit.TelegramID,
+			Title:              updatedHabit.Title,
+			WantToBecome:       updatedHabit.WantToBecome,
+			Days:               updatedHabit.Days,
+			Recurrence:         updatedHabit.Recurrence,
+			IsOneTime:          updatedHabit.IsOneTime,
+			DueDate:            updatedHabit.DueDate,
+			Overdue:            schedule.IsOverdue(updatedHabit, now),
+			IsAuto:             updatedHabit.IsAuto,
+			CreatedAt:          updatedHabit.CreatedAt,
+			LastClickDate:      updatedHabit.LastClickDate,
+			Streak:             updatedHabit.Streak,
+			LongestStreak:      updatedHabit.LongestStreak,
+			Score:              updatedHabit.Score,
+			Stake:              updatedHabit.Stake,
+			Target:             updatedHabit.Target,
+			Unit:               updatedHabit.Unit,
+			TodayValue:         todayValue,
+			Checklist:          updatedHabit.Checklist,
+			ChecklistThreshold: updatedHabit.ChecklistThreshold,
+			TodayItems:         todayItems,
+			Position:           updatedHabit.Position,
+			Tags:               updatedHabit.Tags,
+			Color:              updatedHabit.Color,
+			Icon:               updatedHabit.Icon,
+			Followers:          []models.FollowerInfo{}, // Подписчиков здесь не обогащаем
+			Progress:           progress,
 		})
 	}
 
 	// Формируем и отправляем ответ
 	response := existingUser.ToResponseWithHabits(todayHabitResponses) // Используем обновленный метод
+	// Если устройство в другом поясе (например, в поездке), клиент может предложить сменить сохраненный
+	if clientTimezone, ok := middleware.CtxClientTimezone(c.Request.Context()); ok && clientTimezone != existingUser.Timezone {
+		response.ClientTimezone = clientTimezone
+	}
 	c.JSON(http.StatusOK, response)
 }
 
+// hasTag проверяет, подходит ли привычка под фильтр по тегу, собранный services.TagFilter
+func hasTag(habit models.Habit, tagFilter bson.M) bool {
+	tagID, ok := tagFilter["tags"].(primitive.ObjectID)
+	if !ok {
+		return true
+	}
+	for _, id := range habit.Tags {
+		if id == tagID {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleSettings обрабатывает запросы на получение и обновление настроек пользователя
 func (h *Handler) HandleSettings(c *gin.Context) {
 	// Получаем данные из контекста Telegram
@@ -576,7 +587,12 @@ func (h *Handler) HandleUserProfile(c *gin.Context) {
 	}
 
 	// Получаем привычки пользователя
-	cursor, err := h.habitsCollection.Find(context.Background(), bson.M{"telegram_id": user.TelegramID})
+	filter := bson.M{"telegram_id": user.TelegramID}
+	if err := services.TagFilter(filter, c.Query("tag")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cursor, err := h.habitsCollection.Find(context.Background(), filter, options.Find().SetSort(services.HabitSort()))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -642,34 +658,3 @@ func (h *Handler) GetLeaderboard(c *gin.Context) {
 
 	c.JSON(http.StatusOK, leaderboard)
 }
-
-func (h *Handler) upsertHistory(telegramID int64, date string, history models.History) error {
-	var existingHistory models.History
-	err := h.historyCollection.FindOne(
-		context.Background(),
-		bson.M{
-			"telegram_id": telegramID,
-			"date":        date,
-		},
-	).Decode(&existingHistory)
-
-	if err == mongo.ErrNoDocuments {
-		_, err = h.historyCollection.InsertOne(context.Background(), history)
-	} else if err == nil {
-		_, err = h.historyCollection.UpdateOne(
-			context.Background(),
-			bson.M{
-				"telegram_id": telegramID,
-				"date":        date,
-			},
-			bson.M{
-				"$push": bson.M{
-					"habits": bson.M{
-						"$each": history.Habits,
-					},
-				},
-			},
-		)
-	}
-	return err
-}
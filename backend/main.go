@@ -11,11 +11,16 @@ import (
 	"time"
 
 	"backend/handlers/follower"
+	"backend/handlers/freeze"
 	"backend/handlers/habit"
 	"backend/handlers/invoice"
 	"backend/handlers/ping"
+	"backend/handlers/pot"
+	"backend/handlers/tag"
 	"backend/handlers/ton"
 	"backend/handlers/user"
+	"backend/models"
+	"backend/services"
 
 	"github.com/gin-gonic/gin"
 	tgbot "github.com/go-telegram/bot"
@@ -88,26 +93,112 @@ func main() {
 	txCollection := db.Collection("transactions")
 	settingsCollection := db.Collection("settings")
 	pingsCollection := db.Collection("pings")
+	freezesCollection := db.Collection("freezes")
+	tagsCollection := db.Collection("tags")
+	settlementsCollection := db.Collection("stake_settlements")
+	starsPaymentsCollection := db.Collection("stars_payments")
+	potsCollection := db.Collection("pots")
+	ledgerCollection := db.Collection("ledger")
+	timezoneChangesCollection := db.Collection("timezone_changes")
+	quotesCollection := db.Collection("quotes")
+	unmatchedDepositsCollection := db.Collection("unmatched_deposits")
+	withdrawLimitsCollection := db.Collection("withdraw_limits")
+	tonProofPayloadsCollection := db.Collection("ton_proof_payloads")
 
-	b, err := tgbot.New(botToken)
+	// Обновления бота (оплаты Telegram Stars) приходят на /telegram/updates: их пересылает
+	// Python-бот, который один читает обновления Telegram. Заголовок с секретом обязателен.
+	updatesSecret := os.Getenv("BOT_UPDATES_SECRET")
+	var botOptions []tgbot.Option
+	if updatesSecret != "" {
+		botOptions = append(botOptions, tgbot.WithWebhookSecretToken(updatesSecret))
+	} else {
+		log.Println("Предупреждение: BOT_UPDATES_SECRET не установлен. Оплаты Telegram Stars не будут обрабатываться.")
+	}
+
+	b, err := tgbot.New(botToken, botOptions...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Все изменения баланса WILL проходят через журнал
+	ledger := services.NewLedger(ledgerCollection, usersCollection, settingsCollection)
+	if err := ledger.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов журнала WILL: %v", err)
+	}
+
+	// Суммы наград рассчитываются по правилам из settings
+	rewards := services.NewRewardEngine(settingsCollection, ledger)
+
 	// Инициализация обработчиков
-	userHandler := user.NewHandler(usersCollection, historyCollection, habitsCollection)
-	habitHandler := habit.NewHandler(habitsCollection, historyCollection, usersCollection)
-	invoiceHandler := invoice.NewHandler(b)
+	userHandler := user.NewHandler(usersCollection, historyCollection, habitsCollection, freezesCollection, timezoneChangesCollection, ledger, rewards)
+	if err := userHandler.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов смен часового пояса: %v", err)
+	}
+	potService := services.NewPotService(potsCollection, habitsCollection, historyCollection, ledger)
+	if err := potService.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов банков: %v", err)
+	}
+	habitHandler := habit.NewHandler(habitsCollection, historyCollection, usersCollection, tagsCollection, ledger, rewards, potService)
+	starsService := services.NewStarsService(starsPaymentsCollection, ledger)
+	if err := starsService.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов покупок за Stars: %v", err)
+	}
+	starsService.RegisterHandlers(b)
+	invoiceHandler := invoice.NewHandler(b, starsService)
 	followerHandler := follower.NewHandler(habitsCollection, usersCollection)
-	tonHandler := ton.NewHandler(usersCollection, txCollection, settingsCollection)
+	// Реестр принимаемых jetton: курсы нужны котировкам, адреса — наблюдателю и выводам
+	jettonRegistry, err := services.LoadJettonRegistry(context.Background(), settingsCollection)
+	if err != nil {
+		log.Fatalf("Ошибка загрузки реестра jetton: %v", err)
+	}
+	quoteService := services.NewQuoteService(quotesCollection, jettonRegistry)
+	if err := quoteService.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов котировок: %v", err)
+	}
+	// Владение кошельками подтверждается подписью TON Connect ton_proof
+	tonProofService := services.NewTonProofService(tonProofPayloadsCollection)
+	if err := tonProofService.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов ton_proof: %v", err)
+	}
+	tonHandler := ton.NewHandler(usersCollection, txCollection, settingsCollection, unmatchedDepositsCollection, withdrawLimitsCollection, ledger, quoteService, tonProofService, ton.NewLiteChain())
+	if err := tonHandler.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов транзакций: %v", err)
+	}
+	// Без блокчейна сервер работает дальше: функции TON включатся, когда реестр загрузится
+	go runJettonLoader(tonHandler, jettonRegistry)
 	pingHandler := ping.NewHandler(pingsCollection)
+	freezeHandler := freeze.NewHandler(freezesCollection, usersCollection, ledger)
+	if err := freezeHandler.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов заморозок: %v", err)
+	}
+	tagHandler := tag.NewHandler(tagsCollection, habitsCollection)
+	potHandler := pot.NewHandler(potsCollection, habitsCollection, usersCollection, potService)
+
+	// Доприменяем записи журнала WILL, брошенные при падении процесса
+	go runLedgerRecoveryProcessor(ledger)
+
+	// Повторяем начисление WILL за оплаченные, но не начисленные покупки за Stars
+	go runStarsRecoveryProcessor(starsService)
 
 	// Запускаем процесс транзакций в отдельной горутине
 	go runTonTransactionProcessor(tonHandler)
 
+	// Повторяем начисление депозитов, не зачисленных из-за ошибки
+	go runDepositCreditRecoveryProcessor(tonHandler)
+
 	// Запускаем процесс вывода средств в отдельной горутине
 	go runWithdrawalsProcessor(tonHandler)
 
+	// Запускаем расчет ставок за пропущенные привычки в отдельной горутине
+	stakeService := services.NewStakeSettlementService(habitsCollection, historyCollection, usersCollection, settlementsCollection, freezesCollection, ledger, b)
+	if err := stakeService.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Ошибка создания индексов для расчета ставок: %v", err)
+	}
+	go runStakeSettlementProcessor(stakeService)
+
+	// Запускаем расчет общих банков в отдельной горутине
+	go runPotSettlementProcessor(potService)
+
 	// Настройка CORS middleware
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -117,8 +208,15 @@ func main() {
 		Debug:            true,
 	})
 
+	// Обрабатываем обновления бота, пересланные на /telegram/updates
+	var botUpdatesHandler http.HandlerFunc
+	if updatesSecret != "" {
+		botUpdatesHandler = b.WebhookHandler()
+		go b.StartWebhook(context.Background())
+	}
+
 	// Настройка роутера
-	r := setupGinRouter(userHandler, habitHandler, invoiceHandler, followerHandler, tonHandler, pingHandler, botToken)
+	r := setupGinRouter(userHandler, habitHandler, invoiceHandler, followerHandler, tonHandler, pingHandler, freezeHandler, tagHandler, potHandler, botToken, usersCollection, botUpdatesHandler)
 	r.Use(func(c *gin.Context) {
 		corsMiddleware.ServeHTTP(c.Writer, c.Request, func(w http.ResponseWriter, r *http.Request) {
 			c.Next()
@@ -165,6 +263,60 @@ func runTonTransactionProcessor(handler *ton.TonHandler) {
 	}
 }
 
+// runDepositCreditRecoveryProcessor периодически повторяет начисление депозитов с ошибкой начисления
+func runDepositCreditRecoveryProcessor(handler *ton.TonHandler) {
+	for {
+		ctx := context.Background()
+		credited, err := handler.RetryFailedDepositCredits(ctx)
+		if err != nil {
+			log.Printf("Ошибка при повторном начислении депозитов: %v", err)
+		} else if credited > 0 {
+			log.Printf("Зачислено депозитов после сбоя: %d", credited)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// runLedgerRecoveryProcessor периодически доприменяет неприменённые записи журнала WILL
+func runLedgerRecoveryProcessor(ledger *services.Ledger) {
+	for {
+		ctx := context.Background()
+		recovered, err := ledger.RecoverPending(ctx)
+		if err != nil {
+			log.Printf("Ошибка при доприменении записей журнала: %v", err)
+		} else if recovered > 0 {
+			log.Printf("Доприменено записей журнала: %d", recovered)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// runStarsRecoveryProcessor периодически повторяет начисление WILL за оплаченные покупки за Stars
+func runStarsRecoveryProcessor(starsService *services.StarsService) {
+	for {
+		ctx := context.Background()
+		recovered, err := starsService.RecoverUncredited(ctx)
+		if err != nil {
+			log.Printf("Ошибка при повторном начислении покупок за Stars: %v", err)
+		} else if recovered > 0 {
+			log.Printf("Начислено покупок за Stars после сбоя: %d", recovered)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// runJettonLoader загружает jetton-кошельки казны, повторяя попытки, пока блокчейн недоступен
+func runJettonLoader(handler *ton.TonHandler, registry models.JettonRegistry) {
+	for {
+		err := handler.LoadJettons(context.Background(), registry)
+		if err == nil {
+			return
+		}
+		log.Printf("Ошибка получения jetton-кошельков казны, функции TON отключены: %v", err)
+		time.Sleep(time.Minute)
+	}
+}
+
 // runWithdrawalsProcessor запускает периодическую обработку запросов на вывод
 func runWithdrawalsProcessor(handler *ton.TonHandler) {
 	for {
@@ -180,3 +332,36 @@ func runWithdrawalsProcessor(handler *ton.TonHandler) {
 		time.Sleep(2 * time.Minute)
 	}
 }
+
+// runStakeSettlementProcessor запускает периодический расчет ставок. Дни рассчитываются
+// по часовому поясу каждого пользователя, поэтому проверка идет чаще, чем раз в сутки.
+func runStakeSettlementProcessor(service *services.StakeSettlementService) {
+	for {
+		log.Println("Начинаем расчет ставок")
+		ctx := context.Background()
+
+		err := service.Run(ctx)
+		if err != nil {
+			log.Printf("Ошибка при расчете ставок: %v", err)
+		}
+
+		log.Println("Расчет ставок завершен")
+		time.Sleep(15 * time.Minute)
+	}
+}
+
+// runPotSettlementProcessor запускает периодический расчет общих банков, период которых закончился
+func runPotSettlementProcessor(service *services.PotService) {
+	for {
+		log.Println("Начинаем расчет банков")
+		ctx := context.Background()
+
+		err := service.Run(ctx)
+		if err != nil {
+			log.Printf("Ошибка при расчете банков: %v", err)
+		}
+
+		log.Println("Расчет банков завершен")
+		time.Sleep(15 * time.Minute)
+	}
+}
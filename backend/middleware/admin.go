@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminIDs читает Telegram ID администраторов из ADMIN_IDS (через запятую)
+func adminIDs() map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, value := range strings.Split(os.Getenv("ADMIN_IDS"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Printf("Некорректный ID администратора в ADMIN_IDS: %s", value)
+			continue
+		}
+		ids[id] = true
+	}
+	return ids
+}
+
+// AdminMiddleware пропускает только пользователей из ADMIN_IDS. Должен стоять после AuthMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+	admins := adminIDs()
+	if len(admins) == 0 {
+		log.Println("Предупреждение: ADMIN_IDS не установлен. Административные маршруты недоступны.")
+	}
+
+	return func(c *gin.Context) {
+		initData, ok := CtxInitData(c.Request.Context())
+		if !ok || !admins[initData.User.ID] {
+			c.AbortWithStatusJSON(403, gin.H{
+				"message": "Forbidden",
+			})
+			return
+		}
+		c.Next()
+	}
+}
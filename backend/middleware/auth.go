@@ -2,18 +2,24 @@ package middleware
 
 import (
 	"context"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	initdata "github.com/telegram-mini-apps/init-data-golang"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type contextKey string
 
 const (
-	InitDataKey contextKey = "init-data"
-	TimezoneKey contextKey = "timezone"
+	InitDataKey       contextKey = "init-data"
+	TimezoneKey       contextKey = "timezone"
+	ClientTimezoneKey contextKey = "client-timezone"
 )
 
 // Returns new context with specified init data.
@@ -38,8 +44,91 @@ func CtxTimezone(ctx context.Context) (string, bool) {
 	return timezone, ok
 }
 
-// AuthMiddleware проверяет данные, полученные от Telegram Mini App
-func AuthMiddleware(token string) gin.HandlerFunc {
+// Returns new context with the timezone reported by the client.
+func withClientTimezone(ctx context.Context, timezone string) context.Context {
+	return context.WithValue(ctx, ClientTimezoneKey, timezone)
+}
+
+// Returns the timezone reported by the client (X-Timezone) from the specified context.
+// It may differ from CtxTimezone when the user is traveling.
+func CtxClientTimezone(ctx context.Context) (string, bool) {
+	timezone, ok := ctx.Value(ClientTimezoneKey).(string)
+	return timezone, ok
+}
+
+// storedTimezoneTTL - сколько сохраненный часовой пояс пользователя живет в кэше. Смена пояса
+// через API сбрасывает кэш сразу; TTL ограничивает расхождение между экземплярами сервера.
+const storedTimezoneTTL = time.Minute
+
+// storedTimezonesSweepSize - при таком размере кэша из него вычищаются устаревшие записи
+const storedTimezonesSweepSize = 10000
+
+type cachedTimezone struct {
+	timezone  string
+	expiresAt time.Time
+}
+
+// storedTimezones кэширует часовые пояса пользователей, чтобы не читать профиль на каждый запрос
+var storedTimezones = struct {
+	sync.Mutex
+	entries map[int64]cachedTimezone
+}{entries: make(map[int64]cachedTimezone)}
+
+// ForgetStoredTimezone сбрасывает кэшированный часовой пояс пользователя после его смены
+func ForgetStoredTimezone(telegramID int64) {
+	storedTimezones.Lock()
+	delete(storedTimezones.entries, telegramID)
+	storedTimezones.Unlock()
+}
+
+// storedTimezone возвращает часовой пояс, сохраненный у пользователя, или пустую строку,
+// если пользователя еще нет или пояс не задан
+func storedTimezone(ctx context.Context, usersCollection *mongo.Collection, telegramID int64) string {
+	now := time.Now()
+	storedTimezones.Lock()
+	cached, ok := storedTimezones.entries[telegramID]
+	storedTimezones.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.timezone
+	}
+
+	var user struct {
+		Timezone string `bson:"timezone"`
+	}
+	err := usersCollection.FindOne(ctx,
+		bson.M{"telegram_id": telegramID},
+		options.FindOne().SetProjection(bson.M{"timezone": 1}),
+	).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Ошибка получения часового пояса пользователя %d: %v", telegramID, err)
+	}
+	if user.Timezone == "" {
+		// Пользователь без пояса сохранит его при регистрации — не кэшируем
+		return ""
+	}
+	if _, err := time.LoadLocation(user.Timezone); err != nil {
+		log.Printf("Некорректный сохраненный часовой пояс %s у пользователя %d", user.Timezone, telegramID)
+		return ""
+	}
+
+	storedTimezones.Lock()
+	// Кэш не должен расти с числом когда-либо заходивших пользователей
+	if len(storedTimezones.entries) >= storedTimezonesSweepSize {
+		for id, entry := range storedTimezones.entries {
+			if now.After(entry.expiresAt) {
+				delete(storedTimezones.entries, id)
+			}
+		}
+	}
+	storedTimezones.entries[telegramID] = cachedTimezone{timezone: user.Timezone, expiresAt: now.Add(storedTimezoneTTL)}
+	storedTimezones.Unlock()
+	return user.Timezone
+}
+
+// AuthMiddleware проверяет данные, полученные от Telegram Mini App.
+// Часовой пояс для расчета "сегодня" берется из профиля пользователя; X-Timezone используется,
+// только пока пояс не сохранен, и всегда доступен через CtxClientTimezone.
+func AuthMiddleware(token string, usersCollection *mongo.Collection) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Включаем CORS
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -52,13 +141,13 @@ func AuthMiddleware(token string) gin.HandlerFunc {
 		}
 
 		// Получаем timezone из заголовка
-		timezone := c.GetHeader("X-Timezone")
-		if timezone == "" {
-			timezone = "UTC" // дефолтное значение
+		clientTimezone := c.GetHeader("X-Timezone")
+		if clientTimezone == "" {
+			clientTimezone = "UTC" // дефолтное значение
 		}
 
 		// Проверяем валидность timezone
-		_, err := time.LoadLocation(timezone)
+		_, err := time.LoadLocation(clientTimezone)
 		if err != nil {
 			c.AbortWithStatusJSON(400, gin.H{
 				"error": "invalid timezone",
@@ -66,11 +155,6 @@ func AuthMiddleware(token string) gin.HandlerFunc {
 			return
 		}
 
-		// Добавляем timezone в контекст
-		c.Request = c.Request.WithContext(
-			withTimezone(c.Request.Context(), timezone),
-		)
-
 		// Получаем данные из заголовка Authorization
 		authParts := strings.Split(c.GetHeader("Authorization"), " ")
 		if len(authParts) != 2 {
@@ -102,10 +186,17 @@ func AuthMiddleware(token string) gin.HandlerFunc {
 				return
 			}
 
+			// Сервер сам определяет "сегодня": заголовок не может сдвинуть день для существующего пользователя
+			timezone := storedTimezone(c.Request.Context(), usersCollection, initData.User.ID)
+			if timezone == "" {
+				timezone = clientTimezone
+			}
+
 			// Сохраняем данные в контекст
-			c.Request = c.Request.WithContext(
-				withInitData(c.Request.Context(), initData),
-			)
+			ctx := withInitData(c.Request.Context(), initData)
+			ctx = withTimezone(ctx, timezone)
+			ctx = withClientTimezone(ctx, clientTimezone)
+			c.Request = c.Request.WithContext(ctx)
 		default:
 			c.AbortWithStatusJSON(401, gin.H{
 				"message": "Invalid authorization type",
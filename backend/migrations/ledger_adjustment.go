@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"backend/models"
+	"backend/services"
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// adjustBalances приводит баланс каждого пользователя к значению target(текущий баланс),
+// проводя разницу через журнал WILL как корректировку. Ключ включает имя миграции,
+// поэтому повторный запуск той же миграции баланс не меняет.
+func adjustBalances(ctx context.Context, ledger *services.Ledger, usersCollection *mongo.Collection, migration string, target func(balance int) int) error {
+	if err := ledger.EnsureIndexes(ctx); err != nil {
+		log.Printf("Ошибка создания индексов журнала: %v", err)
+		return err
+	}
+
+	// Баланс, накопленный до журнала, должен быть в нем отражен, иначе корректировка разойдется с балансом
+	if _, err := ledger.RecordOpeningBalances(ctx); err != nil {
+		log.Printf("Ошибка при записи начальных балансов: %v", err)
+		return err
+	}
+
+	cursor, err := usersCollection.Find(ctx, bson.M{})
+	if err != nil {
+		log.Printf("Ошибка при получении пользователей: %v", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	processedCount := 0
+	errorCount := 0
+
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			log.Printf("Ошибка декодирования пользователя: %v", err)
+			errorCount++
+			continue
+		}
+
+		_, err := ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     user.TelegramID,
+			Amount:         target(user.Balance) - user.Balance,
+			Reason:         models.LedgerAdjustment,
+			RefType:        models.LedgerRefMigration,
+			RefID:          migration,
+			IdempotencyKey: fmt.Sprintf("migration:%s:%d", migration, user.TelegramID),
+		})
+		if err != nil {
+			log.Printf("Ошибка при обновлении пользователя %d: %v", user.TelegramID, err)
+			errorCount++
+			continue
+		}
+
+		processedCount++
+		if processedCount%100 == 0 {
+			log.Printf("Обработано пользователей: %d, ошибок: %d", processedCount, errorCount)
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Printf("Ошибка курсора при обходе пользователей: %v", err)
+		return err
+	}
+
+	log.Printf("Миграция %s завершена. Всего обработано: %d, ошибок: %d", migration, processedCount, errorCount)
+	return nil
+}
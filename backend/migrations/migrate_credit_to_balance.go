@@ -1,6 +1,7 @@
 package migrations
 
 import (
+	"backend/services"
 	"context"
 	"log"
 
@@ -11,22 +12,22 @@ import (
 func MigrateCreditToBalance(client *mongo.Client, dbName string) error {
 	ctx := context.Background()
 	usersCollection := client.Database(dbName).Collection("users")
+	ledger := services.NewLedger(client.Database(dbName).Collection("ledger"), usersCollection, client.Database(dbName).Collection("settings"))
 
-	// Обновляем все документы: удаляем поле credit и устанавливаем balance = 100
+	// Удаляем поле credit у всех документов
 	result, err := usersCollection.UpdateMany(
 		ctx,
 		bson.M{}, // пустой фильтр для обновления всех документов
-		bson.M{
-			"$unset": bson.M{"credit": ""},   // удаляем поле credit
-			"$set":   bson.M{"balance": 100}, // устанавливаем balance = 100
-		},
+		bson.M{"$unset": bson.M{"credit": ""}},
 	)
-
 	if err != nil {
 		log.Printf("Ошибка при обновлении документов: %v", err)
 		return err
 	}
-
 	log.Printf("Обновлено документов: %d", result.ModifiedCount)
-	return nil
+
+	// Устанавливаем balance = 100 корректировкой через журнал
+	return adjustBalances(ctx, ledger, usersCollection, "credit_to_balance", func(balance int) int {
+		return 100
+	})
 }
@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"backend/models"
+	"backend/services"
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RebuildHabitStats пересчитывает кэшированные показатели (streak, longest_streak, score,
+// last_click_date) всех привычек по коллекции истории в часовом поясе владельца.
+func RebuildHabitStats(client *mongo.Client, dbName string) error {
+	ctx := context.Background()
+	usersCollection := client.Database(dbName).Collection("users")
+	habitsCollection := client.Database(dbName).Collection("habits")
+	historyCollection := client.Database(dbName).Collection("history")
+
+	cursor, err := habitsCollection.Find(ctx, bson.M{})
+	if err != nil {
+		log.Printf("Ошибка при получении привычек: %v", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	locations := make(map[int64]*time.Location)
+	processedCount := 0
+	errorCount := 0
+
+	for cursor.Next(ctx) {
+		var habit models.Habit
+		if err := cursor.Decode(&habit); err != nil {
+			log.Printf("Ошибка декодирования привычки: %v", err)
+			errorCount++
+			continue
+		}
+
+		loc, ok := locations[habit.TelegramID]
+		if !ok {
+			loc = time.UTC
+			var user models.User
+			err := usersCollection.FindOne(ctx, bson.M{"telegram_id": habit.TelegramID}).Decode(&user)
+			if err == nil && user.Timezone != "" {
+				if userLoc, err := time.LoadLocation(user.Timezone); err == nil {
+					loc = userLoc
+				}
+			}
+			locations[habit.TelegramID] = loc
+		}
+
+		before := habit
+		habit, err = services.RefreshHabitStats(ctx, habitsCollection, historyCollection, habit, time.Now().In(loc))
+		if err != nil {
+			log.Printf("Ошибка пересчета привычки %s: %v", habit.ID.Hex(), err)
+			errorCount++
+			continue
+		}
+		if before.Streak != habit.Streak || before.Score != habit.Score || before.LastClickDate != habit.LastClickDate {
+			log.Printf("Привычка %s: streak %d -> %d, score %d -> %d, last_click_date %q -> %q",
+				habit.ID.Hex(), before.Streak, habit.Streak, before.Score, habit.Score, before.LastClickDate, habit.LastClickDate)
+		}
+
+		processedCount++
+		if processedCount%100 == 0 {
+			log.Printf("Обработано привычек: %d, ошибок: %d", processedCount, errorCount)
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Printf("Ошибка курсора при обходе привычек: %v", err)
+		return err
+	}
+
+	log.Printf("Пересчет показателей привычек завершен. Всего обработано: %d, ошибок: %d", processedCount, errorCount)
+	return nil
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SetTimezoneChangedAt заполняет timezone_changed_at у пользователей, которые ни разу не меняли
+// часовой пояс: без этого поля первая смена проходит без ожидания. Берется дата регистрации,
+// а если ее нет — время запуска миграции.
+func SetTimezoneChangedAt(client *mongo.Client, dbName string) error {
+	ctx := context.Background()
+	usersCollection := client.Database(dbName).Collection("users")
+
+	result, err := usersCollection.UpdateMany(ctx,
+		bson.M{"timezone_changed_at": bson.M{"$exists": false}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"timezone_changed_at": bson.M{"$ifNull": bson.A{"$created_at", time.Now()}},
+			}}},
+		},
+	)
+	if err != nil {
+		log.Printf("Ошибка при заполнении timezone_changed_at: %v", err)
+		return err
+	}
+	log.Printf("Заполнено timezone_changed_at у пользователей: %d", result.ModifiedCount)
+	return nil
+}
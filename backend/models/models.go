@@ -28,41 +28,100 @@ type HabitFollowers struct {
 	Followers     []Follower         `bson:"followers" json:"followers"`
 }
 
+// Типы правил повторения привычки
+const (
+	RecurrenceWeekdays     = "weekdays"       // По выбранным дням недели (поле Days)
+	RecurrenceTimesPerWeek = "times_per_week" // N раз в неделю в любые дни
+	RecurrenceEveryNDays   = "every_n_days"   // Каждые N дней
+	RecurrenceMonthDays    = "month_days"     // По числам месяца
+)
+
+// Recurrence - правило повторения привычки. Если правило не задано,
+// привычка повторяется по дням недели из Habit.Days.
+type Recurrence struct {
+	Type         string   `bson:"type" json:"type"`
+	TimesPerWeek int      `bson:"times_per_week,omitempty" json:"times_per_week,omitempty"`
+	Interval     int      `bson:"interval,omitempty" json:"interval,omitempty"`           // Для every_n_days
+	StartDate    string   `bson:"start_date,omitempty" json:"start_date,omitempty"`       // Точка отсчета для every_n_days, по умолчанию дата создания
+	MonthDays    []int    `bson:"month_days,omitempty" json:"month_days,omitempty"`       // Для month_days: 1..31
+	ExcludeDates []string `bson:"exclude_dates,omitempty" json:"exclude_dates,omitempty"` // Праздники и другие дни без привычки
+}
+
 // Habit - основная структура для хранения привычки в БД
 type Habit struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	TelegramID    int64              `bson:"telegram_id" json:"telegram_id"`
-	Title         string             `bson:"title" json:"title"`
-	WantToBecome  string             `bson:"want_to_become" json:"want_to_become"`
-	Days          []int              `bson:"days" json:"days"`
-	IsOneTime     bool               `bson:"is_one_time" json:"is_one_time"`
-	IsAuto        bool               `bson:"is_auto" json:"is_auto"`
-	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
-	LastClickDate string             `bson:"last_click_date" json:"last_click_date"`
-	Streak        int                `bson:"streak" json:"streak"`
-	Score         int                `bson:"score" json:"score"`
-	Stake         int                `bson:"stake" json:"stake"`
-	Archived      bool               `bson:"archived,omitempty" json:"archived"`
-	Followers     []string           `bson:"followers" json:"followers,omitempty"` // ID других привычек
+	ID                 primitive.ObjectID   `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID         int64                `bson:"telegram_id" json:"telegram_id"`
+	Title              string               `bson:"title" json:"title"`
+	WantToBecome       string               `bson:"want_to_become" json:"want_to_become"`
+	Days               []int                `bson:"days" json:"days"`
+	Recurrence         *Recurrence          `bson:"recurrence,omitempty" json:"recurrence,omitempty"`
+	IsOneTime          bool                 `bson:"is_one_time" json:"is_one_time"`
+	DueDate            string               `bson:"due_date,omitempty" json:"due_date,omitempty"` // Срок разовой задачи (2006-01-02), необязателен
+	IsAuto             bool                 `bson:"is_auto" json:"is_auto"`
+	CreatedAt          time.Time            `bson:"created_at" json:"created_at"`
+	LastClickDate      string               `bson:"last_click_date" json:"last_click_date"`
+	Streak             int                  `bson:"streak" json:"streak"`
+	LongestStreak      int                  `bson:"longest_streak" json:"longest_streak"`
+	Score              int                  `bson:"score" json:"score"`
+	Stake              int                  `bson:"stake" json:"stake"`
+	Target             int                  `bson:"target,omitempty" json:"target"` // Дневная цель (0 или 1 — обычная привычка «сделал/не сделал»)
+	Unit               string               `bson:"unit,omitempty" json:"unit"`     // Единица измерения: стаканы, минуты, страницы...
+	Archived           bool                 `bson:"archived,omitempty" json:"archived"`
+	Checklist          []ChecklistItem      `bson:"checklist,omitempty" json:"checklist"`                     // Пункты привычки-рутины
+	ChecklistThreshold int                  `bson:"checklist_threshold,omitempty" json:"checklist_threshold"` // Сколько пунктов достаточно отметить (0 — все обязательные)
+	Position           int                  `bson:"position" json:"position"`                                 // Место в списке при ручной сортировке
+	Tags               []primitive.ObjectID `bson:"tags,omitempty" json:"tags"`                               // ID тегов пользователя
+	Color              string               `bson:"color,omitempty" json:"color"`                             // Цвет в формате #RRGGBB
+	Icon               string               `bson:"icon,omitempty" json:"icon"`                               // Эмодзи-иконка
+	Followers          []string             `bson:"followers" json:"followers,omitempty"`                     // ID других привычек
+}
+
+// ChecklistItem - пункт чек-листа привычки
+type ChecklistItem struct {
+	ID       primitive.ObjectID `bson:"_id" json:"_id"`
+	Title    string             `bson:"title" json:"title"`
+	Optional bool               `bson:"optional,omitempty" json:"optional"` // Необязательный пункт не нужен для выполнения привычки
+}
+
+// DailyTarget возвращает дневную цель привычки. Для бинарных привычек цель равна 1.
+func (h Habit) DailyTarget() int {
+	if h.Target < 1 {
+		return 1
+	}
+	return h.Target
 }
 
 // HabitResponse - структура для отправки данных на фронтенд
 type HabitResponse struct {
-	ID            primitive.ObjectID `json:"_id"`
-	TelegramID    int64              `json:"telegram_id"`
-	Title         string             `json:"title"`
-	WantToBecome  string             `json:"want_to_become"`
-	Days          []int              `json:"days"`
-	IsOneTime     bool               `json:"is_one_time"`
-	IsAuto        bool               `json:"is_auto"`
-	CreatedAt     time.Time          `json:"created_at"`
-	LastClickDate string             `json:"last_click_date"`
-	Streak        int                `json:"streak"`
-	Score         int                `json:"score"`
-	Stake         int                `json:"stake"`
-	Archived      bool               `json:"archived"`
-	Followers     []FollowerInfo     `json:"followers"` // Обогащенная информация о подписчиках
-	Progress      float64            `json:"progress"`
+	ID                 primitive.ObjectID   `json:"_id"`
+	TelegramID         int64                `json:"telegram_id"`
+	Title              string               `json:"title"`
+	WantToBecome       string               `json:"want_to_become"`
+	Days               []int                `json:"days"`
+	Recurrence         *Recurrence          `json:"recurrence,omitempty"`
+	IsOneTime          bool                 `json:"is_one_time"`
+	DueDate            string               `json:"due_date,omitempty"`
+	Overdue            bool                 `json:"overdue"` // Разовая задача не выполнена в срок
+	IsAuto             bool                 `json:"is_auto"`
+	CreatedAt          time.Time            `json:"created_at"`
+	LastClickDate      string               `json:"last_click_date"`
+	Streak             int                  `json:"streak"`
+	LongestStreak      int                  `json:"longest_streak"`
+	Score              int                  `json:"score"`
+	Stake              int                  `json:"stake"`
+	Target             int                  `json:"target"`
+	Unit               string               `json:"unit"`
+	TodayValue         int                  `json:"today_value"` // Накопленное за сегодня значение
+	Checklist          []ChecklistItem      `json:"checklist"`
+	ChecklistThreshold int                  `json:"checklist_threshold"`
+	TodayItems         []primitive.ObjectID `json:"today_items"` // Отмеченные сегодня пункты чек-листа
+	Archived           bool                 `json:"archived"`
+	Position           int                  `json:"position"`
+	Tags               []primitive.ObjectID `json:"tags"`
+	Color              string               `json:"color"`
+	Icon               string               `json:"icon"`
+	Followers          []FollowerInfo       `json:"followers"` // Обогащенная информация о подписчиках
+	Progress           float64              `json:"progress"`
 }
 
 // FollowerInfo - информация о подписчике для отправки на фронтенд
@@ -86,10 +145,114 @@ type HabitRequest struct {
 	Habit      Habit `json:"habit"`
 }
 
+// Статусы расчета ставки за день
+const (
+	SettlementCompleted = "completed" // Привычка выполнена, ставка не списывается
+	SettlementFrozen    = "frozen"    // Пропуск закрыт заморозкой стрика, ставка не списывается
+	SettlementCharging  = "charging"  // Привычка пропущена, списание не завершено — следующий запуск продолжит его
+	SettlementMissed    = "missed"    // Привычка пропущена, ставка списана и распределена
+)
+
+// StakePayout - выигрыш подписчика из ставки пропущенной привычки
+type StakePayout struct {
+	TelegramID int64              `bson:"telegram_id" json:"telegram_id"`
+	HabitID    primitive.ObjectID `bson:"habit_id" json:"habit_id"`
+	HabitTitle string             `bson:"habit_title" json:"habit_title"`
+	Amount     int                `bson:"amount" json:"amount"`
+}
+
+// StakeSettlement - итог расчета ставки по привычке за день (для «N раз в неделю» — за неделю,
+// Date — последний день периода). Пара habit_id + date уникальна, поэтому повторный расчет ничего не списывает.
+type StakeSettlement struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	HabitID      primitive.ObjectID `bson:"habit_id" json:"habit_id"`
+	TelegramID   int64              `bson:"telegram_id" json:"telegram_id"`
+	Date         string             `bson:"date" json:"date"`
+	Status       string             `bson:"status" json:"status"`
+	Stake        int                `bson:"stake" json:"stake"` // Фактически списанная сумма
+	Payouts      []StakePayout      `bson:"payouts,omitempty" json:"payouts,omitempty"`
+	SystemAmount int                `bson:"system_amount" json:"system_amount"` // Остаток, ушедший в системный баланс
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Статусы общего банка
+const (
+	PotOpen     = "open"     // Идет набор или испытание, ставки заблокированы
+	PotSettling = "settling" // Итоги зафиксированы, выплаты проводятся
+	PotSettled  = "settled"  // Выплаты завершены
+)
+
+// PotParticipant - участник банка со своей копией общей привычки
+type PotParticipant struct {
+	TelegramID int64              `bson:"telegram_id" json:"telegram_id"`
+	HabitID    primitive.ObjectID `bson:"habit_id" json:"habit_id"`
+	JoinedAt   time.Time          `bson:"joined_at" json:"joined_at"`
+	Required   int                `bson:"required" json:"required"` // Выполнений, нужных по расписанию (фиксируется при расчете)
+	Done       int                `bson:"done" json:"done"`         // Засчитанных выполнений (фиксируется при расчете)
+	Completed  *bool              `bson:"completed,omitempty" json:"completed,omitempty"`
+	Payout     int                `bson:"payout" json:"payout"` // Сколько WILL вернулось участнику по итогам
+}
+
+// Pot - общий банк на совместной привычке. Каждый участник блокирует одинаковую ставку на период
+// [StartDate, EndDate]; после окончания ставки пропустивших делятся между выполнившими.
+// Даты считаются в часовом поясе Timezone создателя банка.
+type Pot struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	HabitID      primitive.ObjectID `bson:"habit_id" json:"habit_id"` // Привычка создателя, к которой привязан банк
+	CreatorID    int64              `bson:"creator_id" json:"creator_id"`
+	Title        string             `bson:"title" json:"title"`
+	Stake        int                `bson:"stake" json:"stake"`
+	StartDate    string             `bson:"start_date" json:"start_date"`
+	EndDate      string             `bson:"end_date" json:"end_date"`
+	Timezone     string             `bson:"timezone" json:"timezone"`
+	Status       string             `bson:"status" json:"status"`
+	Participants []PotParticipant   `bson:"participants" json:"participants"`
+	SystemAmount int                `bson:"system_amount,omitempty" json:"system_amount,omitempty"` // Остаток от деления, ушедший в системный баланс
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	SettledAt    *time.Time         `bson:"settled_at,omitempty" json:"settled_at,omitempty"`
+}
+
+// Tag - пользовательская категория привычек
+type Tag struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID int64              `bson:"telegram_id" json:"telegram_id"`
+	Name       string             `bson:"name" json:"name"`
+	Color      string             `bson:"color,omitempty" json:"color"`
+	Icon       string             `bson:"icon,omitempty" json:"icon"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Ограничения на метаданные выполнения
+const (
+	MaxNoteLength = 500 // Максимальная длина заметки в символах
+	MinMood       = 1
+	MaxMood       = 5
+)
+
+// Статусы дня в истории привычки
+const (
+	HistoryStatusFrozen = "frozen" // Пропуск закрыт заморозкой стрика
+)
+
 type HabitHistory struct {
-	HabitID primitive.ObjectID `bson:"habit_id" json:"habit_id"`
-	Title   string             `bson:"title" json:"title"`
-	Done    bool               `bson:"done" json:"done"`
+	HabitID     primitive.ObjectID   `bson:"habit_id" json:"habit_id"`
+	Title       string               `bson:"title" json:"title"`
+	Done        bool                 `bson:"done" json:"done"`
+	Value       int                  `bson:"value,omitempty" json:"value"`                         // Накопленное за день значение
+	Status      string               `bson:"status,omitempty" json:"status,omitempty"`             // Особый статус дня, например frozen
+	Note        string               `bson:"note,omitempty" json:"note,omitempty"`                 // Заметка к выполнению
+	Mood        int                  `bson:"mood,omitempty" json:"mood,omitempty"`                 // Оценка настроения/усилия от 1 до 5
+	CompletedAt *time.Time           `bson:"completed_at,omitempty" json:"completed_at,omitempty"` // Точное время выполнения
+	Items       []primitive.ObjectID `bson:"items,omitempty" json:"items,omitempty"`               // Отмеченные пункты чек-листа
+}
+
+// Progress возвращает накопленное за день значение с учетом старых записей без value,
+// где выполнение хранилось только флагом done.
+func (hh HabitHistory) Progress(target int) int {
+	if hh.Value == 0 && hh.Done {
+		return target
+	}
+	return hh.Value
 }
 
 type History struct {
@@ -99,6 +262,175 @@ type History struct {
 	Habits     []HabitHistory     `bson:"habits" json:"habits"`
 }
 
+// StreakFreeze - заморозка стрика, купленная за WILL. Расходуется автоматически,
+// когда пользователь пропускает запланированный день привычки.
+type StreakFreeze struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID  int64               `bson:"telegram_id" json:"telegram_id"`
+	PurchaseID  primitive.ObjectID  `bson:"purchase_id,omitempty" json:"purchase_id,omitempty"` // Покупка, в которой получена заморозка (ссылка из журнала WILL)
+	Price       int                 `bson:"price" json:"price"`
+	PurchasedAt time.Time           `bson:"purchased_at" json:"purchased_at"`
+	UsedAt      *time.Time          `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	HabitID     *primitive.ObjectID `bson:"habit_id,omitempty" json:"habit_id,omitempty"`         // Привычка, стрик которой сохранен
+	HabitTitle  string              `bson:"habit_title,omitempty" json:"habit_title,omitempty"`   // Название привычки на момент использования
+	CoveredDate string              `bson:"covered_date,omitempty" json:"covered_date,omitempty"` // Пропущенный день (для «N раз в неделю» — последний день недели)
+}
+
+// Причины изменения баланса WILL в журнале
+const (
+	LedgerOpeningBalance   = "opening_balance"   // Баланс, накопленный до появления журнала
+	LedgerAdjustment       = "adjustment"        // Ручная или миграционная корректировка
+	LedgerSignupBonus      = "signup_bonus"      // Приветственный бонус при регистрации
+	LedgerHabitCompletion  = "habit_completion"  // Награда за выполнение привычки
+	LedgerHabitUndo        = "habit_undo"        // Отмена награды за выполнение
+	LedgerReferralReward   = "referral_reward"   // Награда рефереру за выполнение привычки рефералом
+	LedgerReferralUndo     = "referral_undo"     // Отмена награды рефереру
+	LedgerDeposit          = "deposit"           // Пополнение через TON/USDT
+	LedgerWithdrawal       = "withdrawal"        // Вывод средств
+	LedgerWithdrawalRefund = "withdrawal_refund" // Возврат неудавшегося вывода
+	LedgerStakePenalty     = "stake_penalty"     // Списание ставки за пропуск
+	LedgerStakeWin         = "stake_win"         // Выигрыш подписчика из чужой ставки
+	LedgerFreezePurchase   = "freeze_purchase"   // Покупка заморозок стрика
+	LedgerFreezeRefund     = "freeze_refund"     // Возврат за несостоявшуюся покупку заморозок
+	LedgerAIAnalysis       = "ai_analysis"       // Оплата AI-анализа в боте
+	LedgerTransfer         = "transfer"          // Перевод WILL между пользователями в боте
+	LedgerStarsPurchase    = "stars_purchase"    // Покупка WILL за Telegram Stars
+	LedgerPotStake         = "pot_stake"         // Ставка, заблокированная в общем банке
+	LedgerPotRefund        = "pot_refund"        // Возврат ставки из банка (выход до старта, нет победителей)
+	LedgerPotPayout        = "pot_payout"        // Выплата победителю банка: своя ставка и доля проигравших
+	LedgerSystemShare      = "system_share"      // Остаток ставки, не распределенный между пользователями, в системный баланс
+)
+
+// SystemTelegramID - telegram_id записей журнала системного баланса. Они применяются
+// к полю balance документа system_settings в settings, а не к пользователю.
+const SystemTelegramID int64 = 0
+
+// SystemSettingsID - _id документа с системным балансом в коллекции settings
+const SystemSettingsID = "system_settings"
+
+// Типы объектов, на которые ссылается запись журнала
+const (
+	LedgerRefHabit       = "habit"
+	LedgerRefTransaction = "transaction"
+	LedgerRefReferral    = "referral"
+	LedgerRefSettlement  = "stake_settlement"
+	LedgerRefFreeze      = "streak_freeze"
+	LedgerRefUser        = "user"
+	LedgerRefMigration   = "migration"
+	LedgerRefStars       = "stars_payment"
+	LedgerRefPot         = "pot"
+)
+
+// Статусы покупки за Telegram Stars
+const (
+	StarsPaymentPending        = "pending"         // Счет выставлен, оплаты еще не было
+	StarsPaymentPaidUncredited = "paid_uncredited" // Получен successful_payment, WILL еще не начислены
+	StarsPaymentPaid           = "paid"            // WILL начислены
+)
+
+// StarsPayment - покупка WILL за Telegram Stars. Payload уникален для каждого счета
+// и приходит обратно в pre_checkout_query и successful_payment.
+type StarsPayment struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID       int64              `bson:"telegram_id" json:"telegram_id"`
+	Payload          string             `bson:"payload" json:"payload"`
+	Stars            int                `bson:"stars" json:"stars"`
+	WillAmount       int                `bson:"will_amount" json:"will_amount"`
+	Status           string             `bson:"status" json:"status"`
+	TelegramChargeID string             `bson:"telegram_charge_id,omitempty" json:"telegram_charge_id,omitempty"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	PaidAt           *time.Time         `bson:"paid_at,omitempty" json:"paid_at,omitempty"`
+}
+
+// Направления котировки обмена WILL
+const (
+	QuoteDeposit  = "deposit"  // Пользователь платит криптовалютой и получает WILL
+	QuoteWithdraw = "withdraw" // Пользователь выводит WILL в криптовалюту
+)
+
+// Quote - котировка обмена WILL на криптовалюту, рассчитанная сервером. Депозит и вывод создаются
+// только по действующей котировке и используют ее суммы, а не присланные клиентом.
+type Quote struct {
+	ID            primitive.ObjectID `bson:"_id" json:"-"`
+	TelegramID    int64              `bson:"telegram_id" json:"telegram_id"`
+	Direction     string             `bson:"direction" json:"direction"`
+	Currency      string             `bson:"currency" json:"currency"`
+	WillAmount    int                `bson:"will_amount" json:"will_amount"`
+	Amount        float64            `bson:"amount" json:"amount"` // Сумма в валюте: к оплате для депозита, к выводу до комиссии для вывода
+	Fee           float64            `bson:"fee" json:"fee"`       // Комиссия в валюте, удерживается из Amount при выводе
+	Rate          int                `bson:"rate" json:"rate"`     // WILL за единицу валюты
+	ExpiresAt     time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt        *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	TransactionID string             `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// LedgerEntry - запись журнала WILL. Журнал только дополняется: баланс пользователя (users.balance) —
+// сумма Amount всех его записей. IdempotencyKey уникален, поэтому повторная проводка одной операции ничего не меняет.
+type LedgerEntry struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID     int64              `bson:"telegram_id" json:"telegram_id"`
+	Amount         int                `bson:"amount" json:"amount"` // Положительное — начисление, отрицательное — списание
+	Reason         string             `bson:"reason" json:"reason"`
+	RefType        string             `bson:"ref_type,omitempty" json:"ref_type,omitempty"`
+	RefID          string             `bson:"ref_id,omitempty" json:"ref_id,omitempty"`
+	IdempotencyKey string             `bson:"idempotency_key" json:"-"`
+	RewardDate     string             `bson:"reward_date,omitempty" json:"reward_date,omitempty"`   // День выполнения привычки для наград за выполнение
+	RuleVersion    int                `bson:"rule_version,omitempty" json:"rule_version,omitempty"` // Версия правил наград, по которым рассчитана сумма
+	Applied        bool               `bson:"applied" json:"-"`                                     // Запись применена к users.balance; у записей до появления флага поля нет
+	CheckBalance   bool               `bson:"check_balance,omitempty" json:"-"`                     // Проведена через Spend: при доприменении снова проверяется остаток
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// RewardRulesID - _id документа с правилами наград в коллекции settings
+const RewardRulesID = "reward_rules"
+
+// StreakMultiplier - множитель награды, действующий начиная со стрика MinStreak
+type StreakMultiplier struct {
+	MinStreak  int     `bson:"min_streak" json:"min_streak"`
+	Multiplier float64 `bson:"multiplier" json:"multiplier"`
+}
+
+// BonusPeriod - период (даты включительно, YYYY-MM-DD), в который награда за выполнение умножается
+type BonusPeriod struct {
+	StartDate  string  `bson:"start_date" json:"start_date"`
+	EndDate    string  `bson:"end_date" json:"end_date"`
+	Multiplier float64 `bson:"multiplier" json:"multiplier"`
+}
+
+// RewardRules - правила начисления WILL за регистрацию и выполнение привычек.
+// Хранятся в settings под _id RewardRulesID; Version записывается в каждую проводку по этим правилам.
+type RewardRules struct {
+	ID                string             `bson:"_id" json:"-"`
+	Version           int                `bson:"version" json:"version"`
+	SignupBonus       int                `bson:"signup_bonus" json:"signup_bonus"`
+	CompletionReward  int                `bson:"completion_reward" json:"completion_reward"`
+	ReferralReward    int                `bson:"referral_reward" json:"referral_reward"`
+	ReferralDays      int                `bson:"referral_days" json:"referral_days"` // Сколько дней после регистрации реферала платится доля рефереру, 0 — без ограничения
+	DailyCap          int                `bson:"daily_cap" json:"daily_cap"`         // Максимум WILL за выполнения в день, 0 — без ограничения
+	StreakMultipliers []StreakMultiplier `bson:"streak_multipliers" json:"streak_multipliers"`
+	BonusPeriods      []BonusPeriod      `bson:"bonus_periods" json:"bonus_periods"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// JettonRegistryID - _id документа с реестром принимаемых jetton в коллекции settings
+const JettonRegistryID = "jettons"
+
+// JettonConfig - jetton, который принимается в депозитах и выплачивается в выводах
+type JettonConfig struct {
+	Symbol        string `bson:"symbol" json:"symbol"`                 // Код валюты в котировках и транзакциях, например usdt
+	MasterAddress string `bson:"master_address" json:"master_address"` // Адрес мастер-контракта jetton
+	Decimals      int    `bson:"decimals" json:"decimals"`
+	WillRate      int    `bson:"will_rate" json:"will_rate"` // WILL за одну единицу jetton
+}
+
+// JettonRegistry - реестр принимаемых jetton. Хранится в settings под _id JettonRegistryID.
+type JettonRegistry struct {
+	ID        string         `bson:"_id" json:"-"`
+	Jettons   []JettonConfig `bson:"jettons" json:"jettons"`
+	UpdatedAt time.Time      `bson:"updated_at" json:"updated_at"`
+}
+
 type User struct {
 	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
 	TelegramID           int64              `bson:"telegram_id" json:"telegram_id"`
@@ -111,9 +443,29 @@ type User struct {
 	Balance              int                `bson:"balance" json:"balance"`
 	LastVisit            string             `bson:"last_visit" json:"last_visit"`
 	Timezone             string             `bson:"timezone" json:"timezone"`
+	TimezoneChangedAt    *time.Time         `bson:"timezone_changed_at,omitempty" json:"timezone_changed_at,omitempty"`
 	NotificationsEnabled bool               `bson:"notifications_enabled" json:"notifications_enabled"`
 	NotificationTime     string             `bson:"notification_time" json:"notification_time"`
 	OnboardingVersion    int                `bson:"onboarding_version" json:"onboarding_version"`
+	Wallets              []LinkedWallet     `bson:"wallets,omitempty" json:"wallets,omitempty"` // Кошельки, владение которыми подтверждено ton_proof
+}
+
+// LinkedWallet - кошелек TON, привязанный к пользователю после проверки подписи TON Connect ton_proof.
+// На привязанные кошельки разрешены выводы, переводы с них зачисляются и без комментария.
+type LinkedWallet struct {
+	Address   string    `bson:"address" json:"address"`       // Адрес в raw-формате 0:<hex>
+	PublicKey string    `bson:"public_key" json:"public_key"` // Публичный ключ кошелька (hex)
+	LinkedAt  time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// TimezoneChange - запись аудита смены часового пояса пользователя
+type TimezoneChange struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	TelegramID     int64              `bson:"telegram_id" json:"telegram_id"`
+	From           string             `bson:"from" json:"from"`
+	To             string             `bson:"to" json:"to"`
+	ClientTimezone string             `bson:"client_timezone" json:"client_timezone"` // X-Timezone, с которым пришел запрос
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
 }
 
 type UserResponseWithHabits struct {
@@ -128,6 +480,8 @@ type UserResponseWithHabits struct {
 	Balance              int                `json:"balance"`
 	LastVisit            string             `json:"last_visit"`
 	Timezone             string             `json:"timezone"`
+	TimezoneChangedAt    *time.Time         `json:"timezone_changed_at,omitempty"`
+	ClientTimezone       string             `json:"client_timezone,omitempty"` // Пояс устройства, если он отличается от сохраненного
 	NotificationsEnabled bool               `json:"notifications_enabled"`
 	NotificationTime     string             `json:"notification_time"`
 	OnboardingVersion    int                `json:"onboarding_version"`
@@ -147,6 +501,7 @@ func (u *User) ToResponseWithHabits(habitResponses []HabitResponse) UserResponse
 		Balance:              u.Balance,
 		LastVisit:            u.LastVisit,
 		Timezone:             u.Timezone,
+		TimezoneChangedAt:    u.TimezoneChangedAt,
 		NotificationsEnabled: u.NotificationsEnabled,
 		NotificationTime:     u.NotificationTime,
 		OnboardingVersion:    u.OnboardingVersion,
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"net/http"
+
 	"backend/handlers/follower"
+	"backend/handlers/freeze"
 	"backend/handlers/habit"
 	"backend/handlers/invoice"
 	"backend/handlers/ping"
+	"backend/handlers/pot"
+	"backend/handlers/tag"
 	"backend/handlers/ton"
 	"backend/handlers/user"
 	"backend/middleware"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func setupGinRouter(
@@ -19,7 +25,12 @@ func setupGinRouter(
 	followerHandler *follower.Handler,
 	tonHandler *ton.TonHandler,
 	pingHandler *ping.Handler,
+	freezeHandler *freeze.Handler,
+	tagHandler *tag.Handler,
+	potHandler *pot.Handler,
 	botToken string,
+	usersCollection *mongo.Collection,
+	botUpdatesHandler http.HandlerFunc,
 ) *gin.Engine {
 	// Создаем роутер без middleware
 	r := gin.New()
@@ -28,8 +39,14 @@ func setupGinRouter(
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 
-	// Применяем middleware аутентификации
-	r.Use(middleware.AuthMiddleware(botToken))
+	// Обновления бота защищены секретом в заголовке, а не данными Mini App,
+	// поэтому маршрут регистрируется до middleware аутентификации
+	if botUpdatesHandler != nil {
+		r.POST("/telegram/updates", gin.WrapF(botUpdatesHandler))
+	}
+
+	// Применяем middleware аутентификации; часовой пояс пользователя берется из users
+	r.Use(middleware.AuthMiddleware(botToken, usersCollection))
 
 	// Группа API
 	api := r.Group("/api")
@@ -43,6 +60,7 @@ func setupGinRouter(
 			userGroup.GET("/settings", userHandler.HandleSettings)
 			userGroup.PUT("/settings", userHandler.HandleSettings)
 			userGroup.GET("/profile", userHandler.HandleUserProfile)
+			userGroup.PUT("/timezone", userHandler.HandleChangeTimezone)
 		}
 
 		// Маршруты лидерборда
@@ -59,9 +77,14 @@ func setupGinRouter(
 			habitGroup.PUT("/edit", habitHandler.HandleEdit)
 			habitGroup.DELETE("/delete", habitHandler.HandleDelete)
 			habitGroup.PUT("/undo", habitHandler.HandleUndo)
+			habitGroup.PUT("/backfill", habitHandler.HandleBackfill)
+			habitGroup.PUT("/note", habitHandler.HandleNote)
 			habitGroup.PUT("/archive", habitHandler.HandleArchive)
 			habitGroup.PUT("/unarchive", habitHandler.HandleUnarchive)
 			habitGroup.GET("/archived", habitHandler.HandleListArchived)
+			habitGroup.GET("/one-time", habitHandler.HandleListOneTime)
+			habitGroup.PUT("/reorder", habitHandler.HandleReorder)
+			habitGroup.PUT("/checklist/toggle", habitHandler.HandleChecklistToggle)
 			habitGroup.POST("/join", habitHandler.HandleJoin)
 			habitGroup.GET("/followers", habitHandler.HandleGetFollowers)
 			habitGroup.GET("/activity", habitHandler.HandleGetActivity)
@@ -69,14 +92,46 @@ func setupGinRouter(
 			habitGroup.POST("/subscribe", habitHandler.HandleSubscribeToFollower)
 		}
 
+		// Маршруты тегов
+		tagGroup := api.Group("/tags")
+		{
+			tagGroup.GET("", tagHandler.HandleList)
+			tagGroup.POST("/create", tagHandler.HandleCreate)
+			tagGroup.PUT("/edit", tagHandler.HandleEdit)
+			tagGroup.DELETE("/delete", tagHandler.HandleDelete)
+		}
+
+		// Маршруты общих банков
+		potGroup := api.Group("/pots")
+		{
+			potGroup.GET("", potHandler.HandleList)
+			potGroup.GET("/status", potHandler.HandleStatus)
+			potGroup.POST("/create", potHandler.HandleCreate)
+			potGroup.POST("/join", potHandler.HandleJoin)
+			potGroup.POST("/leave", potHandler.HandleLeave)
+		}
+
+		// Маршруты заморозок стрика
+		freezeGroup := api.Group("/freeze")
+		{
+			freezeGroup.GET("", freezeHandler.HandleList)
+			freezeGroup.POST("/buy", freezeHandler.HandleBuy)
+		}
+
 		// Маршруты TON
 		tonGroup := api.Group("/ton")
 		{
-			// tonGroup.POST("/deposit", tonHandler.HandleDeposit)
-			// tonGroup.GET("/transaction", tonHandler.HandleCheckTransaction)
-			tonGroup.POST("/usdt-deposit", tonHandler.HandleUsdtDeposit)
+			tonGroup.POST("/deposit", tonHandler.HandleDeposit)
+			tonGroup.POST("/quote", tonHandler.HandleQuote)
+			tonGroup.POST("/jetton-deposit", tonHandler.HandleJettonDeposit)
 			tonGroup.POST("/check-usdt-transaction", tonHandler.HandleCheckUsdtTransaction)
 			tonGroup.POST("/withdraw", tonHandler.HandleWithdraw)
+			tonGroup.GET("/transactions", tonHandler.HandleListTransactions)
+			tonGroup.GET("/transactions/detail", tonHandler.HandleGetTransaction)
+			tonGroup.POST("/proof/payload", tonHandler.HandleProofPayload)
+			tonGroup.GET("/wallets", tonHandler.HandleListWallets)
+			tonGroup.POST("/wallets", tonHandler.HandleLinkWallet)
+			tonGroup.DELETE("/wallets", tonHandler.HandleUnlinkWallet)
 		}
 
 		// Маршруты пингов
@@ -90,6 +145,15 @@ func setupGinRouter(
 		{
 			invoiceGroup.GET("", invoiceHandler.HandleCreateInvoice)
 		}
+
+		// Административные маршруты: доступны только пользователям из ADMIN_IDS
+		adminGroup := api.Group("/admin", middleware.AdminMiddleware())
+		{
+			adminGroup.GET("/withdrawals", tonHandler.HandleListPendingApprovals)
+			adminGroup.POST("/withdrawals/approve", tonHandler.HandleApproveWithdrawal)
+			adminGroup.POST("/withdrawals/reject", tonHandler.HandleRejectWithdrawal)
+			adminGroup.GET("/deposits/unmatched", tonHandler.HandleListUnmatchedDeposits)
+		}
 	}
 
 	return r
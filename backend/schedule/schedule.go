@@ -0,0 +1,221 @@
+package schedule
+
+import (
+	"backend/models"
+	"fmt"
+	"time"
+)
+
+// DateLayout - формат дат, в котором хранятся дни в истории и в привычках
+const DateLayout = "2006-01-02"
+
+// maxLookback ограничивает поиск предыдущей даты по расписанию (чуть больше года)
+const maxLookback = 400
+
+// Weekday возвращает день недели в нумерации приложения: 0 — понедельник, 6 — воскресенье.
+func Weekday(t time.Time) int {
+	weekday := int(t.Weekday())
+	if weekday == 0 {
+		return 6
+	}
+	return weekday - 1
+}
+
+// Day приводит время к началу календарного дня в его часовом поясе.
+func Day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Rule возвращает правило повторения привычки. Для старых привычек без правила
+// используется повторение по дням недели из Habit.Days.
+func Rule(habit models.Habit) models.Recurrence {
+	if habit.Recurrence == nil || habit.Recurrence.Type == "" {
+		rule := models.Recurrence{Type: models.RecurrenceWeekdays}
+		if habit.Recurrence != nil {
+			rule.ExcludeDates = habit.Recurrence.ExcludeDates
+		}
+		return rule
+	}
+	return *habit.Recurrence
+}
+
+// Validate проверяет корректность расписания привычки.
+func Validate(habit models.Habit) error {
+	for _, day := range habit.Days {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("некорректный день недели: %d", day)
+		}
+	}
+
+	if habit.DueDate != "" {
+		if !habit.IsOneTime {
+			return fmt.Errorf("due_date доступен только для разовых задач")
+		}
+		if _, err := time.Parse(DateLayout, habit.DueDate); err != nil {
+			return fmt.Errorf("некорректный срок: %s", habit.DueDate)
+		}
+	}
+	if habit.IsOneTime && habit.IsAuto {
+		return fmt.Errorf("разовая задача не может быть автоматической")
+	}
+
+	rule := Rule(habit)
+	for _, date := range rule.ExcludeDates {
+		if _, err := time.Parse(DateLayout, date); err != nil {
+			return fmt.Errorf("некорректная дата исключения: %s", date)
+		}
+	}
+
+	switch rule.Type {
+	case models.RecurrenceWeekdays:
+		return nil
+	case models.RecurrenceTimesPerWeek:
+		if rule.TimesPerWeek < 1 || rule.TimesPerWeek > 7 {
+			return fmt.Errorf("times_per_week должен быть от 1 до 7")
+		}
+	case models.RecurrenceEveryNDays:
+		if rule.Interval < 1 {
+			return fmt.Errorf("interval должен быть положительным")
+		}
+		if rule.StartDate != "" {
+			if _, err := time.Parse(DateLayout, rule.StartDate); err != nil {
+				return fmt.Errorf("некорректная дата начала: %s", rule.StartDate)
+			}
+		}
+	case models.RecurrenceMonthDays:
+		if len(rule.MonthDays) == 0 {
+			return fmt.Errorf("month_days не может быть пустым")
+		}
+		for _, day := range rule.MonthDays {
+			if day < 1 || day > 31 {
+				return fmt.Errorf("некорректное число месяца: %d", day)
+			}
+		}
+	default:
+		return fmt.Errorf("неизвестный тип повторения: %s", rule.Type)
+	}
+	return nil
+}
+
+// IsDue отвечает, запланирована ли привычка на календарный день date
+// (день определяется в часовом поясе date).
+func IsDue(habit models.Habit, date time.Time) bool {
+	// Разовая задача показывается каждый день, пока не выполнена: после выполнения она уходит в архив
+	if habit.IsOneTime {
+		return true
+	}
+
+	date = Day(date)
+	rule := Rule(habit)
+
+	dateStr := date.Format(DateLayout)
+	for _, excluded := range rule.ExcludeDates {
+		if excluded == dateStr {
+			return false
+		}
+	}
+
+	switch rule.Type {
+	case models.RecurrenceWeekdays:
+		return containsInt(habit.Days, Weekday(date))
+	case models.RecurrenceTimesPerWeek:
+		// Выполнять можно в любой день недели, норма проверяется по неделе целиком
+		return true
+	case models.RecurrenceEveryNDays:
+		if rule.Interval < 1 {
+			return false
+		}
+		diff := daysBetween(startDate(habit, rule, date.Location()), date)
+		return diff >= 0 && diff%rule.Interval == 0
+	case models.RecurrenceMonthDays:
+		lastDay := time.Date(date.Year(), date.Month()+1, 0, 0, 0, 0, 0, date.Location()).Day()
+		for _, day := range rule.MonthDays {
+			// Числа, которых нет в коротком месяце, переносятся на его последний день
+			if day == date.Day() || (day > lastDay && date.Day() == lastDay) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// IsOverdue отвечает, просрочена ли разовая задача на календарный день date.
+func IsOverdue(habit models.Habit, date time.Time) bool {
+	if !habit.IsOneTime || habit.DueDate == "" || habit.LastClickDate != "" {
+		return false
+	}
+	return Day(date).Format(DateLayout) > habit.DueDate
+}
+
+// PrevDueDate возвращает последний день строго раньше date, на который была запланирована привычка.
+// Второе значение равно false, если такого дня нет в пределах года.
+func PrevDueDate(habit models.Habit, date time.Time) (time.Time, bool) {
+	day := Day(date)
+	for i := 1; i <= maxLookback; i++ {
+		candidate := day.AddDate(0, 0, -i)
+		if IsDue(habit, candidate) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Quota возвращает число выполненных дней, необходимое в одном периоде оценки.
+func Quota(habit models.Habit) int {
+	rule := Rule(habit)
+	if rule.Type == models.RecurrenceTimesPerWeek {
+		return rule.TimesPerWeek
+	}
+	return 1
+}
+
+// Window возвращает период оценки, в который попадает date: для привычек «N раз в неделю»
+// это неделя с понедельника по воскресенье, для остальных — сам день.
+func Window(habit models.Habit, date time.Time) (start, end time.Time) {
+	day := Day(date)
+	if Rule(habit).Type == models.RecurrenceTimesPerWeek {
+		start = day.AddDate(0, 0, -Weekday(day))
+		return start, start.AddDate(0, 0, 6)
+	}
+	return day, day
+}
+
+// PrevWindow возвращает предыдущий период оценки перед тем, в который попадает date.
+// Для дневных правил это предыдущий день по расписанию.
+func PrevWindow(habit models.Habit, date time.Time) (start, end time.Time, ok bool) {
+	if Rule(habit).Type == models.RecurrenceTimesPerWeek {
+		currentStart, _ := Window(habit, date)
+		start, end = Window(habit, currentStart.AddDate(0, 0, -1))
+		return start, end, true
+	}
+	prev, ok := PrevDueDate(habit, date)
+	return prev, prev, ok
+}
+
+// startDate возвращает точку отсчета для правила every_n_days.
+func startDate(habit models.Habit, rule models.Recurrence, loc *time.Location) time.Time {
+	if rule.StartDate != "" {
+		if start, err := time.ParseInLocation(DateLayout, rule.StartDate, loc); err == nil {
+			return start
+		}
+	}
+	return Day(habit.CreatedAt.In(loc))
+}
+
+// daysBetween возвращает количество календарных дней от from до to.
+func daysBetween(from, to time.Time) int {
+	fromUTC := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toUTC := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toUTC.Sub(fromUTC).Hours() / 24)
+}
+
+func containsInt(arr []int, val int) bool {
+	for _, a := range arr {
+		if a == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"backend/models"
+)
+
+// date разбирает день в формате DateLayout в UTC
+func date(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(DateLayout, value)
+	if err != nil {
+		t.Fatalf("Некорректная дата %s: %v", value, err)
+	}
+	return parsed
+}
+
+func TestIsDue(t *testing.T) {
+	created := time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC) // понедельник
+	tests := []struct {
+		name  string
+		habit models.Habit
+		date  string
+		due   bool
+	}{
+		{"старая привычка по дням недели", models.Habit{Days: []int{0, 2}}, "2024-01-03", true},
+		{"старая привычка в другой день", models.Habit{Days: []int{0, 2}}, "2024-01-02", false},
+		{"воскресенье - шестой день", models.Habit{Days: []int{6}}, "2024-01-07", true},
+		{"исключенная дата", models.Habit{Days: []int{0}, Recurrence: &models.Recurrence{ExcludeDates: []string{"2024-01-08"}}}, "2024-01-08", false},
+		{"N раз в неделю - любой день", models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 3}}, "2024-01-05", true},
+		{"каждые 3 дня от создания", models.Habit{CreatedAt: created, Recurrence: &models.Recurrence{Type: models.RecurrenceEveryNDays, Interval: 3}}, "2024-01-07", true},
+		{"каждые 3 дня между повторами", models.Habit{CreatedAt: created, Recurrence: &models.Recurrence{Type: models.RecurrenceEveryNDays, Interval: 3}}, "2024-01-06", false},
+		{"каждые 2 дня от даты начала", models.Habit{CreatedAt: created, Recurrence: &models.Recurrence{Type: models.RecurrenceEveryNDays, Interval: 2, StartDate: "2024-01-02"}}, "2024-01-04", true},
+		{"каждые 2 дня до даты начала", models.Habit{CreatedAt: created, Recurrence: &models.Recurrence{Type: models.RecurrenceEveryNDays, Interval: 2, StartDate: "2024-01-10"}}, "2024-01-08", false},
+		{"число месяца", models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceMonthDays, MonthDays: []int{15}}}, "2024-03-15", true},
+		{"31 число переносится на конец февраля", models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceMonthDays, MonthDays: []int{31}}}, "2024-02-29", true},
+		{"31 число в длинном месяце не переносится", models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceMonthDays, MonthDays: []int{31}}}, "2024-03-30", false},
+		{"разовая задача каждый день", models.Habit{IsOneTime: true}, "2024-01-02", true},
+	}
+	for _, tt := range tests {
+		if got := IsDue(tt.habit, date(t, tt.date)); got != tt.due {
+			t.Errorf("%s: IsDue(%s) = %v, ожидалось %v", tt.name, tt.date, got, tt.due)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	weekly := models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 2}}
+	daily := models.Habit{Days: []int{0, 1, 2, 3, 4, 5, 6}}
+	tests := []struct {
+		name       string
+		habit      models.Habit
+		date       string
+		start, end string
+	}{
+		{"неделя с середины", weekly, "2024-01-10", "2024-01-08", "2024-01-14"},
+		{"неделя с понедельника", weekly, "2024-01-08", "2024-01-08", "2024-01-14"},
+		{"неделя с воскресенья", weekly, "2024-01-14", "2024-01-08", "2024-01-14"},
+		{"дневное правило", daily, "2024-01-10", "2024-01-10", "2024-01-10"},
+	}
+	for _, tt := range tests {
+		start, end := Window(tt.habit, date(t, tt.date))
+		if start.Format(DateLayout) != tt.start || end.Format(DateLayout) != tt.end {
+			t.Errorf("%s: Window(%s) = %s..%s, ожидалось %s..%s", tt.name, tt.date,
+				start.Format(DateLayout), end.Format(DateLayout), tt.start, tt.end)
+		}
+	}
+}
+
+func TestPrevWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		habit      models.Habit
+		date       string
+		start, end string
+		ok         bool
+	}{
+		{"предыдущая неделя", models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 2}}, "2024-01-10", "2024-01-01", "2024-01-07", true},
+		{"предыдущий день по расписанию", models.Habit{Days: []int{0, 4}}, "2024-01-10", "2024-01-08", "2024-01-08", true},
+		{"дни недели без расписания", models.Habit{}, "2024-01-10", "", "", false},
+	}
+	for _, tt := range tests {
+		start, end, ok := PrevWindow(tt.habit, date(t, tt.date))
+		if ok != tt.ok {
+			t.Errorf("%s: PrevWindow(%s) найден = %v, ожидалось %v", tt.name, tt.date, ok, tt.ok)
+			continue
+		}
+		if ok && (start.Format(DateLayout) != tt.start || end.Format(DateLayout) != tt.end) {
+			t.Errorf("%s: PrevWindow(%s) = %s..%s, ожидалось %s..%s", tt.name, tt.date,
+				start.Format(DateLayout), end.Format(DateLayout), tt.start, tt.end)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		habit models.Habit
+		quota int
+	}{
+		{models.Habit{Days: []int{0}}, 1},
+		{models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 4}}, 4},
+		{models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceEveryNDays, Interval: 2}}, 1},
+	}
+	for _, tt := range tests {
+		if got := Quota(tt.habit); got != tt.quota {
+			t.Errorf("Quota(%+v) = %d, ожидалось %d", tt.habit.Recurrence, got, tt.quota)
+		}
+	}
+}
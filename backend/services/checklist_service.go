@@ -0,0 +1,109 @@
+package services
+
+import (
+	"backend/models"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ограничения чек-листа привычки
+const (
+	maxChecklistItems     = 20
+	maxChecklistItemTitle = 100
+)
+
+// PrepareChecklist проверяет чек-лист привычки и выдает ID новым пунктам.
+// Пункты, пришедшие с ID, сохраняют его, чтобы отметки в истории не потерялись при редактировании.
+func PrepareChecklist(habit *models.Habit) error {
+	if len(habit.Checklist) == 0 {
+		if habit.ChecklistThreshold != 0 {
+			return fmt.Errorf("checklist_threshold задается только вместе с чек-листом")
+		}
+		return nil
+	}
+	if len(habit.Checklist) > maxChecklistItems {
+		return fmt.Errorf("в чек-листе не может быть больше %d пунктов", maxChecklistItems)
+	}
+	if habit.Target > 1 {
+		return fmt.Errorf("привычка с чек-листом не может иметь числовую цель")
+	}
+	if habit.ChecklistThreshold < 0 || habit.ChecklistThreshold > len(habit.Checklist) {
+		return fmt.Errorf("checklist_threshold должен быть от 0 до %d", len(habit.Checklist))
+	}
+
+	seen := make(map[primitive.ObjectID]bool)
+	for i := range habit.Checklist {
+		item := &habit.Checklist[i]
+		item.Title = strings.TrimSpace(item.Title)
+		if item.Title == "" {
+			return fmt.Errorf("название пункта чек-листа обязательно")
+		}
+		if utf8.RuneCountInString(item.Title) > maxChecklistItemTitle {
+			return fmt.Errorf("название пункта чек-листа слишком длинное")
+		}
+		if item.ID.IsZero() || seen[item.ID] {
+			item.ID = primitive.NewObjectID()
+		}
+		seen[item.ID] = true
+	}
+	return nil
+}
+
+// ChecklistItemIDs возвращает ID всех пунктов чек-листа по порядку.
+func ChecklistItemIDs(habit models.Habit) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(habit.Checklist))
+	for _, item := range habit.Checklist {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+// ChecklistDone отвечает, выполнена ли привычка по отмеченным пунктам: набран порог
+// checklist_threshold, а если порог не задан — отмечены все обязательные пункты.
+func ChecklistDone(habit models.Habit, ticked []primitive.ObjectID) bool {
+	return ChecklistFraction(habit, ticked) >= 1
+}
+
+// ChecklistFraction возвращает долю выполнения чек-листа (от 0 до 1).
+func ChecklistFraction(habit models.Habit, ticked []primitive.ObjectID) float64 {
+	if len(habit.Checklist) == 0 {
+		return 0
+	}
+
+	tickedSet := make(map[primitive.ObjectID]bool, len(ticked))
+	for _, id := range ticked {
+		tickedSet[id] = true
+	}
+
+	tickedCount, required, requiredTicked := 0, 0, 0
+	for _, item := range habit.Checklist {
+		if tickedSet[item.ID] {
+			tickedCount++
+		}
+		if !item.Optional {
+			required++
+			if tickedSet[item.ID] {
+				requiredTicked++
+			}
+		}
+	}
+
+	if habit.ChecklistThreshold > 0 {
+		return minFraction(float64(tickedCount) / float64(habit.ChecklistThreshold))
+	}
+	if required == 0 {
+		// Все пункты необязательные — достаточно любого одного
+		return minFraction(float64(tickedCount))
+	}
+	return float64(requiredTicked) / float64(required)
+}
+
+func minFraction(fraction float64) float64 {
+	if fraction > 1 {
+		return 1
+	}
+	return fraction
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureFreezeIndexes создает уникальный индекс закрытых заморозками дней: один пропуск привычки
+// закрывается одной заморозкой, даже если ApplyStreakFreezes выполняется параллельно.
+func EnsureFreezeIndexes(ctx context.Context, freezesCollection *mongo.Collection) error {
+	_, err := freezesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "habit_id", Value: 1}, {Key: "covered_date", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"covered_date": bson.M{"$exists": true},
+		}),
+	})
+	return err
+}
+
+// ApplyStreakFreezes закрывает заморозками пропущенные периоды привычки перед текущим, если без них
+// стрик оборвался бы. Заморозки тратятся, только если их хватает на все пропуски подряд — иначе стрик
+// все равно будет потерян. Возвращает количество использованных заморозок.
+func ApplyStreakFreezes(ctx context.Context, freezesCollection, historyCollection *mongo.Collection, habit models.Habit, now time.Time) (int, error) {
+	if habit.IsOneTime {
+		return 0, nil
+	}
+
+	available, err := freezesCollection.CountDocuments(ctx, bson.M{"telegram_id": habit.TelegramID, "used_at": nil})
+	if err != nil || available == 0 {
+		return 0, err
+	}
+
+	dates, frozen, err := habitDays(ctx, historyCollection, habit)
+	if err != nil || len(dates) == 0 {
+		return 0, err
+	}
+
+	// Идем по прошедшим периодам назад до последнего выполненного и собираем пропуски
+	earliest := minDate(dates)
+	today := now.Format(schedule.DateLayout)
+	quota := schedule.Quota(habit)
+	var missed []string
+	chainFound := false
+	start, end, ok := schedule.PrevWindow(habit, now)
+	for ok {
+		// До первого выполнения сохранять нечего
+		if end.Format(schedule.DateLayout) < earliest {
+			break
+		}
+		if countInRange(dates, start, end, today) >= quota || countInRange(frozen, start, end, today) > 0 {
+			chainFound = true
+			break
+		}
+		missed = append(missed, end.Format(schedule.DateLayout))
+		if int64(len(missed)) > available {
+			return 0, nil
+		}
+		start, end, ok = schedule.PrevWindow(habit, start)
+	}
+	if !chainFound || len(missed) == 0 {
+		return 0, nil
+	}
+
+	usedAt := time.Now()
+	used := 0
+	for _, date := range missed {
+		// Берем самую старую неиспользованную заморозку. Уникальный индекс по привычке и дню
+		// не дает параллельному вызову потратить на тот же пропуск вторую заморозку.
+		var freeze models.StreakFreeze
+		err := freezesCollection.FindOneAndUpdate(
+			ctx,
+			bson.M{"telegram_id": habit.TelegramID, "used_at": nil},
+			bson.M{"$set": bson.M{
+				"used_at":      usedAt,
+				"habit_id":     habit.ID,
+				"habit_title":  habit.Title,
+				"covered_date": date,
+			}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "purchased_at", Value: 1}}),
+		).Decode(&freeze)
+		if err == mongo.ErrNoDocuments {
+			// Заморозки закончились параллельно
+			return used, nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			// День уже закрыт параллельным вызовом, заморозка осталась неиспользованной
+			continue
+		}
+		if err != nil {
+			return used, err
+		}
+		used++
+
+		// Отмечаем день в истории, сохраняя частичное значение, если оно было
+		entry, found, err := FindHabitDayEntry(ctx, historyCollection, habit.TelegramID, date, habit.ID)
+		if err != nil {
+			return used, err
+		}
+		if !found {
+			entry = models.HabitHistory{HabitID: habit.ID, Title: habit.Title}
+		}
+		entry.Status = models.HistoryStatusFrozen
+		if err := SetHabitDayEntry(ctx, historyCollection, habit.TelegramID, date, entry); err != nil {
+			return used, err
+		}
+	}
+	return used, nil
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultBackfillWindowDays - за сколько прошедших дней можно исправлять выполнение по умолчанию
+const defaultBackfillWindowDays = 3
+
+// BackfillWindowDays возвращает окно исправления прошлых дней из BACKFILL_WINDOW_DAYS.
+// Дни внутри окна еще могут измениться, поэтому ставки и банки по ним не рассчитываются.
+func BackfillWindowDays() int {
+	if value := os.Getenv("BACKFILL_WINDOW_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err == nil && days >= 0 {
+			return days
+		}
+		log.Printf("Некорректное значение BACKFILL_WINDOW_DAYS=%s, используется %d", value, defaultBackfillWindowDays)
+	}
+	return defaultBackfillWindowDays
+}
+
+// FindHabitDayEntry возвращает запись о привычке из истории пользователя за указанную дату.
+// Второе значение равно false, если записи за этот день нет.
+func FindHabitDayEntry(ctx context.Context, historyCollection *mongo.Collection, telegramID int64, date string, habitID primitive.ObjectID) (models.HabitHistory, bool, error) {
+	var history models.History
+	err := historyCollection.FindOne(ctx, bson.M{
+		"telegram_id":     telegramID,
+		"date":            date,
+		"habits.habit_id": habitID,
+	}).Decode(&history)
+	if err == mongo.ErrNoDocuments {
+		return models.HabitHistory{}, false, nil
+	}
+	if err != nil {
+		return models.HabitHistory{}, false, err
+	}
+
+	for _, entry := range history.Habits {
+		if entry.HabitID == habitID {
+			return entry, true, nil
+		}
+	}
+	return models.HabitHistory{}, false, nil
+}
+
+// SetHabitDayEntry записывает состояние привычки за день: заменяет существующую запись
+// о привычке, добавляет ее в документ дня или создает документ дня, если его еще нет.
+func SetHabitDayEntry(ctx context.Context, historyCollection *mongo.Collection, telegramID int64, date string, entry models.HabitHistory) error {
+	// Запись о привычке уже есть — заменяем ее целиком
+	result, err := historyCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"telegram_id":     telegramID,
+			"date":            date,
+			"habits.habit_id": entry.HabitID,
+		},
+		bson.M{"$set": bson.M{"habits.$": entry}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// Документ дня есть, но привычки в нем нет — добавляем
+	result, err = historyCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"telegram_id": telegramID,
+			"date":        date,
+		},
+		bson.M{"$push": bson.M{"habits": entry}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// Документа дня нет — создаем
+	_, err = historyCollection.InsertOne(ctx, models.History{
+		TelegramID: telegramID,
+		Date:       date,
+		Habits:     []models.HabitHistory{entry},
+	})
+	return err
+}
+
+// RemoveHabitDayEntry удаляет запись о привычке из истории пользователя за указанную дату.
+func RemoveHabitDayEntry(ctx context.Context, historyCollection *mongo.Collection, telegramID int64, date string, habitID primitive.ObjectID) error {
+	_, err := historyCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"telegram_id": telegramID,
+			"date":        date,
+		},
+		bson.M{"$pull": bson.M{"habits": bson.M{"habit_id": habitID}}},
+	)
+	return err
+}
+
+// HabitDayState возвращает накопленное за указанную дату значение привычки и отмеченные пункты чек-листа.
+func HabitDayState(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit, date string) (int, []primitive.ObjectID, error) {
+	entry, found, err := FindHabitDayEntry(ctx, historyCollection, habit.TelegramID, date, habit.ID)
+	if err != nil || !found {
+		return 0, nil, err
+	}
+	return entry.Progress(habit.DailyTarget()), entry.Items, nil
+}
+
+// CountCompletedDays возвращает количество дней в диапазоне [from, to] (даты в формате 2006-01-02),
+// в которые дневная цель привычки была достигнута.
+func CountCompletedDays(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit, from, to string) (int, error) {
+	cursor, err := historyCollection.Find(ctx, bson.M{
+		"telegram_id":     habit.TelegramID,
+		"date":            bson.M{"$gte": from, "$lte": to},
+		"habits.habit_id": habit.ID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	target := habit.DailyTarget()
+	count := 0
+	for cursor.Next(ctx) {
+		var history models.History
+		if err := cursor.Decode(&history); err != nil {
+			continue
+		}
+		for _, entry := range history.Habits {
+			if entry.HabitID == habit.ID && entry.Progress(target) >= target {
+				count++
+				break
+			}
+		}
+	}
+	return count, cursor.Err()
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxJettonDecimals - наибольшая поддерживаемая точность jetton
+const maxJettonDecimals = 18
+
+// DefaultJettonRegistry возвращает реестр, действующий, пока в settings нет документа jettons:
+// USDT с мастер-контрактом из USDT_MASTER_ADDRESS и курсом QUOTE_USDT_WILL_RATE.
+func DefaultJettonRegistry() models.JettonRegistry {
+	registry := models.JettonRegistry{ID: models.JettonRegistryID}
+	if master := os.Getenv("USDT_MASTER_ADDRESS"); master != "" {
+		registry.Jettons = append(registry.Jettons, models.JettonConfig{
+			Symbol:        "usdt",
+			MasterAddress: master,
+			Decimals:      6,
+			WillRate:      quoteInt("QUOTE_USDT_WILL_RATE", defaultQuoteUsdtWillRate),
+		})
+	}
+	return registry
+}
+
+// ValidateJettonRegistry проверяет, что реестр можно применять
+func ValidateJettonRegistry(registry models.JettonRegistry) error {
+	seen := make(map[string]bool)
+	for _, jetton := range registry.Jettons {
+		if jetton.Symbol == "" || jetton.Symbol != strings.ToLower(jetton.Symbol) || jetton.Symbol == "ton" {
+			return fmt.Errorf("некорректный код jetton %q: нужен код в нижнем регистре, отличный от ton", jetton.Symbol)
+		}
+		if seen[jetton.Symbol] {
+			return fmt.Errorf("jetton %s указан дважды", jetton.Symbol)
+		}
+		seen[jetton.Symbol] = true
+
+		if _, err := address.ParseAddr(jetton.MasterAddress); err != nil {
+			return fmt.Errorf("некорректный адрес мастер-контракта %s: %v", jetton.Symbol, err)
+		}
+		if jetton.Decimals < quoteDecimals || jetton.Decimals > maxJettonDecimals {
+			return fmt.Errorf("точность %s должна быть от %d до %d", jetton.Symbol, quoteDecimals, maxJettonDecimals)
+		}
+		if jetton.WillRate <= 0 {
+			return fmt.Errorf("курс %s должен быть положительным", jetton.Symbol)
+		}
+	}
+	return nil
+}
+
+// LoadJettonRegistry читает реестр из settings или возвращает реестр по умолчанию
+func LoadJettonRegistry(ctx context.Context, settingsCollection *mongo.Collection) (models.JettonRegistry, error) {
+	var registry models.JettonRegistry
+	err := settingsCollection.FindOne(ctx, bson.M{"_id": models.JettonRegistryID}).Decode(&registry)
+	if err == mongo.ErrNoDocuments {
+		registry = DefaultJettonRegistry()
+		log.Printf("Реестр jetton не опубликован, используется реестр по умолчанию (jetton: %d)", len(registry.Jettons))
+		return registry, nil
+	}
+	if err != nil {
+		return registry, err
+	}
+	if err := ValidateJettonRegistry(registry); err != nil {
+		return registry, err
+	}
+	return registry, nil
+}
+
+// PublishJettonRegistry сохраняет реестр в settings. Бэкенд применяет его после перезапуска,
+// так как jetton-кошельки казны вычисляются при старте.
+func PublishJettonRegistry(ctx context.Context, settingsCollection *mongo.Collection, registry models.JettonRegistry) (models.JettonRegistry, error) {
+	if err := ValidateJettonRegistry(registry); err != nil {
+		return registry, err
+	}
+	registry.ID = models.JettonRegistryID
+	registry.UpdatedAt = time.Now()
+	_, err := settingsCollection.ReplaceOne(ctx, bson.M{"_id": models.JettonRegistryID}, registry, options.Replace().SetUpsert(true))
+	return registry, err
+}
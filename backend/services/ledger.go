@@ -0,0 +1,410 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInsufficientBalance возвращается, когда на балансе не хватает WILL для списания
+var ErrInsufficientBalance = errors.New("недостаточно WILL на балансе")
+
+// ErrLedgerUserNotFound возвращается при проводке для несуществующего пользователя
+var ErrLedgerUserNotFound = errors.New("пользователь для проводки не найден")
+
+// Сроки восстановления журнала
+const (
+	ledgerPendingAge       = time.Minute // Через сколько неприменённая запись считается брошенной и доприменяется RecoverPending
+	ledgerPendingRetention = time.Hour   // Сколько ID применённой записи хранится в ledger_pending, защищая от повторного применения
+)
+
+// Ledger - журнал WILL. Любое изменение users.balance проходит через него: сначала в журнал
+// добавляется запись с applied = false, затем она применяется к балансу, и запись помечается applied.
+// Если применить запись не удалось, она удаляется. Запись, оставшаяся неприменной после падения процесса,
+// доприменяется повторной проводкой с тем же ключом или RecoverPending, поэтому сумма применённых
+// записей пользователя совпадает с его балансом.
+//
+// Применение защищено от повторов списком ledger_pending в документе пользователя: баланс меняется
+// одним обновлением вместе с добавлением туда ID записи и только если его там еще нет. ID хранится
+// в списке ledgerPendingRetention, чтобы запоздавшая параллельная проводка той же записи не применила
+// ее второй раз, затем RecoverPending убирает его.
+type Ledger struct {
+	ledgerCollection   *mongo.Collection
+	usersCollection    *mongo.Collection
+	settingsCollection *mongo.Collection // Системный баланс: записи с models.SystemTelegramID
+}
+
+func NewLedger(ledgerCollection, usersCollection, settingsCollection *mongo.Collection) *Ledger {
+	return &Ledger{
+		ledgerCollection:   ledgerCollection,
+		usersCollection:    usersCollection,
+		settingsCollection: settingsCollection,
+	}
+}
+
+// balanceOwner возвращает коллекцию и фильтр документа, к балансу которого применяется запись telegramID
+func (l *Ledger) balanceOwner(telegramID int64) (*mongo.Collection, bson.M) {
+	if telegramID == models.SystemTelegramID {
+		return l.settingsCollection, bson.M{"_id": models.SystemSettingsID}
+	}
+	return l.usersCollection, bson.M{"telegram_id": telegramID}
+}
+
+// EnsureIndexes создает уникальный индекс по ключу идемпотентности, индекс для выписки пользователя,
+// индекс для подсчета наград за день и индекс неприменённых записей.
+func (l *Ledger) EnsureIndexes(ctx context.Context) error {
+	_, err := l.ledgerCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "telegram_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "telegram_id", Value: 1}, {Key: "reward_date", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"applied": false}),
+		},
+	})
+	return err
+}
+
+// Post проводит начисление или списание без проверки остатка.
+// Возвращает false, если операция с таким ключом идемпотентности уже проведена.
+func (l *Ledger) Post(ctx context.Context, entry models.LedgerEntry) (bool, error) {
+	return l.apply(ctx, entry, false)
+}
+
+// Spend проводит списание (entry.Amount < 0), только если на балансе хватает WILL,
+// иначе возвращает ErrInsufficientBalance. Возвращает false, если операция уже проведена.
+func (l *Ledger) Spend(ctx context.Context, entry models.LedgerEntry) (bool, error) {
+	if entry.Amount >= 0 {
+		return false, fmt.Errorf("сумма списания должна быть отрицательной: %d", entry.Amount)
+	}
+	return l.apply(ctx, entry, true)
+}
+
+func (l *Ledger) apply(ctx context.Context, entry models.LedgerEntry, checkBalance bool) (bool, error) {
+	if entry.IdempotencyKey == "" {
+		return false, fmt.Errorf("не указан ключ идемпотентности")
+	}
+	if entry.Amount == 0 {
+		return false, nil
+	}
+	entry.ID = primitive.NewObjectID()
+	entry.Applied = false
+	entry.CheckBalance = checkBalance
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	// Ключ идемпотентности уникален: повторная проводка упрется в индекс и баланс не изменит
+	_, err := l.ledgerCollection.InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		// Запись уже есть; если ее не успели применить (падение между шагами), доприменяем.
+		// У записей, сделанных до появления флага, поля applied нет — они применены.
+		var pending models.LedgerEntry
+		err := l.ledgerCollection.FindOne(ctx, bson.M{"idempotency_key": entry.IdempotencyKey, "applied": false}).Decode(&pending)
+		if err == nil {
+			return l.finish(ctx, pending, checkBalance)
+		}
+		if err != mongo.ErrNoDocuments {
+			return false, err
+		}
+		exists, err := l.ledgerCollection.CountDocuments(ctx, bson.M{"idempotency_key": entry.IdempotencyKey})
+		if err != nil {
+			return false, err
+		}
+		if exists == 0 {
+			// Запись только что откатили — повторяем проводку
+			return l.apply(ctx, entry, checkBalance)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return l.finish(ctx, entry, checkBalance)
+}
+
+// finish применяет к балансу записанную, но не применённую запись и помечает ее applied.
+// Повторный вызов для той же записи баланс второй раз не меняет.
+func (l *Ledger) finish(ctx context.Context, entry models.LedgerEntry, checkBalance bool) (bool, error) {
+	owner, ownerFilter := l.balanceOwner(entry.TelegramID)
+	filter := bson.M{"ledger_pending": bson.M{"$ne": entry.ID}}
+	for key, value := range ownerFilter {
+		filter[key] = value
+	}
+	if checkBalance {
+		filter["balance"] = bson.M{"$gte": -entry.Amount}
+	}
+	// Документ системного баланса создается первой записью
+	result, updateErr := owner.UpdateOne(ctx, filter, bson.M{
+		"$inc":      bson.M{"balance": entry.Amount},
+		"$addToSet": bson.M{"ledger_pending": entry.ID},
+	}, options.Update().SetUpsert(entry.TelegramID == models.SystemTelegramID))
+	changed := updateErr == nil && (result.MatchedCount > 0 || result.UpsertedCount > 0)
+	if !changed {
+		// Обновление не прошло или его исход неизвестен: запись могла примениться параллельной
+		// проводкой, восстановлением или этим же обновлением до сетевой ошибки
+		pendingFilter := bson.M{"ledger_pending": entry.ID}
+		for key, value := range ownerFilter {
+			pendingFilter[key] = value
+		}
+		applied, err := owner.CountDocuments(ctx, pendingFilter)
+		if err != nil {
+			// Оставляем запись RecoverPending
+			return false, err
+		}
+		if applied == 0 {
+			err = updateErr
+			if err == nil {
+				err = ErrLedgerUserNotFound
+				if checkBalance {
+					err = ErrInsufficientBalance
+				}
+			}
+			// Запись не применена к балансу — убираем ее, чтобы операцию можно было повторить
+			if _, delErr := l.ledgerCollection.DeleteOne(ctx, bson.M{"_id": entry.ID, "applied": false}); delErr != nil {
+				log.Printf("Не удалось откатить запись журнала %s: %v", entry.IdempotencyKey, delErr)
+			}
+			return false, err
+		}
+		changed = updateErr != nil
+	}
+
+	if _, err := l.ledgerCollection.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": bson.M{"applied": true}}); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// RecoverPending доприменяет записи, которые остались неприменёнными дольше ledgerPendingAge,
+// и убирает из ledger_pending ID применённых записей старше ledgerPendingRetention.
+// Возвращает число доприменённых записей.
+func (l *Ledger) RecoverPending(ctx context.Context) (int, error) {
+	cursor, err := l.ledgerCollection.Find(ctx, bson.M{
+		"applied":    false,
+		"created_at": bson.M{"$lt": time.Now().Add(-ledgerPendingAge)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var entries []models.LedgerEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for _, entry := range entries {
+		// Spend проверяет остаток и при повторе: запись, которую нечем покрыть, удаляется
+		applied, err := l.finish(ctx, entry, entry.CheckBalance)
+		if err != nil {
+			log.Printf("Не удалось доприменить запись журнала %s: %v", entry.IdempotencyKey, err)
+			continue
+		}
+		if applied {
+			recovered++
+			log.Printf("Доприменена запись журнала %s: %d WILL пользователю %d", entry.IdempotencyKey, entry.Amount, entry.TelegramID)
+		}
+	}
+
+	// ObjectID содержит время создания, поэтому старые отметки находятся без чтения журнала
+	expired := primitive.NewObjectIDFromTimestamp(time.Now().Add(-ledgerPendingRetention))
+	for _, owner := range []*mongo.Collection{l.usersCollection, l.settingsCollection} {
+		if err := l.pruneApplied(ctx, owner, expired); err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// pruneApplied убирает из ledger_pending документов owner ID применённых записей, созданных раньше expired
+func (l *Ledger) pruneApplied(ctx context.Context, owner *mongo.Collection, expired primitive.ObjectID) error {
+	cursor, err := owner.Find(ctx,
+		bson.M{"ledger_pending": bson.M{"$lt": expired}},
+		options.Find().SetProjection(bson.M{"ledger_pending": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		ID            interface{}          `bson:"_id"`
+		LedgerPending []primitive.ObjectID `bson:"ledger_pending"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		for _, id := range doc.LedgerPending {
+			if id.Timestamp().After(expired.Timestamp()) {
+				continue
+			}
+			unapplied, err := l.ledgerCollection.CountDocuments(ctx, bson.M{"_id": id, "applied": false})
+			if err != nil || unapplied > 0 {
+				continue
+			}
+			if _, err := owner.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$pull": bson.M{"ledger_pending": id}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Balances возвращает сумму применённых записей журнала по каждому пользователю.
+func (l *Ledger) Balances(ctx context.Context) (map[int64]int, error) {
+	cursor, err := l.ledgerCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"applied": bson.M{"$ne": false}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$telegram_id", "balance": bson.M{"$sum": "$amount"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	balances := make(map[int64]int)
+	for cursor.Next(ctx) {
+		var row struct {
+			TelegramID int64 `bson:"_id"`
+			Balance    int   `bson:"balance"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		balances[row.TelegramID] = row.Balance
+	}
+	return balances, cursor.Err()
+}
+
+// BalanceMismatch - расхождение users.balance с суммой журнала
+type BalanceMismatch struct {
+	TelegramID int64
+	Balance    int // Значение в users.balance
+	Ledger     int // Сумма записей журнала
+}
+
+// Reconcile сверяет users.balance с журналом. При fix = true баланс перезаписывается суммой журнала;
+// запись выполняется только если баланс не изменился с момента чтения. Перед сверкой стоит вызвать
+// RecoverPending, иначе брошенные неприменённые записи не попадут в сумму журнала.
+func (l *Ledger) Reconcile(ctx context.Context, fix bool) ([]BalanceMismatch, error) {
+	balances, err := l.Balances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Пользователи с записью в процессе применения пропускаются: их баланс и журнал сейчас расходятся законно
+	inFlight, err := l.ledgerCollection.Distinct(ctx, "telegram_id", bson.M{"applied": false})
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := l.usersCollection.Find(ctx,
+		bson.M{"telegram_id": bson.M{"$nin": inFlight}},
+		options.Find().SetProjection(bson.M{"telegram_id": 1, "balance": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mismatches []BalanceMismatch
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			log.Printf("Ошибка декодирования пользователя: %v", err)
+			continue
+		}
+		ledgerBalance := balances[user.TelegramID]
+		if ledgerBalance == user.Balance {
+			continue
+		}
+		mismatches = append(mismatches, BalanceMismatch{TelegramID: user.TelegramID, Balance: user.Balance, Ledger: ledgerBalance})
+		if !fix {
+			continue
+		}
+		result, err := l.usersCollection.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "balance": user.Balance},
+			bson.M{"$set": bson.M{"balance": ledgerBalance}},
+		)
+		if err != nil {
+			return mismatches, err
+		}
+		if result.MatchedCount == 0 {
+			log.Printf("Баланс пользователя %d изменился во время сверки, пропускаем", user.TelegramID)
+		}
+	}
+	return mismatches, cursor.Err()
+}
+
+// RecordOpeningBalances фиксирует в журнале баланс, накопленный до его появления: для каждого
+// пользователя, у которого users.balance расходится с журналом, добавляется одна запись opening_balance
+// на разницу. Баланс при этом не меняется. Повторный запуск для того же пользователя ничего не делает.
+func (l *Ledger) RecordOpeningBalances(ctx context.Context) (int, error) {
+	mismatches, err := l.Reconcile(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	for _, mismatch := range mismatches {
+		_, err := l.ledgerCollection.InsertOne(ctx, models.LedgerEntry{
+			TelegramID:     mismatch.TelegramID,
+			Amount:         mismatch.Balance - mismatch.Ledger,
+			Reason:         models.LedgerOpeningBalance,
+			RefType:        models.LedgerRefUser,
+			RefID:          fmt.Sprint(mismatch.TelegramID),
+			IdempotencyKey: fmt.Sprintf("opening:%d", mismatch.TelegramID),
+			Applied:        true,
+			CreatedAt:      time.Now(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			log.Printf("Начальный баланс пользователя %d уже записан, расхождение %d -> %d требует проверки",
+				mismatch.TelegramID, mismatch.Ledger, mismatch.Balance)
+			continue
+		}
+		if err != nil {
+			return recorded, err
+		}
+		recorded++
+	}
+	return recorded, nil
+}
+
+// Count возвращает число записей журнала, подходящих под фильтр.
+func (l *Ledger) Count(ctx context.Context, filter bson.M) (int, error) {
+	count, err := l.ledgerCollection.CountDocuments(ctx, filter)
+	return int(count), err
+}
+
+// Sum возвращает сумму Amount записей журнала, подходящих под фильтр.
+func (l *Ledger) Sum(ctx context.Context, filter bson.M) (int, error) {
+	cursor, err := l.ledgerCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var row struct {
+		Total int `bson:"total"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&row); err != nil {
+			return 0, err
+		}
+	}
+	return row.Total, cursor.Err()
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HabitSort - порядок, в котором привычки отдаются во всех списках: сначала ручная позиция,
+// при равных позициях (старые привычки без позиции) — по дате создания.
+func HabitSort() bson.D {
+	return bson.D{{Key: "position", Value: 1}, {Key: "created_at", Value: 1}}
+}
+
+// NextHabitPosition возвращает позицию для новой привычки пользователя — в конце списка.
+func NextHabitPosition(ctx context.Context, habitsCollection *mongo.Collection, telegramID int64) (int, error) {
+	var last models.Habit
+	err := habitsCollection.FindOne(
+		ctx,
+		bson.M{"telegram_id": telegramID},
+		options.FindOne().SetSort(bson.D{{Key: "position", Value: -1}}),
+	).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return last.Position + 1, nil
+}
+
+// ReorderHabits переставляет привычки пользователя в порядке ids. ids может содержать только часть
+// привычек (например, видимые сегодня): они занимают те же места в общем списке, что и раньше,
+// остальные привычки не сдвигаются. Все позиции записываются одним запросом.
+func ReorderHabits(ctx context.Context, habitsCollection *mongo.Collection, telegramID int64, ids []primitive.ObjectID) error {
+	cursor, err := habitsCollection.Find(
+		ctx,
+		bson.M{"telegram_id": telegramID},
+		options.Find().SetSort(HabitSort()).SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var habits []models.Habit
+	if err := cursor.All(ctx, &habits); err != nil {
+		return err
+	}
+
+	requested := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		if requested[id] {
+			return fmt.Errorf("duplicate habit id: %s", id.Hex())
+		}
+		requested[id] = true
+	}
+
+	owned := 0
+	for _, habit := range habits {
+		if requested[habit.ID] {
+			owned++
+		}
+	}
+	if owned != len(ids) {
+		return fmt.Errorf("habit not found")
+	}
+
+	// Места переставляемых привычек заполняем в новом порядке
+	order := make([]primitive.ObjectID, 0, len(habits))
+	next := 0
+	for _, habit := range habits {
+		if requested[habit.ID] {
+			order = append(order, ids[next])
+			next++
+		} else {
+			order = append(order, habit.ID)
+		}
+	}
+
+	_, err = habitsCollection.UpdateMany(
+		ctx,
+		bson.M{"telegram_id": telegramID, "_id": bson.M{"$in": order}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"position": bson.M{"$indexOfArray": bson.A{order, "$_id"}}}}},
+		},
+	)
+	return err
+}
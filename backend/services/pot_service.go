@@ -0,0 +1,422 @@
+package services
+
+import (
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrPotClosed возвращается при попытке войти в банк или выйти из него после старта
+var ErrPotClosed = errors.New("набор в банк закрыт")
+
+// ErrPotMember возвращается, когда пользователь уже участвует в банке (или еще не участвует — при выходе)
+var ErrPotMember = errors.New("некорректное участие в банке")
+
+// ErrPotNoDueDays возвращается, когда по расписанию привычки в периоде банка нечего выполнять
+var ErrPotNoDueDays = errors.New("в периоде банка нет дней по расписанию привычки")
+
+// PotService блокирует ставки участников общего банка и распределяет их после окончания периода.
+type PotService struct {
+	potsCollection    *mongo.Collection
+	habitsCollection  *mongo.Collection
+	historyCollection *mongo.Collection
+	ledger            *Ledger
+}
+
+func NewPotService(potsCollection, habitsCollection, historyCollection *mongo.Collection, ledger *Ledger) *PotService {
+	return &PotService{
+		potsCollection:    potsCollection,
+		habitsCollection:  habitsCollection,
+		historyCollection: historyCollection,
+		ledger:            ledger,
+	}
+}
+
+// EnsureIndexes создает индексы для поиска банков участника и банков, ожидающих расчета.
+func (s *PotService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.potsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "participants.telegram_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "end_date", Value: 1}}},
+	})
+	return err
+}
+
+// Location возвращает часовой пояс, в котором считаются даты банка.
+func (s *PotService) Location(pot models.Pot) *time.Location {
+	if loc, err := time.LoadLocation(pot.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// EnrollmentOpen отвечает, можно ли еще войти в банк или выйти из него: набор идет до дня старта.
+func (s *PotService) EnrollmentOpen(pot models.Pot, now time.Time) bool {
+	return pot.Status == models.PotOpen && now.In(s.Location(pot)).Format(schedule.DateLayout) < pot.StartDate
+}
+
+// HabitInOpenPot проверяет, участвует ли привычка в банке, который еще не рассчитан. Расписание
+// такой привычки менять нельзя: по нему считается норма участника при расчете банка.
+func (s *PotService) HabitInOpenPot(ctx context.Context, habitID primitive.ObjectID) (bool, error) {
+	count, err := s.potsCollection.CountDocuments(ctx, bson.M{
+		"status":                models.PotOpen,
+		"participants.habit_id": habitID,
+	})
+	return count > 0, err
+}
+
+// potStakeKey - ключ идемпотентности ставки участника. Время входа отличает повторный вход после выхода.
+func potStakeKey(pot models.Pot, participant models.PotParticipant) string {
+	return fmt.Sprintf("pot:%s:%d:%d", pot.ID.Hex(), participant.TelegramID, participant.JoinedAt.UnixNano())
+}
+
+// Enroll блокирует ставку пользователя и добавляет его в банк.
+func (s *PotService) Enroll(ctx context.Context, pot models.Pot, telegramID int64, habitID primitive.ObjectID) (models.PotParticipant, error) {
+	if !s.EnrollmentOpen(pot, time.Now()) {
+		return models.PotParticipant{}, ErrPotClosed
+	}
+	for _, participant := range pot.Participants {
+		if participant.TelegramID == telegramID {
+			return models.PotParticipant{}, ErrPotMember
+		}
+	}
+
+	// Участник без единого дня по расписанию не может ни выиграть, ни проиграть
+	var habit models.Habit
+	if err := s.habitsCollection.FindOne(ctx, bson.M{"_id": habitID}).Decode(&habit); err != nil {
+		return models.PotParticipant{}, err
+	}
+	start, end, err := s.period(pot)
+	if err != nil {
+		return models.PotParticipant{}, err
+	}
+	required := 0
+	for _, window := range potWindows(habit, start, end) {
+		required += window.need
+	}
+	if required == 0 {
+		return models.PotParticipant{}, ErrPotNoDueDays
+	}
+
+	participant := models.PotParticipant{
+		TelegramID: telegramID,
+		HabitID:    habitID,
+		// Храним с точностью Mongo, чтобы ключ ставки совпадал после чтения из базы
+		JoinedAt: time.Now().Truncate(time.Millisecond),
+	}
+	key := potStakeKey(pot, participant)
+
+	_, err = s.ledger.Spend(ctx, models.LedgerEntry{
+		TelegramID:     telegramID,
+		Amount:         -pot.Stake,
+		Reason:         models.LedgerPotStake,
+		RefType:        models.LedgerRefPot,
+		RefID:          pot.ID.Hex(),
+		IdempotencyKey: key + ":stake",
+	})
+	if err != nil {
+		return models.PotParticipant{}, err
+	}
+
+	result, err := s.potsCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":                      pot.ID,
+			"status":                   models.PotOpen,
+			"participants.telegram_id": bson.M{"$ne": telegramID},
+		},
+		bson.M{"$push": bson.M{"participants": participant}},
+	)
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrPotMember
+	}
+	if err != nil {
+		// Участник не добавлен — возвращаем заблокированную ставку
+		s.refund(ctx, pot, participant, key+":refund")
+		return models.PotParticipant{}, err
+	}
+	return participant, nil
+}
+
+// Leave исключает пользователя из банка до старта и возвращает ему ставку.
+func (s *PotService) Leave(ctx context.Context, pot models.Pot, telegramID int64) error {
+	if !s.EnrollmentOpen(pot, time.Now()) {
+		return ErrPotClosed
+	}
+
+	var participant *models.PotParticipant
+	for i := range pot.Participants {
+		if pot.Participants[i].TelegramID == telegramID {
+			participant = &pot.Participants[i]
+			break
+		}
+	}
+	if participant == nil {
+		return ErrPotMember
+	}
+
+	result, err := s.potsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": pot.ID, "status": models.PotOpen, "participants.telegram_id": telegramID},
+		bson.M{"$pull": bson.M{"participants": bson.M{"telegram_id": telegramID}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrPotMember
+	}
+	s.refund(ctx, pot, *participant, potStakeKey(pot, *participant)+":refund")
+	return nil
+}
+
+func (s *PotService) refund(ctx context.Context, pot models.Pot, participant models.PotParticipant, key string) {
+	_, err := s.ledger.Post(ctx, models.LedgerEntry{
+		TelegramID:     participant.TelegramID,
+		Amount:         pot.Stake,
+		Reason:         models.LedgerPotRefund,
+		RefType:        models.LedgerRefPot,
+		RefID:          pot.ID.Hex(),
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		log.Printf("Ошибка возврата ставки банка %s пользователю %d: %v", pot.ID.Hex(), participant.TelegramID, err)
+	}
+}
+
+// potWindow - период нормы привычки внутри банка и сколько выполнений в нем требуется
+type potWindow struct {
+	start, end time.Time
+	need       int
+}
+
+// potWindows делит период банка [start, end] на периоды нормы привычки. Для привычек «N раз в неделю»
+// неделя, попавшая в период частично, требует не больше выполнений, чем в ней дней.
+func potWindows(habit models.Habit, start, end time.Time) []potWindow {
+	var windows []potWindow
+	quota := schedule.Quota(habit)
+	for day := start; !day.After(end); {
+		windowStart, windowEnd := schedule.Window(habit, day)
+		if windowStart.Before(start) {
+			windowStart = start
+		}
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+
+		need := 0
+		if windowStart.Equal(windowEnd) {
+			if schedule.IsDue(habit, windowStart) {
+				need = 1
+			}
+		} else {
+			need = quota
+			if days := int(windowEnd.Sub(windowStart).Hours()/24) + 1; days < need {
+				need = days
+			}
+		}
+		windows = append(windows, potWindow{start: windowStart, end: windowEnd, need: need})
+
+		day = windowEnd.AddDate(0, 0, 1)
+	}
+	return windows
+}
+
+// period возвращает первый и последний день банка в его часовом поясе
+func (s *PotService) period(pot models.Pot) (time.Time, time.Time, error) {
+	loc := s.Location(pot)
+	start, err := time.ParseInLocation(schedule.DateLayout, pot.StartDate, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := time.ParseInLocation(schedule.DateLayout, pot.EndDate, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, end, nil
+}
+
+// Progress возвращает, сколько выполнений нужно участнику за весь период банка по расписанию
+// его привычки и сколько из них уже засчитано.
+func (s *PotService) Progress(ctx context.Context, pot models.Pot, participant models.PotParticipant) (required, done int, err error) {
+	var habit models.Habit
+	err = s.habitsCollection.FindOne(ctx, bson.M{"_id": participant.HabitID}).Decode(&habit)
+	if err == mongo.ErrNoDocuments {
+		// Привычка удалена — участник считается пропустившим
+		return 1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dates, err := CompletedDates(ctx, s.historyCollection, habit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start, end, err := s.period(pot)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, window := range potWindows(habit, start, end) {
+		count := countInRange(dates, window.start, window.end, pot.EndDate)
+		if count > window.need {
+			count = window.need
+		}
+		required += window.need
+		done += count
+	}
+	return required, done, nil
+}
+
+// Run рассчитывает банки, период которых закончился в их часовом поясе, а дни периода
+// уже нельзя исправить через окно исправления.
+func (s *PotService) Run(ctx context.Context) error {
+	// Грубый отбор по дате UTC, точная проверка — в часовом поясе банка
+	window := BackfillWindowDays()
+	cutoff := time.Now().UTC().AddDate(0, 0, 1-window).Format(schedule.DateLayout)
+	cursor, err := s.potsCollection.Find(ctx, bson.M{
+		"status":   bson.M{"$in": []string{models.PotOpen, models.PotSettling}},
+		"end_date": bson.M{"$lt": cutoff},
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка при получении банков: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var pot models.Pot
+		if err := cursor.Decode(&pot); err != nil {
+			log.Printf("Ошибка декодирования банка: %v", err)
+			continue
+		}
+		if time.Now().In(s.Location(pot)).AddDate(0, 0, -window).Format(schedule.DateLayout) <= pot.EndDate {
+			continue
+		}
+		if err := s.settle(ctx, pot); err != nil {
+			log.Printf("Ошибка расчета банка %s: %v", pot.ID.Hex(), err)
+		}
+	}
+	return cursor.Err()
+}
+
+// settle фиксирует итоги банка и проводит выплаты. Итоги сохраняются до выплат (статус settling),
+// поэтому прерванный расчет продолжается с теми же суммами, а ключи журнала не дают заплатить дважды.
+func (s *PotService) settle(ctx context.Context, pot models.Pot) error {
+	if pot.Status == models.PotOpen {
+		winners := 0
+		for i := range pot.Participants {
+			participant := &pot.Participants[i]
+			required, done, err := s.Progress(ctx, pot, *participant)
+			if err != nil {
+				return err
+			}
+			// Без единого дня по расписанию выполнять нечего — такой участник банк не выигрывает, а ставку получает обратно
+			completed := required > 0 && done >= required
+			participant.Required = required
+			participant.Done = done
+			participant.Completed = &completed
+			if completed {
+				winners++
+			}
+		}
+
+		// Ставки пропустивших делятся поровну между выполнившими; если выполнивших нет, ставки возвращаются.
+		// Участник, которому по расписанию нечего было выполнять, не выигрывает и не проигрывает.
+		losers := 0
+		for _, participant := range pot.Participants {
+			if participant.Required > 0 && !*participant.Completed {
+				losers++
+			}
+		}
+		share, systemAmount := 0, 0
+		if winners > 0 {
+			share = pot.Stake * losers / winners
+			systemAmount = pot.Stake*losers - share*winners
+		}
+		for i := range pot.Participants {
+			participant := &pot.Participants[i]
+			switch {
+			case winners == 0, participant.Required == 0:
+				participant.Payout = pot.Stake
+			case *participant.Completed:
+				participant.Payout = pot.Stake + share
+			default:
+				participant.Payout = 0
+			}
+		}
+
+		result, err := s.potsCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": pot.ID, "status": models.PotOpen},
+			bson.M{"$set": bson.M{
+				"status":        models.PotSettling,
+				"participants":  pot.Participants,
+				"system_amount": systemAmount,
+			}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			// Банк уже рассчитывается параллельно
+			return nil
+		}
+		pot.Status = models.PotSettling
+		pot.SystemAmount = systemAmount
+	}
+
+	for _, participant := range pot.Participants {
+		if participant.Payout <= 0 {
+			continue
+		}
+		reason := models.LedgerPotPayout
+		if participant.Completed == nil || !*participant.Completed {
+			reason = models.LedgerPotRefund
+		}
+		_, err := s.ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     participant.TelegramID,
+			Amount:         participant.Payout,
+			Reason:         reason,
+			RefType:        models.LedgerRefPot,
+			RefID:          pot.ID.Hex(),
+			IdempotencyKey: potStakeKey(pot, participant) + ":payout",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Остаток от деления уходит в системный баланс одной записью журнала на банк
+	if pot.SystemAmount > 0 {
+		_, err := s.ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     models.SystemTelegramID,
+			Amount:         pot.SystemAmount,
+			Reason:         models.LedgerSystemShare,
+			RefType:        models.LedgerRefPot,
+			RefID:          pot.ID.Hex(),
+			IdempotencyKey: fmt.Sprintf("pot_system:%s", pot.ID.Hex()),
+		})
+		if err != nil {
+			return fmt.Errorf("ошибка пополнения системного баланса на %d: %v", pot.SystemAmount, err)
+		}
+	}
+
+	_, err := s.potsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": pot.ID, "status": models.PotSettling},
+		bson.M{"$set": bson.M{"status": models.PotSettled, "settled_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("Банк %s рассчитан: участников %d", pot.ID.Hex(), len(pot.Participants))
+	return nil
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"backend/models"
+)
+
+func TestPotWindows(t *testing.T) {
+	weekly := models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 3}}
+	tests := []struct {
+		name       string
+		habit      models.Habit
+		start, end string
+		windows    int
+		required   int
+	}{
+		{"неполные недели в начале и конце", weekly, "2024-01-05", "2024-01-16", 3, 8},
+		{"однодневные куски недель", weekly, "2024-01-07", "2024-01-08", 2, 2},
+		{"полная неделя", weekly, "2024-01-08", "2024-01-14", 1, 3},
+		{"дни недели", models.Habit{Days: []int{0, 2}}, "2024-01-08", "2024-01-14", 7, 2},
+		{"нет дней по расписанию", models.Habit{}, "2024-01-08", "2024-01-10", 3, 0},
+	}
+	for _, tt := range tests {
+		start, _ := time.Parse("2006-01-02", tt.start)
+		end, _ := time.Parse("2006-01-02", tt.end)
+		windows := potWindows(tt.habit, start, end)
+
+		required := 0
+		for i, window := range windows {
+			required += window.need
+			if window.start.Before(start) || window.end.After(end) {
+				t.Errorf("%s: период %d (%s..%s) выходит за пределы банка", tt.name, i, window.start, window.end)
+			}
+			if i > 0 && !window.start.Equal(windows[i-1].end.AddDate(0, 0, 1)) {
+				t.Errorf("%s: период %d начинается не сразу после предыдущего", tt.name, i)
+			}
+		}
+		if len(windows) != tt.windows || required != tt.required {
+			t.Errorf("%s: периодов %d с нормой %d, ожидалось %d с нормой %d", tt.name, len(windows), required, tt.windows, tt.required)
+		}
+	}
+}
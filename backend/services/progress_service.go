@@ -2,6 +2,7 @@ package services
 
 import (
 	"backend/models"
+	"backend/schedule"
 	"context"
 	"log"
 	"time"
@@ -12,20 +13,26 @@ import (
 )
 
 // CalculateHabitCompletionProgress вычисляет прогресс выполнения привычки подписчиками на сегодня.
-// Требует доступ к коллекции привычек для получения данных подписчиков.
-func CalculateHabitCompletionProgress(ctx context.Context, habit models.Habit, timezone string, habitsCollection *mongo.Collection) (float64, error) {
+// Каждый участник вносит долю своей дневной цели, поэтому частично выполненные
+// количественные привычки тоже учитываются.
+// Требует доступ к коллекциям привычек и истории для получения данных подписчиков.
+func CalculateHabitCompletionProgress(ctx context.Context, habit models.Habit, timezone string, habitsCollection, historyCollection *mongo.Collection) (float64, error) {
 	loc, err := time.LoadLocation(timezone)
 	if err != nil {
 		log.Printf("Ошибка загрузки таймзоны %s: %v", timezone, err)
 		return 0.0, err // Возвращаем ошибку, если таймзона невалидна
 	}
-	today := time.Now().In(loc).Format("2006-01-02")
+	now := time.Now().In(loc)
+	today := now.Format("2006-01-02")
 
-	completedCount := 0
+	completed := 0.0
 	// Проверяем владельца
-	if habit.LastClickDate == today {
-		completedCount++
+	ownerFraction, err := dayFraction(ctx, historyCollection, habit, today)
+	if err != nil {
+		log.Printf("Ошибка получения прогресса владельца привычки %s: %v", habit.ID.Hex(), err)
+		return 0.0, err
 	}
+	completed += ownerFraction
 
 	totalParticipants := 1 // Начинаем с владельца (всегда 1)
 
@@ -58,28 +65,33 @@ func CalculateHabitCompletionProgress(ctx context.Context, habit models.Habit, t
 
 			func() {
 				defer cursor.Close(ctx)
-				// Дедуп по пользователю и агрегирование выполнения «сегодня»
-				userSeen := make(map[int64]bool)
-				userCompleted := make(map[int64]bool)
+				// Дедуп по пользователю и агрегирование выполнения «сегодня»:
+				// если у пользователя несколько привычек, берем лучший результат
+				userFraction := make(map[int64]float64)
 				for cursor.Next(ctx) {
 					var followerHabit models.Habit
 					if err := cursor.Decode(&followerHabit); err != nil {
 						log.Printf("Ошибка декодирования привычки подписчика для %s: %v", habit.ID.Hex(), err)
 						continue
 					}
-					userSeen[followerHabit.TelegramID] = true
-					if followerHabit.LastClickDate == today {
-						userCompleted[followerHabit.TelegramID] = true
+					// Подписчики, у которых привычка сегодня не запланирована, не учитываются
+					if !schedule.IsDue(followerHabit, now) {
+						continue
+					}
+					fraction, err := dayFraction(ctx, historyCollection, followerHabit, today)
+					if err != nil {
+						log.Printf("Ошибка получения прогресса привычки подписчика %s: %v", followerHabit.ID.Hex(), err)
+					}
+					if prev, ok := userFraction[followerHabit.TelegramID]; !ok || fraction > prev {
+						userFraction[followerHabit.TelegramID] = fraction
 					}
 				}
 
 				// Всего участников = владелец + уникальные пользователи среди подписок
-				totalParticipants = 1 + len(userSeen)
-				// Добавляем выполнивших среди уникальных пользователей
-				for _, done := range userCompleted {
-					if done {
-						completedCount++
-					}
+				totalParticipants = 1 + len(userFraction)
+				// Добавляем вклад уникальных пользователей
+				for _, fraction := range userFraction {
+					completed += fraction
 				}
 			}()
 		}
@@ -87,8 +99,37 @@ func CalculateHabitCompletionProgress(ctx context.Context, habit models.Habit, t
 
 	progress := 0.0
 	if totalParticipants > 0 {
-		progress = float64(completedCount) / float64(totalParticipants)
+		progress = completed / float64(totalParticipants)
 	}
 
 	return progress, nil
 }
+
+// dayFraction возвращает долю дневной цели привычки, выполненную за указанную дату (от 0 до 1).
+func dayFraction(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit, date string) (float64, error) {
+	if habit.LastClickDate == date {
+		return 1.0, nil
+	}
+
+	target := habit.DailyTarget()
+	if target == 1 && len(habit.Checklist) == 0 {
+		// Бинарная привычка без клика за сегодня не выполнена
+		return 0.0, nil
+	}
+
+	entry, found, err := FindHabitDayEntry(ctx, historyCollection, habit.TelegramID, date, habit.ID)
+	if err != nil || !found {
+		return 0.0, err
+	}
+
+	// У привычки с чек-листом частичный прогресс — доля отмеченных пунктов
+	if len(habit.Checklist) > 0 && entry.Progress(target) < target {
+		return ChecklistFraction(habit, entry.Items), nil
+	}
+
+	fraction := float64(entry.Progress(target)) / float64(target)
+	if fraction > 1 {
+		fraction = 1
+	}
+	return fraction, nil
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// quoteTTL - сколько действует котировка
+const quoteTTL = 10 * time.Minute
+
+// Курсы, комиссия и минимумы по умолчанию. Переопределяются переменными окружения с теми же именами.
+const (
+	defaultQuoteTonWillRate    = 100  // QUOTE_TON_WILL_RATE — WILL за 1 TON
+	defaultQuoteUsdtWillRate   = 1000 // QUOTE_USDT_WILL_RATE — WILL за 1 USDT, пока реестр jetton не опубликован
+	defaultQuoteMinDepositWill = 100  // QUOTE_MIN_DEPOSIT_WILL — минимальный депозит в WILL
+	defaultQuoteMinWithdraw    = 500  // QUOTE_MIN_WITHDRAW_WILL — минимальный вывод в WILL
+	defaultWithdrawFeePercent  = 1.0  // WITHDRAW_FEE_PERCENT — комиссия вывода в процентах
+)
+
+// quoteDecimals - точность сумм котировки в валюте
+const quoteDecimals = 2
+
+var (
+	ErrQuoteInvalid  = errors.New("котировка не найдена или подпись неверна")
+	ErrQuoteExpired  = errors.New("срок действия котировки истек")
+	ErrQuoteUsed     = errors.New("котировка уже использована")
+	ErrQuoteMismatch = errors.New("котировка выдана для другой операции")
+)
+
+// QuoteService выдает подписанные котировки обмена WILL на TON и jetton из реестра и погашает их
+// при создании депозита или вывода. Идентификатор котировки содержит HMAC от ее сумм,
+// поэтому подделать его или изменить суммы в базе незаметно нельзя.
+type QuoteService struct {
+	quotesCollection *mongo.Collection
+	secret           []byte
+	jettonRates      map[string]int // WILL за единицу jetton по коду валюты
+}
+
+func NewQuoteService(quotesCollection *mongo.Collection, jettons models.JettonRegistry) *QuoteService {
+	secret := []byte(os.Getenv("QUOTE_SECRET"))
+	if len(secret) == 0 {
+		log.Println("Предупреждение: QUOTE_SECRET не установлен. Котировки будут недействительны после перезапуска.")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Ошибка генерации ключа котировок: %v", err)
+		}
+	}
+	jettonRates := make(map[string]int, len(jettons.Jettons))
+	for _, jetton := range jettons.Jettons {
+		jettonRates[jetton.Symbol] = jetton.WillRate
+	}
+	return &QuoteService{
+		quotesCollection: quotesCollection,
+		secret:           secret,
+		jettonRates:      jettonRates,
+	}
+}
+
+// EnsureIndexes создает TTL-индекс: котировки удаляются через сутки после истечения.
+func (s *QuoteService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.quotesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())),
+	})
+	return err
+}
+
+// quoteInt читает целый параметр котировок из переменной окружения
+func quoteInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil && parsed > 0 {
+			return parsed
+		}
+		log.Printf("Некорректное значение %s=%s, используется %d", name, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// withdrawFeePercent возвращает комиссию вывода в процентах из WITHDRAW_FEE_PERCENT
+func withdrawFeePercent() float64 {
+	if value := os.Getenv("WITHDRAW_FEE_PERCENT"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err == nil && parsed >= 0 && parsed < 100 {
+			return parsed
+		}
+		log.Printf("Некорректное значение WITHDRAW_FEE_PERCENT=%s, используется %.2f", value, defaultWithdrawFeePercent)
+	}
+	return defaultWithdrawFeePercent
+}
+
+// rate возвращает курс WILL за единицу валюты или 0, если валюта не поддерживается.
+// Курс TON задается QUOTE_TON_WILL_RATE, курсы jetton — реестром.
+func (s *QuoteService) rate(currency string) int {
+	if currency == "ton" {
+		return quoteInt("QUOTE_TON_WILL_RATE", defaultQuoteTonWillRate)
+	}
+	return s.jettonRates[currency]
+}
+
+// WillAmount пересчитывает в WILL по текущему курсу сумму amount в минимальных единицах валюты
+// с точностью decimals, с округлением вниз. Нужен для переводов без котировки; 0 — валюта не поддерживается.
+func (s *QuoteService) WillAmount(currency string, amount *big.Int, decimals int) int {
+	rate := s.rate(currency)
+	if rate == 0 {
+		return 0
+	}
+	will := new(big.Int).Mul(amount, big.NewInt(int64(rate)))
+	will.Quo(will, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	if !will.IsInt64() || will.Int64() > math.MaxInt32 {
+		return 0
+	}
+	return int(will.Int64())
+}
+
+// roundAmount округляет сумму до quoteDecimals знаков: вверх — для оплаты пользователем, вниз — для выплаты
+func roundAmount(amount float64, up bool) float64 {
+	scale := math.Pow10(quoteDecimals)
+	if up {
+		return math.Ceil(amount*scale-1e-9) / scale
+	}
+	return math.Floor(amount*scale+1e-9) / scale
+}
+
+// Create рассчитывает котировку по курсам сервера и сохраняет ее.
+// Возвращает котировку и подписанный идентификатор, который клиент передает при депозите или выводе.
+func (s *QuoteService) Create(ctx context.Context, telegramID int64, direction, currency string, willAmount int) (models.Quote, string, error) {
+	rate := s.rate(currency)
+	if rate == 0 {
+		return models.Quote{}, "", fmt.Errorf("unsupported currency %q", currency)
+	}
+
+	now := time.Now()
+	quote := models.Quote{
+		ID:         primitive.NewObjectID(),
+		TelegramID: telegramID,
+		Direction:  direction,
+		Currency:   currency,
+		WillAmount: willAmount,
+		Rate:       rate,
+		ExpiresAt:  now.Add(quoteTTL).Truncate(time.Millisecond),
+		CreatedAt:  now,
+	}
+
+	switch direction {
+	case models.QuoteDeposit:
+		if minimum := quoteInt("QUOTE_MIN_DEPOSIT_WILL", defaultQuoteMinDepositWill); willAmount < minimum {
+			return models.Quote{}, "", fmt.Errorf("minimum deposit is %d WILL", minimum)
+		}
+		quote.Amount = roundAmount(float64(willAmount)/float64(rate), true)
+	case models.QuoteWithdraw:
+		if minimum := quoteInt("QUOTE_MIN_WITHDRAW_WILL", defaultQuoteMinWithdraw); willAmount < minimum {
+			return models.Quote{}, "", fmt.Errorf("minimum withdrawal is %d WILL", minimum)
+		}
+		quote.Amount = roundAmount(float64(willAmount)/float64(rate), false)
+		quote.Fee = roundAmount(quote.Amount*withdrawFeePercent()/100, true)
+	default:
+		return models.Quote{}, "", fmt.Errorf("unsupported direction %q", direction)
+	}
+	if quote.Amount <= 0 || quote.Amount <= quote.Fee {
+		return models.Quote{}, "", fmt.Errorf("amount is too small")
+	}
+
+	if _, err := s.quotesCollection.InsertOne(ctx, quote); err != nil {
+		return models.Quote{}, "", err
+	}
+	return quote, s.quoteID(quote), nil
+}
+
+// Check проверяет подпись, владельца, направление и срок котировки, не погашая ее.
+// Позволяет рассчитать и проверить операцию до того, как котировка будет израсходована.
+func (s *QuoteService) Check(ctx context.Context, quoteID string, telegramID int64, direction string) (models.Quote, error) {
+	hexID, _, found := strings.Cut(quoteID, ".")
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if !found || err != nil {
+		return models.Quote{}, ErrQuoteInvalid
+	}
+
+	var quote models.Quote
+	err = s.quotesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&quote)
+	if err == mongo.ErrNoDocuments {
+		return models.Quote{}, ErrQuoteInvalid
+	}
+	if err != nil {
+		return models.Quote{}, err
+	}
+	if !hmac.Equal([]byte(s.quoteID(quote)), []byte(quoteID)) {
+		return models.Quote{}, ErrQuoteInvalid
+	}
+	if quote.TelegramID != telegramID || quote.Direction != direction {
+		return models.Quote{}, ErrQuoteMismatch
+	}
+	if quote.UsedAt != nil {
+		return models.Quote{}, ErrQuoteUsed
+	}
+
+	if time.Now().After(quote.ExpiresAt) {
+		return models.Quote{}, ErrQuoteExpired
+	}
+	return quote, nil
+}
+
+// Use проверяет котировку так же, как Check, и помечает ее использованной для транзакции
+// transactionID. Одну котировку можно использовать только один раз.
+func (s *QuoteService) Use(ctx context.Context, quoteID string, telegramID int64, direction, transactionID string) (models.Quote, error) {
+	quote, err := s.Check(ctx, quoteID, telegramID, direction)
+	if err != nil {
+		return models.Quote{}, err
+	}
+
+	now := time.Now()
+	// Условие на used_at не дает использовать котировку в двух одновременных запросах
+	result, err := s.quotesCollection.UpdateOne(ctx,
+		bson.M{"_id": quote.ID, "used_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"used_at": now, "transaction_id": transactionID}},
+	)
+	if err != nil {
+		return models.Quote{}, err
+	}
+	if result.MatchedCount == 0 {
+		return models.Quote{}, ErrQuoteUsed
+	}
+	quote.UsedAt = &now
+	quote.TransactionID = transactionID
+	return quote, nil
+}
+
+// Release снимает погашение котировки, если операция transactionID, для которой она погашена, не создана.
+// Котировку, погашенную другой операцией, Release не трогает.
+func (s *QuoteService) Release(ctx context.Context, quote models.Quote, transactionID string) error {
+	_, err := s.quotesCollection.UpdateOne(ctx,
+		bson.M{"_id": quote.ID, "transaction_id": transactionID},
+		bson.M{"$unset": bson.M{"used_at": "", "transaction_id": ""}},
+	)
+	return err
+}
+
+// quoteID возвращает идентификатор котировки: ObjectID и HMAC-SHA256 от всех ее условий
+func (s *QuoteService) quoteID(quote models.Quote) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d|%s|%s|%d|%d|%.9f|%.9f|%d",
+		quote.ID.Hex(), quote.TelegramID, quote.Direction, quote.Currency,
+		quote.WillAmount, quote.Rate, quote.Amount, quote.Fee, quote.ExpiresAt.UnixMilli())
+	return quote.ID.Hex() + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
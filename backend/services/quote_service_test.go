@@ -0,0 +1,97 @@
+package services
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"backend/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRoundAmount(t *testing.T) {
+	tests := []struct {
+		amount float64
+		up     bool
+		want   float64
+	}{
+		{1.231, true, 1.24},
+		{1.231, false, 1.23},
+		{1.239, false, 1.23},
+		// Погрешность float64 не должна сдвигать уже округленную сумму
+		{0.1 + 0.2, true, 0.3},
+		{1.15, false, 1.15},
+		{2, true, 2},
+	}
+	for _, tt := range tests {
+		if got := roundAmount(tt.amount, tt.up); got != tt.want {
+			t.Errorf("roundAmount(%v, вверх %v) = %v, ожидалось %v", tt.amount, tt.up, got, tt.want)
+		}
+	}
+}
+
+func TestWillAmount(t *testing.T) {
+	s := &QuoteService{jettonRates: map[string]int{"usdt": 1000}}
+	tests := []struct {
+		currency string
+		amount   int64
+		decimals int
+		want     int
+	}{
+		{"usdt", 1_500_000, 6, 1500},
+		{"usdt", 1_999, 6, 1}, // Округление вниз
+		{"usdt", 999, 6, 0},
+		{"unknown", 1_000_000, 6, 0},
+	}
+	for _, tt := range tests {
+		if got := s.WillAmount(tt.currency, big.NewInt(tt.amount), tt.decimals); got != tt.want {
+			t.Errorf("WillAmount(%s, %d) = %d, ожидалось %d", tt.currency, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteIDSignsAllTerms(t *testing.T) {
+	s := &QuoteService{secret: []byte("test secret")}
+	quote := models.Quote{
+		ID:         primitive.NewObjectID(),
+		TelegramID: 1,
+		Direction:  models.QuoteDeposit,
+		Currency:   "usdt",
+		WillAmount: 1000,
+		Rate:       1000,
+		Amount:     1,
+		Fee:        0,
+		ExpiresAt:  time.Now().Add(quoteTTL),
+	}
+	signed := s.quoteID(quote)
+	if s.quoteID(quote) != signed {
+		t.Fatal("Подпись котировки не детерминирована")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(q *models.Quote)
+	}{
+		{"пользователь", func(q *models.Quote) { q.TelegramID = 2 }},
+		{"направление", func(q *models.Quote) { q.Direction = models.QuoteWithdraw }},
+		{"валюта", func(q *models.Quote) { q.Currency = "ton" }},
+		{"сумма WILL", func(q *models.Quote) { q.WillAmount = 1001 }},
+		{"курс", func(q *models.Quote) { q.Rate = 999 }},
+		{"сумма", func(q *models.Quote) { q.Amount = 1.01 }},
+		{"комиссия", func(q *models.Quote) { q.Fee = 0.01 }},
+		{"срок", func(q *models.Quote) { q.ExpiresAt = q.ExpiresAt.Add(time.Second) }},
+	}
+	for _, tt := range tests {
+		modified := quote
+		tt.modify(&modified)
+		if s.quoteID(modified) == signed {
+			t.Errorf("Изменение условия %q не меняет подпись котировки", tt.name)
+		}
+	}
+
+	other := &QuoteService{secret: []byte("other secret")}
+	if other.quoteID(quote) == signed {
+		t.Error("Котировка подписана одинаково разными ключами")
+	}
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rewardRulesTTL - как долго правила наград используются из памяти без повторного чтения settings
+const rewardRulesTTL = time.Minute
+
+// DefaultRewardRules возвращает правила, действующие, пока в settings нет документа reward_rules:
+// 100 WILL за регистрацию, +1 пользователю и +1 рефереру за выполнение.
+func DefaultRewardRules() models.RewardRules {
+	return models.RewardRules{
+		ID:               models.RewardRulesID,
+		SignupBonus:      100,
+		CompletionReward: 1,
+		ReferralReward:   1,
+	}
+}
+
+// ValidateRewardRules проверяет, что правила можно применять.
+func ValidateRewardRules(rules models.RewardRules) error {
+	if rules.SignupBonus < 0 || rules.CompletionReward < 0 || rules.ReferralReward < 0 {
+		return fmt.Errorf("награды не могут быть отрицательными")
+	}
+	if rules.ReferralDays < 0 || rules.DailyCap < 0 {
+		return fmt.Errorf("referral_days и daily_cap не могут быть отрицательными")
+	}
+	for _, m := range rules.StreakMultipliers {
+		if m.MinStreak < 0 || m.Multiplier < 0 {
+			return fmt.Errorf("некорректный множитель стрика: %+v", m)
+		}
+	}
+	for _, p := range rules.BonusPeriods {
+		start, err := time.Parse(schedule.DateLayout, p.StartDate)
+		if err != nil {
+			return fmt.Errorf("некорректная дата начала бонусного периода %q", p.StartDate)
+		}
+		end, err := time.Parse(schedule.DateLayout, p.EndDate)
+		if err != nil {
+			return fmt.Errorf("некорректная дата окончания бонусного периода %q", p.EndDate)
+		}
+		if end.Before(start) || p.Multiplier < 0 {
+			return fmt.Errorf("некорректный бонусный период: %+v", p)
+		}
+	}
+	return nil
+}
+
+// PublishRewardRules сохраняет новые правила в settings со следующим номером версии.
+// Каждая версия дополнительно сохраняется копией под _id reward_rules:v<N>, чтобы по rule_version
+// в журнале можно было узнать, по каким правилам была рассчитана выплата.
+func PublishRewardRules(ctx context.Context, settingsCollection *mongo.Collection, rules models.RewardRules) (models.RewardRules, error) {
+	if err := ValidateRewardRules(rules); err != nil {
+		return rules, err
+	}
+
+	current := DefaultRewardRules()
+	err := settingsCollection.FindOne(ctx, bson.M{"_id": models.RewardRulesID}).Decode(&current)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return rules, err
+	}
+
+	rules.Version = current.Version + 1
+	rules.UpdatedAt = time.Now()
+
+	// Уникальный _id копии не даст двум публикациям получить один номер версии
+	rules.ID = fmt.Sprintf("%s:v%d", models.RewardRulesID, rules.Version)
+	if _, err := settingsCollection.InsertOne(ctx, rules); err != nil {
+		return rules, err
+	}
+
+	rules.ID = models.RewardRulesID
+	_, err = settingsCollection.ReplaceOne(ctx, bson.M{"_id": models.RewardRulesID}, rules, options.Replace().SetUpsert(true))
+	return rules, err
+}
+
+// RewardPayout - суммы WILL, рассчитанные правилами для одного события
+type RewardPayout struct {
+	UserAmount     int
+	ReferrerAmount int
+	RuleVersion    int
+	Ordinal        int // Номер переключения выполнения за день: из него строятся ключи идемпотентности
+}
+
+// Keys возвращает ключи идемпотентности проводок пользователя и реферера за день date привычки habitID.
+// Ключ строится из номера переключения за день: повтор того же клика получает тот же ключ.
+func (p RewardPayout) Keys(habitID primitive.ObjectID, date string) (userKey, referrerKey string) {
+	return fmt.Sprintf("habit:%s:%s:%d", habitID.Hex(), date, p.Ordinal),
+		fmt.Sprintf("referral:%s:%s:%d", habitID.Hex(), date, p.Ordinal)
+}
+
+// RewardEngine рассчитывает награды за регистрацию и выполнение привычек по правилам из settings.
+// Правила перечитываются не чаще раза в rewardRulesTTL, поэтому их можно менять без перезапуска.
+type RewardEngine struct {
+	settingsCollection *mongo.Collection
+	ledger             *Ledger
+
+	mu       sync.Mutex
+	rules    models.RewardRules
+	loadedAt time.Time
+}
+
+func NewRewardEngine(settingsCollection *mongo.Collection, ledger *Ledger) *RewardEngine {
+	return &RewardEngine{
+		settingsCollection: settingsCollection,
+		ledger:             ledger,
+		rules:              DefaultRewardRules(),
+	}
+}
+
+// Rules возвращает действующие правила. Если документ в settings некорректен или не читается,
+// продолжают действовать последние загруженные правила.
+func (e *RewardEngine) Rules(ctx context.Context) models.RewardRules {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.loadedAt) < rewardRulesTTL {
+		return e.rules
+	}
+
+	rules := DefaultRewardRules()
+	err := e.settingsCollection.FindOne(ctx, bson.M{"_id": models.RewardRulesID}).Decode(&rules)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		rules = DefaultRewardRules()
+	case err != nil:
+		log.Printf("Ошибка загрузки правил наград, используется версия %d: %v", e.rules.Version, err)
+		return e.rules
+	default:
+		if err := ValidateRewardRules(rules); err != nil {
+			log.Printf("Правила наград версии %d отклонены, используется версия %d: %v", rules.Version, e.rules.Version, err)
+			e.loadedAt = time.Now()
+			return e.rules
+		}
+	}
+
+	if rules.Version != e.rules.Version {
+		log.Printf("Загружены правила наград версии %d", rules.Version)
+	}
+	e.rules = rules
+	e.loadedAt = time.Now()
+	return e.rules
+}
+
+// Signup рассчитывает бонус за регистрацию.
+func (e *RewardEngine) Signup(ctx context.Context) RewardPayout {
+	rules := e.Rules(ctx)
+	return RewardPayout{UserAmount: rules.SignupBonus, RuleVersion: rules.Version}
+}
+
+// Completion рассчитывает награду за выполнение привычки habit за день date. habit должна содержать
+// стрик, пересчитанный с учетом этого выполнения. За один день привычки награда выплачивается один раз:
+// если за него уже есть невозвращенная выплата, повторно ничего не начисляется.
+func (e *RewardEngine) Completion(ctx context.Context, user models.User, habit models.Habit, date string) (RewardPayout, error) {
+	rules := e.Rules(ctx)
+	payout := RewardPayout{RuleVersion: rules.Version}
+
+	paid, err := e.paidForDay(ctx, user.TelegramID, habit, date, models.LedgerHabitCompletion, models.LedgerHabitUndo)
+	if err != nil || paid > 0 {
+		return payout, err
+	}
+	if payout.Ordinal, err = e.ordinal(ctx, user.TelegramID, habit, date); err != nil {
+		return payout, err
+	}
+
+	amount := int(math.Round(float64(rules.CompletionReward) * streakMultiplier(rules, habit.Streak) * bonusMultiplier(rules, date)))
+	if rules.DailyCap > 0 && amount > 0 {
+		earned, err := e.ledger.Sum(ctx, bson.M{
+			"telegram_id": user.TelegramID,
+			"reward_date": date,
+			"reason":      bson.M{"$in": []string{models.LedgerHabitCompletion, models.LedgerHabitUndo}},
+		})
+		if err != nil {
+			return payout, err
+		}
+		amount = max(0, min(amount, rules.DailyCap-earned))
+	}
+	payout.UserAmount = amount
+
+	// Доля реферера выплачивается только вместе с наградой пользователя
+	if user.ReferrerID == 0 || amount == 0 || !referralActive(rules, user) {
+		return payout, nil
+	}
+	referrerPaid, err := e.paidForDay(ctx, user.ReferrerID, habit, date, models.LedgerReferralReward, models.LedgerReferralUndo)
+	if err != nil {
+		return payout, err
+	}
+	if referrerPaid <= 0 {
+		payout.ReferrerAmount = rules.ReferralReward
+	}
+	return payout, nil
+}
+
+// Undo рассчитывает списание при отмене выполнения: возвращается ровно то, что было выплачено
+// за этот день привычки пользователю и рефереру, независимо от того, по какой версии правил.
+func (e *RewardEngine) Undo(ctx context.Context, user models.User, habit models.Habit, date string) (RewardPayout, error) {
+	payout := RewardPayout{RuleVersion: e.Rules(ctx).Version}
+
+	paid, err := e.paidForDay(ctx, user.TelegramID, habit, date, models.LedgerHabitCompletion, models.LedgerHabitUndo)
+	if err != nil {
+		return payout, err
+	}
+	payout.UserAmount = -max(paid, 0)
+	if payout.Ordinal, err = e.ordinal(ctx, user.TelegramID, habit, date); err != nil {
+		return payout, err
+	}
+
+	if user.ReferrerID != 0 {
+		referrerPaid, err := e.paidForDay(ctx, user.ReferrerID, habit, date, models.LedgerReferralReward, models.LedgerReferralUndo)
+		if err != nil {
+			return payout, err
+		}
+		payout.ReferrerAmount = -max(referrerPaid, 0)
+	}
+	return payout, nil
+}
+
+// paidForDay возвращает сумму, которую telegramID получил за день date привычки habit с учетом отмен.
+func (e *RewardEngine) paidForDay(ctx context.Context, telegramID int64, habit models.Habit, date, reward, undo string) (int, error) {
+	return e.ledger.Sum(ctx, bson.M{
+		"telegram_id": telegramID,
+		"ref_id":      habit.ID.Hex(),
+		"reward_date": date,
+		"reason":      bson.M{"$in": []string{reward, undo}},
+	})
+}
+
+// ordinal возвращает число проведенных начислений и отмен за день date привычки habit. Выполнение и отмена
+// чередуются, поэтому одновременные или повторенные запросы одного переключения получают один номер,
+// а ключ идемпотентности с ним не дает провести выплату дважды.
+func (e *RewardEngine) ordinal(ctx context.Context, telegramID int64, habit models.Habit, date string) (int, error) {
+	return e.ledger.Count(ctx, bson.M{
+		"telegram_id": telegramID,
+		"ref_id":      habit.ID.Hex(),
+		"reward_date": date,
+		"reason":      bson.M{"$in": []string{models.LedgerHabitCompletion, models.LedgerHabitUndo}},
+	})
+}
+
+// streakMultiplier возвращает множитель для наибольшего порога, которого достиг стрик.
+func streakMultiplier(rules models.RewardRules, streak int) float64 {
+	multipliers := append([]models.StreakMultiplier(nil), rules.StreakMultipliers...)
+	sort.Slice(multipliers, func(i, j int) bool { return multipliers[i].MinStreak < multipliers[j].MinStreak })
+
+	result := 1.0
+	for _, m := range multipliers {
+		if streak >= m.MinStreak {
+			result = m.Multiplier
+		}
+	}
+	return result
+}
+
+// bonusMultiplier возвращает наибольший множитель бонусных периодов, в которые попадает date.
+func bonusMultiplier(rules models.RewardRules, date string) float64 {
+	result := 1.0
+	for _, p := range rules.BonusPeriods {
+		if date >= p.StartDate && date <= p.EndDate && p.Multiplier > result {
+			result = p.Multiplier
+		}
+	}
+	return result
+}
+
+// referralActive проверяет, что реферер еще получает долю: прошло не больше ReferralDays с регистрации реферала.
+func referralActive(rules models.RewardRules, user models.User) bool {
+	if rules.ReferralDays == 0 {
+		return true
+	}
+	if user.CreatedAt.IsZero() {
+		return false
+	}
+	return time.Since(user.CreatedAt) < time.Duration(rules.ReferralDays)*24*time.Hour
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"backend/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateRewardRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules models.RewardRules
+		valid bool
+	}{
+		{"правила по умолчанию", DefaultRewardRules(), true},
+		{"отрицательная награда", models.RewardRules{CompletionReward: -1}, false},
+		{"отрицательный лимит", models.RewardRules{DailyCap: -5}, false},
+		{"отрицательный множитель стрика", models.RewardRules{StreakMultipliers: []models.StreakMultiplier{{MinStreak: 3, Multiplier: -1}}}, false},
+		{"бонусный период", models.RewardRules{BonusPeriods: []models.BonusPeriod{{StartDate: "2024-01-01", EndDate: "2024-01-07", Multiplier: 2}}}, true},
+		{"конец периода раньше начала", models.RewardRules{BonusPeriods: []models.BonusPeriod{{StartDate: "2024-01-07", EndDate: "2024-01-01", Multiplier: 2}}}, false},
+		{"некорректная дата периода", models.RewardRules{BonusPeriods: []models.BonusPeriod{{StartDate: "01.01.2024", EndDate: "2024-01-07", Multiplier: 2}}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRewardRules(tt.rules); (err == nil) != tt.valid {
+			t.Errorf("%s: ValidateRewardRules = %v, ожидались корректные правила: %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestStreakMultiplier(t *testing.T) {
+	// Пороги намеренно не отсортированы
+	rules := models.RewardRules{StreakMultipliers: []models.StreakMultiplier{
+		{MinStreak: 30, Multiplier: 3},
+		{MinStreak: 7, Multiplier: 1.5},
+		{MinStreak: 14, Multiplier: 2},
+	}}
+	tests := []struct {
+		streak int
+		want   float64
+	}{
+		{0, 1},
+		{6, 1},
+		{7, 1.5},
+		{13, 1.5},
+		{14, 2},
+		{100, 3},
+	}
+	for _, tt := range tests {
+		if got := streakMultiplier(rules, tt.streak); got != tt.want {
+			t.Errorf("streakMultiplier(%d) = %v, ожидалось %v", tt.streak, got, tt.want)
+		}
+	}
+}
+
+func TestBonusMultiplier(t *testing.T) {
+	rules := models.RewardRules{BonusPeriods: []models.BonusPeriod{
+		{StartDate: "2024-01-01", EndDate: "2024-01-07", Multiplier: 2},
+		{StartDate: "2024-01-05", EndDate: "2024-01-05", Multiplier: 3},
+	}}
+	tests := []struct {
+		date string
+		want float64
+	}{
+		{"2023-12-31", 1},
+		{"2024-01-01", 2},
+		{"2024-01-05", 3},
+		{"2024-01-07", 2},
+		{"2024-01-08", 1},
+	}
+	for _, tt := range tests {
+		if got := bonusMultiplier(rules, tt.date); got != tt.want {
+			t.Errorf("bonusMultiplier(%s) = %v, ожидалось %v", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestReferralActive(t *testing.T) {
+	tests := []struct {
+		name         string
+		referralDays int
+		createdAt    time.Time
+		active       bool
+	}{
+		{"без ограничения", 0, time.Time{}, true},
+		{"в пределах срока", 30, time.Now().Add(-24 * time.Hour), true},
+		{"срок истек", 30, time.Now().Add(-31 * 24 * time.Hour), false},
+		{"дата регистрации неизвестна", 30, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		rules := models.RewardRules{ReferralDays: tt.referralDays}
+		if got := referralActive(rules, models.User{CreatedAt: tt.createdAt}); got != tt.active {
+			t.Errorf("%s: referralActive = %v, ожидалось %v", tt.name, got, tt.active)
+		}
+	}
+}
+
+func TestRewardPayoutKeys(t *testing.T) {
+	habitID := primitive.NewObjectID()
+	tests := []struct {
+		ordinal              int
+		userKey, referrerKey string
+	}{
+		{0, "habit:" + habitID.Hex() + ":2024-01-10:0", "referral:" + habitID.Hex() + ":2024-01-10:0"},
+		{1, "habit:" + habitID.Hex() + ":2024-01-10:1", "referral:" + habitID.Hex() + ":2024-01-10:1"},
+	}
+	for _, tt := range tests {
+		userKey, referrerKey := RewardPayout{Ordinal: tt.ordinal}.Keys(habitID, "2024-01-10")
+		if userKey != tt.userKey || referrerKey != tt.referrerKey {
+			t.Errorf("Keys(ordinal %d) = %s, %s; ожидалось %s, %s", tt.ordinal, userKey, referrerKey, tt.userKey, tt.referrerKey)
+		}
+	}
+
+	// Повтор того же переключения получает тот же ключ, следующее переключение — новый
+	first, _ := RewardPayout{Ordinal: 2}.Keys(habitID, "2024-01-10")
+	retry, _ := RewardPayout{Ordinal: 2}.Keys(habitID, "2024-01-10")
+	next, _ := RewardPayout{Ordinal: 3}.Keys(habitID, "2024-01-10")
+	if first != retry || first == next {
+		t.Errorf("Ключи переключений %s, %s, %s: повтор должен совпадать, следующее переключение — отличаться", first, retry, next)
+	}
+}
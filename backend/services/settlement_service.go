@@ -0,0 +1,471 @@
+package services
+
+import (
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbot "github.com/go-telegram/bot"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// settlementLookbackDays - сколько дней после закрытия окна исправления проверяется при каждом запуске.
+// Позволяет догнать дни, пропущенные из-за простоя; уже рассчитанные дни пропускаются.
+const settlementLookbackDays = 2
+
+// StakeSettlementService списывает ставки за пропущенные привычки, когда день в часовом поясе
+// пользователя уже нельзя исправить, и распределяет их между подписчиками, выполнившими свои привычки.
+type StakeSettlementService struct {
+	habitsCollection      *mongo.Collection
+	historyCollection     *mongo.Collection
+	usersCollection       *mongo.Collection
+	settlementsCollection *mongo.Collection
+	freezesCollection     *mongo.Collection
+	ledger                *Ledger
+	bot                   *tgbot.Bot
+}
+
+func NewStakeSettlementService(habitsCollection, historyCollection, usersCollection, settlementsCollection, freezesCollection *mongo.Collection, ledger *Ledger, b *tgbot.Bot) *StakeSettlementService {
+	return &StakeSettlementService{
+		habitsCollection:      habitsCollection,
+		historyCollection:     historyCollection,
+		usersCollection:       usersCollection,
+		settlementsCollection: settlementsCollection,
+		freezesCollection:     freezesCollection,
+		ledger:                ledger,
+		bot:                   b,
+	}
+}
+
+// EnsureIndexes создает уникальный индекс, который не дает рассчитать привычку за день дважды.
+func (s *StakeSettlementService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.settlementsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "habit_id", Value: 1}, {Key: "date", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// stakeReport собирает движение WILL пользователя за один запуск для уведомления
+type stakeReport struct {
+	sent     []string
+	received []string
+	total    [2]int // списано, получено
+}
+
+// Run рассчитывает ставки всех пользователей за завершившиеся дни.
+func (s *StakeSettlementService) Run(ctx context.Context) error {
+	telegramIDs, err := s.habitsCollection.Distinct(ctx, "telegram_id", bson.M{
+		"stake":       bson.M{"$gt": 0},
+		"archived":    bson.M{"$ne": true},
+		"is_one_time": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка при получении пользователей со ставками: %v", err)
+	}
+
+	reports := make(map[int64]*stakeReport)
+	for _, rawID := range telegramIDs {
+		telegramID, ok := toInt64(rawID)
+		if !ok {
+			continue
+		}
+		if err := s.settleUser(ctx, telegramID, reports); err != nil {
+			log.Printf("Ошибка расчета ставок пользователя %d: %v", telegramID, err)
+		}
+	}
+
+	s.sendReports(ctx, reports)
+	return nil
+}
+
+func (s *StakeSettlementService) settleUser(ctx context.Context, telegramID int64, reports map[int64]*stakeReport) error {
+	var user models.User
+	if err := s.usersCollection.FindOne(ctx, bson.M{"telegram_id": telegramID}).Decode(&user); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil || user.Timezone == "" {
+		loc = time.UTC
+	}
+
+	cursor, err := s.habitsCollection.Find(ctx, bson.M{
+		"telegram_id": telegramID,
+		"stake":       bson.M{"$gt": 0},
+		"archived":    bson.M{"$ne": true},
+		"is_one_time": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return err
+	}
+	var habits []models.Habit
+	if err := cursor.All(ctx, &habits); err != nil {
+		return err
+	}
+
+	// Пропуски закрываются заморозками до расчета: пользователь мог не открывать приложение,
+	// а заморозка, примененная после списания, ставку уже не вернет
+	now := time.Now().In(loc)
+	for _, habit := range habits {
+		usedFreezes, err := ApplyStreakFreezes(ctx, s.freezesCollection, s.historyCollection, habit, now)
+		if err != nil {
+			log.Printf("Ошибка при применении заморозок для привычки %s: %v", habit.ID.Hex(), err)
+		}
+		if usedFreezes > 0 {
+			log.Printf("Для привычки %s использовано заморозок: %d", habit.ID.Hex(), usedFreezes)
+			if _, err := RefreshHabitStats(ctx, s.habitsCollection, s.historyCollection, habit, now); err != nil {
+				log.Printf("Ошибка при обновлении привычки %s: %v", habit.ID.Hex(), err)
+			}
+		}
+	}
+
+	// День рассчитывается, только когда его уже нельзя исправить через HandleBackfill
+	today := schedule.Day(now)
+	window := BackfillWindowDays()
+	for daysAgo := window + settlementLookbackDays; daysAgo > window; daysAgo-- {
+		date := today.AddDate(0, 0, -daysAgo)
+		for _, habit := range habits {
+			if err := s.settleHabit(ctx, habit, date, reports); err != nil {
+				log.Printf("Ошибка расчета ставки привычки %s за %s: %v", habit.ID.Hex(), date.Format(schedule.DateLayout), err)
+			}
+		}
+	}
+	return nil
+}
+
+// settleHabit рассчитывает ставку привычки за период, который заканчивается в день date.
+func (s *StakeSettlementService) settleHabit(ctx context.Context, habit models.Habit, date time.Time, reports map[int64]*stakeReport) error {
+	start, end := schedule.Window(habit, date)
+	if !end.Equal(date) {
+		// Период (неделя) еще не закончился
+		return nil
+	}
+	if start.Equal(end) && !schedule.IsDue(habit, date) {
+		return nil
+	}
+	dateStr := date.Format(schedule.DateLayout)
+	startStr := start.Format(schedule.DateLayout)
+	if habit.CreatedAt.In(date.Location()).Format(schedule.DateLayout) > startStr {
+		// Привычки еще не было в начале периода
+		return nil
+	}
+
+	done, err := s.windowCompleted(ctx, habit, start, end)
+	if err != nil {
+		return err
+	}
+	frozen := false
+	if !done {
+		if frozen, err = s.windowFrozen(ctx, habit, start, end); err != nil {
+			return err
+		}
+	}
+
+	settlement := models.StakeSettlement{
+		HabitID:    habit.ID,
+		TelegramID: habit.TelegramID,
+		Date:       dateStr,
+		Status:     models.SettlementCompleted,
+		CreatedAt:  time.Now(),
+	}
+	switch {
+	case frozen:
+		settlement.Status = models.SettlementFrozen
+	case !done:
+		settlement.Status = models.SettlementCharging
+	}
+
+	// Сначала занимаем день: повторный запуск упрется в уникальный индекс. Списание, которое
+	// не завершилось (статус charging), повторный запуск продолжает с тем же расчетом.
+	result, err := s.settlementsCollection.InsertOne(ctx, settlement)
+	if mongo.IsDuplicateKeyError(err) {
+		err = s.settlementsCollection.FindOne(ctx, bson.M{"habit_id": habit.ID, "date": dateStr}).Decode(&settlement)
+		if err != nil {
+			return err
+		}
+		if settlement.Status != models.SettlementCharging {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	} else {
+		settlement.ID = result.InsertedID.(primitive.ObjectID)
+	}
+	if settlement.Status != models.SettlementCharging {
+		return nil
+	}
+
+	// Списываем ставку, но не больше текущего баланса
+	var owner models.User
+	if err := s.usersCollection.FindOne(ctx, bson.M{"telegram_id": habit.TelegramID}).Decode(&owner); err != nil {
+		return err
+	}
+	stakeKey := fmt.Sprintf("stake:%s:%s", habit.ID.Hex(), dateStr)
+	amount := habit.Stake
+	if owner.Balance < amount {
+		amount = owner.Balance
+	}
+	posted := false
+	if amount > 0 {
+		posted, err = s.ledger.Spend(ctx, models.LedgerEntry{
+			TelegramID:     habit.TelegramID,
+			Amount:         -amount,
+			Reason:         models.LedgerStakePenalty,
+			RefType:        models.LedgerRefSettlement,
+			RefID:          settlement.ID.Hex(),
+			IdempotencyKey: stakeKey,
+		})
+		if errors.Is(err, ErrInsufficientBalance) {
+			log.Printf("Баланс пользователя %d изменился во время расчета ставки, списание пропущено", habit.TelegramID)
+			amount = 0
+		} else if err != nil {
+			// День остается в статусе charging, следующий запуск повторит списание
+			return err
+		}
+	}
+	if !posted && amount > 0 {
+		// Ставка уже списана предыдущим запуском, который не дошел до распределения
+		spent, err := s.ledger.Sum(ctx, bson.M{"idempotency_key": stakeKey})
+		if err != nil {
+			return err
+		}
+		amount = -spent
+	}
+	if amount <= 0 {
+		log.Printf("У пользователя %d нет WILL для ставки по привычке %s", habit.TelegramID, habit.ID.Hex())
+		_, err := s.settlementsCollection.UpdateOne(ctx,
+			bson.M{"_id": settlement.ID},
+			bson.M{"$set": bson.M{"status": models.SettlementMissed, "stake": 0}},
+		)
+		return err
+	}
+
+	// Распределяем ставку между подписчиками пропорционально их ставкам
+	candidates, err := s.payoutCandidates(ctx, habit, start, end)
+	if err != nil {
+		log.Printf("Ошибка поиска подписчиков привычки %s: %v", habit.ID.Hex(), err)
+	}
+	totalStake := 0
+	for _, candidate := range candidates {
+		totalStake += candidate.Stake
+	}
+
+	distributed := 0
+	var payouts []models.StakePayout
+	if totalStake > 0 {
+		for _, candidate := range candidates {
+			win := amount * candidate.Stake / totalStake
+			if win <= 0 {
+				continue
+			}
+			paid, err := s.ledger.Post(ctx, models.LedgerEntry{
+				TelegramID:     candidate.TelegramID,
+				Amount:         win,
+				Reason:         models.LedgerStakeWin,
+				RefType:        models.LedgerRefSettlement,
+				RefID:          settlement.ID.Hex(),
+				IdempotencyKey: fmt.Sprintf("stake_win:%s:%s", settlement.ID.Hex(), candidate.ID.Hex()),
+			})
+			if err != nil {
+				// День остается в статусе charging: следующий запуск доначислит выигрыши
+				return fmt.Errorf("ошибка начисления выигрыша пользователю %d: %v", candidate.TelegramID, err)
+			}
+			distributed += win
+			payouts = append(payouts, models.StakePayout{
+				TelegramID: candidate.TelegramID,
+				HabitID:    candidate.ID,
+				HabitTitle: candidate.Title,
+				Amount:     win,
+			})
+			if paid {
+				report(reports, candidate.TelegramID).addReceived(win, displayName(owner), habit.Title, candidate.Title)
+			}
+		}
+	}
+
+	// Остаток (нет подписчиков или округление) уходит в системный баланс
+	systemAmount := amount - distributed
+	if systemAmount > 0 {
+		_, err := s.ledger.Post(ctx, models.LedgerEntry{
+			TelegramID:     models.SystemTelegramID,
+			Amount:         systemAmount,
+			Reason:         models.LedgerSystemShare,
+			RefType:        models.LedgerRefSettlement,
+			RefID:          settlement.ID.Hex(),
+			IdempotencyKey: fmt.Sprintf("stake_system:%s", settlement.ID.Hex()),
+		})
+		if err != nil {
+			// Списанная ставка уже в журнале, остаток пойдет в систему при следующем запуске
+			return fmt.Errorf("ошибка пополнения системного баланса на %d: %v", systemAmount, err)
+		}
+	}
+	if posted {
+		report(reports, habit.TelegramID).addSent(amount, habit.Title)
+	}
+
+	_, err = s.settlementsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": settlement.ID},
+		bson.M{"$set": bson.M{
+			"status":        models.SettlementMissed,
+			"stake":         amount,
+			"payouts":       payouts,
+			"system_amount": systemAmount,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Ставка по привычке %s за %s: списано %d, подписчикам %d, системе %d",
+		habit.ID.Hex(), dateStr, amount, distributed, systemAmount)
+	return nil
+}
+
+// payoutCandidates возвращает привычки подписчиков, которые получают долю ставки: привычка связана
+// взаимно, не в архиве, ее владелец имеет положительный баланс и выполнил ее за тот же период.
+func (s *StakeSettlementService) payoutCandidates(ctx context.Context, habit models.Habit, start, end time.Time) ([]models.Habit, error) {
+	var followerIDs []primitive.ObjectID
+	for _, id := range habit.Followers {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			followerIDs = append(followerIDs, objectID)
+		}
+	}
+	if len(followerIDs) == 0 {
+		return nil, nil
+	}
+
+	cursor, err := s.habitsCollection.Find(ctx, bson.M{
+		"_id":       bson.M{"$in": followerIDs},
+		"archived":  bson.M{"$ne": true},
+		"followers": habit.ID.Hex(),
+		"stake":     bson.M{"$gt": 0},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var followerHabits []models.Habit
+	if err := cursor.All(ctx, &followerHabits); err != nil {
+		return nil, err
+	}
+
+	var candidates []models.Habit
+	for _, followerHabit := range followerHabits {
+		var followerUser models.User
+		err := s.usersCollection.FindOne(ctx, bson.M{"telegram_id": followerHabit.TelegramID}).Decode(&followerUser)
+		if err != nil || followerUser.Balance <= 0 {
+			continue
+		}
+		done, err := s.windowCompleted(ctx, followerHabit, start, end)
+		if err != nil || !done {
+			continue
+		}
+		candidates = append(candidates, followerHabit)
+	}
+	return candidates, nil
+}
+
+// windowCompleted проверяет, выполнена ли норма привычки в периоде [start, end].
+func (s *StakeSettlementService) windowCompleted(ctx context.Context, habit models.Habit, start, end time.Time) (bool, error) {
+	count, err := CountCompletedDays(ctx, s.historyCollection, habit, start.Format(schedule.DateLayout), end.Format(schedule.DateLayout))
+	if err != nil {
+		return false, err
+	}
+	quota := 1
+	if !start.Equal(end) {
+		quota = schedule.Quota(habit)
+	}
+	return count >= quota, nil
+}
+
+// windowFrozen проверяет, закрыт ли пропуск в периоде [start, end] заморозкой стрика.
+// Так же пропуск трактует расчет стрика: период с заморозкой не считается проваленным.
+func (s *StakeSettlementService) windowFrozen(ctx context.Context, habit models.Habit, start, end time.Time) (bool, error) {
+	_, frozen, err := habitDays(ctx, s.historyCollection, habit)
+	if err != nil {
+		return false, err
+	}
+	return countInRange(frozen, start, end, end.Format(schedule.DateLayout)) > 0, nil
+}
+
+// sendReports отправляет пользователям итог движения WILL за запуск
+func (s *StakeSettlementService) sendReports(ctx context.Context, reports map[int64]*stakeReport) {
+	if s.bot == nil {
+		return
+	}
+	for telegramID, r := range reports {
+		var user models.User
+		_ = s.usersCollection.FindOne(ctx, bson.M{"telegram_id": telegramID}).Decode(&user)
+
+		var text string
+		if user.LanguageCode == "ru" {
+			text = r.format("Отчёт о движении WILL", "📤 Списания:", "📥 Получено:", "💰 Итого")
+		} else {
+			text = r.format("WILL Movement Report", "📤 Deductions:", "📥 Received:", "💰 Total")
+		}
+
+		_, err := s.bot.SendMessage(ctx, &tgbot.SendMessageParams{ChatID: telegramID, Text: text})
+		if err != nil {
+			log.Printf("Не удалось отправить отчет о ставках пользователю %d: %v", telegramID, err)
+		}
+	}
+}
+
+func report(reports map[int64]*stakeReport, telegramID int64) *stakeReport {
+	r, ok := reports[telegramID]
+	if !ok {
+		r = &stakeReport{}
+		reports[telegramID] = r
+	}
+	return r
+}
+
+func (r *stakeReport) addSent(amount int, habitTitle string) {
+	r.sent = append(r.sent, fmt.Sprintf("- %d WILL: '%s'", amount, habitTitle))
+	r.total[0] += amount
+}
+
+func (r *stakeReport) addReceived(amount int, from, fromHabit, forHabit string) {
+	r.received = append(r.received, fmt.Sprintf("- %d WILL: %s ('%s') → '%s'", amount, from, fromHabit, forHabit))
+	r.total[1] += amount
+}
+
+func (r *stakeReport) format(title, sentTitle, receivedTitle, totalTitle string) string {
+	parts := []string{title}
+	if len(r.sent) > 0 {
+		parts = append(parts, sentTitle+"\n"+strings.Join(r.sent, "\n"))
+	}
+	if len(r.received) > 0 {
+		parts = append(parts, receivedTitle+"\n"+strings.Join(r.received, "\n"))
+	}
+	parts = append(parts, fmt.Sprintf("%s: -%d / +%d WILL", totalTitle, r.total[0], r.total[1]))
+	return strings.Join(parts, "\n\n")
+}
+
+func displayName(user models.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return fmt.Sprintf("ID: %d", user.TelegramID)
+}
+
+// toInt64 приводит telegram_id из результата Distinct к int64
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"backend/models"
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	tgbot "github.com/go-telegram/bot"
+	tgmodels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// starsCurrency - валюта счетов Telegram Stars
+const starsCurrency = "XTR"
+
+// defaultStarsWillRate - сколько WILL начисляется за одну звезду по умолчанию
+const defaultStarsWillRate = 10
+
+// StarsService ведет покупки WILL за Telegram Stars: создает запись на каждый счет,
+// проверяет pre_checkout_query по этой записи и начисляет WILL после successful_payment.
+type StarsService struct {
+	paymentsCollection *mongo.Collection
+	ledger             *Ledger
+}
+
+func NewStarsService(paymentsCollection *mongo.Collection, ledger *Ledger) *StarsService {
+	return &StarsService{
+		paymentsCollection: paymentsCollection,
+		ledger:             ledger,
+	}
+}
+
+// EnsureIndexes создает уникальный индекс по payload счета.
+func (s *StarsService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.paymentsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "payload", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// starsWillRate возвращает курс WILL за звезду из STARS_WILL_RATE
+func starsWillRate() int {
+	if value := os.Getenv("STARS_WILL_RATE"); value != "" {
+		rate, err := strconv.Atoi(value)
+		if err == nil && rate > 0 {
+			return rate
+		}
+		log.Printf("Некорректное значение STARS_WILL_RATE=%s, используется %d", value, defaultStarsWillRate)
+	}
+	return defaultStarsWillRate
+}
+
+// CreatePayment сохраняет покупку перед выставлением счета. Payload из нее нужно передать в счет.
+func (s *StarsService) CreatePayment(ctx context.Context, telegramID int64, stars int) (models.StarsPayment, error) {
+	payment := models.StarsPayment{
+		ID:         primitive.NewObjectID(),
+		TelegramID: telegramID,
+		Stars:      stars,
+		WillAmount: stars * starsWillRate(),
+		Status:     models.StarsPaymentPending,
+		CreatedAt:  time.Now(),
+	}
+	payment.Payload = "stars:" + payment.ID.Hex()
+
+	_, err := s.paymentsCollection.InsertOne(ctx, payment)
+	return payment, err
+}
+
+// DeletePayment удаляет покупку, для которой не удалось выставить счет.
+func (s *StarsService) DeletePayment(ctx context.Context, payment models.StarsPayment) error {
+	_, err := s.paymentsCollection.DeleteOne(ctx, bson.M{"_id": payment.ID, "status": models.StarsPaymentPending})
+	return err
+}
+
+// RegisterHandlers подписывает сервис на обновления бота с pre_checkout_query и successful_payment.
+func (s *StarsService) RegisterHandlers(b *tgbot.Bot) {
+	b.RegisterHandlerMatchFunc(func(update *tgmodels.Update) bool {
+		return update.PreCheckoutQuery != nil
+	}, s.handlePreCheckout)
+	b.RegisterHandlerMatchFunc(func(update *tgmodels.Update) bool {
+		return update.Message != nil && update.Message.SuccessfulPayment != nil
+	}, s.handleSuccessfulPayment)
+}
+
+// handlePreCheckout подтверждает оплату, только если счет выставлен этому пользователю,
+// еще не оплачен и сумма совпадает с сохраненной.
+func (s *StarsService) handlePreCheckout(ctx context.Context, b *tgbot.Bot, update *tgmodels.Update) {
+	query := update.PreCheckoutQuery
+	params := &tgbot.AnswerPreCheckoutQueryParams{PreCheckoutQueryID: query.ID, OK: true}
+
+	var payment models.StarsPayment
+	err := s.paymentsCollection.FindOne(ctx, bson.M{"payload": query.InvoicePayload}).Decode(&payment)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		params.OK, params.ErrorMessage = false, "Invoice not found"
+	case err != nil:
+		log.Printf("Ошибка поиска покупки %s: %v", query.InvoicePayload, err)
+		params.OK, params.ErrorMessage = false, "Temporary error, please try again"
+	case payment.Status != models.StarsPaymentPending:
+		params.OK, params.ErrorMessage = false, "Invoice already paid"
+	case query.From == nil || query.From.ID != payment.TelegramID:
+		params.OK, params.ErrorMessage = false, "Invoice belongs to another user"
+	case query.Currency != starsCurrency || query.TotalAmount != payment.Stars:
+		params.OK, params.ErrorMessage = false, "Invoice amount mismatch"
+	}
+	if !params.OK {
+		log.Printf("Отклонен pre_checkout_query %s для счета %s: %s", query.ID, query.InvoicePayload, params.ErrorMessage)
+	}
+
+	if _, err := b.AnswerPreCheckoutQuery(ctx, params); err != nil {
+		log.Printf("Ошибка ответа на pre_checkout_query %s: %v", query.ID, err)
+	}
+}
+
+// handleSuccessfulPayment начисляет WILL за оплаченный счет. Сначала оплата фиксируется в статусе
+// paid_uncredited вместе с charge ID: если начисление не пройдет, его повторит RecoverUncredited.
+// Ключ проводки привязан к payload, поэтому повторное начисление баланс не меняет.
+func (s *StarsService) handleSuccessfulPayment(ctx context.Context, b *tgbot.Bot, update *tgmodels.Update) {
+	paid := update.Message.SuccessfulPayment
+
+	var payment models.StarsPayment
+	if err := s.paymentsCollection.FindOne(ctx, bson.M{"payload": paid.InvoicePayload}).Decode(&payment); err != nil {
+		log.Printf("Оплата %s без сохраненного счета %s: %v", paid.TelegramPaymentChargeID, paid.InvoicePayload, err)
+		return
+	}
+	if paid.Currency != starsCurrency || paid.TotalAmount != payment.Stars {
+		log.Printf("Оплата %s не совпадает со счетом %s: %d %s вместо %d %s",
+			paid.TelegramPaymentChargeID, payment.Payload, paid.TotalAmount, paid.Currency, payment.Stars, starsCurrency)
+		return
+	}
+
+	_, err := s.paymentsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": payment.ID, "status": models.StarsPaymentPending},
+		bson.M{"$set": bson.M{
+			"status":             models.StarsPaymentPaidUncredited,
+			"telegram_charge_id": paid.TelegramPaymentChargeID,
+			"paid_at":            time.Now(),
+		}},
+	)
+	if err != nil {
+		// Звезды уже списаны, поэтому WILL все равно начисляем
+		log.Printf("Ошибка сохранения оплаты %s (charge %s): %v", payment.Payload, paid.TelegramPaymentChargeID, err)
+	}
+
+	if err := s.credit(ctx, payment); err != nil {
+		log.Printf("Ошибка начисления WILL за оплату %s, начисление будет повторено: %v", payment.Payload, err)
+	}
+}
+
+// RecoverUncredited повторяет начисление WILL за оплаченные, но не начисленные покупки.
+// Возвращает количество покупок, начисление по которым завершено.
+func (s *StarsService) RecoverUncredited(ctx context.Context) (int, error) {
+	cursor, err := s.paymentsCollection.Find(ctx, bson.M{"status": models.StarsPaymentPaidUncredited})
+	if err != nil {
+		return 0, err
+	}
+	var payments []models.StarsPayment
+	if err := cursor.All(ctx, &payments); err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	for _, payment := range payments {
+		if err := s.credit(ctx, payment); err != nil {
+			log.Printf("Ошибка повторного начисления WILL за оплату %s: %v", payment.Payload, err)
+			continue
+		}
+		recovered++
+	}
+	return recovered, nil
+}
+
+// credit проводит начисление WILL за покупку и переводит ее в статус paid
+func (s *StarsService) credit(ctx context.Context, payment models.StarsPayment) error {
+	credited, err := s.ledger.Post(ctx, models.LedgerEntry{
+		TelegramID:     payment.TelegramID,
+		Amount:         payment.WillAmount,
+		Reason:         models.LedgerStarsPurchase,
+		RefType:        models.LedgerRefStars,
+		RefID:          payment.ID.Hex(),
+		IdempotencyKey: payment.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	if credited {
+		log.Printf("Пользователю %d начислено %d WILL за %d Stars", payment.TelegramID, payment.WillAmount, payment.Stars)
+	}
+
+	_, err = s.paymentsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": payment.ID, "status": bson.M{"$in": []string{models.StarsPaymentPending, models.StarsPaymentPaidUncredited}}},
+		bson.M{"$set": bson.M{"status": models.StarsPaymentPaid}},
+	)
+	return err
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"backend/models"
+	"backend/schedule"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// HabitStats - показатели привычки, вычисленные по коллекции истории.
+// Поля streak, longest_streak, score и last_click_date в документе привычки — лишь кэш этих значений.
+type HabitStats struct {
+	Streak        int    // Текущий стрик на дату расчета
+	LongestStreak int    // Самый длинный стрик за всю историю
+	Score         int    // Общее количество выполненных дней
+	LastDoneDate  string // Последний день, в который дневная цель была достигнута
+}
+
+// CompletedDates возвращает множество дат (2006-01-02), в которые дневная цель привычки была достигнута.
+func CompletedDates(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit) (map[string]bool, error) {
+	dates, _, err := habitDays(ctx, historyCollection, habit)
+	return dates, err
+}
+
+// habitDays возвращает даты, в которые дневная цель была достигнута, и даты, закрытые заморозкой стрика.
+func habitDays(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit) (map[string]bool, map[string]bool, error) {
+	cursor, err := historyCollection.Find(ctx, bson.M{
+		"telegram_id":     habit.TelegramID,
+		"habits.habit_id": habit.ID,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	target := habit.DailyTarget()
+	dates := make(map[string]bool)
+	frozen := make(map[string]bool)
+	for cursor.Next(ctx) {
+		var history models.History
+		if err := cursor.Decode(&history); err != nil {
+			continue
+		}
+		for _, entry := range history.Habits {
+			if entry.HabitID != habit.ID {
+				continue
+			}
+			if entry.Progress(target) >= target {
+				dates[history.Date] = true
+			} else if entry.Status == models.HistoryStatusFrozen {
+				frozen[history.Date] = true
+			}
+			break
+		}
+	}
+	return dates, frozen, cursor.Err()
+}
+
+// CalculateHabitStats вычисляет показатели привычки по истории на момент now (в часовом поясе пользователя).
+// Стрик — число выполнений в непрерывной цепочке периодов по расписанию, в которых норма выполнена.
+// Текущий период (сегодня или текущая неделя) еще не закончен, поэтому невыполненная норма в нем цепочку не рвет.
+// Период, закрытый заморозкой, цепочку тоже не рвет, но и не увеличивает стрик.
+func CalculateHabitStats(ctx context.Context, historyCollection *mongo.Collection, habit models.Habit, now time.Time) (HabitStats, error) {
+	dates, frozen, err := habitDays(ctx, historyCollection, habit)
+	if err != nil {
+		return HabitStats{}, err
+	}
+	return calculateStats(habit, dates, frozen, now), nil
+}
+
+// RefreshHabitStats пересчитывает показатели привычки по истории и сохраняет их в документ привычки.
+// Все изменения выполнения привычки должны заканчиваться вызовом этой функции.
+func RefreshHabitStats(ctx context.Context, habitsCollection, historyCollection *mongo.Collection, habit models.Habit, now time.Time) (models.Habit, error) {
+	stats, err := CalculateHabitStats(ctx, historyCollection, habit, now)
+	if err != nil {
+		return habit, err
+	}
+
+	_, err = habitsCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": habit.ID},
+		bson.M{"$set": bson.M{
+			"streak":          stats.Streak,
+			"longest_streak":  stats.LongestStreak,
+			"score":           stats.Score,
+			"last_click_date": stats.LastDoneDate,
+		}},
+	)
+	if err != nil {
+		return habit, err
+	}
+
+	habit.Streak = stats.Streak
+	habit.LongestStreak = stats.LongestStreak
+	habit.Score = stats.Score
+	habit.LastClickDate = stats.LastDoneDate
+	return habit, nil
+}
+
+func calculateStats(habit models.Habit, dates, frozen map[string]bool, now time.Time) HabitStats {
+	stats := HabitStats{}
+	today := now.Format(schedule.DateLayout)
+	for date := range dates {
+		if date > today {
+			continue
+		}
+		stats.Score++
+		if date > stats.LastDoneDate {
+			stats.LastDoneDate = date
+		}
+	}
+	// Разовые задачи выполняются один раз, стрика у них нет
+	if stats.LastDoneDate == "" || habit.IsOneTime {
+		return stats
+	}
+
+	// Идем по периодам от текущего к самому раннему выполнению и собираем цепочки
+	earliest := minDate(dates)
+	quota := schedule.Quota(habit)
+	start, end := schedule.Window(habit, now)
+	current := true
+	currentFound := false
+	run := 0
+	for {
+		count := countInRange(dates, start, end, today)
+		if count >= quota || current || countInRange(frozen, start, end, today) > 0 {
+			run += count
+		} else {
+			if !currentFound {
+				stats.Streak = run
+				currentFound = true
+			}
+			if run > stats.LongestStreak {
+				stats.LongestStreak = run
+			}
+			run = 0
+		}
+
+		// Раньше первого выполнения цепочка продолжиться не может
+		if start.Format(schedule.DateLayout) <= earliest {
+			break
+		}
+
+		var ok bool
+		start, end, ok = schedule.PrevWindow(habit, start)
+		if !ok {
+			break
+		}
+		current = false
+	}
+
+	if !currentFound {
+		stats.Streak = run
+	}
+	if run > stats.LongestStreak {
+		stats.LongestStreak = run
+	}
+	return stats
+}
+
+// countInRange считает выполненные дни в периоде [start, end], не заглядывая дальше today.
+func countInRange(dates map[string]bool, start, end time.Time, today string) int {
+	count := 0
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(schedule.DateLayout)
+		if date > today {
+			break
+		}
+		if dates[date] {
+			count++
+		}
+	}
+	return count
+}
+
+func minDate(dates map[string]bool) string {
+	result := ""
+	for date := range dates {
+		if result == "" || date < result {
+			result = date
+		}
+	}
+	return result
+}
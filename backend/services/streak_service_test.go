@@ -0,0 +1,95 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"backend/models"
+)
+
+// dateSet собирает множество дат в формате 2006-01-02
+func dateSet(dates ...string) map[string]bool {
+	set := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		set[date] = true
+	}
+	return set
+}
+
+func TestCalculateStats(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC) // среда
+	daily := models.Habit{Days: []int{0, 1, 2, 3, 4, 5, 6}}
+	weekly := models.Habit{Recurrence: &models.Recurrence{Type: models.RecurrenceTimesPerWeek, TimesPerWeek: 2}}
+	tests := []struct {
+		name   string
+		habit  models.Habit
+		dates  map[string]bool
+		frozen map[string]bool
+		want   HabitStats
+	}{
+		{
+			name:  "цепочка до сегодня",
+			habit: daily,
+			dates: dateSet("2024-01-08", "2024-01-09", "2024-01-10"),
+			want:  HabitStats{Streak: 3, LongestStreak: 3, Score: 3, LastDoneDate: "2024-01-10"},
+		},
+		{
+			name:  "сегодня еще не выполнено",
+			habit: daily,
+			dates: dateSet("2024-01-08", "2024-01-09"),
+			want:  HabitStats{Streak: 2, LongestStreak: 2, Score: 2, LastDoneDate: "2024-01-09"},
+		},
+		{
+			name:  "пропуск вчера обрывает стрик",
+			habit: daily,
+			dates: dateSet("2024-01-03", "2024-01-04", "2024-01-05", "2024-01-08"),
+			want:  HabitStats{Streak: 0, LongestStreak: 3, Score: 4, LastDoneDate: "2024-01-08"},
+		},
+		{
+			name:   "заморозка сохраняет стрик, но не увеличивает",
+			habit:  daily,
+			dates:  dateSet("2024-01-07", "2024-01-08", "2024-01-10"),
+			frozen: dateSet("2024-01-09"),
+			want:   HabitStats{Streak: 3, LongestStreak: 3, Score: 3, LastDoneDate: "2024-01-10"},
+		},
+		{
+			name:  "будущие даты не учитываются",
+			habit: daily,
+			dates: dateSet("2024-01-10", "2024-01-11"),
+			want:  HabitStats{Streak: 1, LongestStreak: 1, Score: 1, LastDoneDate: "2024-01-10"},
+		},
+		{
+			name:  "N раз в неделю с выполненной нормой",
+			habit: weekly,
+			dates: dateSet("2024-01-02", "2024-01-04", "2024-01-08"),
+			want:  HabitStats{Streak: 3, LongestStreak: 3, Score: 3, LastDoneDate: "2024-01-08"},
+		},
+		{
+			name:  "N раз в неделю с невыполненной нормой",
+			habit: weekly,
+			dates: dateSet("2024-01-02", "2024-01-08"),
+			want:  HabitStats{Streak: 1, LongestStreak: 1, Score: 2, LastDoneDate: "2024-01-08"},
+		},
+		{
+			name:  "у разовой задачи нет стрика",
+			habit: models.Habit{IsOneTime: true},
+			dates: dateSet("2024-01-05"),
+			want:  HabitStats{Score: 1, LastDoneDate: "2024-01-05"},
+		},
+		{
+			name:  "нет выполнений",
+			habit: daily,
+			dates: dateSet(),
+			want:  HabitStats{},
+		},
+	}
+	for _, tt := range tests {
+		frozen := tt.frozen
+		if frozen == nil {
+			frozen = dateSet()
+		}
+		if got := calculateStats(tt.habit, tt.dates, frozen, now); got != tt.want {
+			t.Errorf("%s: calculateStats = %+v, ожидалось %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxIconLength - иконка хранится как эмодзи, составные эмодзи занимают несколько символов
+const maxIconLength = 8
+
+var colorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ValidateDisplay проверяет цвет (#RRGGBB) и иконку привычки или тега. Пустые значения допустимы.
+func ValidateDisplay(color, icon string) error {
+	if color != "" && !colorRegex.MatchString(color) {
+		return fmt.Errorf("некорректный цвет: %s", color)
+	}
+	if utf8.RuneCountInString(icon) > maxIconLength {
+		return fmt.Errorf("иконка слишком длинная")
+	}
+	return nil
+}
+
+// UniqueTags убирает повторы из списка тегов привычки, сохраняя порядок.
+func UniqueTags(tagIDs []primitive.ObjectID) []primitive.ObjectID {
+	result := make([]primitive.ObjectID, 0, len(tagIDs))
+	seen := make(map[primitive.ObjectID]bool)
+	for _, id := range tagIDs {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// ValidateHabitTags проверяет, что все теги привычки существуют и принадлежат пользователю.
+func ValidateHabitTags(ctx context.Context, tagsCollection *mongo.Collection, telegramID int64, tagIDs []primitive.ObjectID) error {
+	ids := UniqueTags(tagIDs)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	count, err := tagsCollection.CountDocuments(ctx, bson.M{
+		"_id":         bson.M{"$in": ids},
+		"telegram_id": telegramID,
+	})
+	if err != nil {
+		return err
+	}
+	if int(count) != len(ids) {
+		return fmt.Errorf("тег не найден")
+	}
+	return nil
+}
+
+// TagFilter добавляет к фильтру привычек условие по тегу из параметра запроса.
+// Пустой tag оставляет фильтр без изменений.
+func TagFilter(filter bson.M, tag string) error {
+	if tag == "" {
+		return nil
+	}
+	tagID, err := primitive.ObjectIDFromHex(tag)
+	if err != nil {
+		return fmt.Errorf("invalid tag format")
+	}
+	filter["tags"] = tagID
+	return nil
+}
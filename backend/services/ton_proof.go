@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Сроки действия ton_proof
+const (
+	tonProofPayloadTTL = 15 * time.Minute // Сколько действует выданный payload
+	tonProofMaxAge     = 15 * time.Minute // Насколько подпись кошелька может быть старше времени проверки
+)
+
+var (
+	ErrTonProofPayload   = errors.New("payload ton_proof не выдавался этому пользователю или истек")
+	ErrTonProofUsed      = errors.New("payload ton_proof уже использован")
+	ErrTonProofDomain    = errors.New("ton_proof подписан для другого домена")
+	ErrTonProofExpired   = errors.New("подпись ton_proof устарела")
+	ErrTonProofWallet    = errors.New("state_init не соответствует адресу или кошелек не поддерживается")
+	ErrTonProofSignature = errors.New("подпись ton_proof неверна")
+)
+
+// TonProofDomain - домен приложения из ton_proof в формате TON Connect
+type TonProofDomain struct {
+	LengthBytes uint32 `json:"lengthBytes"`
+	Value       string `json:"value"`
+}
+
+// TonProof - подпись владения кошельком, которую TON Connect возвращает при подключении
+type TonProof struct {
+	Timestamp int64          `json:"timestamp"`
+	Domain    TonProofDomain `json:"domain"`
+	Signature string         `json:"signature"`  // Подпись ed25519 (base64)
+	Payload   string         `json:"payload"`    // Payload, выданный Payload
+	StateInit string         `json:"state_init"` // StateInit кошелька (BOC в base64)
+}
+
+// TonProofService выдает payload для TON Connect ton_proof и проверяет подписанные кошельком доказательства.
+// Payload содержит срок действия и HMAC с Telegram ID, поэтому хранить выданные payload не нужно,
+// а доказательство, полученное для одного пользователя, не подходит другому. Принятые payload
+// записываются до истечения срока, и повторно доказательство с тем же payload не принимается.
+type TonProofService struct {
+	payloadsCollection *mongo.Collection
+	secret             []byte
+	domain             string
+}
+
+// usedTonProofPayload - принятый payload ton_proof. Хранится, пока payload не истечет.
+type usedTonProofPayload struct {
+	Payload    string    `bson:"_id"`
+	TelegramID int64     `bson:"telegram_id"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+}
+
+func NewTonProofService(payloadsCollection *mongo.Collection) *TonProofService {
+	secret := []byte(os.Getenv("TON_PROOF_SECRET"))
+	if len(secret) == 0 {
+		log.Println("Предупреждение: TON_PROOF_SECRET не установлен. Payload ton_proof будут недействительны после перезапуска.")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Ошибка генерации ключа ton_proof: %v", err)
+		}
+	}
+	domain := os.Getenv("TON_PROOF_DOMAIN")
+	if domain == "" {
+		log.Println("Предупреждение: TON_PROOF_DOMAIN не установлен. Привязка кошельков недоступна.")
+	}
+	return &TonProofService{
+		payloadsCollection: payloadsCollection,
+		secret:             secret,
+		domain:             domain,
+	}
+}
+
+// EnsureIndexes создает TTL-индекс: принятые payload удаляются, когда истекают и уже не проходят проверку.
+func (s *TonProofService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.payloadsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Payload выдает пользователю telegramID одноразовую строку, которую кошелек подписывает в ton_proof
+func (s *TonProofService) Payload(telegramID int64) (string, error) {
+	payload := make([]byte, 16, 32)
+	if _, err := rand.Read(payload[:8]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[8:], uint64(time.Now().Add(tonProofPayloadTTL).Unix()))
+	payload = append(payload, s.payloadMAC(telegramID, payload)...)
+	return hex.EncodeToString(payload), nil
+}
+
+// payloadMAC возвращает первые 16 байт HMAC-SHA256 от Telegram ID и случайной части со сроком действия
+func (s *TonProofService) payloadMAC(telegramID int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%d|", telegramID)
+	mac.Write(body)
+	return mac.Sum(nil)[:16]
+}
+
+// checkPayload проверяет, что payload выдан пользователю telegramID и еще действует. Возвращает срок действия.
+func (s *TonProofService) checkPayload(telegramID int64, payload string) (time.Time, error) {
+	raw, err := hex.DecodeString(payload)
+	if err != nil || len(raw) != 32 {
+		return time.Time{}, ErrTonProofPayload
+	}
+	if !hmac.Equal(s.payloadMAC(telegramID, raw[:16]), raw[16:]) {
+		return time.Time{}, ErrTonProofPayload
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(raw[8:16])), 0)
+	if time.Now().After(expiresAt) {
+		return time.Time{}, ErrTonProofPayload
+	}
+	return expiresAt, nil
+}
+
+// usePayload помечает payload использованным. Уникальный _id не дает принять его дважды,
+// в том числе в двух одновременных запросах.
+func (s *TonProofService) usePayload(ctx context.Context, telegramID int64, payload string, expiresAt time.Time) error {
+	_, err := s.payloadsCollection.InsertOne(ctx, usedTonProofPayload{
+		Payload:    payload,
+		TelegramID: telegramID,
+		ExpiresAt:  expiresAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrTonProofUsed
+	}
+	return err
+}
+
+// Verify проверяет ton_proof кошелька rawAddress для пользователя telegramID: payload, домен, срок подписи,
+// соответствие state_init адресу и подпись публичным ключом из state_init, после чего погашает payload.
+// Возвращает адрес и публичный ключ.
+func (s *TonProofService) Verify(ctx context.Context, telegramID int64, rawAddress string, proof TonProof) (*address.Address, ed25519.PublicKey, error) {
+	expiresAt, err := s.checkPayload(telegramID, proof.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.domain == "" || proof.Domain.Value != s.domain || int(proof.Domain.LengthBytes) != len(proof.Domain.Value) {
+		return nil, nil, ErrTonProofDomain
+	}
+	signedAt := time.Unix(proof.Timestamp, 0)
+	if time.Since(signedAt) > tonProofMaxAge || time.Until(signedAt) > time.Minute {
+		return nil, nil, ErrTonProofExpired
+	}
+
+	addr, err := address.ParseRawAddr(rawAddress)
+	if err != nil {
+		return nil, nil, ErrTonProofWallet
+	}
+	publicKey, err := walletPublicKey(addr, proof.StateInit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(proof.Signature)
+	if err != nil || !ed25519.Verify(publicKey, tonProofMessage(addr, proof), signature) {
+		return nil, nil, ErrTonProofSignature
+	}
+	if err := s.usePayload(ctx, telegramID, proof.Payload, expiresAt); err != nil {
+		return nil, nil, err
+	}
+	return addr, publicKey, nil
+}
+
+// tonProofMessage собирает хэш, который подписывает кошелек, по спецификации TON Connect:
+// sha256(0xffff || "ton-connect" || sha256("ton-proof-item-v2/" || адрес || домен || время || payload))
+func tonProofMessage(addr *address.Address, proof TonProof) []byte {
+	var message bytes.Buffer
+	message.WriteString("ton-proof-item-v2/")
+	binary.Write(&message, binary.BigEndian, int32(addr.Workchain()))
+	message.Write(addr.Data())
+	binary.Write(&message, binary.LittleEndian, proof.Domain.LengthBytes)
+	message.WriteString(proof.Domain.Value)
+	binary.Write(&message, binary.LittleEndian, uint64(proof.Timestamp))
+	message.WriteString(proof.Payload)
+	messageHash := sha256.Sum256(message.Bytes())
+
+	var full bytes.Buffer
+	full.Write([]byte{0xff, 0xff})
+	full.WriteString("ton-connect")
+	full.Write(messageHash[:])
+	hash := sha256.Sum256(full.Bytes())
+	return hash[:]
+}
+
+// walletPublicKey проверяет, что state_init соответствует адресу, и извлекает из его данных публичный ключ.
+// Поддерживаются кошельки V3, V4 и V5: у остальных ключ хранится иначе.
+func walletPublicKey(addr *address.Address, stateInitBOC string) (ed25519.PublicKey, error) {
+	boc, err := base64.StdEncoding.DecodeString(stateInitBOC)
+	if err != nil {
+		return nil, ErrTonProofWallet
+	}
+	root, err := cell.FromBOC(boc)
+	if err != nil {
+		return nil, ErrTonProofWallet
+	}
+	if !bytes.Equal(root.Hash(), addr.Data()) {
+		return nil, ErrTonProofWallet
+	}
+
+	var stateInit tlb.StateInit
+	if err := tlb.LoadFromCell(&stateInit, root.BeginParse()); err != nil || stateInit.Code == nil || stateInit.Data == nil {
+		return nil, ErrTonProofWallet
+	}
+
+	// Данные V3 и V4 начинаются с seqno и subwallet_id, у V5 перед ними флаг разрешения подписи
+	var skip uint
+	account := &tlb.Account{IsActive: true, State: &tlb.AccountState{AccountStorage: tlb.AccountStorage{Status: tlb.AccountStatusActive}}, Code: stateInit.Code}
+	switch wallet.GetWalletVersion(account) {
+	case wallet.V3R1, wallet.V3R2, wallet.V4R1, wallet.V4R2:
+		skip = 64
+	case wallet.V5R1Final:
+		skip = 65
+	default:
+		return nil, ErrTonProofWallet
+	}
+
+	data := stateInit.Data.BeginParse()
+	if _, err := data.LoadSlice(skip); err != nil {
+		return nil, ErrTonProofWallet
+	}
+	key, err := data.LoadSlice(256)
+	if err != nil {
+		return nil, ErrTonProofWallet
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func TestCheckPayload(t *testing.T) {
+	s := &TonProofService{secret: []byte("test secret")}
+	valid, err := s.Payload(1)
+	if err != nil {
+		t.Fatalf("Ошибка выдачи payload: %v", err)
+	}
+
+	// Payload с истекшим сроком и верной подписью
+	expiredRaw := make([]byte, 16)
+	binary.BigEndian.PutUint64(expiredRaw[8:], uint64(time.Now().Add(-time.Minute).Unix()))
+	expired := hex.EncodeToString(append(expiredRaw, s.payloadMAC(1, expiredRaw)...))
+
+	// Payload с измененным сроком действия
+	tamperedRaw, _ := hex.DecodeString(valid)
+	binary.BigEndian.PutUint64(tamperedRaw[8:16], uint64(time.Now().Add(24*time.Hour).Unix()))
+	tampered := hex.EncodeToString(tamperedRaw)
+
+	tests := []struct {
+		name       string
+		telegramID int64
+		payload    string
+		valid      bool
+	}{
+		{"выданный payload", 1, valid, true},
+		{"чужой пользователь", 2, valid, false},
+		{"истекший срок", 1, expired, false},
+		{"измененный срок", 1, tampered, false},
+		{"не hex", 1, "not a payload", false},
+		{"короткий payload", 1, valid[:32], false},
+	}
+	for _, tt := range tests {
+		_, err := s.checkPayload(tt.telegramID, tt.payload)
+		if tt.valid && err != nil {
+			t.Errorf("%s: checkPayload = %v, ожидался принятый payload", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrTonProofPayload) {
+			t.Errorf("%s: checkPayload = %v, ожидалось %v", tt.name, err, ErrTonProofPayload)
+		}
+	}
+}
+
+func TestVerifyRejectsBeforeSignature(t *testing.T) {
+	s := &TonProofService{secret: []byte("test secret"), domain: "app.example.com"}
+	payload, err := s.Payload(1)
+	if err != nil {
+		t.Fatalf("Ошибка выдачи payload: %v", err)
+	}
+	domain := TonProofDomain{LengthBytes: uint32(len(s.domain)), Value: s.domain}
+	rawAddress := address.NewAddress(0, 0, make([]byte, 32)).StringRaw()
+
+	tests := []struct {
+		name    string
+		address string
+		proof   TonProof
+		want    error
+	}{
+		{"чужой payload", rawAddress, TonProof{Payload: "00", Domain: domain, Timestamp: time.Now().Unix()}, ErrTonProofPayload},
+		{"другой домен", rawAddress, TonProof{Payload: payload, Domain: TonProofDomain{LengthBytes: 8, Value: "evil.com"}, Timestamp: time.Now().Unix()}, ErrTonProofDomain},
+		{"неверная длина домена", rawAddress, TonProof{Payload: payload, Domain: TonProofDomain{LengthBytes: 1, Value: s.domain}, Timestamp: time.Now().Unix()}, ErrTonProofDomain},
+		{"старая подпись", rawAddress, TonProof{Payload: payload, Domain: domain, Timestamp: time.Now().Add(-time.Hour).Unix()}, ErrTonProofExpired},
+		{"подпись из будущего", rawAddress, TonProof{Payload: payload, Domain: domain, Timestamp: time.Now().Add(time.Hour).Unix()}, ErrTonProofExpired},
+		{"некорректный адрес", "not an address", TonProof{Payload: payload, Domain: domain, Timestamp: time.Now().Unix()}, ErrTonProofWallet},
+		{"некорректный state_init", rawAddress, TonProof{Payload: payload, Domain: domain, Timestamp: time.Now().Unix(), StateInit: "!"}, ErrTonProofWallet},
+	}
+	for _, tt := range tests {
+		if _, _, err := s.Verify(context.Background(), 1, tt.address, tt.proof); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, ожидалось %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTonProofMessage(t *testing.T) {
+	addr := address.NewAddress(0, 0, bytes.Repeat([]byte{0xab}, 32))
+	proof := TonProof{
+		Timestamp: 1700000000,
+		Domain:    TonProofDomain{LengthBytes: 15, Value: "app.example.com"},
+		Payload:   "payload",
+	}
+
+	// Сообщение по спецификации TON Connect, собранное вручную
+	var inner bytes.Buffer
+	inner.WriteString("ton-proof-item-v2/")
+	inner.Write([]byte{0, 0, 0, 0})
+	inner.Write(bytes.Repeat([]byte{0xab}, 32))
+	inner.Write([]byte{15, 0, 0, 0})
+	inner.WriteString("app.example.com")
+	inner.Write([]byte{0x00, 0xf1, 0x53, 0x65, 0, 0, 0, 0}) // 1700000000 little-endian
+	inner.WriteString("payload")
+	innerHash := sha256.Sum256(inner.Bytes())
+	want := sha256.Sum256(append(append([]byte{0xff, 0xff}, "ton-connect"...), innerHash[:]...))
+
+	if got := tonProofMessage(addr, proof); !bytes.Equal(got, want[:]) {
+		t.Errorf("tonProofMessage = %x, ожидалось %x", got, want)
+	}
+
+	// Каждое поле доказательства входит в подписываемое сообщение
+	base := tonProofMessage(addr, proof)
+	changed := []TonProof{
+		{Timestamp: proof.Timestamp + 1, Domain: proof.Domain, Payload: proof.Payload},
+		{Timestamp: proof.Timestamp, Domain: TonProofDomain{LengthBytes: 15, Value: "app.example.org"}, Payload: proof.Payload},
+		{Timestamp: proof.Timestamp, Domain: proof.Domain, Payload: "other"},
+	}
+	for _, other := range changed {
+		if bytes.Equal(tonProofMessage(addr, other), base) {
+			t.Errorf("Изменение доказательства %+v не меняет подписываемое сообщение", other)
+		}
+	}
+	if bytes.Equal(tonProofMessage(address.NewAddress(0, 0, make([]byte, 32)), proof), base) {
+		t.Error("Адрес кошелька не входит в подписываемое сообщение")
+	}
+}
@@ -79,31 +79,44 @@ async function request(endpoint: string, options: RequestOptions = {}) {
     }
 }
 
+// Котировка обмена WILL: суммы к оплате или выводу рассчитывает сервер
+async function getQuote(data: {
+    direction: 'deposit' | 'withdraw';
+    currency: 'ton' | 'usdt';
+    will_amount: number;
+}): Promise<{
+    quote_id: string;
+    direction: string;
+    currency: string;
+    will_amount: number;
+    amount: number;
+    fee: number;
+    rate: number;
+    expires_at: string;
+}> {
+    return request('/api/ton/quote', {
+        method: 'POST',
+        body: JSON.stringify(data)
+    });
+}
+
 // Регистрация TON-депозита
 async function registerTonDeposit(data: { 
     transaction_id: string; 
-    amount: number; 
-    will_amount: number; 
+    quote_id: string; 
     wallet_address: string; 
-    telegram_id: number;
 }) {
     return request('/api/ton/deposit', { 
         method: 'POST', 
-        body: JSON.stringify({
-            ...data,
-            currency: 'ton',
-            payment_type: 'deposit'
-        }) 
+        body: JSON.stringify(data) 
     });
 }
 
 // Регистрация USDT-депозита
 async function registerUsdtDeposit(data: {
   transaction_id: string;
-  amount: number;
-  will_amount: number;
+  quote_id: string;
   wallet_address: string;
-  usdt_master_address: string;
 }) {
   console.log('registerUsdtDeposit вызван с данными:', data);
   try {
@@ -113,9 +126,9 @@ async function registerUsdtDeposit(data: {
       throw new Error('Отсутствует transaction_id');
     }
     
-    if (data.amount <= 0) {
-      console.error('Некорректная сумма USDT:', data.amount);
-      throw new Error('Некорректная сумма USDT');
+    if (!data.quote_id) {
+      console.error('Отсутствует quote_id');
+      throw new Error('Отсутствует quote_id');
     }
     
     if (!data.wallet_address) {
@@ -123,22 +136,13 @@ async function registerUsdtDeposit(data: {
       throw new Error('Отсутствует адрес кошелька');
     }
     
-    if (!data.usdt_master_address) {
-      console.error('Отсутствует адрес мастер-контракта USDT');
-      throw new Error('Отсутствует адрес мастер-контракта USDT');
-    }
-    
-    console.log('Данные проверены, отправляем запрос на /api/ton/usdt-deposit');
-    const result = await request('/api/ton/usdt-deposit', {
+    console.log('Данные проверены, отправляем запрос на /api/ton/jetton-deposit');
+    const result = await request('/api/ton/jetton-deposit', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({
-        ...data,
-        currency: 'usdt',
-        payment_type: 'deposit'
-      }),
+      body: JSON.stringify(data),
     });
     
     console.log('Успешно зарегистрирован USDT-депозит:', result);
@@ -163,8 +167,7 @@ async function checkUsdtTransaction(transactionId: string) {
 // Регистрация запроса на вывод токенов
 async function registerWithdrawal(data: {
   transaction_id: string;
-  will_amount: number;
-  amount: number;
+  quote_id: string;
   wallet_address: string;
 }) {
   console.log('registerWithdrawal вызван с данными:', data);
@@ -175,9 +178,9 @@ async function registerWithdrawal(data: {
       throw new Error('Отсутствует transaction_id');
     }
     
-    if (data.will_amount <= 0) {
-      console.error('Некорректная сумма WILL:', data.will_amount);
-      throw new Error('Некорректная сумма WILL');
+    if (!data.quote_id) {
+      console.error('Отсутствует quote_id');
+      throw new Error('Отсутствует quote_id');
     }
     
     if (!data.wallet_address) {
@@ -191,11 +194,7 @@ async function registerWithdrawal(data: {
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({
-        ...data,
-        currency: 'usdt',
-        payment_type: 'withdraw'
-      }),
+      body: JSON.stringify(data),
     });
     
     console.log('Успешно зарегистрирован запрос на вывод:', result);
@@ -206,6 +205,51 @@ async function registerWithdrawal(data: {
   }
 }
 
+// Привязанный кошелек: владение подтверждено подписью TON Connect ton_proof
+export interface LinkedWallet {
+  address: string;
+  public_key: string;
+  linked_at: string;
+}
+
+// Payload, который кошелек подписывает в ton_proof при подключении
+async function getTonProofPayload(): Promise<{ payload: string }> {
+  return request('/api/ton/proof/payload', {
+    method: 'POST'
+  });
+}
+
+// Привязка кошелька к аккаунту по ton_proof из TON Connect
+async function linkWallet(data: {
+  address: string;
+  network: string;
+  proof: {
+    timestamp: number;
+    domain: { lengthBytes: number; value: string };
+    signature: string;
+    payload: string;
+    state_init: string;
+  };
+}): Promise<{ success: boolean; wallets: LinkedWallet[] }> {
+  return request('/api/ton/wallets', {
+    method: 'POST',
+    body: JSON.stringify(data)
+  });
+}
+
+// Привязанные кошельки пользователя
+async function getLinkedWallets(): Promise<{ wallets: LinkedWallet[] }> {
+  return request('/api/ton/wallets');
+}
+
+// Отвязка кошелька
+async function unlinkWallet(address: string) {
+  return request('/api/ton/wallets', {
+    method: 'DELETE',
+    params: { address }
+  });
+}
+
 // API методы
 export const api = {
     // Пользователь
@@ -242,6 +286,9 @@ export const api = {
     getUserProfile: (username: string) =>
         request('/api/user/profile', { params: { username } }),
     
+    updateTimezone: (timezone: string) =>
+        request('/api/user/timezone', { method: 'PUT', body: JSON.stringify({ timezone }) }),
+    
     // Привычки
     createHabit: (data: any) =>
         request('/api/habit/create', { method: 'POST', body: JSON.stringify(data) }),
@@ -282,13 +329,9 @@ export const api = {
         request('/api/leaderboard'),
     
     // TON-транзакции
+    getQuote,
     registerTonDeposit,
     
-    checkTonTransaction: (transactionId: string, telegramId: number) =>
-        request('/api/ton/transaction', { 
-            params: { transaction_id: transactionId, telegram_id: telegramId.toString() } 
-        }),
-    
     // Инвойсы
     createInvoice: (amount: number) =>
         request('/api/invoice', { params: { amount: amount.toString() } }),
@@ -297,6 +340,10 @@ export const api = {
     registerUsdtDeposit,
     checkUsdtTransaction,
     registerWithdrawal,
+    getTonProofPayload,
+    linkWallet,
+    getLinkedWallets,
+    unlinkWallet,
     createPing: async (data: {
       follower_id: number;
       follower_username: string;
@@ -1,5 +1,6 @@
 import { TonConnectUI, THEME, type Wallet } from '@tonconnect/ui';
 import { themeParams } from '@tma.js/sdk-svelte';
+import { api } from './api';
 
 // Манифест для подключения к TON
 const manifestUrl = 'https://romanychev-l.github.io/habitry_public/manifest.json';
@@ -8,6 +9,10 @@ const manifestUrl = 'https://romanychev-l.github.io/habitry_public/manifest.json
 let tonConnectInstance: TonConnectUI | null = null;
 let isInitializing = false;
 
+// Payload ton_proof действует на сервере 15 минут, обновляем его заранее
+const TON_PROOF_REFRESH_MS = 10 * 60 * 1000;
+let tonProofTimer: ReturnType<typeof setInterval> | null = null;
+
 // Функция для получения экземпляра TonConnectUI
 export function getTonConnect(): TonConnectUI {
   if (!tonConnectInstance && !isInitializing) {
@@ -42,8 +47,16 @@ export function getTonConnect(): TonConnectUI {
         if (!wallet) {
           console.log('Кошелек отключен или произошла ошибка подключения');
           isInitializing = false;
+          return;
         }
+        linkConnectedWallet(wallet);
       });
+
+      // При подключении кошелек подписывает ton_proof — по нему сервер привязывает кошелек к аккаунту
+      refreshTonProofPayload();
+      if (!tonProofTimer) {
+        tonProofTimer = setInterval(refreshTonProofPayload, TON_PROOF_REFRESH_MS);
+      }
       
       console.log('TonConnectUI instance created successfully');
     } catch (error) {
@@ -56,6 +69,43 @@ export function getTonConnect(): TonConnectUI {
   return tonConnectInstance!;
 }
 
+// Запрашивает у сервера payload для ton_proof и передает его в параметры подключения
+async function refreshTonProofPayload(): Promise<void> {
+  if (!tonConnectInstance) return;
+  tonConnectInstance.setConnectRequestParameters({ state: 'loading' });
+  try {
+    const { payload } = await api.getTonProofPayload();
+    tonConnectInstance.setConnectRequestParameters({ state: 'ready', value: { tonProof: payload } });
+  } catch (error) {
+    console.error('Ошибка получения payload для ton_proof:', error);
+    tonConnectInstance.setConnectRequestParameters(null);
+  }
+}
+
+// Отправляет ton_proof подключенного кошелька на сервер. Подпись есть только при новом подключении,
+// при восстановлении сессии кошелек уже привязан или его нужно подключить заново.
+async function linkConnectedWallet(wallet: Wallet): Promise<void> {
+  const tonProof = wallet.connectItems?.tonProof;
+  if (!tonProof || !('proof' in tonProof)) return;
+
+  try {
+    await api.linkWallet({
+      address: wallet.account.address,
+      network: wallet.account.chain,
+      proof: {
+        ...tonProof.proof,
+        state_init: wallet.account.walletStateInit
+      }
+    });
+    console.log('Кошелек привязан к аккаунту:', wallet.account.address);
+  } catch (error) {
+    console.error('Ошибка привязки кошелька:', error);
+  } finally {
+    // Сервер принимает payload один раз: для следующего подключения берем новый
+    refreshTonProofPayload();
+  }
+}
+
 // Функция для проверки, был ли уже создан экземпляр
 export function isTonConnectInitialized(): boolean {
   return !!tonConnectInstance;
@@ -15,11 +15,11 @@ from bot.handlers.ai import ai_router
 from bot.handlers.quotes import quotes_router
 from bot.handlers.f2f import f2f_router
 from bot.handlers.service import service_router
+from bot.handlers.payments import payments_router
 from bot.middlewares.i18n import TranslatorRunnerMiddleware
 from bot.middlewares.recieve import RecieveWillCallbackMiddleware
 from bot.utils.i18n import create_translator_hub
 from bot.services.notification_manager import NotificationManager
-from bot.services.count_manager import CountManager
 from bot.services.ping_manager import PingManager
 
 logging.basicConfig(
@@ -46,14 +46,13 @@ async def main() -> None:
     # Загружаем существующие уведомления
     await notification_manager.load_existing_notifications()
 
-    # Инициализируем и запускаем менеджер подсчета выигрышей
-    count_manager = CountManager(bot, translator_hub)
-    count_manager.start()
+    # Ставки рассчитывает Go-бэкенд (StakeSettlementService)
     
     # Инициализируем и запускаем менеджер пингов
     ping_manager = PingManager(bot)
     ping_manager.start()  # Теперь просто создаст асинхронную задачу
 
+    dp.include_router(payments_router)
     dp.include_router(commands_router)
     dp.include_router(other_router)
     dp.include_router(ai_router)
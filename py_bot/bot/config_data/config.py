@@ -9,6 +9,8 @@ class Settings(BaseSettings):
     MONGO_DB_NAME: str
     BOT_USERNAME: str
     DEEPSEEK_API_KEY: SecretStr
+    BACKEND_PORT: int = 8080
+    BOT_UPDATES_SECRET: SecretStr | None = None
 
     model_config = SettingsConfigDict(env_file=".env", env_file_encoding="utf-8")
 
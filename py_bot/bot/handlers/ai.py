@@ -5,9 +5,11 @@ from aiogram.types import Message
 from aiogram.filters import Command
 from openai import OpenAI
 import json
+import uuid
 from fluentogram import TranslatorRunner
 
 from bot.config_data.config import db, config_settings
+from bot.services.ledger import post_entry, InsufficientBalance
 
 """
 AI API Functions:
@@ -48,13 +50,15 @@ async def check_and_charge_balance(user_id: int, amount: int, i18n) -> tuple[boo
         if current_balance < amount:
             return False, current_balance
             
-        # Списываем средства
-        result = db.users.update_one(
-            {"telegram_id": user_id},
-            {"$inc": {"balance": -amount}}
-        )
+        # Списываем средства через журнал WILL
+        charge_id = uuid.uuid4().hex
+        try:
+            charged = post_entry(user_id, -amount, "ai_analysis", "ai_analysis", charge_id,
+                                 f"ai_analysis:{charge_id}", check_balance=True)
+        except InsufficientBalance:
+            return False, current_balance
         
-        if result.modified_count > 0:
+        if charged:
             new_balance = current_balance - amount
             logging.info(f"Charged {amount} WILL from user {user_id}. New balance: {new_balance}")
             return True, new_balance
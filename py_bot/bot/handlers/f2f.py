@@ -8,10 +8,50 @@ import uuid
 from aiogram.utils.keyboard import InlineKeyboardBuilder
 
 from bot.config_data.config import db
+from bot.services.ledger import post_entry, InsufficientBalance, LedgerEntryPending
 
 f2f_router = Router()
 
 
+def transfer_will(sender_id: int, recipient_id: int, amount: int) -> bool:
+    """
+    Переводит WILL между пользователями двумя записями журнала. Возвращает False, если перевод не выполнен:
+    не хватает средств или зачислить получателю не удалось, и списание возвращено отправителю.
+    """
+    transfer_id = uuid.uuid4().hex
+    try:
+        post_entry(sender_id, -amount, "transfer", "user", str(recipient_id),
+                   f"transfer:{transfer_id}:out", check_balance=True)
+    except InsufficientBalance:
+        return False
+    except LedgerEntryPending:
+        # Списание доприменит бэкенд; получателю ничего не зачисляем, поэтому возвращаем списание тем же путем
+        logging.error(f"Списание перевода {transfer_id} не подтверждено, перевод отменяется")
+        _refund_transfer(sender_id, recipient_id, amount, transfer_id)
+        return False
+
+    try:
+        post_entry(recipient_id, amount, "transfer", "user", str(sender_id), f"transfer:{transfer_id}:in")
+    except LedgerEntryPending:
+        # Запись зачисления осталась в журнале, ее доприменит бэкенд
+        logging.warning(f"Зачисление перевода {transfer_id} пользователю {recipient_id} будет доприменено")
+    except Exception as e:
+        logging.error(f"Не удалось зачислить перевод {transfer_id} пользователю {recipient_id}: {e}")
+        _refund_transfer(sender_id, recipient_id, amount, transfer_id)
+        return False
+    return True
+
+
+def _refund_transfer(sender_id: int, recipient_id: int, amount: int, transfer_id: str) -> None:
+    """Возвращает отправителю списание невыполненного перевода. Ключ не дает вернуть дважды."""
+    try:
+        post_entry(sender_id, amount, "transfer", "user", str(recipient_id), f"transfer:{transfer_id}:refund")
+    except LedgerEntryPending:
+        logging.warning(f"Возврат перевода {transfer_id} пользователю {sender_id} будет доприменен")
+    except Exception as e:
+        logging.critical(f"Не удалось вернуть перевод {transfer_id} ({amount} WILL) пользователю {sender_id}: {e}")
+
+
 @f2f_router.message(Command("send"))
 async def cmd_send_will(msg: Message, i18n: TranslatorRunner, bot: Bot):
     try:
@@ -61,9 +101,14 @@ async def cmd_send_will(msg: Message, i18n: TranslatorRunner, bot: Bot):
 
         recipient_balance = recipient.get('balance', 0)
 
-        # Обновляем балансы
-        db.users.update_one({"telegram_id": sender_id}, {"$inc": {"balance": -amount}})
-        db.users.update_one({"telegram_id": recipient_id}, {"$inc": {"balance": amount}})
+        # Обновляем балансы через журнал WILL
+        if not transfer_will(sender_id, recipient_id, amount):
+            sender_balance = db.users.find_one({"telegram_id": sender_id}).get("balance", 0)
+            if sender_balance < amount:
+                await msg.answer(i18n.send.insufficient_funds(balance=sender_balance))
+            else:
+                await msg.answer(i18n.error.generic())
+            return
         
         # Логируем транзакцию (опционально, можно создать отдельную коллекцию)
         db.transactions.insert_one({
@@ -109,24 +154,37 @@ async def callback_query_send_will(callback_query: types.CallbackQuery, i18n: Tr
     logging.info(f"Callback query: {callback_query.data}")
     user_id = callback_query.from_user.id
     
-    data = callback_query.data.split()
+    # callback_data собирается в send_will: send_<количество>_@<username>_<id отправителя>
+    data = callback_query.data.split("_")
     logging.info(f"Data: {data}")
-    amount = data[1]
-    recipient_username = data[2]
-    sender_id = data[3]
-
-    sender_balance = db.users.find_one({"telegram_id": sender_id}).get("balance", 0)
-
-    if sender_balance < amount:
+    try:
+        amount = int(data[1])
+        recipient_username = "_".join(data[2:-1]).lstrip("@")
+        sender_id = int(data[-1])
+    except (IndexError, ValueError):
+        await callback_query.answer(i18n.send.inline_invalid_input(), show_alert=True)
+        return
+    if amount <= 0:
+        await callback_query.answer(i18n.send.invalid_amount(), show_alert=True)
+        return
+
+    sender = db.users.find_one({"telegram_id": sender_id})
+    if sender is None or sender.get("balance", 0) < amount:
         await callback_query.answer(i18n.send.insufficient_funds_short(), show_alert=True)
-    
-    recipient = db.users.find_one({"username": recipient_username}).get("telegram_id", 0)
+        return
 
-    if recipient == None:
+    recipient = db.users.find_one({"username": recipient_username})
+    if recipient is None:
         await callback_query.answer(i18n.send.user_not_found(username=recipient_username), show_alert=True)
-        
-    db.users.update_one({"telegram_id": sender_id}, {"$inc": {"balance": -amount}})
-    db.users.update_one({"telegram_id": recipient}, {"$inc": {"balance": amount}})
+        return
+
+    if not transfer_will(sender_id, recipient["telegram_id"], amount):
+        sender_balance = db.users.find_one({"telegram_id": sender_id}).get("balance", 0)
+        if sender_balance < amount:
+            await callback_query.answer(i18n.send.insufficient_funds_short(), show_alert=True)
+        else:
+            await callback_query.answer(i18n.error.generic(), show_alert=True)
+        return
 
     await callback_query.answer()
 
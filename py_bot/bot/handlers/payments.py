@@ -0,0 +1,61 @@
+import asyncio
+import logging
+
+import aiohttp
+from aiogram import Router, F
+from aiogram.types import Message, PreCheckoutQuery, Update
+
+from bot.config_data.config import config_settings
+
+
+payments_router = Router()
+
+# Оплаты Telegram Stars проверяет и зачисляет Go-бэкенд. Бот единственный читает обновления
+# Telegram, поэтому пересылает ему pre_checkout_query и successful_payment как есть.
+BACKEND_UPDATES_URL = f"http://localhost:{config_settings.BACKEND_PORT}/telegram/updates"
+
+
+# На pre_checkout_query Telegram ждет ответа не больше 10 секунд, поэтому его пересылаем с одним
+# повтором. Пропущенный successful_payment означает оплаченные, но не начисленные WILL, поэтому
+# его пересылаем, пока бэкенд не примет, с растущей паузой между попытками.
+PRE_CHECKOUT_ATTEMPTS = 2
+SUCCESSFUL_PAYMENT_ATTEMPTS = 8
+RETRY_BASE_DELAY = 1
+
+
+async def forward_update(update: Update, attempts: int) -> bool:
+    """Пересылает обновление в бэкенд с секретом в заголовке X-Telegram-Bot-Api-Secret-Token.
+    Повторяет попытку при ответе не 200 и при ошибке соединения, возвращает True, если бэкенд принял обновление."""
+    if config_settings.BOT_UPDATES_SECRET is None:
+        logging.error("BOT_UPDATES_SECRET не задан, обновление об оплате %s не передано в бэкенд", update.update_id)
+        return False
+
+    payload = update.model_dump(mode="json", exclude_none=True, by_alias=True)
+    headers = {"X-Telegram-Bot-Api-Secret-Token": config_settings.BOT_UPDATES_SECRET.get_secret_value()}
+    for attempt in range(1, attempts + 1):
+        try:
+            async with aiohttp.ClientSession() as session:
+                async with session.post(BACKEND_UPDATES_URL, json=payload, headers=headers,
+                                        timeout=aiohttp.ClientTimeout(total=5)) as response:
+                    if response.status == 200:
+                        return True
+                    logging.error(f"Бэкенд вернул {response.status} на обновление {update.update_id} "
+                                  f"(попытка {attempt} из {attempts})")
+        except Exception as e:
+            logging.error(f"Ошибка пересылки обновления {update.update_id} в бэкенд "
+                          f"(попытка {attempt} из {attempts}): {e}")
+        if attempt < attempts:
+            await asyncio.sleep(RETRY_BASE_DELAY * 2 ** (attempt - 1))
+
+    logging.critical(f"Обновление {update.update_id} не передано в бэкенд после {attempts} попыток")
+    return False
+
+
+@payments_router.pre_checkout_query()
+async def process_pre_checkout_query(pre_checkout_query: PreCheckoutQuery, event_update: Update):
+    await forward_update(event_update, PRE_CHECKOUT_ATTEMPTS)
+
+
+@payments_router.message(F.successful_payment)
+async def process_successful_payment(msg: Message, event_update: Update):
+    await forward_update(event_update, SUCCESSFUL_PAYMENT_ATTEMPTS)
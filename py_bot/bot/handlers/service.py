@@ -6,6 +6,7 @@ from aiogram.filters import Command
 from fluentogram import TranslatorRunner
 
 from bot.config_data.config import db, config_settings
+from bot.services.ledger import post_entry
 
 service_router = Router()
 
@@ -152,9 +153,11 @@ async def cmd_add_will(msg: Message, i18n: TranslatorRunner):
             db.users.insert_one({
                 "telegram_id": admin_id,
                 "username": msg.from_user.username or f"admin_{admin_id}",
-                "balance": amount,
+                "balance": 0,
                 "created_at": datetime.utcnow()
             })
+            post_entry(admin_id, amount, "adjustment", "user", str(admin_id),
+                       f"admin_add:{admin_id}:{msg.message_id}")
             await msg.answer(i18n.add.will_admin_created(amount=amount))
             logging.info(f"Created admin profile with {amount} WILL")
         else:
@@ -162,10 +165,8 @@ async def cmd_add_will(msg: Message, i18n: TranslatorRunner):
             current_balance = admin_user.get('balance', 0)
             new_balance = current_balance + amount
             
-            db.users.update_one(
-                {"telegram_id": admin_id}, 
-                {"$inc": {"balance": amount}}
-            )
+            post_entry(admin_id, amount, "adjustment", "user", str(admin_id),
+                       f"admin_add:{admin_id}:{msg.message_id}")
             
             await msg.answer(i18n.add.will_balance_updated(amount=amount, balance=new_balance))
             logging.info(f"Added {amount} WILL to admin balance. New balance: {new_balance}")
@@ -0,0 +1,111 @@
+import logging
+from datetime import datetime
+
+from bson.objectid import ObjectId
+from pymongo.errors import DuplicateKeyError
+
+from bot.config_data.config import db
+
+logger = logging.getLogger(__name__)
+
+
+class InsufficientBalance(Exception):
+    """На балансе не хватает WILL для списания."""
+
+
+class LedgerEntryPending(Exception):
+    """Исход применения записи неизвестен: запись оставлена в журнале, ее доприменит бэкенд."""
+
+
+def post_entry(telegram_id: int, amount: int, reason: str, ref_type: str, ref_id: str,
+               idempotency_key: str, check_balance: bool = False) -> bool:
+    """
+    Проводит изменение баланса через журнал WILL (коллекция ledger) так же, как бэкенд:
+    сначала добавляет запись с applied = False, затем применяет ее к users.balance вместе с отметкой
+    в ledger_pending и помечает запись applied. Запись удаляется, только если по ledger_pending видно,
+    что к балансу она не применилась. Брошенные записи доприменяет бэкенд (Ledger.RecoverPending).
+
+    Returns:
+        bool: True, если операция проведена; False, если операция с таким ключом уже была
+
+    Raises:
+        InsufficientBalance: не хватает WILL для списания, запись удалена
+        LookupError: пользователь не найден, запись удалена
+        LedgerEntryPending: исход неизвестен, запись оставлена для доприменения
+    """
+    if amount == 0:
+        return False
+
+    entry = {
+        "_id": ObjectId(),
+        "telegram_id": telegram_id,
+        "amount": amount,
+        "reason": reason,
+        "ref_type": ref_type,
+        "ref_id": ref_id,
+        "idempotency_key": idempotency_key,
+        "applied": False,
+        "check_balance": check_balance,
+        "created_at": datetime.utcnow(),
+    }
+    try:
+        db.ledger.insert_one(entry)
+    except DuplicateKeyError:
+        # Запись уже есть; если ее не успели применить (падение между шагами), доприменяем
+        pending = db.ledger.find_one({"idempotency_key": idempotency_key, "applied": False})
+        if pending is None:
+            return False
+        return _finish(pending, check_balance)
+
+    return _finish(entry, check_balance)
+
+
+def _finish(entry: dict, check_balance: bool) -> bool:
+    """
+    Применяет к балансу записанную, но не примененную запись и помечает ее applied (как Ledger.finish в бэкенде).
+    Повторный вызов для той же записи баланс второй раз не меняет.
+    """
+    entry_id, telegram_id, amount = entry["_id"], entry["telegram_id"], entry["amount"]
+    query = {"telegram_id": telegram_id, "ledger_pending": {"$ne": entry_id}}
+    if check_balance and amount < 0:
+        query["balance"] = {"$gte": -amount}
+
+    update_error = None
+    changed = False
+    try:
+        result = db.users.update_one(query, {
+            "$inc": {"balance": amount},
+            "$addToSet": {"ledger_pending": entry_id},
+        })
+        changed = result.matched_count > 0
+    except Exception as e:
+        update_error = e
+
+    if not changed:
+        # Обновление не прошло или его исход неизвестен: запись могла примениться параллельной
+        # проводкой, восстановлением или этим же обновлением до сетевой ошибки
+        try:
+            applied = db.users.count_documents({"telegram_id": telegram_id, "ledger_pending": entry_id})
+        except Exception as e:
+            logger.error(f"Не удалось проверить применение записи журнала {entry['idempotency_key']}: {e}")
+            raise LedgerEntryPending(entry["idempotency_key"]) from e
+
+        if applied == 0:
+            # Запись не применена к балансу — убираем ее, чтобы операцию можно было повторить
+            try:
+                db.ledger.delete_one({"_id": entry_id, "applied": False})
+            except Exception as e:
+                logger.error(f"Не удалось откатить запись журнала {entry['idempotency_key']}: {e}")
+            if update_error is not None:
+                raise update_error
+            if check_balance:
+                raise InsufficientBalance()
+            raise LookupError(f"user {telegram_id} not found")
+        changed = update_error is not None
+
+    try:
+        db.ledger.update_one({"_id": entry_id}, {"$set": {"applied": True}})
+    except Exception as e:
+        # Баланс уже изменен и отмечен в ledger_pending: бэкенд только пометит запись applied
+        logger.error(f"Не удалось отметить запись журнала {entry['idempotency_key']} примененной: {e}")
+    return changed